@@ -10,6 +10,7 @@ require (
 	github.com/google/renameio v1.0.1
 	github.com/jmoiron/sqlx v1.3.4
 	github.com/joesiltberg/bowness v1.1.6
+	github.com/lib/pq v1.10.9
 	github.com/kardianos/service v1.2.1
 	github.com/spf13/viper v1.12.0
 	golang.org/x/time v0.0.0-20211116232009-f0f3c7e86c11
@@ -3,6 +3,8 @@ package program
 import (
 	"context"
 	"net/http"
+
+	"github.com/Sambruk/windermere/scimserverlite"
 )
 
 // Type for storing the authenticated tenant in the context
@@ -30,14 +32,14 @@ func APIKeyAuthMiddleware(h http.Handler, headerName string, clients map[string]
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		keys, ok := r.Header[http.CanonicalHeaderKey(headerName)]
 		if !ok || len(keys) < 1 {
-			http.Error(w, "No API key", http.StatusForbidden)
+			scimserverlite.WriteError(w, http.StatusForbidden, "", "No API key")
 			return
 		}
 
 		tenant := lookupTenant(keys[0], clients)
 
 		if tenant == nil {
-			http.Error(w, "Invalid API key", http.StatusForbidden)
+			scimserverlite.WriteError(w, http.StatusForbidden, "", "Invalid API key")
 			return
 		}
 
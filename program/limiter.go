@@ -30,7 +30,7 @@ func Limiter(h http.Handler, tenantGetter scimserverlite.TenantGetter, r rate.Li
 		limiter := getLimiter(tenantGetter(r.Context()))
 
 		if limiter.Wait(r.Context()) != nil {
-			w.WriteHeader(http.StatusTooManyRequests)
+			scimserverlite.WriteError(w, http.StatusTooManyRequests, "", "Too many requests")
 			return
 		}
 		h.ServeHTTP(w, r)
@@ -32,6 +32,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/Sambruk/windermere/scimserverlite"
 	"github.com/Sambruk/windermere/windermere"
 	"github.com/joesiltberg/bowness/fedtls"
 	"github.com/joesiltberg/bowness/server"
@@ -125,6 +126,23 @@ const (
 	CNFLimitBurst             = "LimitBurst"
 	CNFStorageType            = "StorageType"
 	CNFStorageSource          = "StorageSource"
+	CNFStorageMaxOpenConns    = "StorageMaxOpenConnections"
+	CNFStorageMaxIdleConns    = "StorageMaxIdleConnections"
+	CNFStorageConnMaxLifetime = "StorageConnectionMaxLifetime"
+	CNFStorageConnMaxIdleTime = "StorageConnectionMaxIdleTime"
+	CNFStorageConnectRetries  = "StorageConnectRetries"
+	CNFStorageConnectWait     = "StorageConnectRetryWait"
+	CNFStorageConnectMaxWait  = "StorageConnectMaxRetryWait"
+	CNFStorageQueryTimeout    = "StorageQueryTimeout"
+	CNFStorageRetryAfter      = "StorageRetryAfter"
+	CNFStorageJournal         = "StorageJournal"
+	CNFStorageJournalSync     = "StorageJournalSync"
+	CNFStorageJournalSyncTime = "StorageJournalSyncInterval"
+	CNFStorageSnapshotTime    = "StorageSnapshotInterval"
+	CNFStorageTenantDirectory = "StorageTenantDirectory"
+	CNFStorageKeyFile         = "StorageEncryptionKeyFile"
+	CNFStorageStrictLoading   = "StorageStrictLoading"
+	CNFStoragePlaintext       = "StorageUnencryptedData"
 	CNFAccessLogPath          = "AccessLogPath"
 	CNFJWKSPath               = "JWKSPath"
 	CNFCert                   = "Cert"
@@ -221,8 +239,46 @@ func run(signals chan os.Signal, done chan bool, extension Extension) {
 		viper.GetBool(CNFValidateSchoolUnitCode),
 	)
 
+	journalSync, err := scimserverlite.ParseSyncPolicy(viper.GetString(CNFStorageJournalSync))
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", CNFStorageJournalSync, err)
+	}
+
+	// Encryption keys for the storage, from a key file or the environment
+	keyring, err := windermere.LoadKeyring(viper.GetString(CNFStorageKeyFile))
+	if err != nil {
+		log.Fatalf("Failed to load encryption keys: %v", err)
+	}
+	plaintextPolicy, err := windermere.ParsePlaintextPolicy(viper.GetString(CNFStoragePlaintext))
+	if err != nil {
+		log.Fatalf("Invalid %s: %v", CNFStoragePlaintext, err)
+	}
+
 	// Create the Windermere SCIM handler
-	wind, err := windermere.New(viper.GetString(CNFStorageType), viper.GetString(CNFStorageSource), tenantGetter, validator)
+	// The locations of resources use the base URI published in metadata
+	wind, err := windermere.New(viper.GetString(CNFStorageType), viper.GetString(CNFStorageSource), tenantGetter, validator,
+		windermere.WithBaseURL(viper.GetString(CNFMDBaseURI)),
+		windermere.WithSQLConfig(windermere.SQLConfig{
+			MaxOpenConns:        viper.GetInt(CNFStorageMaxOpenConns),
+			MaxIdleConns:        viper.GetInt(CNFStorageMaxIdleConns),
+			ConnMaxLifetime:     configuredSeconds(CNFStorageConnMaxLifetime),
+			ConnMaxIdleTime:     configuredSeconds(CNFStorageConnMaxIdleTime),
+			ConnectRetries:      viper.GetInt(CNFStorageConnectRetries),
+			ConnectRetryWait:    configuredSeconds(CNFStorageConnectWait),
+			ConnectMaxRetryWait: configuredSeconds(CNFStorageConnectMaxWait),
+			QueryTimeout:        configuredSeconds(CNFStorageQueryTimeout),
+			RetryAfter:          configuredSeconds(CNFStorageRetryAfter),
+		}),
+		windermere.WithJournal(windermere.JournalConfig{
+			Enabled:          viper.GetBool(CNFStorageJournal),
+			Sync:             journalSync,
+			SyncInterval:     configuredSeconds(CNFStorageJournalSyncTime),
+			SnapshotInterval: configuredSeconds(CNFStorageSnapshotTime),
+		}),
+		windermere.WithTenantDirectory(viper.GetString(CNFStorageTenantDirectory)),
+		windermere.WithEncryption(keyring),
+		windermere.WithPlaintextPolicy(plaintextPolicy),
+		windermere.WithStrictLoading(viper.GetBool(CNFStorageStrictLoading)))
 
 	if err != nil {
 		log.Fatalf("Failed to initialize Windermere: %v", err)
@@ -245,6 +301,10 @@ func run(signals chan os.Signal, done chan bool, extension Extension) {
 		handler = PanicReportTimeoutHandler(handler, beTimeout, "Backend timeout")
 	}
 
+	// Errors from the timeout handler (and other middleware not aware
+	// of SCIM) are rewritten to SCIM errors
+	handler = SCIMErrorHandler(handler)
+
 	accessLogPath := viper.GetString(CNFAccessLogPath)
 	if accessLogPath != "" {
 		handler = accessLogHandler(handler, accessLogPath, tenantGetter)
@@ -274,7 +334,7 @@ func run(signals chan os.Signal, done chan bool, extension Extension) {
 		// Create the HTTP server
 		fedtlsServer = &http.Server{
 			// Wrap the HTTP handler with authentication middleware.
-			Handler: server.AuthMiddleware(handler, mdstore, nil),
+			Handler: SCIMErrorHandler(server.AuthMiddleware(handler, mdstore, nil)),
 
 			// In order to use the authentication middleware, the server needs
 			// to have a ConnContext configured so the middleware can access
@@ -354,6 +414,8 @@ func run(signals chan os.Signal, done chan bool, extension Extension) {
 		http.Handle("/metadata", metadataHandler(certFile,
 			viper.GetString(CNFMDEntityID), viper.GetString(CNFMDBaseURI),
 			viper.GetString(CNFMDOrganization), viper.GetString(CNFMDOrganizationID)))
+		http.Handle("/storage/loadreport", storageReportHandler(func() interface{} { return wind.LoadReport() }))
+		http.Handle("/storage/quarantine", storageReportHandler(func() interface{} { return wind.GetQuarantine() }))
 		go func() {
 			log.Println(http.ListenAndServeTLS(adminAddress, certFile, keyFile, nil))
 		}()
@@ -420,6 +482,23 @@ func Main(ext Extension) {
 		CNFLimitBurst:             50,
 		CNFStorageType:            "file",
 		CNFStorageSource:          "SS12000.json",
+		CNFStorageMaxOpenConns:    10,
+		CNFStorageMaxIdleConns:    10,
+		CNFStorageConnMaxLifetime: 180,
+		CNFStorageConnMaxIdleTime: 0,
+		CNFStorageConnectRetries:  0,
+		CNFStorageConnectWait:     5,
+		CNFStorageConnectMaxWait:  60,
+		CNFStorageQueryTimeout:    0,
+		CNFStorageRetryAfter:      5,
+		CNFStorageJournal:         false,
+		CNFStorageJournalSync:     "interval",
+		CNFStorageJournalSyncTime: 1,
+		CNFStorageSnapshotTime:    300,
+		CNFStorageTenantDirectory: "",
+		CNFStorageKeyFile:         "",
+		CNFStorageStrictLoading:   false,
+		CNFStoragePlaintext:       "auto",
 		CNFAccessLogPath:          "",
 		CNFAdminListenAddress:     "",
 		CNFValidateUUID:           true,
@@ -430,6 +509,22 @@ func Main(ext Extension) {
 		viper.SetDefault(key, value)
 	}
 
+	// The migrate command is run instead of the server
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := migrate(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// The reencrypt command is also run instead of the server
+	if len(os.Args) > 1 && os.Args[1] == "reencrypt" {
+		if err := reencrypt(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Parse command line
 	var install = flag.Bool("install", false, "install as a service")
 	var uninstall = flag.Bool("uninstall", false, "uninstall as a service")
@@ -0,0 +1,136 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package program
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/Sambruk/windermere/windermere"
+	"github.com/jmoiron/sqlx"
+	"github.com/spf13/viper"
+)
+
+const migrateUsage = `Usage: windermere migrate [-dry-run] <command> <config file>
+
+Commands:
+  status        show the schema version of the database
+  up [n]        upgrade the schema to version n (default: latest)
+  down <n>      downgrade the schema to version n (0 removes all tables)
+`
+
+// Runs the migrate command, which manages the database schema of the
+// configured SQL storage. Output is written to out.
+func migrate(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "print the SQL instead of executing it")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), migrateUsage)
+		flags.PrintDefaults()
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	args = flags.Args()
+	if len(args) < 2 || len(args) > 3 {
+		flags.Usage()
+		return errors.New("wrong number of arguments")
+	}
+
+	command, configPath := args[0], args[len(args)-1]
+	var version *int
+	if len(args) == 3 {
+		v, err := strconv.Atoi(args[1])
+		if err != nil || v < 0 {
+			return fmt.Errorf("invalid schema version: %s", args[1])
+		}
+		version = &v
+	}
+
+	viper.SetConfigFile(configPath)
+	if err := viper.ReadInConfig(); err != nil {
+		return err
+	}
+
+	storageType := viper.GetString(CNFStorageType)
+	if storageType == "file" || storageType == "dummy" {
+		return fmt.Errorf("storage type %s has no database schema", storageType)
+	}
+
+	db, err := sqlx.Open(storageType, viper.GetString(CNFStorageSource))
+	if err != nil {
+		return fmt.Errorf("failed to open connection to database: %v", err)
+	}
+	defer db.Close()
+
+	current, latest, err := windermere.SchemaVersions(db)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %v", err)
+	}
+
+	to, down := latest, false
+	switch command {
+	case "status":
+		if version != nil {
+			return errors.New("status takes no version")
+		}
+		fmt.Fprintf(out, "Database schema version: %d\nLatest schema version: %d\n", current, latest)
+		return nil
+	case "up":
+		if version != nil {
+			to = *version
+		}
+	case "down":
+		if version == nil {
+			return errors.New("down needs the version to downgrade to")
+		}
+		to, down = *version, true
+	default:
+		flags.Usage()
+		return fmt.Errorf("unknown command: %s", command)
+	}
+
+	if *dryRun {
+		steps, err := windermere.MigrationSQL(storageType, current, to, down)
+		if err != nil {
+			return err
+		}
+		for i, step := range steps {
+			from, next := current+i, current+i+1
+			if down {
+				from, next = current-i, current-i-1
+			}
+			fmt.Fprintf(out, "-- Schema version %d to %d\n%s\n", from, next, step)
+		}
+		return nil
+	}
+
+	from, err := windermere.MigrateSchema(db, to, down)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Migrated database schema from version %d to %d\n", from, to)
+	return nil
+}
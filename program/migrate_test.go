@@ -0,0 +1,41 @@
+package program
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sambruk/windermere/test"
+)
+
+func TestMigrate(t *testing.T) {
+	dir := t.TempDir()
+	config := filepath.Join(dir, "config.yaml")
+	test.Ensure(t, os.WriteFile(config, []byte("StorageType: sqlite\nStorageSource: "+filepath.Join(dir, "storage.db")+"\n"), 0600))
+
+	run := func(args ...string) string {
+		t.Helper()
+		var out strings.Builder
+		test.Ensure(t, migrate(append(args, config), &out))
+		return out.String()
+	}
+
+	if out := run("status"); !strings.Contains(out, "Database schema version: 0") {
+		t.Errorf("unexpected status for empty database: %s", out)
+	}
+	if out := run("-dry-run", "up", "1"); !strings.Contains(out, "-- Schema version 0 to 1") || !strings.Contains(out, "CREATE TABLE Users") {
+		t.Errorf("unexpected dry run output: %s", out)
+	}
+	if out := run("status"); !strings.Contains(out, "Database schema version: 0") {
+		t.Errorf("dry run shouldn't migrate: %s", out)
+	}
+	run("up")
+	run("down", "1")
+	if out := run("status"); !strings.Contains(out, "Database schema version: 1") {
+		t.Errorf("unexpected status after migrating down: %s", out)
+	}
+
+	test.MustFail(t, migrate([]string{"down", config}, &strings.Builder{}))
+	test.MustFail(t, migrate([]string{"sideways", config}, &strings.Builder{}))
+}
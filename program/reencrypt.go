@@ -0,0 +1,99 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package program
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+
+	"github.com/Sambruk/windermere/windermere"
+	"github.com/jmoiron/sqlx"
+	"github.com/spf13/viper"
+)
+
+const reencryptUsage = `Usage: windermere reencrypt <config file>
+
+Encrypts the configured storage (all files of file storage, or the
+encrypted columns of SQL storage) with the current encryption key. The
+data may be encrypted with an older key from the key file (or
+WINDERMERE_STORAGE_OLD_KEYS), or not encrypted at all. Windermere must
+be stopped meanwhile. Afterwards unencrypted data is rejected, unless
+StorageUnencryptedData is set to allow.
+`
+
+// Runs the reencrypt command, used for rotating the encryption key of
+// the storage. Output is written to out.
+func reencrypt(args []string, out io.Writer) error {
+	flags := flag.NewFlagSet("reencrypt", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), reencryptUsage)
+	}
+
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	args = flags.Args()
+	if len(args) != 1 {
+		flags.Usage()
+		return errors.New("wrong number of arguments")
+	}
+
+	viper.SetConfigFile(args[0])
+	if err := viper.ReadInConfig(); err != nil {
+		return err
+	}
+
+	storageType := viper.GetString(CNFStorageType)
+	if storageType == "dummy" {
+		return fmt.Errorf("storage type %s isn't stored", storageType)
+	}
+
+	keyring, err := windermere.LoadKeyring(viper.GetString(CNFStorageKeyFile))
+	if err != nil {
+		return err
+	} else if keyring == nil {
+		return errors.New("no encryption key configured")
+	}
+
+	if storageType == "file" {
+		count, err := windermere.Reencrypt(viper.GetString(CNFStorageSource), viper.GetString(CNFStorageTenantDirectory), keyring)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "Encrypted %d files\n", count)
+		return nil
+	}
+
+	db, err := sqlx.Open(storageType, viper.GetString(CNFStorageSource))
+	if err != nil {
+		return fmt.Errorf("failed to open connection to database: %v", err)
+	}
+	defer db.Close()
+
+	count, err := windermere.ReencryptSQL(db, keyring)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Encrypted %d resources\n", count)
+	return nil
+}
@@ -0,0 +1,45 @@
+package program
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sambruk/windermere/test"
+)
+
+func TestReencrypt(t *testing.T) {
+	dir := t.TempDir()
+	storage := filepath.Join(dir, "SS12000.json")
+	keyFile := filepath.Join(dir, "storage.key")
+	config := filepath.Join(dir, "config.yaml")
+	plaintext := []byte(`{"Version":1,"Resources":{}}`)
+	test.Ensure(t, os.WriteFile(storage, plaintext, 0600))
+	test.Ensure(t, os.WriteFile(keyFile, []byte("# Current key\nMDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=\n"), 0600))
+	test.Ensure(t, os.WriteFile(config, []byte("StorageType: file\nStorageSource: "+storage+"\nStorageEncryptionKeyFile: "+keyFile+"\n"), 0600))
+
+	var out strings.Builder
+	test.Ensure(t, reencrypt([]string{config}, &out))
+	if !strings.Contains(out.String(), "Encrypted 1 files") {
+		t.Errorf("unexpected output: %s", out.String())
+	}
+
+	data, err := os.ReadFile(storage)
+	test.Ensure(t, err)
+	if bytes.Equal(data, plaintext) || !bytes.HasPrefix(data, []byte(`{"encryption":`)) {
+		t.Errorf("expected the file to be encrypted, got: %s", data)
+	}
+
+	test.MustFail(t, reencrypt([]string{}, &strings.Builder{}))
+	test.Ensure(t, os.WriteFile(config, []byte("StorageType: dummy\nStorageEncryptionKeyFile: "+keyFile+"\n"), 0600))
+	test.MustFail(t, reencrypt([]string{config}, &strings.Builder{}))
+
+	test.Ensure(t, os.WriteFile(config, []byte("StorageType: sqlite\nStorageSource: "+filepath.Join(dir, "storage.db")+"\nStorageEncryptionKeyFile: "+keyFile+"\n"), 0600))
+	out.Reset()
+	test.Ensure(t, reencrypt([]string{config}, &out))
+	if !strings.Contains(out.String(), "Encrypted 0 resources") {
+		t.Errorf("unexpected output: %s", out.String())
+	}
+}
@@ -0,0 +1,84 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package program
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/Sambruk/windermere/scimserverlite"
+)
+
+// ResponseWriter which holds back plain text error responses so they
+// can be rewritten as SCIM errors
+type scimErrorResponseWriter struct {
+	http.ResponseWriter
+	statusCode int
+	capturing  bool
+	body       bytes.Buffer
+}
+
+// Returns true if the response already is in a format a SCIM client can parse
+func isSCIMContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil &&
+		(mediaType == scimserverlite.SCIMMediaType || mediaType == scimserverlite.SCIMDeprecatedMediaType)
+}
+
+// WriteHeader overrides the method from http.ResponseWriter so we can catch errors
+func (w *scimErrorResponseWriter) WriteHeader(code int) {
+	if w.statusCode != 0 {
+		return
+	}
+	w.statusCode = code
+	if code >= 400 && !isSCIMContentType(w.Header().Get("Content-Type")) {
+		w.capturing = true
+		return
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write overrides the method from http.ResponseWriter so we can catch errors
+func (w *scimErrorResponseWriter) Write(b []byte) (int, error) {
+	if w.statusCode == 0 {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.capturing {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// SCIMErrorHandler is a middleware which rewrites plain text error
+// responses from the handlers it wraps (for instance authentication
+// middleware and http.TimeoutHandler) to the JSON error format
+// defined by RFC 7644.
+func SCIMErrorHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &scimErrorResponseWriter{ResponseWriter: w}
+		h.ServeHTTP(sw, r)
+		if sw.capturing {
+			w.Header().Del("Content-Length")
+			scimserverlite.WriteError(w, sw.statusCode, "", strings.TrimSpace(sw.body.String()))
+		}
+	})
+}
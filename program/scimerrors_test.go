@@ -0,0 +1,81 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package program
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Sambruk/windermere/scimserverlite"
+)
+
+func TestSCIMErrorHandler(t *testing.T) {
+	slow := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(100 * time.Millisecond)
+	})
+	plain := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Access denied", http.StatusForbidden)
+	})
+	scim := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scimserverlite.WriteError(w, http.StatusConflict, "uniqueness", "Conflict")
+	})
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})
+
+	cases := []struct {
+		handler  http.Handler
+		status   int
+		scimType string
+		detail   string
+	}{
+		{PanicReportTimeoutHandler(slow, 10*time.Millisecond, "Backend timeout"), http.StatusServiceUnavailable, "", "Backend timeout"},
+		{plain, http.StatusForbidden, "", "Access denied"},
+		{scim, http.StatusConflict, "uniqueness", "Conflict"},
+	}
+
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		SCIMErrorHandler(c.handler).ServeHTTP(w, httptest.NewRequest("GET", "/Users", nil))
+		if w.Code != c.status {
+			t.Errorf("Expected status %d, got %d", c.status, w.Code)
+		}
+		if w.Header().Get("Content-Type") != scimserverlite.SCIMMediaType {
+			t.Errorf("Unexpected Content-Type: %s", w.Header().Get("Content-Type"))
+		}
+		var response map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to parse error response (%v): %s", err, w.Body.String())
+		}
+		scimType, _ := response["scimType"].(string)
+		if scimType != c.scimType || response["detail"] != c.detail {
+			t.Errorf("Unexpected error response: %v", response)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	SCIMErrorHandler(ok).ServeHTTP(w, httptest.NewRequest("GET", "/Users", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "hello" {
+		t.Errorf("Successful response was modified: %d %s", w.Code, w.Body.String())
+	}
+}
@@ -19,6 +19,12 @@
 
 package scimserverlite
 
+import (
+	"context"
+	"errors"
+	"time"
+)
+
 // SCIMErrorType is a standard type of error the backend can return
 type SCIMErrorType int
 
@@ -33,6 +39,29 @@ const (
 	// MalformedResourceError is returned if the client sent a resource that's invalid.
 	// For instance missing required attributes or if an attribute has the wrong datatype
 	MalformedResourceError
+	// InvalidSyntaxError is returned if a request couldn't be parsed or has the wrong structure
+	InvalidSyntaxError
+	// InvalidFilterError is returned if a filter is invalid or can't be used
+	InvalidFilterError
+	// InvalidPathError is returned if an attribute path is invalid
+	InvalidPathError
+	// NoTargetError is returned if a path didn't match anything to operate on
+	NoTargetError
+	// MutabilityError is returned if the client tries to modify an attribute which can't be modified
+	MutabilityError
+	// TooManyError is returned if a request would affect or return too many resources
+	TooManyError
+	// PreconditionFailedError is returned if a resource's version didn't match
+	// the version the client expected (If-Match)
+	PreconditionFailedError
+	// UnavailableError is returned if the backend is temporarily unable
+	// to handle requests, for instance if its database can't be reached
+	UnavailableError
+	// InvalidValueError is returned if a request parameter has an invalid value
+	InvalidValueError
+	// CanceledError is returned if the client cancelled the request, for
+	// instance by closing the connection
+	CanceledError
 )
 
 // SCIMTypedError should be used by the backend when possible
@@ -62,7 +91,47 @@ func NewError(t SCIMErrorType, msg string) SCIMTypedError {
 	return scimError{errorType: t, message: msg}
 }
 
+type unavailableError struct {
+	scimError
+	retryAfter time.Duration
+}
+
+// RetryAfter returns how long the client should wait before retrying
+func (e unavailableError) RetryAfter() time.Duration {
+	return e.retryAfter
+}
+
+// NewUnavailableError creates a new SCIMTypedError of type UnavailableError.
+// The client is told to retry after retryAfter, unless it is zero.
+func NewUnavailableError(msg string, retryAfter time.Duration) SCIMTypedError {
+	return unavailableError{
+		scimError:  scimError{errorType: UnavailableError, message: msg},
+		retryAfter: retryAfter,
+	}
+}
+
+// ContextError returns the SCIMTypedError to use for the error of a
+// request's context (see context.Context.Err). A request which has timed
+// out gets an UnavailableError so the client can try again, a request
+// which the client has cancelled gets a CanceledError. A nil error is
+// returned as nil.
+func ContextError(err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.DeadlineExceeded):
+		return NewUnavailableError("The request timed out", 0)
+	case errors.Is(err, context.Canceled):
+		return NewError(CanceledError, "The request was cancelled by the client")
+	}
+	return err
+}
+
 // Backend is where the SCIM server stores, modifies and gets the resources
+//
+// Backends can also implement PatchBackend, QueryBackend, BatchBackend,
+// ConditionalBackend and ContextBackend, otherwise the server makes do
+// with the methods of Backend (see WithContext).
 type Backend interface {
 	Create(tenant, resourceType, resource string) (string, error)
 	Update(tenant, resourceType, resourceID, resource string) (string, error)
@@ -73,3 +142,298 @@ type Backend interface {
 	GetParsedResources(tenant, resourceType string) (map[string]interface{}, error)
 	GetParsedResource(tenant, resourceType string, id string) (interface{}, error)
 }
+
+// PatchBackend is implemented by backends which apply PATCH requests
+// themselves. For other backends the patch is applied to the resource
+// from GetResource, which is then replaced with Update.
+type PatchBackend interface {
+	Patch(tenant, resourceType, resourceID string, patch *PatchRequest) (string, error)
+}
+
+// QueryBackend is implemented by backends which can filter, sort and
+// page resources themselves. For other backends ApplyQuery is used on
+// all resources from GetResources.
+type QueryBackend interface {
+	QueryResources(tenant, resourceType string, query *Query) (*QueryResult, error)
+}
+
+// BatchBackend is implemented by backends which can do many modifications
+// at once. For other backends the modifications of a batch are done one by
+// one, and aren't rolled back if apply fails.
+type BatchBackend interface {
+	// Batch calls apply with a BatchModifier for the tenant, so that many
+	// modifications can be done in one transaction (or under one lock).
+	// Backends with transactions roll back all modifications done through
+	// the BatchModifier if apply returns an error, otherwise they are
+	// committed when apply returns.
+	Batch(tenant string, apply func(BatchModifier) error) error
+}
+
+// BatchModifier modifies resources for one tenant within a Backend.Batch.
+// The methods work like the corresponding methods in Backend, but Create
+// also returns the ID of the created resource. A nil Precondition always
+// matches.
+type BatchModifier interface {
+	Create(resourceType, resource string) (resourceID, created string, err error)
+	Update(resourceType, resourceID, resource string, ifMatch *Precondition) (string, error)
+	Patch(resourceType, resourceID string, patch *PatchRequest, ifMatch *Precondition) (string, error)
+	Delete(resourceType, resourceID string, ifMatch *Precondition) error
+}
+
+// ConditionalBackend is implemented by backends which can check the
+// version of a resource in the same operation as they modify it, so
+// that concurrent modifications can't be lost between the check and
+// the modification. A nil Precondition always matches.
+type ConditionalBackend interface {
+	UpdateIfMatch(tenant, resourceType, resourceID, resource string, ifMatch *Precondition) (string, error)
+	DeleteIfMatch(tenant, resourceType, resourceID string, ifMatch *Precondition) error
+}
+
+// ContextBackend is like Backend, but each method takes the context of
+// the request so the backend can stop working on requests which have
+// timed out or been cancelled by the client. The Server uses these
+// methods, backends which don't implement it are adapted (see
+// WithContext).
+type ContextBackend interface {
+	CreateContext(ctx context.Context, tenant, resourceType, resource string) (string, error)
+	UpdateContext(ctx context.Context, tenant, resourceType, resourceID, resource string) (string, error)
+	PatchContext(ctx context.Context, tenant, resourceType, resourceID string, patch *PatchRequest) (string, error)
+	DeleteContext(ctx context.Context, tenant, resourceType, resourceID string) error
+	ClearContext(ctx context.Context, tenant string) error
+	GetResourcesContext(ctx context.Context, tenant, resourceType string) (map[string]string, error)
+	QueryResourcesContext(ctx context.Context, tenant, resourceType string, query *Query) (*QueryResult, error)
+	GetResourceContext(ctx context.Context, tenant, resourceType string, id string) (string, error)
+	GetParsedResourcesContext(ctx context.Context, tenant, resourceType string) (map[string]interface{}, error)
+	GetParsedResourceContext(ctx context.Context, tenant, resourceType string, id string) (interface{}, error)
+	BatchContext(ctx context.Context, tenant string, apply func(BatchModifier) error) error
+}
+
+// ConditionalContextBackend is like ConditionalBackend, but each method
+// takes the context of the request.
+type ConditionalContextBackend interface {
+	UpdateIfMatchContext(ctx context.Context, tenant, resourceType, resourceID, resource string, ifMatch *Precondition) (string, error)
+	DeleteIfMatchContext(ctx context.Context, tenant, resourceType, resourceID string, ifMatch *Precondition) error
+}
+
+// WithContext returns the ContextBackend for a backend. Backends which
+// don't implement ContextBackend are adapted so that the context is only
+// checked before each call, a request which has already timed out or been
+// cancelled isn't started. The adapter falls back on the methods of
+// Backend for backends which don't implement PatchBackend, QueryBackend
+// or BatchBackend. An adapted ConditionalBackend also implements
+// ConditionalContextBackend.
+func WithContext(backend Backend) ContextBackend {
+	if contextBackend, ok := backend.(ContextBackend); ok {
+		return contextBackend
+	}
+	adapter := contextAdapter{backend: backend}
+	if conditional, ok := backend.(ConditionalBackend); ok {
+		return conditionalContextAdapter{contextAdapter: adapter, conditional: conditional}
+	}
+	return adapter
+}
+
+// Adapts a Backend to ContextBackend, see WithContext
+type contextAdapter struct {
+	backend Backend
+}
+
+func (a contextAdapter) CreateContext(ctx context.Context, tenant, resourceType, resource string) (string, error) {
+	if err := ContextError(ctx.Err()); err != nil {
+		return "", err
+	}
+	return a.backend.Create(tenant, resourceType, resource)
+}
+
+func (a contextAdapter) UpdateContext(ctx context.Context, tenant, resourceType, resourceID, resource string) (string, error) {
+	if err := ContextError(ctx.Err()); err != nil {
+		return "", err
+	}
+	return a.backend.Update(tenant, resourceType, resourceID, resource)
+}
+
+func (a contextAdapter) PatchContext(ctx context.Context, tenant, resourceType, resourceID string, patch *PatchRequest) (string, error) {
+	if err := ContextError(ctx.Err()); err != nil {
+		return "", err
+	}
+	if patcher, ok := a.backend.(PatchBackend); ok {
+		return patcher.Patch(tenant, resourceType, resourceID, patch)
+	}
+	return patchWithUpdate(a.backend, tenant, resourceType, resourceID, patch, nil)
+}
+
+func (a contextAdapter) DeleteContext(ctx context.Context, tenant, resourceType, resourceID string) error {
+	if err := ContextError(ctx.Err()); err != nil {
+		return err
+	}
+	return a.backend.Delete(tenant, resourceType, resourceID)
+}
+
+func (a contextAdapter) ClearContext(ctx context.Context, tenant string) error {
+	if err := ContextError(ctx.Err()); err != nil {
+		return err
+	}
+	return a.backend.Clear(tenant)
+}
+
+func (a contextAdapter) GetResourcesContext(ctx context.Context, tenant, resourceType string) (map[string]string, error) {
+	if err := ContextError(ctx.Err()); err != nil {
+		return nil, err
+	}
+	return a.backend.GetResources(tenant, resourceType)
+}
+
+func (a contextAdapter) QueryResourcesContext(ctx context.Context, tenant, resourceType string, query *Query) (*QueryResult, error) {
+	if err := ContextError(ctx.Err()); err != nil {
+		return nil, err
+	}
+	if querier, ok := a.backend.(QueryBackend); ok {
+		return querier.QueryResources(tenant, resourceType, query)
+	}
+	resources, err := a.backend.GetResources(tenant, resourceType)
+	if err != nil {
+		return nil, err
+	}
+	return ApplyQuery(resources, query)
+}
+
+func (a contextAdapter) GetResourceContext(ctx context.Context, tenant, resourceType string, id string) (string, error) {
+	if err := ContextError(ctx.Err()); err != nil {
+		return "", err
+	}
+	return a.backend.GetResource(tenant, resourceType, id)
+}
+
+func (a contextAdapter) GetParsedResourcesContext(ctx context.Context, tenant, resourceType string) (map[string]interface{}, error) {
+	if err := ContextError(ctx.Err()); err != nil {
+		return nil, err
+	}
+	return a.backend.GetParsedResources(tenant, resourceType)
+}
+
+func (a contextAdapter) GetParsedResourceContext(ctx context.Context, tenant, resourceType string, id string) (interface{}, error) {
+	if err := ContextError(ctx.Err()); err != nil {
+		return nil, err
+	}
+	return a.backend.GetParsedResource(tenant, resourceType, id)
+}
+
+func (a contextAdapter) BatchContext(ctx context.Context, tenant string, apply func(BatchModifier) error) error {
+	if err := ContextError(ctx.Err()); err != nil {
+		return err
+	}
+	if batcher, ok := a.backend.(BatchBackend); ok {
+		return batcher.Batch(tenant, apply)
+	}
+	return apply(&sequentialBatch{backend: a.backend, tenant: tenant})
+}
+
+// Adapts a Backend which also implements ConditionalBackend, see WithContext
+type conditionalContextAdapter struct {
+	contextAdapter
+	conditional ConditionalBackend
+}
+
+func (a conditionalContextAdapter) UpdateIfMatchContext(ctx context.Context, tenant, resourceType, resourceID, resource string, ifMatch *Precondition) (string, error) {
+	if err := ContextError(ctx.Err()); err != nil {
+		return "", err
+	}
+	return a.conditional.UpdateIfMatch(tenant, resourceType, resourceID, resource, ifMatch)
+}
+
+func (a conditionalContextAdapter) DeleteIfMatchContext(ctx context.Context, tenant, resourceType, resourceID string, ifMatch *Precondition) error {
+	if err := ContextError(ctx.Err()); err != nil {
+		return err
+	}
+	return a.conditional.DeleteIfMatch(tenant, resourceType, resourceID, ifMatch)
+}
+
+// The BatchModifier for backends which don't implement BatchBackend, the
+// modifications are done one by one
+type sequentialBatch struct {
+	backend Backend
+	tenant  string
+}
+
+func (b *sequentialBatch) Create(resourceType, resource string) (string, string, error) {
+	created, err := b.backend.Create(b.tenant, resourceType, resource)
+	if err != nil {
+		return "", "", err
+	}
+	return resourceIDOf(created), created, nil
+}
+
+func (b *sequentialBatch) Update(resourceType, resourceID, resource string, ifMatch *Precondition) (string, error) {
+	return updateWithBackend(b.backend, b.tenant, resourceType, resourceID, resource, ifMatch)
+}
+
+func (b *sequentialBatch) Patch(resourceType, resourceID string, patch *PatchRequest, ifMatch *Precondition) (string, error) {
+	if patcher, ok := b.backend.(PatchBackend); ok {
+		if err := checkVersionWithBackend(b.backend, b.tenant, resourceType, resourceID, ifMatch); err != nil {
+			return "", err
+		}
+		return patcher.Patch(b.tenant, resourceType, resourceID, patch)
+	}
+	return patchWithUpdate(b.backend, b.tenant, resourceType, resourceID, patch, ifMatch)
+}
+
+func (b *sequentialBatch) Delete(resourceType, resourceID string, ifMatch *Precondition) error {
+	if conditional, ok := b.backend.(ConditionalBackend); ok {
+		return conditional.DeleteIfMatch(b.tenant, resourceType, resourceID, ifMatch)
+	}
+	if err := checkVersionWithBackend(b.backend, b.tenant, resourceType, resourceID, ifMatch); err != nil {
+		return err
+	}
+	return b.backend.Delete(b.tenant, resourceType, resourceID)
+}
+
+// Updates a resource if its version matches ifMatch. Unless the backend
+// implements ConditionalBackend the version is checked before the update.
+func updateWithBackend(backend Backend, tenant, resourceType, resourceID, resource string, ifMatch *Precondition) (string, error) {
+	if conditional, ok := backend.(ConditionalBackend); ok {
+		return conditional.UpdateIfMatch(tenant, resourceType, resourceID, resource, ifMatch)
+	}
+	if err := checkVersionWithBackend(backend, tenant, resourceType, resourceID, ifMatch); err != nil {
+		return "", err
+	}
+	return backend.Update(tenant, resourceType, resourceID, resource)
+}
+
+// Checks the current version of a resource against ifMatch
+func checkVersionWithBackend(backend Backend, tenant, resourceType, resourceID string, ifMatch *Precondition) error {
+	if ifMatch == nil {
+		return nil
+	}
+	existing, err := backend.GetResource(tenant, resourceType, resourceID)
+	if err != nil {
+		return err
+	}
+	return CheckVersion(ifMatch, resourceID, ResourceVersionOf(existing))
+}
+
+// Applies a patch for backends which don't implement PatchBackend. The
+// resource is replaced with Update, for a ConditionalBackend only if it
+// hasn't been modified since it was read.
+func patchWithUpdate(backend Backend, tenant, resourceType, resourceID string, patch *PatchRequest, ifMatch *Precondition) (string, error) {
+	existing, err := backend.GetResource(tenant, resourceType, resourceID)
+	if err != nil {
+		return "", err
+	}
+	version := ResourceVersionOf(existing)
+	if err := CheckVersion(ifMatch, resourceID, version); err != nil {
+		return "", err
+	}
+
+	patched, err := ApplyPatch(existing, patch)
+	if err != nil {
+		return "", err
+	}
+	if resourceIDOf(patched) != resourceIDOf(existing) {
+		return "", NewError(MalformedResourceError, "PATCH request may not change the resource's id")
+	}
+
+	if version != "" {
+		ifMatch = ParsePrecondition(version)
+	}
+	return updateWithBackend(backend, tenant, resourceType, resourceID, patched, ifMatch)
+}
@@ -0,0 +1,331 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package scimserverlite
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Schema URIs for bulk requests and responses (RFC 7644 section 3.7)
+const (
+	BulkRequestSchema  = "urn:ietf:params:scim:api:messages:2.0:BulkRequest"
+	BulkResponseSchema = "urn:ietf:params:scim:api:messages:2.0:BulkResponse"
+)
+
+// Limits for bulk requests, advertised in /ServiceProviderConfig
+const (
+	bulkMaxOperations  = 10000
+	bulkMaxPayloadSize = 32 * 1024 * 1024
+)
+
+// The prefix for references to resources created earlier in a bulk request
+const bulkIDPrefix = "bulkId:"
+
+type bulkOperation struct {
+	Method  string          `json:"method"`
+	BulkID  string          `json:"bulkId,omitempty"`
+	Version string          `json:"version,omitempty"`
+	Path    string          `json:"path"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+type bulkRequest struct {
+	Schemas      []string        `json:"schemas"`
+	FailOnErrors *int            `json:"failOnErrors,omitempty"`
+	Operations   []bulkOperation `json:"Operations"`
+}
+
+type bulkOperationResponse struct {
+	Method   string         `json:"method"`
+	BulkID   string         `json:"bulkId,omitempty"`
+	Version  string         `json:"version,omitempty"`
+	Location string         `json:"location,omitempty"`
+	Response *errorResponse `json:"response,omitempty"`
+	Status   string         `json:"status"`
+}
+
+func bulkError(errorType SCIMErrorType, format string, args ...interface{}) error {
+	return NewError(errorType, fmt.Sprintf(format, args...))
+}
+
+// Parses and checks the body of a bulk request
+func parseBulkRequest(body []byte) (*bulkRequest, error) {
+	var request bulkRequest
+	err := json.Unmarshal(body, &request)
+
+	if err != nil {
+		return nil, bulkError(InvalidSyntaxError, "Failed to parse bulk request: %v", err)
+	}
+
+	found := false
+	for _, schema := range request.Schemas {
+		if schema == BulkRequestSchema {
+			found = true
+		}
+	}
+	if !found {
+		return nil, bulkError(InvalidSyntaxError, "Bulk request must use schema %s", BulkRequestSchema)
+	}
+	return &request, nil
+}
+
+// Handles requests to /Bulk (RFC 7644 section 3.7). All operations are
+// done within one Backend.Batch. Operations which fail with a SCIMTypedError
+// are reported in the response, other errors (and an unavailable backend)
+// abort the whole request (and roll back the modifications in transactional
+// backends).
+//
+// A bulkId reference can only refer to a resource created by an earlier
+// operation in the same request.
+func (s *Server) bulkHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, http.StatusMethodNotAllowed, "", "Bulk requests must use POST")
+		return
+	}
+
+	if !checkMediaType(w, r) {
+		return
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, bulkMaxPayloadSize+1))
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, "", "Failed to read HTTP body")
+		return
+	}
+	if len(body) > bulkMaxPayloadSize {
+		WriteError(w, http.StatusRequestEntityTooLarge, "",
+			fmt.Sprintf("The size of the bulk operation exceeds the maxPayloadSize (%d)", bulkMaxPayloadSize))
+		return
+	}
+
+	request, err := parseBulkRequest(body)
+	if err != nil {
+		handleBackendError(w, err)
+		return
+	}
+
+	if len(request.Operations) > bulkMaxOperations {
+		WriteError(w, http.StatusRequestEntityTooLarge, "",
+			fmt.Sprintf("The number of operations exceeds the maxOperations (%d)", bulkMaxOperations))
+		return
+	}
+
+	tenant := s.getTenant(r.Context())
+	var responses []bulkOperationResponse
+
+	err = s.backend.BatchContext(r.Context(), tenant, func(b BatchModifier) error {
+		responses = make([]bulkOperationResponse, 0, len(request.Operations))
+		ids := make(map[string]string)
+		errors := 0
+
+		for i := range request.Operations {
+			if request.FailOnErrors != nil && *request.FailOnErrors > 0 && errors >= *request.FailOnErrors {
+				break
+			}
+
+			op := &request.Operations[i]
+			response, err := s.bulkOperation(b, r, op, ids)
+
+			if err != nil {
+				if typedError, ok := err.(SCIMTypedError); !ok || typedError.Type() == UnavailableError {
+					return err
+				}
+				errors++
+				status, scimType := ErrorStatus(err)
+				response = bulkOperationResponse{
+					Method:   op.Method,
+					BulkID:   op.BulkID,
+					Response: newErrorResponse(status, scimType, err.Error()),
+					Status:   strconv.Itoa(status),
+				}
+			}
+			responses = append(responses, response)
+		}
+		return nil
+	})
+
+	if err != nil {
+		handleBackendError(w, err)
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"schemas":    []string{BulkResponseSchema},
+		"Operations": responses,
+	})
+}
+
+// Performs one operation in a bulk request. ids maps the bulkIds of
+// the resources created so far to their resource IDs.
+func (s *Server) bulkOperation(b BatchModifier, r *http.Request, op *bulkOperation, ids map[string]string) (bulkOperationResponse, error) {
+	response := bulkOperationResponse{Method: op.Method, BulkID: op.BulkID}
+	method := strings.ToUpper(op.Method)
+
+	path, err := resolveBulkIDsInPath(op.Path, ids)
+	if err != nil {
+		return response, err
+	}
+
+	components := strings.Split(strings.Trim(path, "/"), "/")
+	resourceType := components[0]
+	if !s.endpoints[resourceType] {
+		return response, bulkError(InvalidPathError, "Unknown resource type in path: %s", op.Path)
+	}
+
+	resourceID := ""
+	if len(components) == 2 {
+		resourceID = components[1]
+	} else if len(components) > 2 {
+		return response, bulkError(InvalidPathError, "Invalid path: %s", op.Path)
+	}
+
+	if method == "POST" {
+		if resourceID != "" {
+			return response, bulkError(InvalidPathError, "POST operations must refer to a resource type: %s", op.Path)
+		}
+		if op.BulkID == "" {
+			return response, bulkError(InvalidSyntaxError, "POST operations require a bulkId")
+		}
+		if _, ok := ids[op.BulkID]; ok {
+			return response, bulkError(MalformedResourceError, "Duplicate bulkId: %s", op.BulkID)
+		}
+	} else if resourceID == "" {
+		return response, bulkError(InvalidPathError, "%s operations must refer to a resource: %s", op.Method, op.Path)
+	}
+
+	var data string
+	if method == "POST" || method == "PUT" || method == "PATCH" {
+		if len(op.Data) == 0 {
+			return response, bulkError(InvalidSyntaxError, "%s operations require data", op.Method)
+		}
+		data, err = resolveBulkIDsInData(op.Data, ids)
+		if err != nil {
+			return response, err
+		}
+	}
+
+	ifMatch := ParsePrecondition(op.Version)
+	var resource string
+
+	switch method {
+	case "POST":
+		resourceID, resource, err = b.Create(resourceType, data)
+		if err == nil {
+			ids[op.BulkID] = resourceID
+			response.Status = strconv.Itoa(http.StatusCreated)
+		}
+	case "PUT":
+		resource, err = b.Update(resourceType, resourceID, data, ifMatch)
+		response.Status = strconv.Itoa(http.StatusOK)
+	case "PATCH":
+		var patch *PatchRequest
+		patch, err = ParsePatchRequest(data)
+		if err == nil {
+			resource, err = b.Patch(resourceType, resourceID, patch, ifMatch)
+		}
+		response.Status = strconv.Itoa(http.StatusOK)
+	case "DELETE":
+		err = b.Delete(resourceType, resourceID, ifMatch)
+		response.Status = strconv.Itoa(http.StatusNoContent)
+	default:
+		return response, bulkError(InvalidSyntaxError, "Unsupported method in bulk operation: %s", op.Method)
+	}
+
+	if err != nil {
+		return response, err
+	}
+
+	response.Location = s.resourceLocation(r, resourceType, resourceID)
+	response.Version = ResourceVersionOf(resource)
+	return response, nil
+}
+
+// Looks up the resource ID for a bulkId reference
+func resolveBulkID(reference string, ids map[string]string) (string, error) {
+	id, ok := ids[strings.TrimPrefix(reference, bulkIDPrefix)]
+	if !ok {
+		return "", bulkError(MalformedResourceError, "Couldn't resolve %s, it must be created earlier in the bulk request", reference)
+	}
+	return id, nil
+}
+
+// Replaces bulkId references in a bulk operation's path
+func resolveBulkIDsInPath(path string, ids map[string]string) (string, error) {
+	components := strings.Split(path, "/")
+	for i := range components {
+		if strings.HasPrefix(components[i], bulkIDPrefix) {
+			id, err := resolveBulkID(components[i], ids)
+			if err != nil {
+				return "", err
+			}
+			components[i] = id
+		}
+	}
+	return strings.Join(components, "/"), nil
+}
+
+// Replaces bulkId references in a bulk operation's data. Any string
+// value of the form "bulkId:<bulkId>" is treated as a reference.
+func resolveBulkIDsInData(data json.RawMessage, ids map[string]string) (string, error) {
+	decoded, err := decodeJSON(data)
+	if err != nil {
+		return "", bulkError(InvalidSyntaxError, "Failed to parse data in bulk operation: %v", err)
+	}
+
+	var resolve func(v interface{}) (interface{}, error)
+	resolve = func(v interface{}) (interface{}, error) {
+		switch value := v.(type) {
+		case string:
+			if strings.HasPrefix(value, bulkIDPrefix) {
+				return resolveBulkID(value, ids)
+			}
+		case map[string]interface{}:
+			for key := range value {
+				resolved, err := resolve(value[key])
+				if err != nil {
+					return nil, err
+				}
+				value[key] = resolved
+			}
+		case []interface{}:
+			for i := range value {
+				resolved, err := resolve(value[i])
+				if err != nil {
+					return nil, err
+				}
+				value[i] = resolved
+			}
+		}
+		return v, nil
+	}
+
+	resolved, err := resolve(decoded)
+	if err != nil {
+		return "", err
+	}
+
+	body, err := json.Marshal(resolved)
+	return string(body), err
+}
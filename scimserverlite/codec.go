@@ -0,0 +1,62 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package scimserverlite
+
+// A Codec transforms data before it's written to storage and back when
+// it's read, for instance to encrypt it. Encoded data must not contain
+// newlines since journals are line based.
+type Codec interface {
+	Encode(data []byte) ([]byte, error)
+	Decode(data []byte) ([]byte, error)
+}
+
+// A SourceCodec is a Codec which is told where the data it decodes was
+// read from (a file, or a line in a journal), for its errors and warnings
+type SourceCodec interface {
+	Codec
+	DecodeFrom(source string, data []byte) ([]byte, error)
+}
+
+// SetCodec makes the backend encode everything it writes itself, that
+// is journals and the files in the tenant directory. Data written with
+// Snapshot or Serialize isn't encoded. It should be called before the
+// backend is used.
+func (backend *InMemoryBackend) SetCodec(codec Codec) {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	backend.codec = codec
+}
+
+func (backend *InMemoryBackend) encode(data []byte) ([]byte, error) {
+	if backend.codec == nil {
+		return data, nil
+	}
+	return backend.codec.Encode(data)
+}
+
+func (backend *InMemoryBackend) decode(source string, data []byte) ([]byte, error) {
+	if backend.codec == nil {
+		return data, nil
+	}
+	if sourceCodec, ok := backend.codec.(SourceCodec); ok {
+		return sourceCodec.DecodeFrom(source, data)
+	}
+	return backend.codec.Decode(data)
+}
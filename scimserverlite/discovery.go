@@ -0,0 +1,248 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package scimserverlite
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+)
+
+// Schema URIs for the discovery resources (RFC 7643 section 8.7)
+const (
+	ServiceProviderConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+	ResourceTypeSchema          = "urn:ietf:params:scim:schemas:core:2.0:ResourceType"
+	SchemaSchema                = "urn:ietf:params:scim:schemas:core:2.0:Schema"
+)
+
+// SchemaAttribute describes an attribute in a schema (RFC 7643 section 7)
+type SchemaAttribute struct {
+	Name           string            `json:"name"`
+	Type           string            `json:"type"`
+	MultiValued    bool              `json:"multiValued"`
+	Description    string            `json:"description,omitempty"`
+	Required       bool              `json:"required"`
+	CaseExact      bool              `json:"caseExact"`
+	Mutability     string            `json:"mutability"`
+	Returned       string            `json:"returned"`
+	Uniqueness     string            `json:"uniqueness"`
+	ReferenceTypes []string          `json:"referenceTypes,omitempty"`
+	SubAttributes  []SchemaAttribute `json:"subAttributes,omitempty"`
+}
+
+// Schema describes the attributes of a resource type or extension
+type Schema struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name,omitempty"`
+	Description string            `json:"description,omitempty"`
+	Attributes  []SchemaAttribute `json:"attributes"`
+}
+
+// SchemaExtension is an extension schema used by a resource type
+type SchemaExtension struct {
+	Schema   string `json:"schema"`
+	Required bool   `json:"required"`
+}
+
+// ResourceType describes a resource type (RFC 7643 section 6)
+type ResourceType struct {
+	Name             string            `json:"name"`
+	Description      string            `json:"description,omitempty"`
+	Endpoint         string            `json:"endpoint"`
+	Schema           string            `json:"schema"`
+	SchemaExtensions []SchemaExtension `json:"schemaExtensions,omitempty"`
+}
+
+// The features the server supports, as advertised in /ServiceProviderConfig
+type features struct {
+	patch  bool
+	bulk   bool
+	filter bool
+	sort   bool
+	etag   bool
+}
+
+func (s *Server) features() features {
+	return features{
+		patch:  true,
+		bulk:   true,
+		filter: true,
+		sort:   true,
+		etag:   true,
+	}
+}
+
+// EnableDiscovery registers the discovery endpoints /ServiceProviderConfig,
+// /Schemas and /ResourceTypes (RFC 7644 section 4). The resource types and
+// schemas are served as given, the service provider configuration is
+// generated from the features supported by the server.
+func (s *Server) EnableDiscovery(resourceTypes []ResourceType, schemas []Schema) {
+	s.resourceTypes = resourceTypes
+	s.schemas = schemas
+
+	discoveryHandler := func(handler func(w http.ResponseWriter, r *http.Request, id string)) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != "GET" {
+				WriteError(w, http.StatusMethodNotAllowed, "", "Discovery endpoints are read only")
+				return
+			}
+			path := strings.Split(strings.TrimSuffix(r.URL.Path, "/"), "/")
+			id := ""
+			if len(path) > 2 {
+				id = path[len(path)-1]
+			}
+			handler(w, r, id)
+		}
+	}
+
+	for _, endpoint := range []string{"/ServiceProviderConfig", "/ServiceProviderConfig/"} {
+		s.mux.HandleFunc(endpoint, discoveryHandler(s.serviceProviderConfigHandler))
+	}
+	for _, endpoint := range []string{"/Schemas", "/Schemas/"} {
+		s.mux.HandleFunc(endpoint, discoveryHandler(s.schemasHandler))
+	}
+	for _, endpoint := range []string{"/ResourceTypes", "/ResourceTypes/"} {
+		s.mux.HandleFunc(endpoint, discoveryHandler(s.resourceTypesHandler))
+	}
+}
+
+// Converts a struct to a JSON object so that common attributes can be added
+func toJSONObject(v interface{}) (map[string]interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	result := make(map[string]interface{})
+	err = json.Unmarshal(data, &result)
+	return result, err
+}
+
+// Adds schemas and meta to a discovery resource
+func discoveryResource(v interface{}, schema, resourceType, location string) (map[string]interface{}, error) {
+	result, err := toJSONObject(v)
+	if err != nil {
+		return nil, err
+	}
+	result["schemas"] = []string{schema}
+	result["meta"] = map[string]interface{}{
+		"resourceType": resourceType,
+		"location":     location,
+	}
+	return result, nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, "", "Failed to encode response")
+		return
+	}
+	w.Header().Set("Content-Type", SCIMMediaType)
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
+
+// Writes a list of discovery resources, or a single resource if id is given
+func writeDiscoveryResources(w http.ResponseWriter, resources []map[string]interface{}, ids []string, id string) {
+	if id != "" {
+		for i := range resources {
+			if ids[i] == id {
+				writeJSON(w, resources[i])
+				return
+			}
+		}
+		WriteError(w, http.StatusNotFound, "", fmt.Sprintf("Resource %s not found", id))
+		return
+	}
+
+	writeJSON(w, map[string]interface{}{
+		"schemas":      []string{"urn:ietf:params:scim:api:messages:2.0:ListResponse"},
+		"totalResults": len(resources),
+		"itemsPerPage": len(resources),
+		"startIndex":   1,
+		"Resources":    resources,
+	})
+}
+
+func (s *Server) serviceProviderConfigHandler(w http.ResponseWriter, r *http.Request, id string) {
+	if id != "" {
+		WriteError(w, http.StatusNotFound, "", "The service provider configuration has no sub resources")
+		return
+	}
+	f := s.features()
+	supported := func(b bool) map[string]interface{} {
+		return map[string]interface{}{"supported": b}
+	}
+	writeJSON(w, map[string]interface{}{
+		"schemas": []string{ServiceProviderConfigSchema},
+		"patch":   supported(f.patch),
+		"bulk": map[string]interface{}{
+			"supported":      f.bulk,
+			"maxOperations":  bulkMaxOperations,
+			"maxPayloadSize": bulkMaxPayloadSize,
+		},
+		"filter": map[string]interface{}{
+			"supported": f.filter,
+			// The number of results isn't limited
+			"maxResults": math.MaxInt32,
+		},
+		"changePassword":        supported(false),
+		"sort":                  supported(f.sort),
+		"etag":                  supported(f.etag),
+		"authenticationSchemes": []interface{}{},
+		"meta": map[string]interface{}{
+			"resourceType": "ServiceProviderConfig",
+			"location":     s.baseURL(r) + "/ServiceProviderConfig",
+		},
+	})
+}
+
+func (s *Server) schemasHandler(w http.ResponseWriter, r *http.Request, id string) {
+	resources := make([]map[string]interface{}, len(s.schemas))
+	ids := make([]string, len(s.schemas))
+	for i := range s.schemas {
+		resource, err := discoveryResource(&s.schemas[i], SchemaSchema, "Schema", s.baseURL(r)+"/Schemas/"+s.schemas[i].ID)
+		if err != nil {
+			WriteError(w, http.StatusInternalServerError, "", "Failed to encode schema")
+			return
+		}
+		resources[i] = resource
+		ids[i] = s.schemas[i].ID
+	}
+	writeDiscoveryResources(w, resources, ids, id)
+}
+
+func (s *Server) resourceTypesHandler(w http.ResponseWriter, r *http.Request, id string) {
+	resources := make([]map[string]interface{}, len(s.resourceTypes))
+	ids := make([]string, len(s.resourceTypes))
+	for i := range s.resourceTypes {
+		resource, err := discoveryResource(&s.resourceTypes[i], ResourceTypeSchema, "ResourceType", s.baseURL(r)+"/ResourceTypes/"+s.resourceTypes[i].Name)
+		if err != nil {
+			WriteError(w, http.StatusInternalServerError, "", "Failed to encode resource type")
+			return
+		}
+		resource["id"] = s.resourceTypes[i].Name
+		resources[i] = resource
+		ids[i] = s.resourceTypes[i].Name
+	}
+	writeDiscoveryResources(w, resources, ids, id)
+}
@@ -17,7 +17,12 @@ func (backend *DummyBackend) Create(tenant, resourceType, resource string) (stri
 	if err != nil {
 		return "", NewError(MalformedResourceError, "Failed to parse resource:\n"+err.Error())
 	}
-	return resource, nil
+	// There are no IDs in the dummy backend, use externalId if there is one
+	id, _ := CreateIDFromExternalID(resource)
+	if id == "" {
+		return resource, nil
+	}
+	return SetResourceID(resource, id)
 }
 
 func (backend *DummyBackend) Update(tenant, resourceType, resourceID, resource string) (string, error) {
@@ -25,13 +30,60 @@ func (backend *DummyBackend) Update(tenant, resourceType, resourceID, resource s
 	if err != nil {
 		return "", NewError(MalformedResourceError, "Failed to parse resource:\n"+err.Error())
 	}
-	return resource, nil
+	return SetResourceID(resource, resourceID)
+}
+
+// Since the DummyBackend has no stored resources there is never
+// a resource to apply a PATCH request to.
+func (backend *DummyBackend) Patch(tenant, resourceType, resourceID string, patch *PatchRequest) (string, error) {
+	return "", NewError(MissingResourceError, "Resource missing: "+resourceID)
 }
 
 func (backend *DummyBackend) Delete(tenant, resourceType, resourceID string) error {
 	return nil
 }
 
+// The BatchModifier for DummyBackend, which just like the backend
+// only verifies that the modifications can be parsed. Since there are
+// no stored resources, modifications with a precondition always fail.
+type dummyBatch struct {
+	backend *DummyBackend
+	tenant  string
+}
+
+func (b *dummyBatch) Create(resourceType, resource string) (string, string, error) {
+	created, err := b.backend.Create(b.tenant, resourceType, resource)
+	if err != nil {
+		return "", "", err
+	}
+	return resourceIDOf(created), created, nil
+}
+
+func (b *dummyBatch) Update(resourceType, resourceID, resource string, ifMatch *Precondition) (string, error) {
+	if err := checkVersionWithBackend(b.backend, b.tenant, resourceType, resourceID, ifMatch); err != nil {
+		return "", err
+	}
+	return b.backend.Update(b.tenant, resourceType, resourceID, resource)
+}
+
+func (b *dummyBatch) Patch(resourceType, resourceID string, patch *PatchRequest, ifMatch *Precondition) (string, error) {
+	if err := checkVersionWithBackend(b.backend, b.tenant, resourceType, resourceID, ifMatch); err != nil {
+		return "", err
+	}
+	return b.backend.Patch(b.tenant, resourceType, resourceID, patch)
+}
+
+func (b *dummyBatch) Delete(resourceType, resourceID string, ifMatch *Precondition) error {
+	if err := checkVersionWithBackend(b.backend, b.tenant, resourceType, resourceID, ifMatch); err != nil {
+		return err
+	}
+	return b.backend.Delete(b.tenant, resourceType, resourceID)
+}
+
+func (backend *DummyBackend) Batch(tenant string, apply func(BatchModifier) error) error {
+	return apply(&dummyBatch{backend: backend, tenant: tenant})
+}
+
 func (backend *DummyBackend) Clear(tenant string) error {
 	return nil
 }
@@ -40,6 +92,10 @@ func (backend *DummyBackend) GetResources(tenant, resourceType string) (map[stri
 	return make(map[string]string), nil
 }
 
+func (backend *DummyBackend) QueryResources(tenant, resourceType string, query *Query) (*QueryResult, error) {
+	return ApplyQuery(make(map[string]string), query)
+}
+
 func (backend *DummyBackend) GetResource(tenant, resourceType string, id string) (string, error) {
 	return "", NewError(MissingResourceError, "Resource missing: "+id)
 }
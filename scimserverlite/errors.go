@@ -0,0 +1,116 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package scimserverlite
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrorSchema is the schema for error responses
+const ErrorSchema = "urn:ietf:params:scim:api:messages:2.0:Error"
+
+// The JSON body of an error response
+type errorResponse struct {
+	Schemas  []string `json:"schemas"`
+	Status   string   `json:"status"`
+	ScimType string   `json:"scimType,omitempty"`
+	Detail   string   `json:"detail,omitempty"`
+}
+
+func newErrorResponse(status int, scimType, detail string) *errorResponse {
+	return &errorResponse{
+		Schemas:  []string{ErrorSchema},
+		Status:   fmt.Sprintf("%d", status),
+		ScimType: scimType,
+		Detail:   detail,
+	}
+}
+
+// WriteError writes an error response in the JSON format defined by
+// RFC 7644 section 3.12. scimType may be empty, it should only be
+// given for errors with status 400 (and 409 for uniqueness).
+func WriteError(w http.ResponseWriter, status int, scimType, detail string) {
+	body, err := json.Marshal(newErrorResponse(status, scimType, detail))
+
+	if err != nil {
+		http.Error(w, detail, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", SCIMMediaType)
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// StatusClientClosedRequest is the (non-standard) status for requests
+// which the client cancelled before the response was written. The client
+// won't see it, but it shows in access logs that it wasn't a server error.
+const StatusClientClosedRequest = 499
+
+// ErrorStatus returns the HTTP status and scimType to use for an error.
+// Errors which aren't SCIMTypedErrors are internal server errors.
+func ErrorStatus(e error) (int, string) {
+	typedError, ok := e.(SCIMTypedError)
+	if !ok {
+		return http.StatusInternalServerError, ""
+	}
+
+	switch typedError.Type() {
+	case ConflictError:
+		return http.StatusConflict, "uniqueness"
+	case MissingResourceError:
+		return http.StatusNotFound, ""
+	case MalformedResourceError, InvalidValueError:
+		return http.StatusBadRequest, "invalidValue"
+	case InvalidSyntaxError:
+		return http.StatusBadRequest, "invalidSyntax"
+	case InvalidFilterError:
+		return http.StatusBadRequest, "invalidFilter"
+	case InvalidPathError:
+		return http.StatusBadRequest, "invalidPath"
+	case NoTargetError:
+		return http.StatusBadRequest, "noTarget"
+	case MutabilityError:
+		return http.StatusBadRequest, "mutability"
+	case TooManyError:
+		return http.StatusBadRequest, "tooMany"
+	case PreconditionFailedError:
+		return http.StatusPreconditionFailed, ""
+	case UnavailableError:
+		return http.StatusServiceUnavailable, ""
+	case CanceledError:
+		return StatusClientClosedRequest, ""
+	}
+	return http.StatusInternalServerError, ""
+}
+
+func handleBackendError(w http.ResponseWriter, e error) {
+	if retry, ok := e.(interface{ RetryAfter() time.Duration }); ok && retry.RetryAfter() > 0 {
+		// Retry-After is given in whole seconds, round up
+		seconds := (retry.RetryAfter() + time.Second - 1) / time.Second
+		w.Header().Set("Retry-After", strconv.Itoa(int(seconds)))
+	}
+	status, scimType := ErrorStatus(e)
+	WriteError(w, status, scimType, e.Error())
+}
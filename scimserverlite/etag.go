@@ -0,0 +1,153 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package scimserverlite
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+// A Precondition is a list of entity tags from an If-Match or
+// If-None-Match header (RFC 7232), or "*" which matches any version.
+type Precondition struct {
+	any  bool
+	tags []string
+}
+
+// ParsePrecondition parses the value of an If-Match or If-None-Match
+// header. Returns nil if the header is empty.
+func ParsePrecondition(header string) *Precondition {
+	if strings.TrimSpace(header) == "" {
+		return nil
+	}
+	var p Precondition
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" {
+			p.any = true
+		} else if tag != "" {
+			p.tags = append(p.tags, tag)
+		}
+	}
+	return &p
+}
+
+// Returns the opaque part of an entity tag, so that weak and strong
+// tags can be compared (SCIM versions are typically weak).
+func opaqueTag(tag string) string {
+	return strings.TrimPrefix(tag, "W/")
+}
+
+// Matches returns true if version (the current version of an existing
+// resource, possibly empty if it's unknown) matches the precondition.
+// A nil Precondition matches any version.
+func (p *Precondition) Matches(version string) bool {
+	if p == nil || p.any {
+		return true
+	}
+	for _, tag := range p.tags {
+		if version != "" && opaqueTag(tag) == opaqueTag(version) {
+			return true
+		}
+	}
+	return false
+}
+
+// CheckVersion returns a PreconditionFailedError if the version of a
+// resource doesn't match an If-Match precondition.
+func CheckVersion(ifMatch *Precondition, resourceID, version string) error {
+	if !ifMatch.Matches(version) {
+		return NewError(PreconditionFailedError, "Resource "+resourceID+" has been modified (version "+version+")")
+	}
+	return nil
+}
+
+// ResourceVersionOf returns the version (meta.version) of a resource
+// from the backend, or an empty string if the resource has no version.
+func ResourceVersionOf(resource string) string {
+	var r struct {
+		Meta *Meta `json:"meta"`
+	}
+	if json.Unmarshal([]byte(resource), &r) != nil || r.Meta == nil {
+		return ""
+	}
+	return r.Meta.Version
+}
+
+// Updates a resource if its version matches ifMatch. For backends which
+// don't implement ConditionalBackend the version is checked before the
+// update, which leaves a small window for concurrent modifications.
+func (s *Server) updateIfMatch(ctx context.Context, tenant, resourceType, resourceID, resource string, ifMatch *Precondition) (string, error) {
+	if conditional, ok := s.backend.(ConditionalContextBackend); ok {
+		return conditional.UpdateIfMatchContext(ctx, tenant, resourceType, resourceID, resource, ifMatch)
+	}
+	if err := s.checkVersion(ctx, tenant, resourceType, resourceID, ifMatch); err != nil {
+		return "", err
+	}
+	return s.backend.UpdateContext(ctx, tenant, resourceType, resourceID, resource)
+}
+
+// Deletes a resource if its version matches ifMatch, see updateIfMatch.
+func (s *Server) deleteIfMatch(ctx context.Context, tenant, resourceType, resourceID string, ifMatch *Precondition) error {
+	if conditional, ok := s.backend.(ConditionalContextBackend); ok {
+		return conditional.DeleteIfMatchContext(ctx, tenant, resourceType, resourceID, ifMatch)
+	}
+	if err := s.checkVersion(ctx, tenant, resourceType, resourceID, ifMatch); err != nil {
+		return err
+	}
+	return s.backend.DeleteContext(ctx, tenant, resourceType, resourceID)
+}
+
+// Patches a resource if its version matches ifMatch. A conditional patch
+// is applied in a batch, so that backends check the version in the same
+// transaction (or under the same lock) as they apply the patch.
+func (s *Server) patchIfMatch(ctx context.Context, tenant, resourceType, resourceID string, patch *PatchRequest, ifMatch *Precondition) (string, error) {
+	if ifMatch == nil {
+		return s.backend.PatchContext(ctx, tenant, resourceType, resourceID, patch)
+	}
+	var patched string
+	err := s.backend.BatchContext(ctx, tenant, func(b BatchModifier) error {
+		var err error
+		patched, err = b.Patch(resourceType, resourceID, patch, ifMatch)
+		return err
+	})
+	return patched, err
+}
+
+// Checks the current version of a resource against ifMatch
+func (s *Server) checkVersion(ctx context.Context, tenant, resourceType, resourceID string, ifMatch *Precondition) error {
+	if ifMatch == nil {
+		return nil
+	}
+	existing, err := s.backend.GetResourceContext(ctx, tenant, resourceType, resourceID)
+	if err != nil {
+		return err
+	}
+	return CheckVersion(ifMatch, resourceID, ResourceVersionOf(existing))
+}
+
+// Sets the ETag header from a resource's version, if it has one
+func setETag(w http.ResponseWriter, version string) {
+	if version != "" {
+		w.Header().Set("ETag", version)
+	}
+}
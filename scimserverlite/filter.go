@@ -0,0 +1,556 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package scimserverlite
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Filter is a parsed SCIM filter expression (RFC 7644 section 3.4.2.2)
+//
+// A Filter is a tree of AttributeExpression, LogicalExpression,
+// NotExpression and ValuePathExpression nodes. Backends which can
+// evaluate filters more efficiently (for instance in a database)
+// can walk the tree, otherwise Matches can be used to evaluate the
+// filter against a resource.
+type Filter interface {
+	// Matches returns true if the resource (or complex value) matches the filter
+	Matches(resource map[string]interface{}) bool
+}
+
+// Comparison operators in attribute expressions
+const (
+	OpEqual          = "eq"
+	OpNotEqual       = "ne"
+	OpContains       = "co"
+	OpStartsWith     = "sw"
+	OpEndsWith       = "ew"
+	OpGreaterThan    = "gt"
+	OpLessThan       = "lt"
+	OpGreaterOrEqual = "ge"
+	OpLessOrEqual    = "le"
+	OpPresent        = "pr"
+)
+
+// AttributeExpression compares an attribute with a value, for instance
+// userName eq "baje@skola.kommunen.se". For the "pr" operator Value is nil.
+// Value is a string, float64, bool or nil.
+type AttributeExpression struct {
+	Path     AttributePath
+	Operator string
+	Value    interface{}
+}
+
+// LogicalExpression combines two filters with "and" or "or"
+type LogicalExpression struct {
+	Operator string
+	Left     Filter
+	Right    Filter
+}
+
+// NotExpression negates a filter
+type NotExpression struct {
+	Filter Filter
+}
+
+// ValuePathExpression filters on the values of a multi-valued attribute,
+// for instance emails[type eq "work" and value co "@example.com"]
+type ValuePathExpression struct {
+	Path   AttributePath
+	Filter Filter
+}
+
+// ParseFilter parses a SCIM filter expression
+func ParseFilter(filter string) (Filter, error) {
+	p, err := newFilterParser(filter)
+	if err != nil {
+		return nil, err
+	}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if !p.atEnd() {
+		return nil, fmt.Errorf("unexpected %s in filter", p.peek().text)
+	}
+	return f, nil
+}
+
+type filterTokenKind int
+
+const (
+	tokenWord filterTokenKind = iota
+	tokenString
+	tokenOpenParen
+	tokenCloseParen
+	tokenOpenBracket
+	tokenCloseBracket
+)
+
+type filterToken struct {
+	kind filterTokenKind
+	text string
+}
+
+func tokenizeFilter(s string) ([]filterToken, error) {
+	tokens := []filterToken{}
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '(':
+			tokens = append(tokens, filterToken{tokenOpenParen, "("})
+			i++
+		case c == ')':
+			tokens = append(tokens, filterToken{tokenCloseParen, ")"})
+			i++
+		case c == '[':
+			tokens = append(tokens, filterToken{tokenOpenBracket, "["})
+			i++
+		case c == ']':
+			tokens = append(tokens, filterToken{tokenCloseBracket, "]"})
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("unterminated string in filter")
+			}
+			var str string
+			if err := json.Unmarshal([]byte(s[i:j+1]), &str); err != nil {
+				return nil, fmt.Errorf("invalid string in filter: %s", s[i:j+1])
+			}
+			tokens = append(tokens, filterToken{tokenString, str})
+			i = j + 1
+		default:
+			j := i
+			for ; j < len(s) && !strings.ContainsRune(" \t\n\r()[]\"", rune(s[j])); j++ {
+			}
+			tokens = append(tokens, filterToken{tokenWord, s[i:j]})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func newFilterParser(s string) (*filterParser, error) {
+	tokens, err := tokenizeFilter(s)
+	if err != nil {
+		return nil, err
+	}
+	return &filterParser{tokens: tokens}, nil
+}
+
+func (p *filterParser) atEnd() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *filterParser) peek() filterToken {
+	if p.atEnd() {
+		return filterToken{tokenWord, ""}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *filterParser) next() (filterToken, error) {
+	if p.atEnd() {
+		return filterToken{}, fmt.Errorf("unexpected end of filter")
+	}
+	t := p.tokens[p.pos]
+	p.pos++
+	return t, nil
+}
+
+func (p *filterParser) expect(kind filterTokenKind, text string) error {
+	t, err := p.next()
+	if err != nil {
+		return err
+	}
+	if t.kind != kind {
+		return fmt.Errorf("expected %s in filter, got %s", text, t.text)
+	}
+	return nil
+}
+
+func (p *filterParser) peekKeyword(keyword string) bool {
+	t := p.peek()
+	return t.kind == tokenWord && strings.EqualFold(t.text, keyword)
+}
+
+func (p *filterParser) parseOr() (Filter, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("or") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &LogicalExpression{Operator: "or", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (Filter, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peekKeyword("and") {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &LogicalExpression{Operator: "and", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseParenthesized() (Filter, error) {
+	if err := p.expect(tokenOpenParen, "("); err != nil {
+		return nil, err
+	}
+	f, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(tokenCloseParen, ")"); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (p *filterParser) parseUnary() (Filter, error) {
+	if p.peekKeyword("not") && p.pos+1 < len(p.tokens) && p.tokens[p.pos+1].kind == tokenOpenParen {
+		p.pos++
+		f, err := p.parseParenthesized()
+		if err != nil {
+			return nil, err
+		}
+		return &NotExpression{Filter: f}, nil
+	}
+	if p.peek().kind == tokenOpenParen {
+		return p.parseParenthesized()
+	}
+	return p.parseAttributeExpression()
+}
+
+func (p *filterParser) parseAttributeExpression() (Filter, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if t.kind != tokenWord {
+		return nil, fmt.Errorf("expected attribute in filter, got %s", t.text)
+	}
+	path, err := ParseAttributePath(t.text)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.peek().kind == tokenOpenBracket {
+		if path.SubAttribute != "" {
+			return nil, fmt.Errorf("value filter not allowed after sub-attribute: %s", t.text)
+		}
+		p.pos++
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(tokenCloseBracket, "]"); err != nil {
+			return nil, err
+		}
+		return &ValuePathExpression{Path: path, Filter: inner}, nil
+	}
+
+	opToken, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	op := strings.ToLower(opToken.text)
+	if opToken.kind != tokenWord {
+		return nil, fmt.Errorf("expected operator in filter, got %s", opToken.text)
+	}
+
+	switch op {
+	case OpPresent:
+		return &AttributeExpression{Path: path, Operator: op}, nil
+	case OpEqual, OpNotEqual, OpContains, OpStartsWith, OpEndsWith,
+		OpGreaterThan, OpLessThan, OpGreaterOrEqual, OpLessOrEqual:
+	default:
+		return nil, fmt.Errorf("unknown operator in filter: %s", opToken.text)
+	}
+
+	valueToken, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	value, err := parseCompareValue(valueToken)
+	if err != nil {
+		return nil, err
+	}
+	return &AttributeExpression{Path: path, Operator: op, Value: value}, nil
+}
+
+func parseCompareValue(t filterToken) (interface{}, error) {
+	if t.kind == tokenString {
+		return t.text, nil
+	}
+	if t.kind != tokenWord {
+		return nil, fmt.Errorf("expected value in filter, got %s", t.text)
+	}
+	switch strings.ToLower(t.text) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	f, err := strconv.ParseFloat(t.text, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value in filter: %s", t.text)
+	}
+	return f, nil
+}
+
+// Returns the JSON object which holds the attributes for a path's schema.
+// Attributes from extension schemas are kept in an object named after the
+// schema URI, while attributes from the core schema are on the top level.
+func schemaContainer(resource map[string]interface{}, path AttributePath) map[string]interface{} {
+	if path.URI == "" {
+		return resource
+	}
+	if _, v, ok := lookupAttribute(resource, path.URI); ok {
+		if m, ok := v.(map[string]interface{}); ok {
+			return m
+		}
+	}
+	return resource
+}
+
+// Returns all values an attribute path refers to, multi-valued attributes
+// are flattened.
+func attributeValues(resource map[string]interface{}, path AttributePath) []interface{} {
+	_, v, ok := lookupAttribute(schemaContainer(resource, path), path.Name)
+	if !ok || v == nil {
+		return nil
+	}
+
+	var values []interface{}
+	if arr, isArray := v.([]interface{}); isArray {
+		values = arr
+	} else {
+		values = []interface{}{v}
+	}
+
+	if path.SubAttribute == "" {
+		return values
+	}
+
+	result := []interface{}{}
+	for _, value := range values {
+		if m, ok := value.(map[string]interface{}); ok {
+			if _, sub, ok := lookupAttribute(m, path.SubAttribute); ok && sub != nil {
+				result = append(result, sub)
+			}
+		}
+	}
+	return result
+}
+
+// Matches implements Filter for AttributeExpression
+func (e *AttributeExpression) Matches(resource map[string]interface{}) bool {
+	values := attributeValues(resource, e.Path)
+
+	if e.Operator == OpPresent {
+		for _, v := range values {
+			if s, ok := v.(string); ok && s == "" {
+				continue
+			}
+			return true
+		}
+		return false
+	}
+
+	if e.Value == nil {
+		if e.Operator == OpEqual {
+			return len(values) == 0
+		} else if e.Operator == OpNotEqual {
+			return len(values) > 0
+		}
+		return false
+	}
+
+	for _, v := range values {
+		// A complex value is compared using its "value" sub-attribute
+		if m, ok := v.(map[string]interface{}); ok {
+			if _, sub, ok := lookupAttribute(m, "value"); ok {
+				v = sub
+			}
+		}
+		if compareValue(v, e.Operator, e.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Compares a value from a resource with a value from a filter
+func compareValue(actual interface{}, op string, expected interface{}) bool {
+	switch exp := expected.(type) {
+	case string:
+		act, ok := actual.(string)
+		if !ok {
+			return false
+		}
+		act = strings.ToLower(act)
+		exp = strings.ToLower(exp)
+		switch op {
+		case OpEqual:
+			return act == exp
+		case OpNotEqual:
+			return act != exp
+		case OpContains:
+			return strings.Contains(act, exp)
+		case OpStartsWith:
+			return strings.HasPrefix(act, exp)
+		case OpEndsWith:
+			return strings.HasSuffix(act, exp)
+		case OpGreaterThan:
+			return act > exp
+		case OpLessThan:
+			return act < exp
+		case OpGreaterOrEqual:
+			return act >= exp
+		case OpLessOrEqual:
+			return act <= exp
+		}
+	case float64:
+		var act float64
+		switch a := actual.(type) {
+		case float64:
+			act = a
+		case json.Number:
+			f, err := a.Float64()
+			if err != nil {
+				return false
+			}
+			act = f
+		default:
+			return false
+		}
+		switch op {
+		case OpEqual:
+			return act == exp
+		case OpNotEqual:
+			return act != exp
+		case OpGreaterThan:
+			return act > exp
+		case OpLessThan:
+			return act < exp
+		case OpGreaterOrEqual:
+			return act >= exp
+		case OpLessOrEqual:
+			return act <= exp
+		}
+	case bool:
+		act, ok := actual.(bool)
+		if !ok {
+			return false
+		}
+		switch op {
+		case OpEqual:
+			return act == exp
+		case OpNotEqual:
+			return act != exp
+		}
+	}
+	return false
+}
+
+// Matches implements Filter for LogicalExpression
+func (e *LogicalExpression) Matches(resource map[string]interface{}) bool {
+	if e.Operator == "and" {
+		return e.Left.Matches(resource) && e.Right.Matches(resource)
+	}
+	return e.Left.Matches(resource) || e.Right.Matches(resource)
+}
+
+// Matches implements Filter for NotExpression
+func (e *NotExpression) Matches(resource map[string]interface{}) bool {
+	return !e.Filter.Matches(resource)
+}
+
+// Matches implements Filter for ValuePathExpression
+func (e *ValuePathExpression) Matches(resource map[string]interface{}) bool {
+	for _, v := range attributeValues(resource, e.Path) {
+		if m, ok := v.(map[string]interface{}); ok && e.Filter.Matches(m) {
+			return true
+		}
+	}
+	return false
+}
+
+// Decodes a resource for evaluation of filters and sorting. The id attribute
+// is set since that's how the resources are presented to the client.
+func decodeResource(id, resource string) (map[string]interface{}, error) {
+	decoded, err := decodeJSON([]byte(resource))
+	if err != nil {
+		return nil, err
+	}
+	m, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("resource %s is not a JSON object", id)
+	}
+	m["id"] = id
+	return m, nil
+}
+
+// FilterResources returns the resources (indexed by id) which match a filter.
+func FilterResources(resources map[string]string, filter Filter) (map[string]string, error) {
+	result := make(map[string]string)
+	for id, resource := range resources {
+		m, err := decodeResource(id, resource)
+		if err != nil {
+			return nil, err
+		}
+		if filter.Matches(m) {
+			result[id] = resource
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,135 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package scimserverlite
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+const filterUser = `
+{
+	"externalId": "u1",
+	"userName": "baje@skola.kommunen.se",
+	"name": {
+		"familyName": "Jensen",
+		"givenName": "Barbara"
+	},
+	"emails": [
+		{"value": "baje@skolan.kommunen.se", "type": "work"},
+		{"value": "babs@example.com", "type": "home"}
+	],
+	"urn:scim:schemas:extension:sis:school:1.0:User": {
+		"enrolments": [
+			{"value": "s1", "schoolYear": 4}
+		]
+	},
+	"active": true
+}
+`
+
+func TestFilterMatches(t *testing.T) {
+	var user map[string]interface{}
+	Ensure(t, json.Unmarshal([]byte(filterUser), &user))
+
+	tests := []struct {
+		filter  string
+		matches bool
+	}{
+		{`userName eq "BAJE@skola.kommunen.se"`, true},
+		{`userName ne "baje@skola.kommunen.se"`, false},
+		{`userName sw "baje" and name.familyName co "ens"`, true},
+		{`userName ew "kommunen.se" and name.givenName eq "Lisa"`, false},
+		{`name.givenName eq "Lisa" or name.familyName eq "Jensen"`, true},
+		{`not (userName eq "baje@skola.kommunen.se")`, false},
+		{`displayName pr`, false},
+		{`name.familyName pr`, true},
+		{`emails[type eq "home" and value co "example"]`, true},
+		{`emails[type eq "work" and value co "example"]`, false},
+		{`emails co "@example.com"`, true},
+		{`urn:scim:schemas:extension:sis:school:1.0:User:enrolments.schoolYear gt 3`, true},
+		{`urn:scim:schemas:extension:sis:school:1.0:User:enrolments.schoolYear le 3`, false},
+		{`urn:scim:schemas:extension:sis:school:1.0:User:enrolments.value eq "s1"`, true},
+		{`active eq true`, true},
+		{`displayName eq null`, true},
+		{`(userName eq "x" or externalId eq "u1") and active ne false`, true},
+	}
+
+	for _, test := range tests {
+		f, err := ParseFilter(test.filter)
+		if err != nil {
+			t.Errorf("Failed to parse filter %s: %v", test.filter, err)
+			continue
+		}
+		if f.Matches(user) != test.matches {
+			t.Errorf("Expected %v for filter %s", test.matches, test.filter)
+		}
+	}
+}
+
+func TestFilterInvalid(t *testing.T) {
+	invalid := []string{
+		``,
+		`userName`,
+		`userName eq`,
+		`userName xx "a"`,
+		`userName eq "a" and`,
+		`(userName eq "a"`,
+		`emails[type eq "work"`,
+		`userName eq "unterminated`,
+		`userName eq bareword`,
+	}
+	for _, filter := range invalid {
+		if _, err := ParseFilter(filter); err == nil {
+			t.Errorf("Expected failure for filter %s", filter)
+		}
+	}
+}
+
+func TestFilterHandler(t *testing.T) {
+	s, b := newTestServer()
+	_, err := b.Create(T1, UserType, UserA)
+	Ensure(t, err)
+	_, err = b.Create(T1, UserType, `{"name": "Anders Andersson", "age": 30}`)
+	Ensure(t, err)
+
+	w := doRequest(s, "GET", "/Users?filter="+url.QueryEscape(`age gt 40 and name sw "barbara"`), "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 from filtered GET, got %d: %s", w.Code, w.Body.String())
+	}
+	response := decodeBody(t, w)
+	resources := response["Resources"].([]interface{})
+	if response["totalResults"] != 1.0 || len(resources) != 1 || resources[0].(map[string]interface{})["id"] != "0" {
+		t.Errorf("Unexpected response to filtered GET: %v", response)
+	}
+
+	w = doRequest(s, "GET", "/Users?filter="+url.QueryEscape(`id eq "1"`), "")
+	response = decodeBody(t, w)
+	if response["totalResults"] != 1.0 {
+		t.Errorf("Expected to find resource by id: %v", response)
+	}
+
+	w = doRequest(s, "GET", "/Users?filter="+url.QueryEscape(`age gt`), "")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid filter, got %d", w.Code)
+	}
+}
@@ -22,8 +22,10 @@ package scimserverlite
 import (
 	"encoding/json"
 	"fmt"
+	"maps"
 	"sort"
 	"sync"
+	"time"
 )
 
 // A ResourceSet contains all resources for one tenant
@@ -33,19 +35,41 @@ type ResourceSet map[string]map[string]string
 type ParsedResourceSet map[string]map[string]interface{}
 
 // InMemoryBackend is a simple SCIM backend which stores all resources in memory
+//
+// Modifications hold the lock exclusively while reads share it. Maps
+// returned to callers are copies, so they can be used after the lock is
+// released without seeing later modifications. Modifications also hold
+// the write lock, which saves hold while writing to disk so that only
+// modifications wait for them (see lockModification).
 type InMemoryBackend struct {
 	resources map[string]ResourceSet
 	parsed    map[string]ParsedResourceSet
 	idFactory IDGenerator
 	parser    ObjectParser
-	lock      sync.Mutex
+	lock      sync.RWMutex
+	journal   *Journal
+	codec     Codec
+
+	// For loading, see SetStrictLoading and LoadReport
+	strict     bool
+	report     LoadReport
+	quarantine map[string][]QuarantinedResource
+
+	// For per-tenant files, see UseTenantDirectory
+	directory *TenantDirectory
+	loaded    map[string]bool
+	modified  map[string]bool
+	journals  map[string]*Journal
+
+	writeLock sync.Mutex
 }
 
 const currentVersion = 1
 
 type serialized struct {
-	Version   int
-	Resources map[string]ResourceSet
+	Version    int
+	Resources  map[string]ResourceSet
+	Quarantine map[string][]QuarantinedResource `json:",omitempty"`
 }
 
 // ObjectParser is a function which parses the resource from JSON to a Go object
@@ -58,6 +82,8 @@ type ObjectParser func(resourceType, resource string) (interface{}, error)
 func (backend *InMemoryBackend) initStorage() {
 	backend.resources = make(map[string]ResourceSet)
 	backend.parsed = make(map[string]ParsedResourceSet)
+	backend.report = make(LoadReport)
+	backend.quarantine = make(map[string][]QuarantinedResource)
 }
 
 // NewInMemoryBackend allocates and returns a new InMemoryBackend
@@ -83,9 +109,54 @@ func (backend *InMemoryBackend) getResource(tenant, resourceType, resourceID str
 
 // Create will create a resource in the backend
 func (backend *InMemoryBackend) Create(tenant, resourceType, resource string) (string, error) {
-	backend.lock.Lock()
-	defer backend.lock.Unlock()
+	if err := backend.ensureLoaded(tenant); err != nil {
+		return "", err
+	}
+
+	backend.lockModification()
+	defer backend.unlockModification()
+
+	_, created, err := backend.create(tenant, resourceType, resource)
+	return created, err
+}
+
+// Creates a resource, the caller must hold the lock
+func (backend *InMemoryBackend) create(tenant, resourceType, resource string) (string, string, error) {
+	resourceID, err := backend.idFactory(resource)
+
+	if err != nil {
+		return "", "", err
+	}
+
+	resource, err = touchResource(resource, "", resourceID, time.Now())
+
+	if err != nil {
+		return "", "", err
+	}
+
+	var parsed interface{}
+	if backend.parser != nil {
+		parsed, err = backend.parser(resourceType, resource)
+
+		if err != nil {
+			return "", "", NewError(MalformedResourceError, "Failed to parse resource:\n"+err.Error())
+		}
+
+	}
+
+	err = backend.record(journalEntry{Op: journalPut, Tenant: tenant, ResourceType: resourceType, ID: resourceID, Resource: resource})
 
+	if err != nil {
+		return "", "", err
+	}
+
+	backend.store(tenant, resourceType, resourceID, resource, parsed)
+
+	return resourceID, resource, nil
+}
+
+// Stores a resource, the caller must hold the lock
+func (backend *InMemoryBackend) store(tenant, resourceType, resourceID, resource string, parsed interface{}) {
 	if backend.resources[tenant] == nil {
 		backend.resources[tenant] = make(ResourceSet)
 	}
@@ -102,91 +173,275 @@ func (backend *InMemoryBackend) Create(tenant, resourceType, resource string) (s
 		backend.parsed[tenant][resourceType] = make(map[string]interface{})
 	}
 
-	resourceID, err := backend.idFactory(resource)
+	backend.resources[tenant][resourceType][resourceID] = resource
+	backend.parsed[tenant][resourceType][resourceID] = parsed
+}
 
-	if err != nil {
+// Update will update a resource in the backend
+func (backend *InMemoryBackend) Update(tenant, resourceType, resourceID, resource string) (string, error) {
+	return backend.UpdateIfMatch(tenant, resourceType, resourceID, resource, nil)
+}
+
+// UpdateIfMatch will update a resource in the backend if its current version matches ifMatch
+func (backend *InMemoryBackend) UpdateIfMatch(tenant, resourceType, resourceID, resource string, ifMatch *Precondition) (string, error) {
+	if err := backend.ensureLoaded(tenant); err != nil {
 		return "", err
 	}
 
-	var parsed interface{}
-	if backend.parser != nil {
-		parsed, err = backend.parser(resourceType, resource)
+	backend.lockModification()
+	defer backend.unlockModification()
 
-		if err != nil {
-			return "", NewError(MalformedResourceError, "Failed to parse resource:\n"+err.Error())
-		}
+	return backend.update(tenant, resourceType, resourceID, resource, ifMatch)
+}
 
+// Updates a resource, the caller must hold the lock
+func (backend *InMemoryBackend) update(tenant, resourceType, resourceID, resource string, ifMatch *Precondition) (string, error) {
+	existing, ok := backend.getResource(tenant, resourceType, resourceID)
+	if !ok {
+		return "", NewError(MissingResourceError, "Resource missing: "+resourceID)
 	}
 
-	backend.resources[tenant][resourceType][resourceID] = resource
-	backend.parsed[tenant][resourceType][resourceID] = parsed
+	if err := CheckVersion(ifMatch, resourceID, ResourceVersionOf(existing)); err != nil {
+		return "", err
+	}
+
+	resource, err := touchResource(resource, existing, resourceID, time.Now())
+
+	if err != nil {
+		return "", err
+	}
+
+	parsed, err := backend.parseModified(resourceType, resourceID, resource)
+
+	if err != nil {
+		return "", err
+	}
+
+	err = backend.record(journalEntry{Op: journalPut, Tenant: tenant, ResourceType: resourceType, ID: resourceID, Resource: resource})
 
+	if err != nil {
+		return "", err
+	}
+
+	backend.store(tenant, resourceType, resourceID, resource, parsed)
 	return resource, nil
 }
 
-// Update will update a resource in the backend
-func (backend *InMemoryBackend) Update(tenant, resourceType, resourceID, resource string) (string, error) {
-	backend.lock.Lock()
-	defer backend.lock.Unlock()
+// Parsed resources which know their own id, such as the SS12000 types
+// where the id is the externalId
+type identifiedObject interface {
+	GetID() string
+}
 
-	var parsed interface{}
-	var err error
-	if backend.parser != nil {
-		parsed, err = backend.parser(resourceType, resource)
+// Parses a resource which replaces the resource with id resourceID. If
+// the parsed resource knows its id, it must be resourceID or the resource
+// would be stored under an id other than its own.
+func (backend *InMemoryBackend) parseModified(resourceType, resourceID, resource string) (interface{}, error) {
+	if backend.parser == nil {
+		return nil, nil
+	}
 
-		if err != nil {
-			return "", NewError(MalformedResourceError, "Failed to parse resource:\n"+err.Error())
-		}
+	parsed, err := backend.parser(resourceType, resource)
+
+	if err != nil {
+		return nil, NewError(MalformedResourceError, "Failed to parse resource:\n"+err.Error())
+	}
+
+	if obj, ok := parsed.(identifiedObject); ok && obj.GetID() != resourceID {
+		return nil, NewError(MalformedResourceError, "The resource's id doesn't match the id in the URL")
+	}
+	return parsed, nil
+}
 
+// Patch will apply a PATCH request to a resource in the backend
+func (backend *InMemoryBackend) Patch(tenant, resourceType, resourceID string, patch *PatchRequest) (string, error) {
+	if err := backend.ensureLoaded(tenant); err != nil {
+		return "", err
 	}
 
-	if _, ok := backend.getResource(tenant, resourceType, resourceID); !ok {
+	backend.lockModification()
+	defer backend.unlockModification()
+
+	return backend.patch(tenant, resourceType, resourceID, patch, nil)
+}
+
+// Patches a resource, the caller must hold the lock
+func (backend *InMemoryBackend) patch(tenant, resourceType, resourceID string, patch *PatchRequest, ifMatch *Precondition) (string, error) {
+	existing, ok := backend.getResource(tenant, resourceType, resourceID)
+	if !ok {
 		return "", NewError(MissingResourceError, "Resource missing: "+resourceID)
 	}
 
-	backend.resources[tenant][resourceType][resourceID] = resource
-	backend.parsed[tenant][resourceType][resourceID] = parsed
+	if err := CheckVersion(ifMatch, resourceID, ResourceVersionOf(existing)); err != nil {
+		return "", err
+	}
+
+	resource, err := ApplyPatch(existing, patch)
+	if err != nil {
+		return "", err
+	}
+
+	resource, err = touchResource(resource, existing, resourceID, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	parsed, err := backend.parseModified(resourceType, resourceID, resource)
+	if err != nil {
+		return "", err
+	}
+
+	err = backend.record(journalEntry{Op: journalPut, Tenant: tenant, ResourceType: resourceType, ID: resourceID, Resource: resource})
+
+	if err != nil {
+		return "", err
+	}
+
+	backend.store(tenant, resourceType, resourceID, resource, parsed)
 	return resource, nil
 }
 
 // Delete will delete a resource from the backend
 func (backend *InMemoryBackend) Delete(tenant, resourceType, resourceID string) error {
-	backend.lock.Lock()
-	defer backend.lock.Unlock()
+	return backend.DeleteIfMatch(tenant, resourceType, resourceID, nil)
+}
+
+// DeleteIfMatch will delete a resource from the backend if its current version matches ifMatch
+func (backend *InMemoryBackend) DeleteIfMatch(tenant, resourceType, resourceID string, ifMatch *Precondition) error {
+	if err := backend.ensureLoaded(tenant); err != nil {
+		return err
+	}
+
+	backend.lockModification()
+	defer backend.unlockModification()
+
+	return backend.delete(tenant, resourceType, resourceID, ifMatch)
+}
 
-	if _, ok := backend.getResource(tenant, resourceType, resourceID); !ok {
+// Deletes a resource, the caller must hold the lock
+func (backend *InMemoryBackend) delete(tenant, resourceType, resourceID string, ifMatch *Precondition) error {
+	existing, ok := backend.getResource(tenant, resourceType, resourceID)
+	if !ok {
 		return NewError(MissingResourceError, "Resource missing: "+resourceID)
 	}
 
+	if err := CheckVersion(ifMatch, resourceID, ResourceVersionOf(existing)); err != nil {
+		return err
+	}
+
+	if err := backend.record(journalEntry{Op: journalDelete, Tenant: tenant, ResourceType: resourceType, ID: resourceID}); err != nil {
+		return err
+	}
+
 	delete(backend.resources[tenant][resourceType], resourceID)
 	delete(backend.parsed[tenant][resourceType], resourceID)
 	return nil
 }
 
+// The BatchModifier for InMemoryBackend, used while the backend is locked
+type inMemoryBatch struct {
+	backend *InMemoryBackend
+	tenant  string
+}
+
+func (b *inMemoryBatch) Create(resourceType, resource string) (string, string, error) {
+	return b.backend.create(b.tenant, resourceType, resource)
+}
+
+func (b *inMemoryBatch) Update(resourceType, resourceID, resource string, ifMatch *Precondition) (string, error) {
+	return b.backend.update(b.tenant, resourceType, resourceID, resource, ifMatch)
+}
+
+func (b *inMemoryBatch) Patch(resourceType, resourceID string, patch *PatchRequest, ifMatch *Precondition) (string, error) {
+	return b.backend.patch(b.tenant, resourceType, resourceID, patch, ifMatch)
+}
+
+func (b *inMemoryBatch) Delete(resourceType, resourceID string, ifMatch *Precondition) error {
+	return b.backend.delete(b.tenant, resourceType, resourceID, ifMatch)
+}
+
+// Batch applies several modifications under one lock. Modifications
+// are applied immediately, so they are kept even if apply fails.
+func (backend *InMemoryBackend) Batch(tenant string, apply func(BatchModifier) error) error {
+	if err := backend.ensureLoaded(tenant); err != nil {
+		return err
+	}
+
+	backend.lockModification()
+	defer backend.unlockModification()
+
+	return apply(&inMemoryBatch{backend: backend, tenant: tenant})
+}
+
 // Clear will remove all resources for a given tenant in the backend
 func (backend *InMemoryBackend) Clear(tenant string) error {
-	backend.lock.Lock()
-	defer backend.lock.Unlock()
+	if err := backend.ensureLoaded(tenant); err != nil {
+		return err
+	}
+
+	backend.lockModification()
+	defer backend.unlockModification()
+	if err := backend.record(journalEntry{Op: journalClear, Tenant: tenant}); err != nil {
+		return err
+	}
 	backend.resources[tenant] = make(ResourceSet)
 	backend.parsed[tenant] = make(ParsedResourceSet)
+	delete(backend.quarantine, tenant)
 	return nil
 }
 
 // Serialize returns all resources in a format which can later be read with Load()
+// With a tenant directory only the tenants which have been loaded are included.
 func (backend *InMemoryBackend) Serialize() ([]byte, error) {
-	backend.lock.Lock()
-	resources := backend.resources
-	backend.lock.Unlock()
+	backend.lock.RLock()
+	resources := backend.copyAll()
+	quarantine := maps.Clone(backend.quarantine)
+	backend.lock.RUnlock()
 
 	serializedForm := serialized{Version: currentVersion,
-		Resources: resources}
+		Resources:  resources,
+		Quarantine: quarantine}
 
 	json, err := json.MarshalIndent(&serializedForm, "", "  ")
 
 	return json, err
 }
 
-// Load reads all resources from serialized form
+// Copies the maps of all resources so they can be marshalled after
+// the lock is released, the caller must hold the lock
+func (backend *InMemoryBackend) copyAll() map[string]ResourceSet {
+	resources := make(map[string]ResourceSet, len(backend.resources))
+	for tenant, resourceSet := range backend.resources {
+		resources[tenant] = copyResourceSet(resourceSet)
+	}
+	return resources
+}
+
+func copyResourceSet(resourceSet ResourceSet) ResourceSet {
+	resources := make(ResourceSet, len(resourceSet))
+	for resourceType, byID := range resourceSet {
+		resources[resourceType] = maps.Clone(byID)
+	}
+	return resources
+}
+
+// Locks the backend for a modification. Saves only hold the write lock
+// while they write to disk, so they block modifications but not reads.
+func (backend *InMemoryBackend) lockModification() {
+	backend.writeLock.Lock()
+	backend.lock.Lock()
+}
+
+func (backend *InMemoryBackend) unlockModification() {
+	backend.lock.Unlock()
+	backend.writeLock.Unlock()
+}
+
+// Load reads all resources from serialized form. With a tenant directory
+// (see UseTenantDirectory) only the tenants in serializedForm are
+// replaced, which is how a single file is migrated to a tenant directory.
+// Resources which can't be parsed are quarantined, or with strict loading
+// nothing is loaded (see SetStrictLoading and LoadReport).
 func (backend *InMemoryBackend) Load(serializedForm []byte) error {
 	var unmarshalled serialized
 
@@ -210,33 +465,50 @@ func (backend *InMemoryBackend) Load(serializedForm []byte) error {
 	}
 
 	parsed := make(map[string]ParsedResourceSet)
+	report := make(LoadReport)
+	quarantined := make(map[string][]QuarantinedResource)
 
 	for tenant := range unmarshalled.Resources {
-		parsed[tenant] = make(ParsedResourceSet)
-		for resourceType := range unmarshalled.Resources[tenant] {
-			parsed[tenant][resourceType] = make(map[string]interface{})
-
-			for id, resource := range unmarshalled.Resources[tenant][resourceType] {
-				var parsedObject interface{}
-				if backend.parser != nil {
-					parsedObject, err = backend.parser(resourceType, resource)
-				}
-				parsed[tenant][resourceType][id] = parsedObject
-			}
-		}
+		parsed[tenant], report[tenant], quarantined[tenant] = backend.parseResourceSet(unmarshalled.Resources[tenant])
 	}
 
-	backend.lock.Lock()
-	backend.resources = unmarshalled.Resources
-	backend.parsed = parsed
-	backend.lock.Unlock()
+	backend.lockModification()
+	defer backend.unlockModification()
+
+	if backend.strict && report.Invalid() > 0 {
+		return &LoadError{Report: report}
+	}
+
+	if backend.directory == nil {
+		backend.resources = unmarshalled.Resources
+		backend.parsed = parsed
+		backend.report = report
+		backend.quarantine = make(map[string][]QuarantinedResource)
+	}
+
+	for tenant := range unmarshalled.Resources {
+		if backend.directory != nil {
+			// With a tenant directory the loaded tenants replace what's
+			// stored in their files the next time they are saved
+			backend.resources[tenant] = unmarshalled.Resources[tenant]
+			backend.parsed[tenant] = parsed[tenant]
+			backend.report[tenant] = report[tenant]
+			backend.loaded[tenant] = true
+			backend.modified[tenant] = true
+		}
+		backend.setQuarantine(tenant, unmarshalled.Quarantine[tenant], quarantined[tenant])
+	}
 	return nil
 }
 
 // GetResourceTypes returns the resource types for which we have objects for a given tenant
 func (backend *InMemoryBackend) GetResourceTypes(tenant string) []string {
-	backend.lock.Lock()
-	defer backend.lock.Unlock()
+	if err := backend.ensureLoaded(tenant); err != nil {
+		return []string{}
+	}
+
+	backend.lock.RLock()
+	defer backend.lock.RUnlock()
 
 	result := []string{}
 
@@ -255,8 +527,12 @@ func (backend *InMemoryBackend) GetResourceTypes(tenant string) []string {
 
 // CountResources returns number of objects for a resource type for a given tenant
 func (backend *InMemoryBackend) CountResources(tenant, resourceType string) int {
-	backend.lock.Lock()
-	defer backend.lock.Unlock()
+	if err := backend.ensureLoaded(tenant); err != nil {
+		return 0
+	}
+
+	backend.lock.RLock()
+	defer backend.lock.RUnlock()
 
 	if _, ok := backend.resources[tenant]; !ok {
 		return 0
@@ -269,10 +545,14 @@ func (backend *InMemoryBackend) CountResources(tenant, resourceType string) int
 	return len(resources)
 }
 
-// GetResources returns all resources for a type
+// GetResources returns a copy of all resources for a type
 func (backend *InMemoryBackend) GetResources(tenant, resourceType string) (map[string]string, error) {
-	backend.lock.Lock()
-	defer backend.lock.Unlock()
+	if err := backend.ensureLoaded(tenant); err != nil {
+		return nil, err
+	}
+
+	backend.lock.RLock()
+	defer backend.lock.RUnlock()
 
 	if _, ok := backend.resources[tenant]; !ok {
 		return make(map[string]string), nil
@@ -283,15 +563,31 @@ func (backend *InMemoryBackend) GetResources(tenant, resourceType string) (map[s
 		return make(map[string]string), nil
 	}
 
-	return resources, nil
+	return maps.Clone(resources), nil
+}
+
+// QueryResources returns the resources for a type which match a query.
+// The query is applied to a copy of the resources, so that the lock isn't
+// held while each resource is decoded and matched.
+func (backend *InMemoryBackend) QueryResources(tenant, resourceType string, query *Query) (*QueryResult, error) {
+	resources, err := backend.GetResources(tenant, resourceType)
+	if err != nil {
+		return nil, err
+	}
+	return ApplyQuery(resources, query)
 }
 
-// GetParsedResources returns all parsed resources
+// GetParsedResources returns a copy of the map of all parsed resources
 // If no ObjectParser was given, or if the ObjectParser returns nil for some resource types,
 // the returned map may contain nils.
+// The parsed objects themselves are shared and must not be modified.
 func (backend *InMemoryBackend) GetParsedResources(tenant, resourceType string) (map[string]interface{}, error) {
-	backend.lock.Lock()
-	defer backend.lock.Unlock()
+	if err := backend.ensureLoaded(tenant); err != nil {
+		return nil, err
+	}
+
+	backend.lock.RLock()
+	defer backend.lock.RUnlock()
 
 	if _, ok := backend.parsed[tenant]; !ok {
 		return make(map[string]interface{}), nil
@@ -302,15 +598,19 @@ func (backend *InMemoryBackend) GetParsedResources(tenant, resourceType string)
 		return make(map[string]interface{}), nil
 	}
 
-	return parsed, nil
+	return maps.Clone(parsed), nil
 }
 
 // GetResource returns a specific resource for a given tenant
 func (backend *InMemoryBackend) GetResource(tenant, resourceType string, id string) (string, error) {
-	backend.lock.Lock()
-	defer backend.lock.Unlock()
+	if err := backend.ensureLoaded(tenant); err != nil {
+		return "", err
+	}
+
+	backend.lock.RLock()
+	defer backend.lock.RUnlock()
 
-	failure := fmt.Errorf("no resource (%s) of type (%s) for tenant (%s)", id, resourceType, tenant)
+	failure := NewError(MissingResourceError, fmt.Sprintf("no resource (%s) of type (%s) for tenant (%s)", id, resourceType, tenant))
 
 	if _, ok := backend.resources[tenant]; !ok {
 		return "", failure
@@ -335,10 +635,14 @@ func (backend *InMemoryBackend) GetResource(tenant, resourceType string, id stri
 // If no ObjectParser was given, or if the ObjectParser returns nil for some resource types,
 // the returned interface{} may be nil.
 func (backend *InMemoryBackend) GetParsedResource(tenant, resourceType string, id string) (interface{}, error) {
-	backend.lock.Lock()
-	defer backend.lock.Unlock()
+	if err := backend.ensureLoaded(tenant); err != nil {
+		return nil, err
+	}
+
+	backend.lock.RLock()
+	defer backend.lock.RUnlock()
 
-	failure := fmt.Errorf("no resource (%s) of type (%s) for tenant (%s)", id, resourceType, tenant)
+	failure := NewError(MissingResourceError, fmt.Sprintf("no resource (%s) of type (%s) for tenant (%s)", id, resourceType, tenant))
 
 	if _, ok := backend.parsed[tenant]; !ok {
 		return nil, failure
@@ -23,6 +23,8 @@ import (
 	"fmt"
 	"reflect"
 	"sort"
+	"strconv"
+	"sync"
 	"testing"
 )
 
@@ -98,6 +100,18 @@ func MustFail(t *testing.T, err error) {
 	}
 }
 
+// Compares the content of a resource from the backend with the resource
+// given by the client, the id and meta data set by the backend are ignored.
+func sameContent(t *testing.T, resource, expected string) bool {
+	t.Helper()
+	var r, e map[string]interface{}
+	Ensure(t, json.Unmarshal([]byte(resource), &r))
+	Ensure(t, json.Unmarshal([]byte(expected), &e))
+	delete(r, "meta")
+	delete(r, "id")
+	return reflect.DeepEqual(r, e)
+}
+
 func TestCRUD(t *testing.T) {
 	b := NewInMemoryBackend(newSerialIDGenerator(), objectParser)
 	_, err := b.Create(T1, UserType, UserA)
@@ -105,7 +119,7 @@ func TestCRUD(t *testing.T) {
 
 	resource, err := b.GetResource(T1, UserType, "0")
 	Ensure(t, err)
-	if resource != UserA {
+	if !sameContent(t, resource, UserA) {
 		t.Errorf("GetResource returned:\n%s\n, expected:\n%s\n", resource, UserA)
 	}
 
@@ -114,7 +128,7 @@ func TestCRUD(t *testing.T) {
 
 	resource, err = b.GetResource(T1, UserType, "0")
 	Ensure(t, err)
-	if resource != UserB {
+	if !sameContent(t, resource, UserB) {
 		t.Errorf("GetResource returned:\n%s\n, expected:\n%s\n", resource, UserA)
 	}
 
@@ -151,13 +165,13 @@ func TestMultiTenancy(t *testing.T) {
 
 	resource, err := b.GetResource(T1, UserType, "0")
 	Ensure(t, err)
-	if resource != UserA {
+	if !sameContent(t, resource, UserA) {
 		t.Errorf("GetResource returned:\n%s\n, expected:\n%s\n", resource, UserA)
 	}
 
 	resource, err = b.GetResource(T2, UserType, "1")
 	Ensure(t, err)
-	if resource != UserB {
+	if !sameContent(t, resource, UserB) {
 		t.Errorf("GetResource returned:\n%s\n, expected:\n%s\n", resource, UserB)
 	}
 
@@ -174,7 +188,7 @@ func TestMultiTenancy(t *testing.T) {
 
 	resource, err = b.GetResource(T2, UserType, "1")
 	Ensure(t, err)
-	if resource != UserB {
+	if !sameContent(t, resource, UserB) {
 		t.Errorf("GetResource returned:\n%s\n, expected:\n%s\n", resource, UserB)
 	}
 
@@ -263,3 +277,120 @@ func TestLoadFromOld(t *testing.T) {
 		t.Errorf("Bad user after load from old format, wanted %v, got %v", &babs, obj)
 	}
 }
+
+func TestCopyOnRead(t *testing.T) {
+	b := NewInMemoryBackend(newSerialIDGenerator(), objectParser)
+	_, err := b.Create(T1, UserType, UserA)
+	Ensure(t, err)
+
+	resources, err := b.GetResources(T1, UserType)
+	Ensure(t, err)
+	parsed, err := b.GetParsedResources(T1, UserType)
+	Ensure(t, err)
+
+	_, err = b.Create(T1, UserType, UserB)
+	Ensure(t, err)
+	Ensure(t, b.Delete(T1, UserType, "0"))
+
+	if len(resources) != 1 || resources["0"] == "" || len(parsed) != 1 || parsed["0"] == nil {
+		t.Errorf("Returned maps changed by later modifications: %v, %v", resources, parsed)
+	}
+}
+
+// Run with -race to detect reads which aren't protected from concurrent writes
+func TestConcurrentAccess(t *testing.T) {
+	b := NewInMemoryBackend(newSerialIDGenerator(), objectParser)
+	const users = 10
+	for i := 0; i < users; i++ {
+		_, err := b.Create(T1, UserType, UserA)
+		Ensure(t, err)
+	}
+
+	var writers, readers sync.WaitGroup
+	done := make(chan struct{})
+
+	// Ensure can't be used in the goroutines (it calls t.Fatalf), so
+	// errors are collected and reported when all goroutines are done
+	errs := make(chan error, 100)
+	check := func(err error) {
+		if err != nil {
+			select {
+			case errs <- err:
+			default:
+				// Enough errors have been collected
+			}
+		}
+	}
+
+	for w := 0; w < 4; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			for i := 0; i < 200; i++ {
+				id := strconv.Itoa((w + i) % users)
+				_, err := b.Update(T1, UserType, id, fmt.Sprintf(`{"name": "User %d", "age": %d}`, w, i))
+				check(err)
+
+				err = b.Batch(T1, func(m BatchModifier) error {
+					id, _, err := m.Create(UserType, UserB)
+					if err != nil {
+						return err
+					}
+					return m.Delete(UserType, id, nil)
+				})
+				check(err)
+
+				_, err = b.Create(T2, GroupType, GroupA)
+				check(err)
+				if i%50 == 0 {
+					check(b.Clear(T2))
+				}
+			}
+		}(w)
+	}
+
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				resources, err := b.GetResources(T1, UserType)
+				check(err)
+				for id, resource := range resources {
+					var user testUser
+					if err := json.Unmarshal([]byte(resource), &user); err != nil {
+						check(fmt.Errorf("torn resource %s: %v", id, err))
+					}
+				}
+				parsed, err := b.GetParsedResources(T1, UserType)
+				check(err)
+				for range parsed {
+				}
+				_, err = b.QueryResources(T1, UserType, &Query{})
+				check(err)
+				_, err = b.Serialize()
+				check(err)
+				b.GetResourceTypes(T2)
+				b.CountResources(T2, GroupType)
+			}
+		}()
+	}
+
+	writers.Wait()
+	close(done)
+	readers.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	if n := b.CountResources(T1, UserType); n != users {
+		t.Errorf("Expected %d users after concurrent modifications, got %d", users, n)
+	}
+}
@@ -0,0 +1,354 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package scimserverlite
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"sync"
+	"time"
+)
+
+// SyncPolicy decides when a Journal is flushed to stable storage
+type SyncPolicy int
+
+const (
+	// SyncAlways flushes the journal after every operation
+	SyncAlways SyncPolicy = iota
+	// SyncPeriodically flushes the journal once per sync interval, a crash
+	// may lose the operations of the last interval
+	SyncPeriodically
+	// SyncNever leaves flushing to the operating system
+	SyncNever
+)
+
+// ParseSyncPolicy parses a sync policy from its name as used in
+// configuration files ("always", "interval" or "never")
+func ParseSyncPolicy(name string) (SyncPolicy, error) {
+	switch name {
+	case "always":
+		return SyncAlways, nil
+	case "interval":
+		return SyncPeriodically, nil
+	case "never":
+		return SyncNever, nil
+	}
+	return 0, fmt.Errorf("unknown journal sync policy: %s", name)
+}
+
+// Operations recorded in the journal
+const (
+	journalPut    = "put"
+	journalDelete = "delete"
+	journalClear  = "clear"
+)
+
+// One line in the journal. Creations and modifications are recorded
+// as the resulting resource so replaying doesn't depend on the clock
+// or the ID generator.
+type journalEntry struct {
+	Op           string `json:"op"`
+	Tenant       string `json:"tenant"`
+	ResourceType string `json:"resourceType,omitempty"`
+	ID           string `json:"id,omitempty"`
+	Resource     string `json:"resource,omitempty"`
+}
+
+// A Journal is an append-only log of the modifications of an
+// InMemoryBackend, so modifications since the last snapshot (see
+// InMemoryBackend.Snapshot) survive a crash. The journal is replayed
+// on top of the snapshot with InMemoryBackend.Replay.
+type Journal struct {
+	file   *os.File
+	policy SyncPolicy
+
+	lock  sync.Mutex
+	dirty bool
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// OpenJournal opens a journal for appending, creating it if it doesn't
+// exist. With SyncPeriodically the journal is flushed every syncInterval.
+func OpenJournal(path string, policy SyncPolicy, syncInterval time.Duration) (*Journal, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	j := &Journal{
+		file:   file,
+		policy: policy,
+		done:   make(chan struct{}),
+	}
+
+	if policy == SyncPeriodically {
+		if syncInterval <= 0 {
+			syncInterval = time.Second
+		}
+		j.wg.Add(1)
+		go j.syncPeriodically(syncInterval)
+	}
+	return j, nil
+}
+
+func (j *Journal) syncPeriodically(interval time.Duration) {
+	defer j.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			j.Sync()
+		case <-j.done:
+			return
+		}
+	}
+}
+
+// Sync flushes the journal to stable storage if anything has been
+// written since the last flush
+func (j *Journal) Sync() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if !j.dirty {
+		return nil
+	}
+	j.dirty = false
+	return j.file.Sync()
+}
+
+// Appends a line to the journal
+func (j *Journal) write(line []byte) error {
+	line = append(line, '\n')
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if _, err := j.file.Write(line); err != nil {
+		return err
+	}
+	if j.policy == SyncAlways {
+		return j.file.Sync()
+	}
+	j.dirty = true
+	return nil
+}
+
+// Empties the journal, after its entries have been included in a snapshot
+func (j *Journal) truncate() error {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	if err := j.file.Truncate(0); err != nil {
+		return err
+	}
+	j.dirty = false
+	return j.file.Sync()
+}
+
+// Close flushes and closes the journal
+func (j *Journal) Close() error {
+	close(j.done)
+	j.wg.Wait()
+
+	j.lock.Lock()
+	defer j.lock.Unlock()
+
+	err := j.file.Sync()
+	if closeErr := j.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// SetJournal makes the backend record all modifications in a journal.
+// Modifications which can't be written to the journal fail and aren't
+// applied.
+func (backend *InMemoryBackend) SetJournal(j *Journal) {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	backend.journal = j
+}
+
+// Records a modification in the journal, if there is one. The caller
+// must hold the lock.
+func (backend *InMemoryBackend) record(entry journalEntry) error {
+	journal := backend.journal
+	if backend.directory != nil {
+		backend.modified[entry.Tenant] = true
+
+		var err error
+		journal, err = backend.tenantJournal(entry.Tenant)
+		if err != nil {
+			return fmt.Errorf("failed to open journal: %v", err)
+		}
+	}
+
+	if journal == nil {
+		return nil
+	}
+
+	line, err := json.Marshal(entry)
+	if err == nil {
+		line, err = backend.encode(line)
+	}
+	if err == nil {
+		err = journal.write(line)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write to journal: %v", err)
+	}
+	return nil
+}
+
+// Snapshot serializes all resources (see Serialize) and passes them to
+// save. If save succeeds the journal is emptied, since its modifications
+// are included in the snapshot. Modifications are blocked meanwhile, but
+// reads only while the resources are copied.
+func (backend *InMemoryBackend) Snapshot(save func([]byte) error) error {
+	backend.writeLock.Lock()
+	defer backend.writeLock.Unlock()
+
+	backend.lock.RLock()
+	resources := backend.copyAll()
+	quarantine := maps.Clone(backend.quarantine)
+	journal := backend.journal
+	backend.lock.RUnlock()
+
+	serializedForm, err := json.MarshalIndent(&serialized{Version: currentVersion, Resources: resources, Quarantine: quarantine}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = save(serializedForm); err != nil {
+		return err
+	}
+
+	if journal != nil {
+		return journal.truncate()
+	}
+	return nil
+}
+
+// Replay applies the modifications from a journal, normally on top of
+// the snapshot loaded with Load. A partially written last line, from a
+// crash while writing it, is ignored.
+func (backend *InMemoryBackend) Replay(r io.Reader) error {
+	backend.lockModification()
+	defer backend.unlockModification()
+
+	_, err := backend.replay(r, journalName(r))
+	return err
+}
+
+// The name of a journal in errors and warnings
+func journalName(r io.Reader) string {
+	if f, ok := r.(interface{ Name() string }); ok {
+		return f.Name()
+	}
+	return "journal"
+}
+
+// Replays a journal, the caller must hold the lock. Returns the length of
+// the complete lines, which is less than the length of the journal if the
+// last line was never completely written.
+func (backend *InMemoryBackend) replay(r io.Reader, name string) (int64, error) {
+	reader := bufio.NewReader(r)
+	var complete int64
+	for lineNumber := 1; ; lineNumber++ {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// An unterminated line was never completely written
+			return complete, nil
+		} else if err != nil {
+			return complete, err
+		}
+		complete += int64(len(line))
+
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+
+		line, err = backend.decode(fmt.Sprintf("%s, line %d", name, lineNumber), line)
+		if err != nil {
+			return complete, fmt.Errorf("failed to decode journal entry on line %d: %v", lineNumber, err)
+		}
+
+		var entry journalEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return complete, fmt.Errorf("invalid journal entry on line %d: %v", lineNumber, err)
+		}
+
+		if err := backend.replayEntry(entry); err != nil {
+			return complete, fmt.Errorf("failed to replay journal entry on line %d: %v", lineNumber, err)
+		}
+	}
+}
+
+// Applies one journal entry, the caller must hold the lock
+func (backend *InMemoryBackend) replayEntry(entry journalEntry) error {
+	if backend.directory != nil {
+		if !backend.loaded[entry.Tenant] {
+			if err := backend.loadTenant(entry.Tenant); err != nil {
+				return err
+			}
+		}
+		backend.modified[entry.Tenant] = true
+	}
+
+	switch entry.Op {
+	case journalPut:
+		var parsed interface{}
+		if backend.parser != nil {
+			var err error
+			parsed, err = backend.parser(entry.ResourceType, entry.Resource)
+			if err != nil {
+				return backend.quarantineReplayed(entry, err)
+			}
+		}
+		if _, ok := backend.getResource(entry.Tenant, entry.ResourceType, entry.ID); !ok {
+			backend.typeReport(entry.Tenant, entry.ResourceType).Valid++
+		}
+		backend.store(entry.Tenant, entry.ResourceType, entry.ID, entry.Resource, parsed)
+	case journalDelete:
+		if _, ok := backend.getResource(entry.Tenant, entry.ResourceType, entry.ID); ok {
+			backend.typeReport(entry.Tenant, entry.ResourceType).Valid--
+		}
+		delete(backend.resources[entry.Tenant][entry.ResourceType], entry.ID)
+		delete(backend.parsed[entry.Tenant][entry.ResourceType], entry.ID)
+	case journalClear:
+		backend.resources[entry.Tenant] = make(ResourceSet)
+		backend.parsed[entry.Tenant] = make(ParsedResourceSet)
+		backend.report[entry.Tenant] = make(map[string]*ResourceTypeReport)
+		delete(backend.quarantine, entry.Tenant)
+	default:
+		return fmt.Errorf("unknown operation: %s", entry.Op)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package scimserverlite
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Replays a journal into a new backend loaded from a snapshot
+func recoverBackend(t *testing.T, snapshot []byte, journalPath string) *InMemoryBackend {
+	t.Helper()
+	b := NewInMemoryBackend(newSerialIDGenerator(), objectParser)
+	if snapshot != nil {
+		Ensure(t, b.Load(snapshot))
+	}
+	f, err := os.Open(journalPath)
+	Ensure(t, err)
+	defer f.Close()
+	Ensure(t, b.Replay(f))
+	return b
+}
+
+func TestJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	journal, err := OpenJournal(path, SyncAlways, 0)
+	Ensure(t, err)
+	defer journal.Close()
+
+	b := NewInMemoryBackend(newSerialIDGenerator(), objectParser)
+	b.SetJournal(journal)
+
+	_, err = b.Create(T1, UserType, UserA)
+	Ensure(t, err)
+	_, err = b.Create(T1, UserType, UserB)
+	Ensure(t, err)
+	_, err = b.Create(T2, GroupType, GroupA)
+	Ensure(t, err)
+	_, err = b.Patch(T1, UserType, "0", &PatchRequest{Operations: []PatchOperation{{Op: "replace", Path: "age", Value: json.RawMessage("50")}}})
+	Ensure(t, err)
+	Ensure(t, b.Delete(T1, UserType, "1"))
+	Ensure(t, b.Clear(T2))
+
+	recovered := recoverBackend(t, nil, path)
+	for _, tenant := range []string{T1, T2} {
+		for _, resourceType := range []string{UserType, GroupType} {
+			expected, _ := b.GetResources(tenant, resourceType)
+			actual, _ := recovered.GetResources(tenant, resourceType)
+			if len(expected) != len(actual) || (len(expected) > 0 && !reflect.DeepEqual(expected, actual)) {
+				t.Errorf("Different %s for %s after replay, expected %v, got %v", resourceType, tenant, expected, actual)
+			}
+		}
+	}
+	parsed, err := recovered.GetParsedResource(T1, UserType, "0")
+	Ensure(t, err)
+	if parsed.(*testUser).Age != 50 {
+		t.Errorf("Expected patched user after replay, got %v", parsed)
+	}
+
+	// A snapshot includes the journal, which is emptied
+	var snapshot []byte
+	Ensure(t, b.Snapshot(func(serializedForm []byte) error {
+		snapshot = serializedForm
+		return nil
+	}))
+	if info, err := os.Stat(path); err != nil || info.Size() != 0 {
+		t.Errorf("Expected empty journal after snapshot: %v", err)
+	}
+
+	_, err = b.Create(T1, UserType, UserB)
+	Ensure(t, err)
+	recovered = recoverBackend(t, snapshot, path)
+	if n := recovered.CountResources(T1, UserType); n != 2 {
+		t.Errorf("Expected 2 users from snapshot and journal, got %d", n)
+	}
+}
+
+func TestJournalTornWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	journal, err := OpenJournal(path, SyncPeriodically, time.Millisecond)
+	Ensure(t, err)
+
+	b := NewInMemoryBackend(newSerialIDGenerator(), objectParser)
+	b.SetJournal(journal)
+	_, err = b.Create(T1, UserType, UserA)
+	Ensure(t, err)
+	Ensure(t, journal.Close())
+
+	// A crash while writing leaves an incomplete last line
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	Ensure(t, err)
+	_, err = f.WriteString(`{"op":"put","tenant":"`)
+	Ensure(t, err)
+	Ensure(t, f.Close())
+
+	recovered := recoverBackend(t, nil, path)
+	if n := recovered.CountResources(T1, UserType); n != 1 {
+		t.Errorf("Expected 1 user after replaying journal with torn write, got %d", n)
+	}
+
+	// Journal entries which can't be written aren't applied
+	b.SetJournal(journal)
+	_, err = b.Create(T1, UserType, UserB)
+	MustFail(t, err)
+	if n := b.CountResources(T1, UserType); n != 1 {
+		t.Errorf("Expected modification to fail without journal, got %d users", n)
+	}
+}
+
+func TestReadsDuringSnapshot(t *testing.T) {
+	b := NewInMemoryBackend(newSerialIDGenerator(), objectParser)
+	_, err := b.Create(T1, UserType, UserA)
+	Ensure(t, err)
+
+	saving, release := make(chan struct{}), make(chan struct{})
+	saved := make(chan error)
+	go func() {
+		saved <- b.Snapshot(func([]byte) error {
+			close(saving)
+			<-release
+			return nil
+		})
+	}()
+	<-saving
+
+	// Modifications wait for the save...
+	created := make(chan error)
+	go func() {
+		_, err := b.Create(T1, UserType, UserB)
+		created <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case <-created:
+		t.Errorf("Expected modification to wait for the snapshot to be saved")
+	default:
+	}
+
+	// ...but reads don't, even with a modification waiting
+	read := make(chan int)
+	go func() {
+		read <- b.CountResources(T1, UserType)
+	}()
+	select {
+	case n := <-read:
+		if n != 1 {
+			t.Errorf("Expected 1 user while saving, got %d", n)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected reads not to wait for the snapshot to be saved")
+	}
+
+	close(release)
+	Ensure(t, <-saved)
+	Ensure(t, <-created)
+}
@@ -0,0 +1,241 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package scimserverlite
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A LoadReport tells, per tenant and resource type, how many of the stored
+// resources could be parsed when they were loaded. Resources which couldn't
+// be parsed are quarantined (see GetQuarantine) instead of being served.
+type LoadReport map[string]map[string]*ResourceTypeReport
+
+// ResourceTypeReport is the part of a LoadReport for one resource type
+type ResourceTypeReport struct {
+	Valid   int `json:"valid"`
+	Invalid int `json:"invalid"`
+
+	// Why each invalid resource couldn't be parsed, by resource ID
+	Reasons map[string]string `json:"reasons,omitempty"`
+}
+
+// Invalid returns the total number of invalid resources in the report
+func (report LoadReport) Invalid() int {
+	invalid := 0
+	for _, byType := range report {
+		for _, typeReport := range byType {
+			invalid += typeReport.Invalid
+		}
+	}
+	return invalid
+}
+
+// String summarizes the report with one line per tenant and resource
+// type, followed by the reasons for any invalid resources
+func (report LoadReport) String() string {
+	var b strings.Builder
+	for _, tenant := range sortedKeys(report) {
+		for _, resourceType := range sortedKeys(report[tenant]) {
+			typeReport := report[tenant][resourceType]
+			fmt.Fprintf(&b, "tenant %q, %s: %d valid, %d invalid\n", tenant, resourceType, typeReport.Valid, typeReport.Invalid)
+			for _, id := range sortedKeys(typeReport.Reasons) {
+				fmt.Fprintf(&b, "  %s: %s\n", id, typeReport.Reasons[id])
+			}
+		}
+	}
+	return b.String()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// A QuarantinedResource is a stored resource which couldn't be parsed
+// when it was loaded. It's kept in storage for administrators to inspect,
+// but isn't served to clients.
+type QuarantinedResource struct {
+	ResourceType string    `json:"resourceType"`
+	ID           string    `json:"id"`
+	Resource     string    `json:"resource"`
+	Reason       string    `json:"reason"`
+	Quarantined  time.Time `json:"quarantined"`
+}
+
+// LoadError is returned when loading in strict mode (see SetStrictLoading)
+// finds invalid stored resources
+type LoadError struct {
+	Report LoadReport
+}
+
+func (e *LoadError) Error() string {
+	return fmt.Sprintf("%d stored resources are invalid:\n%s", e.Report.Invalid(), e.Report)
+}
+
+// SetStrictLoading makes loading fail with a LoadError if any stored
+// resource can't be parsed, instead of quarantining it. With a tenant
+// directory this happens when the tenant is loaded. It should be called
+// before the backend is loaded.
+func (backend *InMemoryBackend) SetStrictLoading(strict bool) {
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+	backend.strict = strict
+}
+
+// LoadReport returns the report for the tenants loaded so far
+func (backend *InMemoryBackend) LoadReport() LoadReport {
+	backend.lock.RLock()
+	defer backend.lock.RUnlock()
+
+	report := make(LoadReport, len(backend.report))
+	for tenant, byType := range backend.report {
+		report[tenant] = make(map[string]*ResourceTypeReport, len(byType))
+		for resourceType, typeReport := range byType {
+			c := *typeReport
+			report[tenant][resourceType] = &c
+		}
+	}
+	return report
+}
+
+// GetQuarantine returns the quarantined resources of the tenants loaded
+// so far, by tenant. The quarantine of a tenant is emptied when the
+// tenant is cleared.
+func (backend *InMemoryBackend) GetQuarantine() map[string][]QuarantinedResource {
+	backend.lock.RLock()
+	defer backend.lock.RUnlock()
+
+	quarantine := make(map[string][]QuarantinedResource, len(backend.quarantine))
+	for tenant, resources := range backend.quarantine {
+		quarantine[tenant] = append([]QuarantinedResource(nil), resources...)
+	}
+	return quarantine
+}
+
+// Parses all resources of a tenant as they are loaded. Resources which
+// can't be parsed are removed from resources and returned for quarantine.
+func (backend *InMemoryBackend) parseResourceSet(resources ResourceSet) (ParsedResourceSet, map[string]*ResourceTypeReport, []QuarantinedResource) {
+	parsed := make(ParsedResourceSet)
+	report := make(map[string]*ResourceTypeReport)
+	var quarantined []QuarantinedResource
+	now := time.Now()
+
+	for _, resourceType := range sortedKeys(resources) {
+		parsed[resourceType] = make(map[string]interface{})
+		typeReport := &ResourceTypeReport{}
+		report[resourceType] = typeReport
+
+		for _, id := range sortedKeys(resources[resourceType]) {
+			resource := resources[resourceType][id]
+			var parsedObject interface{}
+			if backend.parser != nil {
+				var err error
+				parsedObject, err = backend.parser(resourceType, resource)
+				if err != nil {
+					typeReport.Invalid++
+					if typeReport.Reasons == nil {
+						typeReport.Reasons = make(map[string]string)
+					}
+					typeReport.Reasons[id] = err.Error()
+					quarantined = append(quarantined, QuarantinedResource{
+						ResourceType: resourceType,
+						ID:           id,
+						Resource:     resource,
+						Reason:       err.Error(),
+						Quarantined:  now,
+					})
+					delete(resources[resourceType], id)
+					continue
+				}
+			}
+			typeReport.Valid++
+			parsed[resourceType][id] = parsedObject
+		}
+	}
+	return parsed, report, quarantined
+}
+
+// Sets the quarantine of a tenant being loaded, from the resources which
+// were already quarantined in storage and those quarantined now. The
+// caller must hold the lock.
+func (backend *InMemoryBackend) setQuarantine(tenant string, stored, quarantined []QuarantinedResource) {
+	all := append(stored, quarantined...)
+	if len(all) == 0 {
+		delete(backend.quarantine, tenant)
+		return
+	}
+	backend.quarantine[tenant] = all
+}
+
+// Returns the report for a resource type of a tenant, creating it if
+// needed. The caller must hold the lock.
+func (backend *InMemoryBackend) typeReport(tenant, resourceType string) *ResourceTypeReport {
+	if backend.report[tenant] == nil {
+		backend.report[tenant] = make(map[string]*ResourceTypeReport)
+	}
+	typeReport := backend.report[tenant][resourceType]
+	if typeReport == nil {
+		typeReport = &ResourceTypeReport{}
+		backend.report[tenant][resourceType] = typeReport
+	}
+	return typeReport
+}
+
+// Quarantines a resource from the journal which can't be parsed, just
+// like when it's loaded from a file. Any earlier version of the resource
+// is removed. In strict mode a LoadError is returned instead. The caller
+// must hold the lock.
+func (backend *InMemoryBackend) quarantineReplayed(entry journalEntry, reason error) error {
+	if backend.strict {
+		return &LoadError{Report: LoadReport{entry.Tenant: {entry.ResourceType: &ResourceTypeReport{
+			Invalid: 1,
+			Reasons: map[string]string{entry.ID: reason.Error()},
+		}}}}
+	}
+
+	typeReport := backend.typeReport(entry.Tenant, entry.ResourceType)
+	if _, ok := backend.getResource(entry.Tenant, entry.ResourceType, entry.ID); ok {
+		delete(backend.resources[entry.Tenant][entry.ResourceType], entry.ID)
+		delete(backend.parsed[entry.Tenant][entry.ResourceType], entry.ID)
+		typeReport.Valid--
+	}
+	typeReport.Invalid++
+	if typeReport.Reasons == nil {
+		typeReport.Reasons = make(map[string]string)
+	}
+	typeReport.Reasons[entry.ID] = reason.Error()
+
+	backend.quarantine[entry.Tenant] = append(backend.quarantine[entry.Tenant], QuarantinedResource{
+		ResourceType: entry.ResourceType,
+		ID:           entry.ID,
+		Resource:     entry.Resource,
+		Reason:       reason.Error(),
+		Quarantined:  time.Now(),
+	})
+	return nil
+}
@@ -0,0 +1,157 @@
+package scimserverlite
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// One valid user, one user which can't be parsed and a resource of an
+// unknown type
+const savedWithInvalid = `
+{
+	"Version": 1,
+	"Resources": {
+		"tenant1": {
+			"Users": {
+				"0": "{\"Name\": \"Barbara Jensen\",\"Age\": 47}",
+				"1": "{\"Name\": \"John Smith\",\"Age\": \"old\"}"
+			},
+			"Foo": {
+				"2": "{}"
+			}
+		}
+	}
+}`
+
+func TestLoadReport(t *testing.T) {
+	b := NewInMemoryBackend(newSerialIDGenerator(), objectParser)
+	Ensure(t, b.Load([]byte(savedWithInvalid)))
+
+	report := b.LoadReport()
+	if users := report[T1][UserType]; users == nil || users.Valid != 1 || users.Invalid != 1 || users.Reasons["1"] == "" {
+		t.Errorf("Bad report for users: %v", report)
+	}
+	if foo := report[T1]["Foo"]; foo == nil || foo.Valid != 0 || foo.Invalid != 1 {
+		t.Errorf("Bad report for Foo: %v", report)
+	}
+	if report.Invalid() != 2 {
+		t.Errorf("Expected 2 invalid resources, got %d", report.Invalid())
+	}
+
+	// Invalid resources aren't served
+	parsed, err := b.GetParsedResources(T1, UserType)
+	Ensure(t, err)
+	if len(parsed) != 1 || parsed["0"] == nil {
+		t.Errorf("Expected only the valid user to be parsed, got %v", parsed)
+	}
+	_, err = b.GetResource(T1, UserType, "1")
+	MustFail(t, err)
+
+	quarantine := b.GetQuarantine()
+	if len(quarantine[T1]) != 2 || quarantine[T1][0].ID != "2" || quarantine[T1][1].ID != "1" {
+		t.Errorf("Expected both invalid resources to be quarantined, got %v", quarantine)
+	}
+
+	// The quarantine is kept in storage
+	saved, err := b.Serialize()
+	Ensure(t, err)
+	b2 := NewInMemoryBackend(newSerialIDGenerator(), objectParser)
+	Ensure(t, b2.Load(saved))
+	if len(b2.GetQuarantine()[T1]) != 2 {
+		t.Errorf("Expected the quarantine to be kept, got %v", b2.GetQuarantine())
+	}
+	if n := b2.LoadReport().Invalid(); n != 0 {
+		t.Errorf("Expected no invalid resources when loading again, got %d", n)
+	}
+
+	// Clearing the tenant empties the quarantine
+	Ensure(t, b2.Clear(T1))
+	if len(b2.GetQuarantine()) != 0 {
+		t.Errorf("Expected an empty quarantine after clearing, got %v", b2.GetQuarantine())
+	}
+}
+
+func TestStrictLoading(t *testing.T) {
+	b := NewInMemoryBackend(newSerialIDGenerator(), objectParser)
+	b.SetStrictLoading(true)
+
+	err := b.Load([]byte(savedWithInvalid))
+	var loadError *LoadError
+	if !errors.As(err, &loadError) || loadError.Report.Invalid() != 2 {
+		t.Fatalf("Expected a load error with 2 invalid resources, got %v", err)
+	}
+	if n := b.CountResources(T1, UserType); n != 0 {
+		t.Errorf("Expected nothing to be loaded, got %d users", n)
+	}
+
+	// With a tenant directory the tenant fails to load
+	dir := t.TempDir()
+	b = newTenantDirectoryBackend(t, dir, false, nil)
+	Ensure(t, os.WriteFile(b.directory.file(T1), []byte(savedWithInvalid), 0600))
+	b.SetStrictLoading(true)
+	_, err = b.GetResources(T1, UserType)
+	if err == nil || !strings.Contains(err.Error(), "2 stored resources are invalid") {
+		t.Errorf("Expected a load error for the tenant, got %v", err)
+	}
+
+	// Without strict mode the tenant is saved without the invalid resources
+	var written []string
+	b = newTenantDirectoryBackend(t, dir, false, &written)
+	if n := b.CountResources(T1, UserType); n != 1 {
+		t.Errorf("Expected 1 valid user, got %d", n)
+	}
+	Ensure(t, b.SaveTenants())
+	if len(written) != 1 {
+		t.Errorf("Expected the tenant to be saved after quarantining, got %v", written)
+	}
+	b = newTenantDirectoryBackend(t, dir, false, nil)
+	b.SetStrictLoading(true)
+	if n := b.CountResources(T1, UserType); n != 1 || len(b.GetQuarantine()[T1]) != 2 {
+		t.Errorf("Expected the saved tenant to load in strict mode with its quarantine, got %d users and %v", n, b.GetQuarantine())
+	}
+}
+
+func TestQuarantineFromJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	journal, err := OpenJournal(path, SyncAlways, 0)
+	Ensure(t, err)
+
+	// Without a parser anything is accepted when written
+	b := NewInMemoryBackend(newSerialIDGenerator(), nil)
+	b.SetJournal(journal)
+	_, err = b.Create(T1, UserType, UserA)
+	Ensure(t, err)
+	_, err = b.Create(T1, UserType, `{"name": "John Smith", "age": "old"}`)
+	Ensure(t, err)
+	Ensure(t, journal.Close())
+
+	replay := func(strict bool) (*InMemoryBackend, error) {
+		b := NewInMemoryBackend(newSerialIDGenerator(), objectParser)
+		b.SetStrictLoading(strict)
+		f, err := os.Open(path)
+		Ensure(t, err)
+		defer f.Close()
+		return b, b.Replay(f)
+	}
+
+	_, err = replay(true)
+	if err == nil || !strings.Contains(err.Error(), "1 stored resources are invalid") {
+		t.Errorf("Expected strict replay to fail, got %v", err)
+	}
+
+	recovered, err := replay(false)
+	Ensure(t, err)
+	if n := recovered.CountResources(T1, UserType); n != 1 {
+		t.Errorf("Expected only the valid user after replay, got %d", n)
+	}
+	report := recovered.LoadReport()
+	if users := report[T1][UserType]; users == nil || users.Valid != 1 || users.Invalid != 1 || users.Reasons["1"] == "" {
+		t.Errorf("Bad report after replay: %v", report)
+	}
+	if quarantine := recovered.GetQuarantine()[T1]; len(quarantine) != 1 || quarantine[0].ID != "1" {
+		t.Errorf("Expected the invalid user to be quarantined, got %v", quarantine)
+	}
+}
@@ -0,0 +1,130 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package scimserverlite
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Meta is the part of a resource's meta attribute (RFC 7643 section 3.1)
+// which is maintained by the backend. The server adds resourceType and
+// location when the resource is returned to a client.
+type Meta struct {
+	Created      string `json:"created,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	Version      string `json:"version,omitempty"`
+}
+
+// The format used for created and lastModified. The fixed number of
+// decimals means the timestamps can be compared as strings.
+const metaTimeFormat = "2006-01-02T15:04:05.000Z07:00"
+
+// MetaTime formats a timestamp for the created and lastModified attributes
+func MetaTime(t time.Time) string {
+	return t.UTC().Format(metaTimeFormat)
+}
+
+// ResourceVersion returns a weak entity tag to use as version for a
+// resource, based on the resource's JSON representation (without meta).
+func ResourceVersion(content []byte) string {
+	sum := sha256.Sum256(content)
+	return fmt.Sprintf("W/\"%x\"", sum[:8])
+}
+
+// Sets the meta attribute for a resource which has been created or
+// modified. previous is the resource before the modification, or empty
+// if the resource is created, any client supplied meta is replaced. The
+// id attribute is set to id (unless it's empty).
+func touchResource(resource, previous, id string, now time.Time) (string, error) {
+	decoded, err := decodeJSON([]byte(resource))
+	if err != nil {
+		return "", NewError(MalformedResourceError, "Failed to parse resource:\n"+err.Error())
+	}
+	m, ok := decoded.(map[string]interface{})
+	if !ok {
+		return "", NewError(MalformedResourceError, "Resource is not a JSON object")
+	}
+
+	delete(m, "meta")
+	if id != "" {
+		m["id"] = id
+	}
+	content, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+
+	meta := Meta{
+		Created:      MetaTime(now),
+		LastModified: MetaTime(now),
+		Version:      ResourceVersion(content),
+	}
+
+	if previous != "" {
+		var old struct {
+			Meta *Meta `json:"meta"`
+		}
+		// Resources stored before meta was maintained have no creation time
+		meta.Created = ""
+		if json.Unmarshal([]byte(previous), &old) == nil && old.Meta != nil {
+			meta.Created = old.Meta.Created
+		}
+	}
+
+	m["meta"] = meta
+	body, err := json.Marshal(m)
+	return string(body), err
+}
+
+// Returns the name of a resource type, as given in the ResourceType
+// resources if discovery is enabled, otherwise the name of the end point.
+func (s *Server) resourceTypeName(endpoint string) string {
+	for _, resourceType := range s.resourceTypes {
+		if resourceType.Endpoint == "/"+endpoint {
+			return resourceType.Name
+		}
+	}
+	return endpoint
+}
+
+// Adds the attributes in meta which depend on the request (resourceType
+// and location) to a resource from the backend. The location is only
+// added if the resource's id is known.
+func (s *Server) addMeta(resource map[string]interface{}, r *http.Request, endpoint, resourceID string) {
+	meta, ok := resource["meta"].(map[string]interface{})
+	if !ok {
+		meta = make(map[string]interface{})
+	}
+	meta["resourceType"] = s.resourceTypeName(endpoint)
+	if resourceID != "" {
+		meta["location"] = s.resourceLocation(r, endpoint, resourceID)
+	}
+	resource["meta"] = meta
+}
+
+// Returns the URL of a resource
+func (s *Server) resourceLocation(r *http.Request, endpoint, resourceID string) string {
+	return s.baseURL(r) + "/" + endpoint + "/" + url.PathEscape(resourceID)
+}
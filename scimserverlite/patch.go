@@ -0,0 +1,522 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package scimserverlite
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// PatchOpSchema is the schema URI for PATCH requests
+const PatchOpSchema = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+
+// PatchOperation is a single operation in a PATCH request
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// PatchRequest is a PATCH request as defined in RFC 7644 section 3.5.2
+type PatchRequest struct {
+	Schemas    []string         `json:"schemas"`
+	Operations []PatchOperation `json:"Operations"`
+}
+
+// The target of a PATCH operation, for instance
+// members[value eq "2819c223-7f76-453a-919d-413861904646"].display
+type patchPath struct {
+	attribute    AttributePath
+	filter       Filter // filter is nil unless the path has a value filter
+	subAttribute string // subAttribute after a value filter
+}
+
+func patchError(errorType SCIMErrorType, format string, args ...interface{}) error {
+	return NewError(errorType, fmt.Sprintf(format, args...))
+}
+
+// ParsePatchRequest parses and checks the body of a PATCH request
+func ParsePatchRequest(body string) (*PatchRequest, error) {
+	var request PatchRequest
+	err := json.Unmarshal([]byte(body), &request)
+
+	if err != nil {
+		return nil, patchError(InvalidSyntaxError, "Failed to parse PATCH request: %v", err)
+	}
+
+	if request.Schemas != nil {
+		found := false
+		for _, schema := range request.Schemas {
+			if schema == PatchOpSchema {
+				found = true
+			}
+		}
+		if !found {
+			return nil, patchError(InvalidSyntaxError, "PATCH request must use schema %s", PatchOpSchema)
+		}
+	}
+
+	if len(request.Operations) == 0 {
+		return nil, patchError(InvalidSyntaxError, "PATCH request has no operations")
+	}
+
+	for _, operation := range request.Operations {
+		switch strings.ToLower(operation.Op) {
+		case "add", "replace":
+			if len(operation.Value) == 0 {
+				return nil, patchError(InvalidSyntaxError, "PATCH operation %s requires a value", operation.Op)
+			}
+		case "remove":
+			if operation.Path == "" {
+				return nil, patchError(NoTargetError, "PATCH operation remove requires a path")
+			}
+		default:
+			return nil, patchError(InvalidSyntaxError, "Unknown PATCH operation: %s", operation.Op)
+		}
+
+		if operation.Path != "" {
+			if _, err := parsePatchPath(operation.Path); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &request, nil
+}
+
+func parsePatchPath(path string) (*patchPath, error) {
+	p, err := newFilterParser(path)
+	if err != nil {
+		return nil, patchError(InvalidPathError, "Invalid path %s: %v", path, err)
+	}
+
+	t, err := p.next()
+	if err != nil || t.kind != tokenWord {
+		return nil, patchError(InvalidPathError, "Invalid path: %s", path)
+	}
+
+	var result patchPath
+	result.attribute, err = ParseAttributePath(t.text)
+	if err != nil {
+		return nil, patchError(InvalidPathError, "Invalid path %s: %v", path, err)
+	}
+
+	if p.peek().kind == tokenOpenBracket {
+		if result.attribute.SubAttribute != "" {
+			return nil, patchError(InvalidPathError, "Invalid path: %s", path)
+		}
+		p.pos++
+		result.filter, err = p.parseOr()
+		if err != nil {
+			return nil, patchError(InvalidFilterError, "Invalid filter in path %s: %v", path, err)
+		}
+		if err = p.expect(tokenCloseBracket, "]"); err != nil {
+			return nil, patchError(InvalidPathError, "Invalid path %s: %v", path, err)
+		}
+		if !p.atEnd() {
+			t, _ = p.next()
+			if t.kind != tokenWord || !strings.HasPrefix(t.text, ".") || !validAttributeName(t.text[1:]) {
+				return nil, patchError(InvalidPathError, "Invalid path: %s", path)
+			}
+			result.subAttribute = t.text[1:]
+		}
+	}
+
+	if !p.atEnd() {
+		return nil, patchError(InvalidPathError, "Invalid path: %s", path)
+	}
+
+	if strings.EqualFold(result.attribute.Name, "id") && result.attribute.URI == "" {
+		return nil, patchError(MutabilityError, "The id attribute can't be modified")
+	}
+	return &result, nil
+}
+
+func decodeJSON(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var v interface{}
+	err := decoder.Decode(&v)
+	return v, err
+}
+
+// ApplyPatch applies the operations in a PATCH request to a resource
+// and returns the modified resource.
+//
+// The result isn't validated, so backends should parse it as any
+// other resource before storing it.
+func ApplyPatch(resource string, patch *PatchRequest) (string, error) {
+	decoded, err := decodeJSON([]byte(resource))
+	if err != nil {
+		return "", err
+	}
+	m, ok := decoded.(map[string]interface{})
+	if !ok {
+		return "", fmt.Errorf("resource is not a JSON object")
+	}
+
+	for _, operation := range patch.Operations {
+		var value interface{}
+		if len(operation.Value) > 0 {
+			value, err = decodeJSON(operation.Value)
+			if err != nil {
+				return "", patchError(InvalidSyntaxError, "Invalid value in PATCH operation: %v", err)
+			}
+		}
+
+		var path *patchPath
+		if operation.Path != "" {
+			path, err = parsePatchPath(operation.Path)
+			if err != nil {
+				return "", err
+			}
+		}
+
+		switch strings.ToLower(operation.Op) {
+		case "add":
+			err = patchAdd(m, path, value)
+		case "replace":
+			err = patchReplace(m, path, value)
+		case "remove":
+			err = patchRemove(m, path, value)
+		default:
+			err = patchError(InvalidSyntaxError, "Unknown PATCH operation: %s", operation.Op)
+		}
+
+		if err != nil {
+			return "", err
+		}
+	}
+
+	result, err := json.Marshal(m)
+	if err != nil {
+		return "", err
+	}
+	return string(result), nil
+}
+
+// Returns the JSON object for a path's schema, creating an
+// object for an extension schema if it doesn't already exist
+func patchContainer(resource map[string]interface{}, path AttributePath) map[string]interface{} {
+	if path.URI == "" {
+		return resource
+	}
+	if _, v, ok := lookupAttribute(resource, path.URI); ok {
+		if m, ok := v.(map[string]interface{}); ok {
+			return m
+		}
+	}
+	if strings.HasPrefix(strings.ToLower(path.URI), "urn:ietf:params:scim:schemas:core:") {
+		return resource
+	}
+	m := make(map[string]interface{})
+	resource[path.URI] = m
+	return m
+}
+
+// Returns the key to use for an attribute, which is the existing
+// key if the attribute is already set (possibly with different case)
+func attributeKey(m map[string]interface{}, name string) string {
+	if key, _, ok := lookupAttribute(m, name); ok {
+		return key
+	}
+	return name
+}
+
+// Adds a value to an attribute according to the rules for the "add" operation
+func addValue(m map[string]interface{}, name string, value interface{}) {
+	key, existing, ok := lookupAttribute(m, name)
+	if !ok || existing == nil {
+		m[attributeKey(m, name)] = value
+		return
+	}
+
+	switch e := existing.(type) {
+	case []interface{}:
+		newValues, isArray := value.([]interface{})
+		if !isArray {
+			newValues = []interface{}{value}
+		}
+		for _, v := range newValues {
+			duplicate := false
+			for _, old := range e {
+				if reflect.DeepEqual(old, v) {
+					duplicate = true
+				}
+			}
+			if !duplicate {
+				e = append(e, v)
+			}
+		}
+		m[key] = e
+	case map[string]interface{}:
+		complexValue, isMap := value.(map[string]interface{})
+		if !isMap {
+			m[key] = value
+			return
+		}
+		for subName, subValue := range complexValue {
+			addValue(e, subName, subValue)
+		}
+	default:
+		m[key] = value
+	}
+}
+
+// Replaces an attribute's value, complex values are replaced
+// per sub-attribute
+func replaceValue(m map[string]interface{}, name string, value interface{}) {
+	key, existing, ok := lookupAttribute(m, name)
+	if ok {
+		e, existingIsMap := existing.(map[string]interface{})
+		v, valueIsMap := value.(map[string]interface{})
+		if existingIsMap && valueIsMap {
+			for subName, subValue := range v {
+				replaceValue(e, subName, subValue)
+			}
+			return
+		}
+		m[key] = value
+		return
+	}
+	m[name] = value
+}
+
+// Returns the values of a multi-valued attribute that matches a value filter
+func matchingValues(container map[string]interface{}, path *patchPath) ([]map[string]interface{}, error) {
+	_, v, ok := lookupAttribute(container, path.attribute.Name)
+	if !ok {
+		return nil, nil
+	}
+	arr, ok := v.([]interface{})
+	if !ok {
+		return nil, patchError(InvalidPathError, "Value filter used on attribute %s which isn't multi-valued", path.attribute.Name)
+	}
+	result := []map[string]interface{}{}
+	for _, element := range arr {
+		if m, ok := element.(map[string]interface{}); ok && path.filter.Matches(m) {
+			result = append(result, m)
+		}
+	}
+	return result, nil
+}
+
+// Applies an operation (add or replace) to the values matching a value filter
+func patchFilteredValues(m map[string]interface{}, path *patchPath, value interface{}, apply func(map[string]interface{}, string, interface{})) error {
+	matches, err := matchingValues(patchContainer(m, path.attribute), path)
+	if err != nil {
+		return err
+	}
+	if len(matches) == 0 {
+		return patchError(NoTargetError, "No values matched path filter for %s", path.attribute.Name)
+	}
+	for _, match := range matches {
+		if path.subAttribute != "" {
+			apply(match, path.subAttribute, value)
+		} else {
+			complexValue, ok := value.(map[string]interface{})
+			if !ok {
+				return patchError(MalformedResourceError, "Value for %s must be a complex value", path.attribute.Name)
+			}
+			for subName, subValue := range complexValue {
+				apply(match, subName, subValue)
+			}
+		}
+	}
+	return nil
+}
+
+// Applies an operation (add or replace) to an attribute or sub-attribute
+func patchAttribute(m map[string]interface{}, path *patchPath, value interface{}, apply func(map[string]interface{}, string, interface{})) error {
+	container := patchContainer(m, path.attribute)
+	if path.attribute.SubAttribute == "" {
+		apply(container, path.attribute.Name, value)
+		return nil
+	}
+
+	key, parent, ok := lookupAttribute(container, path.attribute.Name)
+	if !ok || parent == nil {
+		container[attributeKey(container, path.attribute.Name)] = map[string]interface{}{
+			path.attribute.SubAttribute: value,
+		}
+		return nil
+	}
+
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		apply(p, path.attribute.SubAttribute, value)
+	case []interface{}:
+		for _, element := range p {
+			if elementMap, ok := element.(map[string]interface{}); ok {
+				apply(elementMap, path.attribute.SubAttribute, value)
+			}
+		}
+	default:
+		return patchError(InvalidPathError, "Attribute %s has no sub-attributes", key)
+	}
+	return nil
+}
+
+func patchAdd(m map[string]interface{}, path *patchPath, value interface{}) error {
+	if path == nil {
+		attributes, ok := value.(map[string]interface{})
+		if !ok {
+			return patchError(MalformedResourceError, "Value for add without path must be a JSON object")
+		}
+		for name, v := range attributes {
+			if strings.EqualFold(name, "id") {
+				return patchError(MutabilityError, "The id attribute can't be modified")
+			}
+			addValue(m, name, v)
+		}
+		return nil
+	}
+	if path.filter != nil {
+		return patchFilteredValues(m, path, value, addValue)
+	}
+	return patchAttribute(m, path, value, addValue)
+}
+
+func patchReplace(m map[string]interface{}, path *patchPath, value interface{}) error {
+	if path == nil {
+		attributes, ok := value.(map[string]interface{})
+		if !ok {
+			return patchError(MalformedResourceError, "Value for replace without path must be a JSON object")
+		}
+		for name, v := range attributes {
+			if strings.EqualFold(name, "id") {
+				return patchError(MutabilityError, "The id attribute can't be modified")
+			}
+			replaceValue(m, name, v)
+		}
+		return nil
+	}
+	if path.filter != nil {
+		return patchFilteredValues(m, path, value, func(m map[string]interface{}, name string, v interface{}) {
+			m[attributeKey(m, name)] = v
+		})
+	}
+	return patchAttribute(m, path, value, func(m map[string]interface{}, name string, v interface{}) {
+		m[attributeKey(m, name)] = v
+	})
+}
+
+// Checks if a value in a multi-valued attribute should be removed, given
+// the values in a remove operation. Complex values are compared
+// by their "value" sub-attribute.
+func shouldRemove(element interface{}, toRemove []interface{}) bool {
+	for _, r := range toRemove {
+		if reflect.DeepEqual(element, r) {
+			return true
+		}
+		em, ok1 := element.(map[string]interface{})
+		rm, ok2 := r.(map[string]interface{})
+		if ok1 && ok2 {
+			_, ev, ok1 := lookupAttribute(em, "value")
+			_, rv, ok2 := lookupAttribute(rm, "value")
+			if ok1 && ok2 && reflect.DeepEqual(ev, rv) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func patchRemove(m map[string]interface{}, path *patchPath, value interface{}) error {
+	if path == nil {
+		return patchError(NoTargetError, "Remove operation requires a path")
+	}
+	container := patchContainer(m, path.attribute)
+	key, existing, ok := lookupAttribute(container, path.attribute.Name)
+	if !ok {
+		return nil
+	}
+
+	if path.filter != nil {
+		arr, ok := existing.([]interface{})
+		if !ok {
+			return patchError(InvalidPathError, "Value filter used on attribute %s which isn't multi-valued", path.attribute.Name)
+		}
+		remaining := []interface{}{}
+		for _, element := range arr {
+			elementMap, isMap := element.(map[string]interface{})
+			if !isMap || !path.filter.Matches(elementMap) {
+				remaining = append(remaining, element)
+				continue
+			}
+			if path.subAttribute != "" {
+				if subKey, _, ok := lookupAttribute(elementMap, path.subAttribute); ok {
+					delete(elementMap, subKey)
+				}
+				remaining = append(remaining, element)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(container, key)
+		} else {
+			container[key] = remaining
+		}
+		return nil
+	}
+
+	if path.attribute.SubAttribute != "" {
+		switch p := existing.(type) {
+		case map[string]interface{}:
+			if subKey, _, ok := lookupAttribute(p, path.attribute.SubAttribute); ok {
+				delete(p, subKey)
+			}
+		case []interface{}:
+			for _, element := range p {
+				if elementMap, ok := element.(map[string]interface{}); ok {
+					if subKey, _, ok := lookupAttribute(elementMap, path.attribute.SubAttribute); ok {
+						delete(elementMap, subKey)
+					}
+				}
+			}
+		}
+		return nil
+	}
+
+	// Some clients specify which values to remove from a multi-valued
+	// attribute with a value rather than a filter in the path.
+	if arr, ok := existing.([]interface{}); ok && value != nil {
+		toRemove, isArray := value.([]interface{})
+		if !isArray {
+			toRemove = []interface{}{value}
+		}
+		remaining := []interface{}{}
+		for _, element := range arr {
+			if !shouldRemove(element, toRemove) {
+				remaining = append(remaining, element)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(container, key)
+		} else {
+			container[key] = remaining
+		}
+		return nil
+	}
+
+	delete(container, key)
+	return nil
+}
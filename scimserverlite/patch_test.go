@@ -0,0 +1,193 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package scimserverlite
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+)
+
+const patchGroup = `
+{
+	"externalId": "g1",
+	"displayName": "grupp1",
+	"studentMemberships": [
+		{"value": "u1"},
+		{"value": "u2"}
+	],
+	"urn:scim:schemas:extension:sis:school:1.0:Extra": {
+		"code": "A"
+	}
+}
+`
+
+func applyPatchOps(t *testing.T, resource, operations string) (map[string]interface{}, error) {
+	t.Helper()
+	patch, err := ParsePatchRequest(`{"schemas": ["` + PatchOpSchema + `"], "Operations": ` + operations + `}`)
+	if err != nil {
+		return nil, err
+	}
+	patched, err := ApplyPatch(resource, patch)
+	if err != nil {
+		return nil, err
+	}
+	var result map[string]interface{}
+	Ensure(t, json.Unmarshal([]byte(patched), &result))
+	return result, nil
+}
+
+func memberValues(group map[string]interface{}) []string {
+	result := []string{}
+	members, _ := group["studentMemberships"].([]interface{})
+	for _, m := range members {
+		result = append(result, m.(map[string]interface{})["value"].(string))
+	}
+	return result
+}
+
+func TestPatchMembers(t *testing.T) {
+	group, err := applyPatchOps(t, patchGroup, `[{"op": "add", "path": "studentMemberships", "value": [{"value": "u3"}, {"value": "u1"}]}]`)
+	Ensure(t, err)
+	if !reflect.DeepEqual(memberValues(group), []string{"u1", "u2", "u3"}) {
+		t.Errorf("Unexpected members after add: %v", memberValues(group))
+	}
+
+	group, err = applyPatchOps(t, patchGroup, `[{"op": "remove", "path": "studentMemberships[value eq \"u1\"]"}]`)
+	Ensure(t, err)
+	if !reflect.DeepEqual(memberValues(group), []string{"u2"}) {
+		t.Errorf("Unexpected members after remove with filter: %v", memberValues(group))
+	}
+
+	group, err = applyPatchOps(t, patchGroup, `[{"op": "Remove", "path": "studentMemberships", "value": [{"value": "u2"}]}]`)
+	Ensure(t, err)
+	if !reflect.DeepEqual(memberValues(group), []string{"u1"}) {
+		t.Errorf("Unexpected members after remove with value: %v", memberValues(group))
+	}
+
+	group, err = applyPatchOps(t, patchGroup, `[{"op": "remove", "path": "studentMemberships"}]`)
+	Ensure(t, err)
+	if _, ok := group["studentMemberships"]; ok {
+		t.Errorf("Expected all members to be removed: %v", group)
+	}
+}
+
+func TestPatchReplace(t *testing.T) {
+	group, err := applyPatchOps(t, patchGroup, `[{"op": "replace", "path": "displayName", "value": "grupp2"}]`)
+	Ensure(t, err)
+	if group["displayName"] != "grupp2" {
+		t.Errorf("Unexpected displayName after replace: %v", group["displayName"])
+	}
+
+	group, err = applyPatchOps(t, patchGroup, `[{"op": "replace", "value": {"DisplayName": "grupp3"}}]`)
+	Ensure(t, err)
+	if group["displayName"] != "grupp3" {
+		t.Errorf("Unexpected displayName after replace without path: %v", group["displayName"])
+	}
+
+	group, err = applyPatchOps(t, patchGroup, `[{"op": "replace", "path": "urn:scim:schemas:extension:sis:school:1.0:Extra:code", "value": "B"}]`)
+	Ensure(t, err)
+	extension := group["urn:scim:schemas:extension:sis:school:1.0:Extra"].(map[string]interface{})
+	if extension["code"] != "B" {
+		t.Errorf("Unexpected extension attribute after replace: %v", extension)
+	}
+
+	_, err = applyPatchOps(t, patchGroup, `[{"op": "replace", "path": "studentMemberships[value eq \"u9\"].value", "value": "u8"}]`)
+	MustFail(t, err)
+}
+
+func TestPatchInvalid(t *testing.T) {
+	invalid := []string{
+		`[]`,
+		`[{"op": "move", "path": "displayName"}]`,
+		`[{"op": "remove"}]`,
+		`[{"op": "add", "path": "displayName"}]`,
+		`[{"op": "replace", "path": "members[value eq", "value": "x"}]`,
+		`[{"op": "replace", "path": "id", "value": "x"}]`,
+	}
+	for _, ops := range invalid {
+		_, err := applyPatchOps(t, patchGroup, ops)
+		if err == nil {
+			t.Errorf("Expected failure for operations %s", ops)
+		}
+	}
+}
+
+func TestPatchHandler(t *testing.T) {
+	s, b := newTestServer()
+	_, err := b.Create(T1, UserType, UserA)
+	Ensure(t, err)
+
+	w := doRequest(s, "PATCH", "/Users/0", `{"schemas": ["`+PatchOpSchema+`"], "Operations": [{"op": "replace", "path": "age", "value": 50}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 from PATCH, got %d: %s", w.Code, w.Body.String())
+	}
+
+	obj, err := b.GetParsedResource(T1, UserType, "0")
+	Ensure(t, err)
+	if user := obj.(*testUser); user.Age != 50 {
+		t.Errorf("Parsed resource not updated by PATCH: %v", user)
+	}
+
+	w = doRequest(s, "PATCH", "/Users/0", `{"schemas": ["`+PatchOpSchema+`"], "Operations": [{"op": "replace", "path": "age", "value": "old"}]}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 from PATCH resulting in invalid resource, got %d", w.Code)
+	}
+
+	w = doRequest(s, "PATCH", "/Users/7", `{"schemas": ["`+PatchOpSchema+`"], "Operations": [{"op": "replace", "path": "age", "value": 50}]}`)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 from PATCH of missing resource, got %d", w.Code)
+	}
+}
+
+func TestPatchWithoutPatchBackend(t *testing.T) {
+	b := NewInMemoryBackend(newSerialIDGenerator(), objectParser)
+	// Only the methods in Backend, so the server can't use b.Patch
+	s := NewServer([]string{UserType, GroupType}, struct{ Backend }{b}, func(c context.Context) string { return T1 })
+	_, err := b.Create(T1, UserType, UserA)
+	Ensure(t, err)
+
+	w := doRequest(s, "PATCH", "/Users/0", `{"schemas": ["`+PatchOpSchema+`"], "Operations": [{"op": "replace", "path": "age", "value": 50}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 from PATCH, got %d: %s", w.Code, w.Body.String())
+	}
+
+	obj, err := b.GetParsedResource(T1, UserType, "0")
+	Ensure(t, err)
+	if user := obj.(*testUser); user.Age != 50 {
+		t.Errorf("Parsed resource not updated by PATCH: %v", user)
+	}
+
+	w = doRequest(s, "PATCH", "/Users/7", `{"schemas": ["`+PatchOpSchema+`"], "Operations": [{"op": "replace", "path": "age", "value": 50}]}`)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 from PATCH of missing resource, got %d", w.Code)
+	}
+}
+
+func TestPatchDummyBackend(t *testing.T) {
+	s := NewServer([]string{UserType}, NewDummyBackend(objectParser), func(c context.Context) string { return T1 })
+
+	w := doRequest(s, "PATCH", "/Users/abc", `{"schemas": ["`+PatchOpSchema+`"], "Operations": [{"op": "replace", "path": "age", "value": 50}]}`)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 from PATCH in dummy backend, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,102 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package scimserverlite
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// AttributePath refers to an attribute (and possibly a sub-attribute) in a
+// resource, for instance "name.familyName" or
+// "urn:scim:schemas:extension:sis:school:1.0:User:enrolments.value"
+type AttributePath struct {
+	URI          string // URI is the schema URI, or empty if none was given
+	Name         string
+	SubAttribute string // SubAttribute is empty if the path refers to the whole attribute
+}
+
+func (p AttributePath) String() string {
+	s := p.Name
+	if p.URI != "" {
+		s = p.URI + ":" + s
+	}
+	if p.SubAttribute != "" {
+		s = s + "." + p.SubAttribute
+	}
+	return s
+}
+
+// ParseAttributePath parses an attribute path such as "name.givenName"
+func ParseAttributePath(path string) (AttributePath, error) {
+	var result AttributePath
+	rest := path
+
+	if strings.HasPrefix(strings.ToLower(path), "urn:") {
+		i := strings.LastIndex(path, ":")
+		result.URI = path[:i]
+		rest = path[i+1:]
+	}
+
+	if i := strings.Index(rest, "."); i >= 0 {
+		result.Name = rest[:i]
+		result.SubAttribute = rest[i+1:]
+		if !validAttributeName(result.SubAttribute) {
+			return result, fmt.Errorf("invalid attribute path: %s", path)
+		}
+	} else {
+		result.Name = rest
+	}
+
+	if !validAttributeName(result.Name) {
+		return result, fmt.Errorf("invalid attribute path: %s", path)
+	}
+	return result, nil
+}
+
+func validAttributeName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c == '$' && i == 0:
+		case unicode.IsLetter(c):
+		case i > 0 && (unicode.IsDigit(c) || c == '-' || c == '_'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Finds an attribute in a JSON object, attribute names are case insensitive
+func lookupAttribute(m map[string]interface{}, name string) (string, interface{}, bool) {
+	if v, ok := m[name]; ok {
+		return name, v, true
+	}
+	for key, v := range m {
+		if strings.EqualFold(key, name) {
+			return key, v, true
+		}
+	}
+	return "", nil, false
+}
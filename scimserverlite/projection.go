@@ -0,0 +1,210 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package scimserverlite
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// A projection selects which attributes to return in a response,
+// as given by the attributes and excludedAttributes query parameters
+// (RFC 7644 section 3.9).
+type projection struct {
+	attributes []string
+	excluded   []string
+}
+
+// Attributes which are always returned
+var alwaysReturned = []string{"id", "schemas"}
+
+// Parses the attributes and excludedAttributes query parameters,
+// returns nil if neither is given.
+func parseProjection(values url.Values) (*projection, error) {
+	parseList := func(param string) ([]string, error) {
+		result := []string{}
+		for _, list := range values[param] {
+			for _, attribute := range strings.Split(list, ",") {
+				attribute = strings.TrimSpace(attribute)
+				if attribute == "" {
+					continue
+				}
+				if _, err := ParseAttributePath(attribute); err != nil {
+					return nil, fmt.Errorf("Invalid %s: %v", param, err)
+				}
+				result = append(result, attribute)
+			}
+		}
+		return result, nil
+	}
+
+	attributes, err := parseList("attributes")
+	if err != nil {
+		return nil, err
+	}
+	excluded, err := parseList("excludedAttributes")
+	if err != nil {
+		return nil, err
+	}
+	if len(attributes) == 0 && len(excluded) == 0 {
+		return nil, nil
+	}
+	return &projection{attributes: attributes, excluded: excluded}, nil
+}
+
+// Finds where an attribute is in a resource. If the attribute belongs to an
+// extension schema the key of the extension object is returned as well.
+// An attribute given by a full URI (such as an extension schema itself)
+// is returned as a top level attribute.
+func projectionTarget(resource map[string]interface{}, attribute string) (string, AttributePath) {
+	if key, _, ok := lookupAttribute(resource, attribute); ok {
+		return "", AttributePath{Name: key}
+	}
+	path, _ := ParseAttributePath(attribute)
+	extension := ""
+	if path.URI != "" {
+		if key, v, ok := lookupAttribute(resource, path.URI); ok {
+			if _, isMap := v.(map[string]interface{}); isMap {
+				extension = key
+			}
+		}
+	}
+	path.URI = ""
+	return extension, path
+}
+
+// Copies an attribute (or sub-attribute) from one object to another
+func copyAttribute(from, to map[string]interface{}, path AttributePath) {
+	key, value, ok := lookupAttribute(from, path.Name)
+	if !ok {
+		return
+	}
+	if path.SubAttribute == "" {
+		to[key] = value
+		return
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		target, ok := to[key].(map[string]interface{})
+		if !ok {
+			target = make(map[string]interface{})
+			to[key] = target
+		}
+		if subKey, sub, ok := lookupAttribute(v, path.SubAttribute); ok {
+			target[subKey] = sub
+		}
+	case []interface{}:
+		// Multi-valued complex attribute, sub-attributes are copied
+		// to the corresponding values in the target
+		target, ok := to[key].([]interface{})
+		if !ok || len(target) != len(v) {
+			target = make([]interface{}, len(v))
+			for i := range target {
+				target[i] = make(map[string]interface{})
+			}
+			to[key] = target
+		}
+		for i := range v {
+			m, ok := v[i].(map[string]interface{})
+			t, isMap := target[i].(map[string]interface{})
+			if !ok || !isMap {
+				continue
+			}
+			if subKey, sub, ok := lookupAttribute(m, path.SubAttribute); ok {
+				t[subKey] = sub
+			}
+		}
+	}
+}
+
+// Removes an attribute (or sub-attribute) from an object
+func removeAttribute(from map[string]interface{}, path AttributePath) {
+	key, value, ok := lookupAttribute(from, path.Name)
+	if !ok {
+		return
+	}
+	if path.SubAttribute == "" {
+		delete(from, key)
+		return
+	}
+
+	values := []interface{}{value}
+	if arr, ok := value.([]interface{}); ok {
+		values = arr
+	}
+	for _, v := range values {
+		if m, ok := v.(map[string]interface{}); ok {
+			if subKey, _, ok := lookupAttribute(m, path.SubAttribute); ok {
+				delete(m, subKey)
+			}
+		}
+	}
+}
+
+func isAlwaysReturned(attribute string) bool {
+	for _, a := range alwaysReturned {
+		if strings.EqualFold(a, attribute) {
+			return true
+		}
+	}
+	return false
+}
+
+// Applies the projection to a resource, the resource may be modified
+func (p *projection) apply(resource map[string]interface{}) map[string]interface{} {
+	if p == nil {
+		return resource
+	}
+
+	result := resource
+	if len(p.attributes) > 0 {
+		result = make(map[string]interface{})
+		for _, a := range alwaysReturned {
+			copyAttribute(resource, result, AttributePath{Name: a})
+		}
+		for _, attribute := range p.attributes {
+			extension, path := projectionTarget(resource, attribute)
+			from, to := resource, result
+			if extension != "" {
+				from = resource[extension].(map[string]interface{})
+				if to, _ = result[extension].(map[string]interface{}); to == nil {
+					to = make(map[string]interface{})
+					result[extension] = to
+				}
+			}
+			copyAttribute(from, to, path)
+		}
+	}
+
+	for _, attribute := range p.excluded {
+		if isAlwaysReturned(attribute) {
+			continue
+		}
+		extension, path := projectionTarget(result, attribute)
+		from := result
+		if extension != "" {
+			from = result[extension].(map[string]interface{})
+		}
+		removeAttribute(from, path)
+	}
+	return result
+}
@@ -0,0 +1,72 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package scimserverlite
+
+import (
+	"encoding/json"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestProjection(t *testing.T) {
+	tests := []struct {
+		attributes string
+		excluded   string
+		expected   string
+	}{
+		{"userName", "", `{"userName": "baje@skola.kommunen.se"}`},
+		{"name.givenName,emails.value", "", `{
+			"name": {"givenName": "Barbara"},
+			"emails": [{"value": "baje@skolan.kommunen.se"}, {"value": "babs@example.com"}]
+		}`},
+		{"urn:scim:schemas:extension:sis:school:1.0:User:enrolments.value", "", `{
+			"urn:scim:schemas:extension:sis:school:1.0:User": {"enrolments": [{"value": "s1"}]}
+		}`},
+		{"urn:scim:schemas:extension:sis:school:1.0:User", "", `{
+			"urn:scim:schemas:extension:sis:school:1.0:User": {"enrolments": [{"value": "s1", "schoolYear": 4}]}
+		}`},
+		{"", "emails,name.familyName,urn:scim:schemas:extension:sis:school:1.0:User,active,id", `{
+			"externalId": "u1",
+			"userName": "baje@skola.kommunen.se",
+			"name": {"givenName": "Barbara"}
+		}`},
+	}
+
+	for _, test := range tests {
+		var user map[string]interface{}
+		Ensure(t, json.Unmarshal([]byte(filterUser), &user))
+		user["id"] = "u1"
+
+		p, err := parseProjection(url.Values{"attributes": {test.attributes}, "excludedAttributes": {test.excluded}})
+		Ensure(t, err)
+
+		var expected map[string]interface{}
+		Ensure(t, json.Unmarshal([]byte(test.expected), &expected))
+		expected["id"] = "u1"
+
+		if result := p.apply(user); !reflect.DeepEqual(result, expected) {
+			t.Errorf("Unexpected projection for attributes=%s excludedAttributes=%s: %v", test.attributes, test.excluded, result)
+		}
+	}
+
+	_, err := parseProjection(url.Values{"attributes": {"name..givenName"}})
+	MustFail(t, err)
+}
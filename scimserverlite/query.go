@@ -0,0 +1,224 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package scimserverlite
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// Query describes which resources a client wants from a resource type
+type Query struct {
+	// Filter selects the resources to return, nil means all resources
+	Filter Filter
+	// StartIndex is the 1-based index of the first resource to return,
+	// values less than 1 are interpreted as 1
+	StartIndex int
+	// Count is the maximum number of resources to return, nil means no limit
+	Count *int
+	// SortBy is the attribute to order the resources by, nil means the
+	// resources are ordered by id. Resources without a value are placed last.
+	SortBy *AttributePath
+	// SortDescending reverses the order given by SortBy
+	SortDescending bool
+}
+
+// QueryResource is a resource returned from a query
+type QueryResource struct {
+	ID       string
+	Resource string
+}
+
+// QueryResult is the result of a query. Resources are ordered by the
+// query's sort attribute and then by id, so that paging through the
+// results gives a consistent result.
+type QueryResult struct {
+	// TotalResults is the number of resources matching the query's filter,
+	// regardless of paging
+	TotalResults int
+	// StartIndex is the 1-based index of the first resource in Resources
+	StartIndex int
+	Resources  []QueryResource
+}
+
+func (q *Query) startIndex() int {
+	if q == nil || q.StartIndex < 1 {
+		return 1
+	}
+	return q.StartIndex
+}
+
+// Offset returns the number of matching resources to skip
+func (q *Query) Offset() int {
+	return q.startIndex() - 1
+}
+
+// ApplyQuery filters, orders and pages a set of resources (indexed by id)
+// according to a query. Backends which can't do this more efficiently
+// can use ApplyQuery to implement QueryResources.
+func ApplyQuery(resources map[string]string, query *Query) (*QueryResult, error) {
+	type entry struct {
+		id  string
+		key interface{}
+	}
+
+	var filter Filter
+	var sortBy *AttributePath
+	if query != nil {
+		filter = query.Filter
+		sortBy = query.SortBy
+	}
+
+	entries := make([]entry, 0, len(resources))
+	for id, resource := range resources {
+		e := entry{id: id}
+		if filter != nil || sortBy != nil {
+			m, err := decodeResource(id, resource)
+			if err != nil {
+				return nil, err
+			}
+			if filter != nil && !filter.Matches(m) {
+				continue
+			}
+			if sortBy != nil {
+				e.key = sortKey(m, *sortBy)
+			}
+		}
+		entries = append(entries, e)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.key == nil && b.key != nil {
+			return false
+		} else if a.key != nil && b.key == nil {
+			return true
+		} else if a.key != nil && b.key != nil {
+			if c := compareSortKeys(a.key, b.key); c != 0 {
+				if query.SortDescending {
+					return c > 0
+				}
+				return c < 0
+			}
+		}
+		return a.id < b.id
+	})
+
+	result := &QueryResult{
+		TotalResults: len(entries),
+		StartIndex:   query.startIndex(),
+		Resources:    []QueryResource{},
+	}
+
+	offset := query.Offset()
+	if offset > len(entries) {
+		offset = len(entries)
+	}
+	entries = entries[offset:]
+	if query != nil && query.Count != nil && *query.Count < len(entries) {
+		if *query.Count < 0 {
+			entries = entries[:0]
+		} else {
+			entries = entries[:*query.Count]
+		}
+	}
+
+	for _, e := range entries {
+		result.Resources = append(result.Resources, QueryResource{ID: e.id, Resource: resources[e.id]})
+	}
+	return result, nil
+}
+
+// Returns the value to sort a resource by, or nil if the resource
+// has no value for the attribute. For multi-valued attributes the
+// primary value is used if there is one, otherwise the first value.
+func sortKey(resource map[string]interface{}, path AttributePath) interface{} {
+	values := attributeValues(resource, path)
+	if len(values) == 0 {
+		return nil
+	}
+	value := values[0]
+	for _, v := range values {
+		if m, ok := v.(map[string]interface{}); ok {
+			if _, primary, ok := lookupAttribute(m, "primary"); ok && primary == true {
+				value = v
+				break
+			}
+		}
+	}
+	if m, ok := value.(map[string]interface{}); ok {
+		_, sub, _ := lookupAttribute(m, "value")
+		return sub
+	}
+	return value
+}
+
+// Compares two sort keys, strings are compared case insensitively.
+// Keys of different types are ordered by type.
+func compareSortKeys(a, b interface{}) int {
+	rank := func(v interface{}) int {
+		switch v.(type) {
+		case bool:
+			return 0
+		case json.Number, float64:
+			return 1
+		case string:
+			return 2
+		default:
+			return 3
+		}
+	}
+	if ra, rb := rank(a), rank(b); ra != rb {
+		return ra - rb
+	}
+
+	switch va := a.(type) {
+	case bool:
+		vb := b.(bool)
+		if va == vb {
+			return 0
+		} else if !va {
+			return -1
+		}
+		return 1
+	case string:
+		return strings.Compare(strings.ToLower(va), strings.ToLower(b.(string)))
+	case json.Number, float64:
+		fa, fb := sortNumber(a), sortNumber(b)
+		if fa < fb {
+			return -1
+		} else if fa > fb {
+			return 1
+		}
+	}
+	return 0
+}
+
+func sortNumber(v interface{}) float64 {
+	switch n := v.(type) {
+	case json.Number:
+		f, _ := n.Float64()
+		return f
+	case float64:
+		return n
+	}
+	return 0
+}
@@ -27,6 +27,7 @@ import (
 	"mime"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 )
 
@@ -41,8 +42,16 @@ type TenantGetter func(c context.Context) string
 // Server is a light weight SCIM server
 type Server struct {
 	mux       *http.ServeMux
-	backend   Backend
+	backend   ContextBackend
 	getTenant TenantGetter
+	endpoints map[string]bool
+
+	// For the discovery endpoints, see EnableDiscovery
+	resourceTypes []ResourceType
+	schemas       []Schema
+
+	// The URL the server is reached at, see SetBaseURL
+	base string
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -53,17 +62,40 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func NewServer(endpoints []string, backend Backend, tenantGetter TenantGetter) *Server {
 	var server Server
 	server.mux = http.NewServeMux()
-	server.backend = backend
+	server.backend = WithContext(backend)
 	server.getTenant = tenantGetter
+	server.endpoints = make(map[string]bool)
 
 	for _, endpoint := range endpoints {
+		server.endpoints[endpoint] = true
 		server.mux.HandleFunc("/"+endpoint, func(w http.ResponseWriter, r *http.Request) { genericSCIMHandler(w, r, &server) })
 		server.mux.HandleFunc("/"+endpoint+"/", func(w http.ResponseWriter, r *http.Request) { genericSCIMHandler(w, r, &server) })
 	}
+	server.mux.HandleFunc("/Bulk", server.bulkHandler)
+	server.mux.HandleFunc("/"+searchEndpoint, server.rootSearchHandler)
 
 	return &server
 }
 
+// SetBaseURL sets the URL clients use to reach the server (for instance
+// "https://scim.example.com"), which is used for the resources' locations.
+// If no base URL is set it's derived from each request.
+func (s *Server) SetBaseURL(base string) {
+	s.base = strings.TrimSuffix(base, "/")
+}
+
+// Returns the URL the server is reached at
+func (s *Server) baseURL(r *http.Request) string {
+	if s.base != "" {
+		return s.base
+	}
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host
+}
+
 func getResourceType(url *url.URL) (string, error) {
 	path := strings.Split(url.Path, "/")
 	if len(path) < 2 {
@@ -80,34 +112,63 @@ func getResourceTypeAndID(url *url.URL) (string, string, error) {
 	return path[len(path)-2], path[len(path)-1], nil
 }
 
-// Writes the response to a query.
-// This is a bit of a hack to get the rebuild-cache functionality to work
-// in the Egil SCIM client. Only GET of all resources for a type is
-// implemented, no paging, no filtering or sorting.
-func writeQueryResponse(w io.Writer, resources map[string]string) error {
+// Gets the resource type and, if the URL refers to a specific resource,
+// the resource ID. For URLs referring to a resource type end point
+// (such as "/Users" or "/Users/") the returned ID is empty.
+func (s *Server) getResourceTypeAndOptionalID(url *url.URL) (string, string, error) {
+	path := strings.Split(url.Path, "/")
+	if len(path) < 2 {
+		return "", "", fmt.Errorf("Too few components in path")
+	}
+	last := path[len(path)-1]
+	if s.endpoints[last] {
+		return last, "", nil
+	}
+	if len(path) < 3 {
+		return "", "", fmt.Errorf("Too few components in path")
+	}
+	resourceType := path[len(path)-2]
+	if !s.endpoints[resourceType] {
+		return "", "", fmt.Errorf("Unknown resource type: %s", resourceType)
+	}
+	return resourceType, last, nil
+}
+
+// Writes the response to a query as a ListResponse (RFC 7644 section 3.4.2).
+// resourceType is empty for queries over all resource types (see queryAll).
+func (s *Server) writeQueryResponse(w io.Writer, r *http.Request, resourceType string, result *QueryResult, p *projection) error {
 
 	type queryResponse struct {
 		Schemas      []string                 `json:"schemas"`
 		TotalResults int                      `json:"totalResults"`
+		ItemsPerPage int                      `json:"itemsPerPage"`
+		StartIndex   int                      `json:"startIndex"`
 		Resources    []map[string]interface{} `json:"Resources"`
 	}
 
 	var response queryResponse
 
 	response.Schemas = []string{"urn:ietf:params:scim:api:messages:2.0:ListResponse"}
-	response.TotalResults = len(resources)
-	response.Resources = make([]map[string]interface{}, 0, len(resources))
+	response.TotalResults = result.TotalResults
+	response.ItemsPerPage = len(result.Resources)
+	response.StartIndex = result.StartIndex
+	response.Resources = make([]map[string]interface{}, 0, len(result.Resources))
 
-	for id, resource := range resources {
+	for _, resource := range result.Resources {
 		parsed := make(map[string]interface{})
-		err := json.Unmarshal([]byte(resource), &parsed)
+		err := json.Unmarshal([]byte(resource.Resource), &parsed)
 
 		if err != nil {
 			return err
 		}
 
+		endpoint, id := resourceType, resource.ID
+		if endpoint == "" {
+			endpoint, id = splitQueryAllID(resource.ID)
+		}
 		parsed["id"] = id
-		response.Resources = append(response.Resources, parsed)
+		s.addMeta(parsed, r, endpoint, id)
+		response.Resources = append(response.Resources, p.apply(parsed))
 	}
 
 	body, err := json.Marshal(&response)
@@ -120,31 +181,115 @@ func writeQueryResponse(w io.Writer, resources map[string]string) error {
 	return err
 }
 
-func handleBackendError(w http.ResponseWriter, e error) {
-	typedError, ok := e.(SCIMTypedError)
-	status := http.StatusInternalServerError
-	if ok {
-		errorType := typedError.Type()
-
-		switch errorType {
-		case ConflictError:
-			status = http.StatusConflict
-		case MissingResourceError:
-			status = http.StatusNotFound
-		case MalformedResourceError:
-			status = http.StatusBadRequest
+// Parses the query parameters for filtering, sorting and paging
+func parseQuery(values url.Values) (*Query, error) {
+	var query Query
+	var err error
+
+	if filter := values.Get("filter"); filter != "" {
+		query.Filter, err = ParseFilter(filter)
+		if err != nil {
+			return nil, NewError(InvalidFilterError, fmt.Sprintf("Invalid filter: %v", err))
+		}
+	}
+
+	if sortBy := values.Get("sortBy"); sortBy != "" {
+		path, err := ParseAttributePath(sortBy)
+		if err != nil {
+			return nil, NewError(InvalidPathError, fmt.Sprintf("Invalid sortBy: %v", err))
 		}
+		query.SortBy = &path
+	}
+
+	switch sortOrder := values.Get("sortOrder"); strings.ToLower(sortOrder) {
+	case "", "ascending":
+	case "descending":
+		query.SortDescending = true
+	default:
+		return nil, NewError(InvalidValueError, fmt.Sprintf("Invalid sortOrder: %s", sortOrder))
 	}
-	http.Error(w, e.Error(), status)
+
+	if startIndex := values.Get("startIndex"); startIndex != "" {
+		query.StartIndex, err = strconv.Atoi(startIndex)
+		if err != nil {
+			return nil, NewError(InvalidValueError, fmt.Sprintf("Invalid startIndex: %s", startIndex))
+		}
+		// Values less than 1 are interpreted as 1 (RFC 7644 section 3.4.2.4)
+		if query.StartIndex < 1 {
+			query.StartIndex = 1
+		}
+	} else {
+		query.StartIndex = 1
+	}
+
+	if count := values.Get("count"); count != "" {
+		c, err := strconv.Atoi(count)
+		if err != nil {
+			return nil, NewError(InvalidValueError, fmt.Sprintf("Invalid count: %s", count))
+		}
+		// Negative values are interpreted as 0 (RFC 7644 section 3.4.2.4)
+		if c < 0 {
+			c = 0
+		}
+		query.Count = &c
+	}
+	return &query, nil
 }
 
 const SCIMMediaType = "application/scim+json"
 const SCIMDeprecatedMediaType = "application/json"
 
-func resourceResponse(w http.ResponseWriter, backendResource string, status int) {
-	w.WriteHeader(status)
+// Writes a single resource from the backend, with the id and meta attributes
+// set and the projection (if any) applied. resourceID may be empty if it
+// isn't known, the resource is then written without id and location.
+// Created and replaced resources also get a Location header.
+func (s *Server) writeResource(w http.ResponseWriter, r *http.Request, resourceType, resourceID, backendResource string, status int, p *projection) {
+	parsed := make(map[string]interface{})
+	err := json.Unmarshal([]byte(backendResource), &parsed)
+
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, "", "Failed to parse resource from backend")
+		return
+	}
+
+	if resourceID != "" {
+		parsed["id"] = resourceID
+	}
+	s.addMeta(parsed, r, resourceType, resourceID)
+	setETag(w, ResourceVersionOf(backendResource))
+	if resourceID != "" && (status == http.StatusCreated || r.Method == "PUT") {
+		w.Header().Set("Location", s.resourceLocation(r, resourceType, resourceID))
+	}
+
+	body, err := json.Marshal(p.apply(parsed))
+
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, "", "Failed to encode resource")
+		return
+	}
+
 	w.Header().Set("Content-Type", SCIMMediaType)
-	w.Write([]byte(backendResource))
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// Checks that the request body is SCIM (or plain JSON), if not an error
+// is written and false is returned.
+func checkMediaType(w http.ResponseWriter, r *http.Request) bool {
+	contentType := r.Header.Get("Content-Type")
+	mediaType, _, err := mime.ParseMediaType(contentType)
+
+	if err != nil {
+		WriteError(w, http.StatusUnsupportedMediaType, "", fmt.Sprintf("Failed to parse Content-Type (%s): %v", contentType, err))
+		return false
+	}
+	if mediaType != SCIMMediaType &&
+		mediaType != SCIMDeprecatedMediaType {
+		WriteError(w, http.StatusUnsupportedMediaType, "",
+			fmt.Sprintf("Bad media type: got \"%s\" (SCIM uses %s)", mediaType, SCIMMediaType))
+		return false
+	}
+	return true
 }
 
 func genericSCIMHandler(w http.ResponseWriter, r *http.Request, server *Server) {
@@ -152,80 +297,157 @@ func genericSCIMHandler(w http.ResponseWriter, r *http.Request, server *Server)
 	body := ""
 	tenant := server.getTenant(r.Context())
 
-	if r.Method == "POST" || r.Method == "PUT" {
-		contentType := r.Header.Get("Content-Type")
-		mediaType, _, err := mime.ParseMediaType(contentType)
-
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to parse Content-Type (%s): %v", contentType, err), http.StatusUnsupportedMediaType)
-			return
-		}
-		if mediaType != SCIMMediaType &&
-			mediaType != SCIMDeprecatedMediaType {
-			http.Error(w, fmt.Sprintf("Bad media type: got \"%s\" (SCIM uses %s)", mediaType, SCIMMediaType),
-				http.StatusUnsupportedMediaType)
+	if r.Method == "POST" || r.Method == "PUT" || r.Method == "PATCH" {
+		if !checkMediaType(w, r) {
 			return
 		}
 
 		if b, err := io.ReadAll(r.Body); err == nil {
 			body = string(b)
 		} else {
-			http.Error(w, "Failed to read HTTP body", http.StatusInternalServerError)
+			WriteError(w, http.StatusInternalServerError, "", "Failed to read HTTP body")
 			return
 		}
 	}
 
 	if r.Method == "POST" {
+		if resourceType, resourceID, err := getResourceTypeAndID(r.URL); err == nil && resourceID == searchEndpoint && server.endpoints[resourceType] {
+			server.search(w, r, tenant, resourceType, body)
+			return
+		}
 		resourceType, err := getResourceType(r.URL)
 		if err != nil {
-			http.Error(w, "Failed to get resource type from URL", http.StatusBadRequest)
+			WriteError(w, http.StatusBadRequest, "", "Failed to get resource type from URL")
 			return
 		}
-		backendResource, err := server.backend.Create(tenant, resourceType, body)
+		backendResource, err := server.backend.CreateContext(r.Context(), tenant, resourceType, body)
 		if err != nil {
 			handleBackendError(w, err)
 			return
 		}
-		resourceResponse(w, backendResource, http.StatusCreated)
+		setDiscardedWarning(w, body, backendResource)
+		server.writeResource(w, r, resourceType, resourceIDOf(backendResource), backendResource, http.StatusCreated, nil)
 	} else if r.Method == "PUT" {
 		resourceType, resourceID, err := getResourceTypeAndID(r.URL)
 		if err != nil {
-			http.Error(w, "Failed to get resource type and ID from URL", http.StatusBadRequest)
+			WriteError(w, http.StatusBadRequest, "", "Failed to get resource type and ID from URL")
+			return
+		}
+		ifMatch := ParsePrecondition(r.Header.Get("If-Match"))
+		backendResource, err := server.updateIfMatch(r.Context(), tenant, resourceType, resourceID, body, ifMatch)
+		if err != nil {
+			handleBackendError(w, err)
+			return
+		}
+		setDiscardedWarning(w, body, backendResource)
+		server.writeResource(w, r, resourceType, resourceID, backendResource, http.StatusOK, nil)
+	} else if r.Method == "PATCH" {
+		resourceType, resourceID, err := server.getResourceTypeAndOptionalID(r.URL)
+		if err != nil || resourceID == "" {
+			WriteError(w, http.StatusBadRequest, "", "Failed to get resource type and ID from URL")
+			return
+		}
+		patch, err := ParsePatchRequest(body)
+		if err != nil {
+			handleBackendError(w, err)
 			return
 		}
-		backendResource, err := server.backend.Update(tenant, resourceType, resourceID, body)
+		ifMatch := ParsePrecondition(r.Header.Get("If-Match"))
+		backendResource, err := server.patchIfMatch(r.Context(), tenant, resourceType, resourceID, patch, ifMatch)
 		if err != nil {
 			handleBackendError(w, err)
 			return
 		}
-		resourceResponse(w, backendResource, http.StatusOK)
+		server.writeResource(w, r, resourceType, resourceID, backendResource, http.StatusOK, nil)
 	} else if r.Method == "DELETE" {
 		resourceType, resourceID, err := getResourceTypeAndID(r.URL)
 		if err != nil {
-			http.Error(w, "Failed to get resource type and ID from URL", http.StatusBadRequest)
+			WriteError(w, http.StatusBadRequest, "", "Failed to get resource type and ID from URL")
 			return
 		}
-		err = server.backend.Delete(tenant, resourceType, resourceID)
+		ifMatch := ParsePrecondition(r.Header.Get("If-Match"))
+		err = server.deleteIfMatch(r.Context(), tenant, resourceType, resourceID, ifMatch)
 		if err != nil {
 			handleBackendError(w, err)
 			return
 		}
 		w.WriteHeader(204)
 	} else if r.Method == "GET" {
-		resourceType, err := getResourceType(r.URL)
+		resourceType, resourceID, err := server.getResourceTypeAndOptionalID(r.URL)
 		if err != nil {
-			http.Error(w, "Failed to get resource type from URL", http.StatusBadRequest)
+			WriteError(w, http.StatusBadRequest, "", "Failed to get resource type from URL")
 			return
 		}
-		resources, err := server.backend.GetResources(tenant, resourceType)
+		p, err := parseProjection(r.URL.Query())
+		if err != nil {
+			WriteError(w, http.StatusBadRequest, "invalidValue", err.Error())
+			return
+		}
+		if resourceID != "" {
+			backendResource, err := server.backend.GetResourceContext(r.Context(), tenant, resourceType, resourceID)
+			if err != nil {
+				typedError, ok := err.(SCIMTypedError)
+				if ok && typedError.Type() == MissingResourceError {
+					WriteError(w, http.StatusNotFound, "", fmt.Sprintf("Resource %s not found", resourceID))
+				} else {
+					handleBackendError(w, err)
+				}
+				return
+			}
+			version := ResourceVersionOf(backendResource)
+			ifNoneMatch := ParsePrecondition(r.Header.Get("If-None-Match"))
+			if ifNoneMatch != nil && ifNoneMatch.Matches(version) {
+				setETag(w, version)
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			server.writeResource(w, r, resourceType, resourceID, backendResource, http.StatusOK, p)
+			return
+		}
+		query, err := parseQuery(r.URL.Query())
+		if err != nil {
+			handleBackendError(w, err)
+			return
+		}
+		result, err := server.backend.QueryResourcesContext(r.Context(), tenant, resourceType, query)
 		if err != nil {
 			handleBackendError(w, err)
 			return
 		}
-		writeQueryResponse(w, resources)
+		w.Header().Set("Content-Type", SCIMMediaType)
+		server.writeQueryResponse(w, r, resourceType, result, p)
 	} else {
-		http.Error(w, "Not implemented", http.StatusNotImplemented)
+		WriteError(w, http.StatusNotImplemented, "", "Not implemented")
+	}
+}
+
+// Returns the id attribute of a resource from the backend, or an empty
+// string if the resource has no id
+func resourceIDOf(resource string) string {
+	var r struct {
+		ID string `json:"id"`
 	}
+	if json.Unmarshal([]byte(resource), &r) != nil {
+		return ""
+	}
+	return r.ID
+}
+
+// SetResourceID sets the id attribute of a resource. Backends which don't
+// store the id in the resources use it so that the resources they return
+// from Create and Update have the id the server assigned.
+func SetResourceID(resource, id string) (string, error) {
+	decoded, err := decodeJSON([]byte(resource))
+	if err != nil {
+		return "", err
+	}
+	m, ok := decoded.(map[string]interface{})
+	if !ok {
+		return "", fmt.Errorf("resource is not a JSON object")
+	}
+	m["id"] = id
+	body, err := json.Marshal(m)
+	return string(body), err
 }
 
 // IDGenerator is a function which takes a resource and generates an ID for the resource
@@ -237,21 +459,25 @@ func CreateIDFromExternalID(resource string) (string, error) {
 	err := json.Unmarshal([]byte(resource), &f)
 
 	if err != nil {
-		return "", err
+		return "", NewError(MalformedResourceError, "Failed to parse resource:\n"+err.Error())
 	}
 
-	m := f.(map[string]interface{})
+	m, ok := f.(map[string]interface{})
+
+	if !ok {
+		return "", NewError(MalformedResourceError, "Resource is not a JSON object")
+	}
 
 	externalID, ok := m["externalId"]
 
 	if !ok {
-		return "", fmt.Errorf("Missing externalId in resource")
+		return "", NewError(MalformedResourceError, "Missing externalId in resource")
 	}
 
 	externalIDString, ok := externalID.(string)
 
 	if !ok {
-		return "", fmt.Errorf("externalId has invalid type")
+		return "", NewError(MalformedResourceError, "externalId has invalid type")
 	}
 
 	return externalIDString, nil
@@ -0,0 +1,746 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package scimserverlite
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestServer() (*Server, *InMemoryBackend) {
+	b := NewInMemoryBackend(newSerialIDGenerator(), objectParser)
+	s := NewServer([]string{UserType, GroupType}, b, func(c context.Context) string { return T1 })
+	return s, b
+}
+
+func doRequest(s *Server, method, target, body string) *httptest.ResponseRecorder {
+	var reader io.Reader
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	r := httptest.NewRequest(method, target, reader)
+	if body != "" {
+		r.Header.Set("Content-Type", SCIMMediaType)
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func decodeBody(t *testing.T, w *httptest.ResponseRecorder) map[string]interface{} {
+	t.Helper()
+	result := make(map[string]interface{})
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Fatalf("Failed to decode response body (%v): %s", err, w.Body.String())
+	}
+	return result
+}
+
+func TestGetSingleResource(t *testing.T) {
+	s, b := newTestServer()
+	_, err := b.Create(T1, UserType, UserA)
+	Ensure(t, err)
+	_, err = b.Create(T1, UserType, UserB)
+	Ensure(t, err)
+
+	w := doRequest(s, "GET", "/Users/1", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for existing resource, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != SCIMMediaType {
+		t.Errorf("Expected Content-Type %s, got %s", SCIMMediaType, ct)
+	}
+	user := decodeBody(t, w)
+	if user["id"] != "1" || user["age"] != float64(48) {
+		t.Errorf("Unexpected resource returned: %v", user)
+	}
+
+	w = doRequest(s, "GET", "/Users/2", "")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected 404 for missing resource, got %d", w.Code)
+	}
+	scimErr := decodeBody(t, w)
+	if scimErr["status"] != "404" {
+		t.Errorf("Expected SCIM error with status 404, got %v", scimErr)
+	}
+
+	// A user shouldn't be found through another resource type
+	w = doRequest(s, "GET", "/Groups/1", "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for resource of other type, got %d", w.Code)
+	}
+}
+
+func TestGetResourceType(t *testing.T) {
+	s, b := newTestServer()
+	_, err := b.Create(T1, UserType, UserA)
+	Ensure(t, err)
+
+	for _, target := range []string{"/Users", "/Users/"} {
+		w := doRequest(s, "GET", target, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("Expected 200 for GET %s, got %d", target, w.Code)
+		}
+		list := decodeBody(t, w)
+		if list["totalResults"] != float64(1) {
+			t.Errorf("Expected one resource from GET %s, got %v", target, list["totalResults"])
+		}
+	}
+}
+
+func TestPaging(t *testing.T) {
+	s, b := newTestServer()
+	for i := 0; i < 5; i++ {
+		_, err := b.Create(T1, UserType, UserA)
+		Ensure(t, err)
+	}
+
+	w := doRequest(s, "GET", "/Users?startIndex=2&count=2", "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for paged GET, got %d", w.Code)
+	}
+	list := decodeBody(t, w)
+	if list["totalResults"] != 5.0 || list["itemsPerPage"] != 2.0 || list["startIndex"] != 2.0 {
+		t.Errorf("Unexpected paging information: %v", list)
+	}
+	ids := []interface{}{}
+	for _, r := range list["Resources"].([]interface{}) {
+		ids = append(ids, r.(map[string]interface{})["id"])
+	}
+	if !reflect.DeepEqual(ids, []interface{}{"1", "2"}) {
+		t.Errorf("Unexpected resources in page: %v", ids)
+	}
+
+	list = decodeBody(t, doRequest(s, "GET", "/Users?startIndex=0&count=-1", ""))
+	if list["totalResults"] != 5.0 || list["itemsPerPage"] != 0.0 || list["startIndex"] != 1.0 {
+		t.Errorf("Unexpected paging information for out of range values: %v", list)
+	}
+
+	w = doRequest(s, "GET", "/Users?count=many", "")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid count, got %d", w.Code)
+	}
+}
+
+func TestSortAndProjection(t *testing.T) {
+	s, b := newTestServer()
+	for _, user := range []string{`{"name": "Carl", "age": 30}`, `{"name": "anna", "age": 50}`, `{"name": "Bea"}`} {
+		_, err := b.Create(T1, UserType, user)
+		Ensure(t, err)
+	}
+
+	names := func(list map[string]interface{}) []interface{} {
+		result := []interface{}{}
+		for _, r := range list["Resources"].([]interface{}) {
+			result = append(result, r.(map[string]interface{})["name"])
+		}
+		return result
+	}
+
+	list := decodeBody(t, doRequest(s, "GET", "/Users?sortBy=name", ""))
+	if !reflect.DeepEqual(names(list), []interface{}{"anna", "Bea", "Carl"}) {
+		t.Errorf("Unexpected order when sorting by name: %v", names(list))
+	}
+
+	list = decodeBody(t, doRequest(s, "GET", "/Users?sortBy=age&sortOrder=descending&count=2", ""))
+	if !reflect.DeepEqual(names(list), []interface{}{"anna", "Carl"}) {
+		t.Errorf("Unexpected order when sorting by age: %v", names(list))
+	}
+
+	list = decodeBody(t, doRequest(s, "GET", "/Users?sortBy=age&attributes=name", ""))
+	if !reflect.DeepEqual(names(list), []interface{}{"Carl", "anna", "Bea"}) {
+		t.Errorf("Resources without value should be last: %v", names(list))
+	}
+	for _, r := range list["Resources"].([]interface{}) {
+		if _, ok := r.(map[string]interface{})["age"]; ok {
+			t.Errorf("Expected only name and id to be returned: %v", r)
+		}
+	}
+
+	user := decodeBody(t, doRequest(s, "GET", "/Users/0?excludedAttributes=name", ""))
+	if _, ok := user["name"]; ok || user["id"] != "0" || user["age"] != 30.0 {
+		t.Errorf("Unexpected resource with excluded attribute: %v", user)
+	}
+
+	w := doRequest(s, "GET", "/Users?sortOrder=sideways", "")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for invalid sortOrder, got %d", w.Code)
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	s, _ := newTestServer()
+	s.EnableDiscovery([]ResourceType{
+		{Name: "User", Endpoint: "/Users", Schema: "urn:test:User"},
+	}, []Schema{
+		{ID: "urn:test:User", Name: "User", Attributes: []SchemaAttribute{{Name: "name", Type: "string"}}},
+	})
+
+	config := decodeBody(t, doRequest(s, "GET", "/ServiceProviderConfig", ""))
+	for feature, supported := range map[string]bool{"patch": true, "filter": true, "sort": true, "etag": true, "bulk": true} {
+		if config[feature].(map[string]interface{})["supported"] != supported {
+			t.Errorf("Expected %s supported to be %v: %v", feature, supported, config[feature])
+		}
+	}
+
+	list := decodeBody(t, doRequest(s, "GET", "/ResourceTypes", ""))
+	if list["totalResults"] != 1.0 {
+		t.Errorf("Unexpected resource types: %v", list)
+	}
+
+	schema := decodeBody(t, doRequest(s, "GET", "/Schemas/urn:test:User", ""))
+	if schema["id"] != "urn:test:User" || schema["meta"].(map[string]interface{})["resourceType"] != "Schema" {
+		t.Errorf("Unexpected schema: %v", schema)
+	}
+
+	if w := doRequest(s, "GET", "/Schemas/urn:test:Group", ""); w.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for missing schema, got %d", w.Code)
+	}
+	if w := doRequest(s, "DELETE", "/ResourceTypes/User", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for DELETE of resource type, got %d", w.Code)
+	}
+}
+
+func TestErrorResponses(t *testing.T) {
+	s, b := newTestServer()
+	_, err := b.Create(T1, UserType, UserA)
+	Ensure(t, err)
+
+	cases := []struct {
+		method, target, body string
+		status               int
+		scimType             string
+	}{
+		{"POST", "/Users", `{"externalId": "x", "age": "old"}`, http.StatusBadRequest, "invalidValue"},
+		{"DELETE", "/Users/7", "", http.StatusNotFound, ""},
+		{"GET", "/Users?filter=userName+eq", "", http.StatusBadRequest, "invalidFilter"},
+		{"GET", "/Users?count=many", "", http.StatusBadRequest, "invalidValue"},
+		{"GET", "/Users?startIndex=first", "", http.StatusBadRequest, "invalidValue"},
+		{"GET", "/Users?sortOrder=up", "", http.StatusBadRequest, "invalidValue"},
+		{"PATCH", "/Users/0", `{"schemas": ["` + PatchOpSchema + `"], "Operations": []}`, http.StatusBadRequest, "invalidSyntax"},
+		{"PATCH", "/Users/0", `{"schemas": ["` + PatchOpSchema + `"], "Operations": [{"op": "remove"}]}`, http.StatusBadRequest, "noTarget"},
+		{"PATCH", "/Users/0", `{"schemas": ["` + PatchOpSchema + `"], "Operations": [{"op": "replace", "path": "id", "value": "1"}]}`, http.StatusBadRequest, "mutability"},
+		{"HEAD", "/Users", "", http.StatusNotImplemented, ""},
+	}
+
+	for _, c := range cases {
+		w := doRequest(s, c.method, c.target, c.body)
+		if w.Code != c.status {
+			t.Errorf("Expected %d from %s %s, got %d", c.status, c.method, c.target, w.Code)
+			continue
+		}
+		if contentType := w.Header().Get("Content-Type"); contentType != SCIMMediaType {
+			t.Errorf("Unexpected Content-Type for error from %s %s: %s", c.method, c.target, contentType)
+		}
+		response := decodeBody(t, w)
+		schemas, _ := response["schemas"].([]interface{})
+		if len(schemas) != 1 || schemas[0] != ErrorSchema {
+			t.Errorf("Unexpected schemas in error response: %v", response)
+		}
+		if response["status"] != strconv.Itoa(c.status) {
+			t.Errorf("Unexpected status in error response: %v", response)
+		}
+		scimType, _ := response["scimType"].(string)
+		if scimType != c.scimType {
+			t.Errorf("Expected scimType %q from %s %s, got: %v", c.scimType, c.method, c.target, response)
+		}
+	}
+
+	if status, scimType := ErrorStatus(NewError(ConflictError, "conflict")); status != http.StatusConflict || scimType != "uniqueness" {
+		t.Errorf("Unexpected status for conflict: %d %s", status, scimType)
+	}
+
+	for _, values := range []url.Values{{"count": {"many"}}, {"startIndex": {"first"}}, {"sortOrder": {"up"}}} {
+		_, err := parseQuery(values)
+		if typed, ok := err.(SCIMTypedError); !ok || typed.Type() != InvalidValueError {
+			t.Errorf("Expected InvalidValueError for %v, got: %v", values, err)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/Users", strings.NewReader(UserA))
+	r.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusUnsupportedMediaType || decodeBody(t, w)["detail"] == nil {
+		t.Errorf("Expected SCIM error for bad media type, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// A backend which can't reach its storage
+type unavailableBackend struct {
+	*InMemoryBackend
+}
+
+func (b unavailableBackend) GetResource(tenant, resourceType string, id string) (string, error) {
+	return "", NewUnavailableError("database unreachable", 1500*time.Millisecond)
+}
+
+func TestUnavailable(t *testing.T) {
+	_, b := newTestServer()
+	s := NewServer([]string{UserType}, unavailableBackend{b}, func(c context.Context) string { return T1 })
+
+	w := doRequest(s, "GET", "/Users/0", "")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 from unavailable backend, got %d: %s", w.Code, w.Body.String())
+	}
+	if retryAfter := w.Header().Get("Retry-After"); retryAfter != "2" {
+		t.Errorf("Expected Retry-After 2, got: %q", retryAfter)
+	}
+	if response := decodeBody(t, w); response["status"] != "503" {
+		t.Errorf("Unexpected error response: %v", response)
+	}
+}
+
+func TestContext(t *testing.T) {
+	s, b := newTestServer()
+	_, err := b.Create(T1, UserType, UserA)
+	Ensure(t, err)
+	_, err = b.Create(T1, UserType, UserB)
+	Ensure(t, err)
+
+	// Backends implementing only Backend are adapted
+	adapted := WithContext(b)
+	if _, ok := adapted.(ConditionalContextBackend); !ok {
+		t.Errorf("Expected adapted InMemoryBackend to be a ConditionalContextBackend")
+	}
+	if _, err := adapted.GetResourceContext(context.Background(), T1, UserType, "1"); err != nil {
+		t.Errorf("Failed to get resource through adapter: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = adapted.GetResourceContext(ctx, T1, UserType, "1")
+	if typed, ok := err.(SCIMTypedError); !ok || typed.Type() != CanceledError {
+		t.Errorf("Expected adapter to fail with cancelled context, got: %v", err)
+	}
+
+	// The request's context is passed to the backend
+	r := httptest.NewRequest("GET", "/Users/1", nil).WithContext(ctx)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != StatusClientClosedRequest {
+		t.Errorf("Expected cancelled request to fail, got %d: %s", w.Code, w.Body.String())
+	}
+
+	// A request which has timed out can be retried
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancel()
+	r = httptest.NewRequest("GET", "/Users/1", nil).WithContext(ctx)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected timed out request to be unavailable, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestMeta(t *testing.T) {
+	s, _ := newTestServer()
+
+	w := doRequest(s, "POST", "/Users", UserA)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 from POST, got %d: %s", w.Code, w.Body.String())
+	}
+	created := decodeBody(t, w)["meta"].(map[string]interface{})
+	if created["created"] == nil || created["created"] != created["lastModified"] || created["version"] == nil {
+		t.Errorf("Unexpected meta for created resource: %v", created)
+	}
+
+	meta := decodeBody(t, doRequest(s, "GET", "/Users/0", ""))["meta"].(map[string]interface{})
+	if meta["resourceType"] != UserType || meta["location"] != "http://example.com/Users/0" {
+		t.Errorf("Unexpected meta from GET: %v", meta)
+	}
+
+	w = doRequest(s, "PUT", "/Users/0", UserB)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 from PUT, got %d: %s", w.Code, w.Body.String())
+	}
+	updated := decodeBody(t, w)["meta"].(map[string]interface{})
+	if updated["created"] != created["created"] || updated["version"] == created["version"] {
+		t.Errorf("Unexpected meta after update: %v (created: %v)", updated, created)
+	}
+
+	// Meta from the client is ignored
+	w = doRequest(s, "PUT", "/Users/0", `{"name": "Barbara Jensen", "age": 48, "meta": {"created": "2000-01-01T00:00:00Z"}}`)
+	if meta := decodeBody(t, w)["meta"].(map[string]interface{}); meta["created"] != created["created"] || meta["version"] != updated["version"] {
+		t.Errorf("Meta from client wasn't ignored: %v", meta)
+	}
+
+	s.EnableDiscovery([]ResourceType{{Name: "User", Endpoint: "/Users", Schema: "urn:test:User"}}, nil)
+	list := decodeBody(t, doRequest(s, "GET", "/Users?filter=meta.lastModified+pr", ""))
+	resources := list["Resources"].([]interface{})
+	if len(resources) != 1 {
+		t.Fatalf("Expected one resource with meta.lastModified, got: %v", list)
+	}
+	if meta := resources[0].(map[string]interface{})["meta"].(map[string]interface{}); meta["resourceType"] != "User" {
+		t.Errorf("Expected resource type name from discovery, got: %v", meta)
+	}
+}
+
+func TestConditionalRequests(t *testing.T) {
+	s, _ := newTestServer()
+
+	doConditional := func(method, target, body, header, etag string) *httptest.ResponseRecorder {
+		var reader io.Reader
+		if body != "" {
+			reader = strings.NewReader(body)
+		}
+		r := httptest.NewRequest(method, target, reader)
+		r.Header.Set("Content-Type", SCIMMediaType)
+		r.Header.Set(header, etag)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	w := doRequest(s, "POST", "/Users", UserA)
+	etag := w.Header().Get("ETag")
+	if etag == "" || etag != decodeBody(t, w)["meta"].(map[string]interface{})["version"] {
+		t.Fatalf("Expected ETag matching meta.version from POST, got %q", etag)
+	}
+
+	if w := doRequest(s, "GET", "/Users/0", ""); w.Header().Get("ETag") != etag {
+		t.Errorf("Expected ETag %s from GET, got %q", etag, w.Header().Get("ETag"))
+	}
+	if w := doConditional("GET", "/Users/0", "", "If-None-Match", etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("Expected 304 from GET with matching If-None-Match, got %d", w.Code)
+	}
+	if w := doConditional("GET", "/Users/0", "", "If-None-Match", `W/"other"`); w.Code != http.StatusOK {
+		t.Errorf("Expected 200 from GET with other If-None-Match, got %d", w.Code)
+	}
+
+	if w := doConditional("PUT", "/Users/0", UserB, "If-Match", `W/"other"`); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 from PUT with wrong If-Match, got %d", w.Code)
+	}
+	w = doConditional("PUT", "/Users/0", UserB, "If-Match", `W/"other", `+etag)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 from PUT with matching If-Match, got %d: %s", w.Code, w.Body.String())
+	}
+	newETag := w.Header().Get("ETag")
+	if newETag == "" || newETag == etag {
+		t.Errorf("Expected a new ETag after PUT, got %q", newETag)
+	}
+
+	patch := `{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [{"op": "replace", "path": "age", "value": 50}]}`
+	if w := doConditional("PATCH", "/Users/0", patch, "If-Match", etag); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 from PATCH with outdated If-Match, got %d", w.Code)
+	}
+	w = doConditional("PATCH", "/Users/0", patch, "If-Match", newETag)
+	if w.Code != http.StatusOK || decodeBody(t, w)["age"] != float64(50) {
+		t.Fatalf("Expected 200 from PATCH with matching If-Match, got %d: %s", w.Code, w.Body.String())
+	}
+	if patchedETag := w.Header().Get("ETag"); patchedETag == "" || patchedETag == newETag {
+		t.Errorf("Expected a new ETag after PATCH, got %q", patchedETag)
+	}
+
+	if w := doConditional("DELETE", "/Users/0", "", "If-Match", etag); w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 from DELETE with outdated If-Match, got %d", w.Code)
+	}
+	if w := doConditional("DELETE", "/Users/0", "", "If-Match", "*"); w.Code != http.StatusNoContent {
+		t.Errorf("Expected 204 from DELETE with If-Match *, got %d", w.Code)
+	}
+}
+
+func TestBulk(t *testing.T) {
+	s, b := newTestServer()
+
+	w := doRequest(s, "POST", "/Bulk", `{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:BulkRequest"],
+		"Operations": [
+			{"method": "POST", "path": "/Users", "bulkId": "u1", "data": {"name": "Barbara Jensen", "age": 47}},
+			{"method": "POST", "path": "/Groups", "bulkId": "g1", "data": {"members": [{"value": "bulkId:u1"}]}},
+			{"method": "PATCH", "path": "/Users/bulkId:u1", "data": {
+				"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+				"Operations": [{"op": "replace", "path": "age", "value": 48}]}},
+			{"method": "DELETE", "path": "/Users/missing"},
+			{"method": "POST", "path": "/Groups", "bulkId": "g2", "data": {"members": [{"value": "bulkId:unknown"}]}}
+		]
+	}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for bulk request, got %d: %s", w.Code, w.Body.String())
+	}
+
+	var response struct {
+		Schemas    []string
+		Operations []struct {
+			Method   string
+			BulkID   string
+			Location string
+			Status   string
+			Response map[string]interface{}
+		}
+	}
+	Ensure(t, json.Unmarshal(w.Body.Bytes(), &response))
+
+	if len(response.Schemas) != 1 || response.Schemas[0] != BulkResponseSchema || len(response.Operations) != 5 {
+		t.Fatalf("Unexpected bulk response: %s", w.Body.String())
+	}
+	for i, status := range []string{"201", "201", "200", "404", "400"} {
+		if response.Operations[i].Status != status {
+			t.Errorf("Expected status %s for operation %d, got %s", status, i, response.Operations[i].Status)
+		}
+	}
+
+	userLocation := response.Operations[0].Location
+	userID := userLocation[strings.LastIndex(userLocation, "/")+1:]
+	if response.Operations[2].Location != userLocation {
+		t.Errorf("Expected PATCH of %s, got %s", userLocation, response.Operations[2].Location)
+	}
+
+	user := decodeBody(t, doRequest(s, "GET", userLocation, ""))
+	if user["age"] != float64(48) {
+		t.Errorf("Expected the user to be patched: %v", user)
+	}
+
+	group := decodeBody(t, doRequest(s, "GET", response.Operations[1].Location, ""))
+	members := group["members"].([]interface{})
+	if members[0].(map[string]interface{})["value"] != userID {
+		t.Errorf("Expected bulkId reference to be replaced with %s: %v", userID, group)
+	}
+
+	if response.Operations[4].Response["scimType"] != "invalidValue" {
+		t.Errorf("Expected invalidValue for unresolved bulkId: %v", response.Operations[4].Response)
+	}
+
+	// Processing should stop after failOnErrors errors
+	w = doRequest(s, "POST", "/Bulk", `{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:BulkRequest"],
+		"failOnErrors": 1,
+		"Operations": [
+			{"method": "DELETE", "path": "/Users/missing"},
+			{"method": "DELETE", "path": "/Users/`+userID+`"}
+		]
+	}`)
+	Ensure(t, json.Unmarshal(w.Body.Bytes(), &response))
+	if len(response.Operations) != 1 {
+		t.Errorf("Expected processing to stop after the first error: %s", w.Body.String())
+	}
+	if _, err := b.GetResource(T1, UserType, userID); err != nil {
+		t.Errorf("Expected the user not to be deleted: %v", err)
+	}
+
+	w = doRequest(s, "POST", "/Bulk", `{"Operations": []}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for bulk request without schema, got %d", w.Code)
+	}
+}
+
+func TestDummyBatchPreconditions(t *testing.T) {
+	d := NewDummyBackend(objectParser)
+	ifMatch := ParsePrecondition(`W/"1"`)
+
+	Ensure(t, d.Batch(T1, func(m BatchModifier) error {
+		_, err := m.Update(UserType, "abc", `{"name": "Barbara Jensen"}`, nil)
+		Ensure(t, err)
+		_, err = m.Update(UserType, "abc", `{"name": "Barbara Jensen"}`, ifMatch)
+		MustFail(t, err)
+		_, err = m.Patch(UserType, "abc", &PatchRequest{Operations: []PatchOperation{{Op: "replace", Path: "age", Value: json.RawMessage("50")}}}, ifMatch)
+		MustFail(t, err)
+		MustFail(t, m.Delete(UserType, "abc", ifMatch))
+		return nil
+	}))
+}
+
+func TestSearch(t *testing.T) {
+	s, b := newTestServer()
+	for _, user := range []string{`{"name": "Carl", "age": 30}`, `{"name": "anna", "age": 50}`, `{"name": "Bea"}`} {
+		_, err := b.Create(T1, UserType, user)
+		Ensure(t, err)
+	}
+	_, err := b.Create(T1, GroupType, `{"name": "Bertil"}`)
+	Ensure(t, err)
+
+	names := func(list map[string]interface{}) []interface{} {
+		result := []interface{}{}
+		for _, r := range list["Resources"].([]interface{}) {
+			result = append(result, r.(map[string]interface{})["name"])
+		}
+		return result
+	}
+
+	w := doRequest(s, "POST", "/Users/.search", `{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:SearchRequest"],
+		"filter": "age pr",
+		"sortBy": "name",
+		"attributes": ["name"]
+	}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected 200 for search, got %d: %s", w.Code, w.Body.String())
+	}
+	list := decodeBody(t, w)
+	if !reflect.DeepEqual(names(list), []interface{}{"anna", "Carl"}) {
+		t.Errorf("Unexpected search result: %v", list)
+	}
+	for _, r := range list["Resources"].([]interface{}) {
+		if _, ok := r.(map[string]interface{})["age"]; ok {
+			t.Errorf("Expected only name and id to be returned: %v", r)
+		}
+	}
+	if len(b.resources[T1][UserType]) != 3 {
+		t.Errorf("A search shouldn't create resources")
+	}
+
+	list = decodeBody(t, doRequest(s, "POST", "/.search", `{"filter": "name sw \"b\"", "sortBy": "name", "count": 10}`))
+	if !reflect.DeepEqual(names(list), []interface{}{"Bea", "Bertil"}) || list["totalResults"] != 2.0 {
+		t.Errorf("Unexpected search result from server root: %v", list)
+	}
+	for _, r := range list["Resources"].([]interface{}) {
+		location := r.(map[string]interface{})["meta"].(map[string]interface{})["location"].(string)
+		if !strings.HasSuffix(location, "/"+r.(map[string]interface{})["id"].(string)) {
+			t.Errorf("Unexpected location for resource from server root: %v", r)
+		}
+	}
+
+	w = doRequest(s, "POST", "/Users/.search", `{"schemas": ["urn:ietf:params:scim:api:messages:2.0:ListResponse"]}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for search with wrong schema, got %d", w.Code)
+	}
+
+	w = doRequest(s, "GET", "/.search", "")
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected 405 for GET /.search, got %d", w.Code)
+	}
+}
+
+func TestLocation(t *testing.T) {
+	s, _ := newTestServer()
+
+	w := doRequest(s, "POST", "/Users", UserA)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 from POST, got %d: %s", w.Code, w.Body.String())
+	}
+	if location := w.Header().Get("Location"); location != "http://example.com/Users/0" {
+		t.Errorf("Unexpected Location for created resource: %s", location)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != SCIMMediaType {
+		t.Errorf("Expected Content-Type %s, got %s", SCIMMediaType, ct)
+	}
+	if created := decodeBody(t, w); created["id"] != "0" {
+		t.Errorf("Expected id in created resource: %v", created)
+	}
+
+	s.SetBaseURL("https://scim.example.com/")
+	w = doRequest(s, "PUT", "/Users/0", UserB)
+	if location := w.Header().Get("Location"); location != "https://scim.example.com/Users/0" {
+		t.Errorf("Unexpected Location with base URL: %s", location)
+	}
+	updated := decodeBody(t, w)
+	if updated["id"] != "0" || updated["meta"].(map[string]interface{})["location"] != "https://scim.example.com/Users/0" {
+		t.Errorf("Unexpected id or location in updated resource: %v", updated)
+	}
+
+	// The dummy backend uses externalId as id
+	d := NewServer([]string{UserType}, NewDummyBackend(objectParser), func(c context.Context) string { return T1 })
+	w = doRequest(d, "POST", "/Users", `{"externalId": "abc", "name": "Barbara Jensen"}`)
+	if w.Header().Get("Location") != "http://example.com/Users/abc" || decodeBody(t, w)["id"] != "abc" {
+		t.Errorf("Unexpected response from dummy backend: %v %s", w.Header(), w.Body.String())
+	}
+}
+
+// A backend implementing only the methods of Backend
+type originalBackend struct {
+	b *InMemoryBackend
+}
+
+func (o originalBackend) Create(tenant, resourceType, resource string) (string, error) {
+	return o.b.Create(tenant, resourceType, resource)
+}
+
+func (o originalBackend) Update(tenant, resourceType, resourceID, resource string) (string, error) {
+	return o.b.Update(tenant, resourceType, resourceID, resource)
+}
+
+func (o originalBackend) Delete(tenant, resourceType, resourceID string) error {
+	return o.b.Delete(tenant, resourceType, resourceID)
+}
+
+func (o originalBackend) Clear(tenant string) error {
+	return o.b.Clear(tenant)
+}
+
+func (o originalBackend) GetResources(tenant, resourceType string) (map[string]string, error) {
+	return o.b.GetResources(tenant, resourceType)
+}
+
+func (o originalBackend) GetResource(tenant, resourceType string, id string) (string, error) {
+	return o.b.GetResource(tenant, resourceType, id)
+}
+
+func (o originalBackend) GetParsedResources(tenant, resourceType string) (map[string]interface{}, error) {
+	return o.b.GetParsedResources(tenant, resourceType)
+}
+
+func (o originalBackend) GetParsedResource(tenant, resourceType string, id string) (interface{}, error) {
+	return o.b.GetParsedResource(tenant, resourceType, id)
+}
+
+func TestOriginalBackend(t *testing.T) {
+	b := NewInMemoryBackend(newSerialIDGenerator(), objectParser)
+	s := NewServer([]string{UserType, GroupType}, originalBackend{b}, func(c context.Context) string { return T1 })
+
+	if w := doRequest(s, "POST", "/Users", UserA); w.Code != http.StatusCreated {
+		t.Fatalf("Expected 201 from POST, got %d: %s", w.Code, w.Body.String())
+	}
+
+	patch := `{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [{"op": "replace", "path": "age", "value": 50}]}`
+	if w := doRequest(s, "PATCH", "/Users/0", patch); w.Code != http.StatusOK || decodeBody(t, w)["age"] != float64(50) {
+		t.Errorf("Expected PATCH to be applied, got %d: %s", w.Code, w.Body.String())
+	}
+	idPatch := `{"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [{"op": "replace", "path": "id", "value": "1"}]}`
+	if w := doRequest(s, "PATCH", "/Users/0", idPatch); w.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 from PATCH of id, got %d", w.Code)
+	}
+
+	w := doRequest(s, "GET", "/Users?filter=age+eq+50", "")
+	if w.Code != http.StatusOK || decodeBody(t, w)["totalResults"] != float64(1) {
+		t.Errorf("Expected filtered GET to find the user, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = doRequest(s, "POST", "/Bulk", `{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:BulkRequest"],
+		"Operations": [
+			{"method": "POST", "path": "/Users", "bulkId": "u1", "data": {"name": "John Smith", "age": 33}},
+			{"method": "POST", "path": "/Groups", "bulkId": "g1", "data": {"members": [{"value": "bulkId:u1"}]}}
+		]
+	}`)
+	if w.Code != http.StatusOK || b.CountResources(T1, GroupType) != 1 || b.CountResources(T1, UserType) != 2 {
+		t.Errorf("Expected bulk request to be applied, got %d: %s", w.Code, w.Body.String())
+	}
+
+	r := httptest.NewRequest("PUT", "/Users/0", strings.NewReader(UserB))
+	r.Header.Set("Content-Type", SCIMMediaType)
+	r.Header.Set("If-Match", `W/"other"`)
+	w = httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("Expected 412 from PUT with wrong If-Match, got %d", w.Code)
+	}
+}
@@ -0,0 +1,190 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package scimserverlite
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SearchRequestSchema is the schema URI for queries using POST (RFC 7644 section 3.4.3)
+const SearchRequestSchema = "urn:ietf:params:scim:api:messages:2.0:SearchRequest"
+
+// The path component for queries using POST, at the server root or
+// for a resource type (for instance /Users/.search)
+const searchEndpoint = ".search"
+
+type searchRequest struct {
+	Schemas            []string `json:"schemas"`
+	Attributes         []string `json:"attributes"`
+	ExcludedAttributes []string `json:"excludedAttributes"`
+	Filter             string   `json:"filter"`
+	SortBy             string   `json:"sortBy"`
+	SortOrder          string   `json:"sortOrder"`
+	StartIndex         *int     `json:"startIndex"`
+	Count              *int     `json:"count"`
+}
+
+// Parses the body of a query using POST. The request is converted to
+// the corresponding query parameters so that it's handled exactly as
+// a query using GET.
+func parseSearchRequest(body string) (*Query, *projection, error) {
+	var request searchRequest
+	err := json.Unmarshal([]byte(body), &request)
+
+	if err != nil {
+		return nil, nil, NewError(InvalidSyntaxError, "Failed to parse SearchRequest: "+err.Error())
+	}
+
+	if request.Schemas != nil {
+		found := false
+		for _, schema := range request.Schemas {
+			if schema == SearchRequestSchema {
+				found = true
+			}
+		}
+		if !found {
+			return nil, nil, NewError(InvalidSyntaxError, "SearchRequest must use schema "+SearchRequestSchema)
+		}
+	}
+
+	values := make(url.Values)
+	set := func(param, value string) {
+		if value != "" {
+			values.Set(param, value)
+		}
+	}
+	set("attributes", strings.Join(request.Attributes, ","))
+	set("excludedAttributes", strings.Join(request.ExcludedAttributes, ","))
+	set("filter", request.Filter)
+	set("sortBy", request.SortBy)
+	set("sortOrder", request.SortOrder)
+	if request.StartIndex != nil {
+		set("startIndex", strconv.Itoa(*request.StartIndex))
+	}
+	if request.Count != nil {
+		set("count", strconv.Itoa(*request.Count))
+	}
+
+	p, err := parseProjection(values)
+	if err != nil {
+		return nil, nil, NewError(InvalidValueError, err.Error())
+	}
+
+	query, err := parseQuery(values)
+	if err != nil {
+		return nil, nil, err
+	}
+	return query, p, nil
+}
+
+// Handles POST /.search, which queries all resource types
+func (s *Server) rootSearchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		WriteError(w, http.StatusMethodNotAllowed, "", "Queries to "+searchEndpoint+" must use POST")
+		return
+	}
+
+	if !checkMediaType(w, r) {
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		WriteError(w, http.StatusInternalServerError, "", "Failed to read HTTP body")
+		return
+	}
+
+	s.search(w, r, s.getTenant(r.Context()), "", string(body))
+}
+
+// Handles a query using POST, for one resource type or for all
+// resource types if resourceType is empty.
+func (s *Server) search(w http.ResponseWriter, r *http.Request, tenant, resourceType, body string) {
+	query, p, err := parseSearchRequest(body)
+	if err != nil {
+		handleBackendError(w, err)
+		return
+	}
+
+	var result *QueryResult
+	if resourceType == "" {
+		result, err = s.queryAll(r.Context(), tenant, query)
+	} else {
+		result, err = s.backend.QueryResourcesContext(r.Context(), tenant, resourceType, query)
+	}
+
+	if err != nil {
+		handleBackendError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", SCIMMediaType)
+	s.writeQueryResponse(w, r, resourceType, result, p)
+}
+
+// Queries all resource types. The resources in the result are identified
+// by resource type and id, see splitQueryAllID. Resource types for which
+// the backend can't use the filter (for instance because an attribute
+// doesn't exist for that type) are treated as having no matches.
+func (s *Server) queryAll(ctx context.Context, tenant string, query *Query) (*QueryResult, error) {
+	endpoints := make([]string, 0, len(s.endpoints))
+	for endpoint := range s.endpoints {
+		endpoints = append(endpoints, endpoint)
+	}
+	sort.Strings(endpoints)
+
+	resources := make(map[string]string)
+	for _, endpoint := range endpoints {
+		result, err := s.backend.QueryResourcesContext(ctx, tenant, endpoint, &Query{Filter: query.Filter})
+		if err != nil {
+			if typedError, ok := err.(SCIMTypedError); ok && typedError.Type() == InvalidFilterError {
+				continue
+			}
+			return nil, err
+		}
+		for _, resource := range result.Resources {
+			resources[endpoint+"/"+resource.ID] = resource.Resource
+		}
+	}
+
+	// The resources are already filtered, ApplyQuery does the sorting and paging
+	return ApplyQuery(resources, &Query{
+		StartIndex:     query.StartIndex,
+		Count:          query.Count,
+		SortBy:         query.SortBy,
+		SortDescending: query.SortDescending,
+	})
+}
+
+// Splits the id of a resource from queryAll into resource type and id
+func splitQueryAllID(id string) (string, string) {
+	parts := strings.SplitN(id, "/", 2)
+	if len(parts) < 2 {
+		return "", id
+	}
+	return parts[0], parts[1]
+}
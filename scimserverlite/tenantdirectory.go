@@ -0,0 +1,283 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package scimserverlite
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// TenantDirectory is a directory where an InMemoryBackend keeps each
+// tenant's resources in a file of its own (see UseTenantDirectory), so
+// tenants can be loaded and saved independently of each other.
+type TenantDirectory struct {
+	Path string
+
+	// Whether each tenant's modifications are written to a journal next
+	// to its file, and when the journals are flushed (see Journal)
+	Journal      bool
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+
+	// Writes a file, preferably atomically. os.WriteFile is used if nil.
+	WriteFile func(path string, data []byte) error
+}
+
+// Returns the path of a tenant's file. Tenants are usually URLs, so
+// all characters except lower case letters, digits, '.' and '-' are
+// escaped as _xx (in hex). Upper case letters are escaped as well since
+// file names may be case insensitive.
+func (d *TenantDirectory) file(tenant string) string {
+	var name strings.Builder
+	name.WriteString("tenant-")
+	for _, c := range []byte(tenant) {
+		if c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '.' || c == '-' {
+			name.WriteByte(c)
+		} else {
+			fmt.Fprintf(&name, "_%02x", c)
+		}
+	}
+	name.WriteString(".json")
+	return filepath.Join(d.Path, name.String())
+}
+
+// Returns the path of a tenant's journal
+func (d *TenantDirectory) journal(tenant string) string {
+	return d.file(tenant) + ".journal"
+}
+
+func (d *TenantDirectory) write(path string, data []byte) error {
+	if d.WriteFile != nil {
+		return d.WriteFile(path, data)
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// UseTenantDirectory makes the backend keep each tenant's resources in
+// a file of its own in a directory, which is created if needed. Tenants
+// are loaded from their files (and journals) when first used, and saved
+// with SaveTenants. It should be called before the backend is used.
+func (backend *InMemoryBackend) UseTenantDirectory(directory *TenantDirectory) error {
+	if err := os.MkdirAll(directory.Path, 0700); err != nil {
+		return err
+	}
+
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+
+	backend.directory = directory
+	backend.loaded = make(map[string]bool)
+	backend.modified = make(map[string]bool)
+	backend.journals = make(map[string]*Journal)
+	return nil
+}
+
+// Loads a tenant from the tenant directory unless already loaded
+func (backend *InMemoryBackend) ensureLoaded(tenant string) error {
+	backend.lock.RLock()
+	loaded := backend.directory == nil || backend.loaded[tenant]
+	backend.lock.RUnlock()
+
+	if loaded {
+		return nil
+	}
+
+	backend.lock.Lock()
+	defer backend.lock.Unlock()
+
+	if backend.loaded[tenant] {
+		return nil
+	}
+	return backend.loadTenant(tenant)
+}
+
+// Loads a tenant's file and replays its journal, the caller must hold
+// the lock exclusively
+func (backend *InMemoryBackend) loadTenant(tenant string) (err error) {
+	// Set first since the journal is replayed through replayEntry
+	backend.loaded[tenant] = true
+	defer func() {
+		if err != nil {
+			delete(backend.loaded, tenant)
+			err = fmt.Errorf("failed to load tenant %s: %v", tenant, err)
+		}
+	}()
+
+	data, err := os.ReadFile(backend.directory.file(tenant))
+	if err == nil {
+		if data, err = backend.decode(backend.directory.file(tenant), data); err != nil {
+			return err
+		}
+
+		var unmarshalled serialized
+		if err = json.Unmarshal(data, &unmarshalled); err != nil {
+			return err
+		}
+		parsed, report, quarantined := backend.parseResourceSet(unmarshalled.Resources[tenant])
+		if backend.strict && len(quarantined) > 0 {
+			return &LoadError{Report: LoadReport{tenant: report}}
+		}
+
+		backend.resources[tenant] = unmarshalled.Resources[tenant]
+		backend.parsed[tenant] = parsed
+		backend.report[tenant] = report
+		backend.setQuarantine(tenant, unmarshalled.Quarantine[tenant], quarantined)
+		if len(quarantined) > 0 {
+			// Saved without the quarantined resources
+			backend.modified[tenant] = true
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	journal, err := os.OpenFile(backend.directory.journal(tenant), os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer journal.Close()
+
+	complete, err := backend.replay(journal, journal.Name())
+	if err != nil {
+		return err
+	}
+
+	// Remove a partially written last line, or the next entry would be
+	// appended to it
+	info, err := journal.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > complete {
+		return journal.Truncate(complete)
+	}
+	return nil
+}
+
+// Returns the journal for a tenant, opening it if needed. Returns nil
+// if journals aren't kept. The caller must hold the lock exclusively.
+func (backend *InMemoryBackend) tenantJournal(tenant string) (*Journal, error) {
+	if !backend.directory.Journal {
+		return nil, nil
+	}
+	if journal, ok := backend.journals[tenant]; ok {
+		return journal, nil
+	}
+
+	journal, err := OpenJournal(backend.directory.journal(tenant), backend.directory.Sync, backend.directory.SyncInterval)
+	if err != nil {
+		return nil, err
+	}
+	backend.journals[tenant] = journal
+	return journal, nil
+}
+
+// A modified tenant to save, copied so it can be written to disk without
+// holding the lock
+type tenantSave struct {
+	tenant     string
+	resources  ResourceSet
+	quarantine []QuarantinedResource
+	journal    *Journal
+}
+
+// SaveTenants saves the tenants which have been modified since they were
+// last saved to their files in the tenant directory, and empties their
+// journals. Modifications are blocked meanwhile, but reads only while the
+// modified tenants are copied.
+func (backend *InMemoryBackend) SaveTenants() error {
+	backend.writeLock.Lock()
+	defer backend.writeLock.Unlock()
+
+	backend.lock.RLock()
+	saves := make([]tenantSave, 0, len(backend.modified))
+	for tenant := range backend.modified {
+		saves = append(saves, tenantSave{
+			tenant:     tenant,
+			resources:  copyResourceSet(backend.resources[tenant]),
+			quarantine: backend.quarantine[tenant],
+			journal:    backend.journals[tenant],
+		})
+	}
+	backend.lock.RUnlock()
+
+	for _, save := range saves {
+		if err := backend.saveTenant(save); err != nil {
+			return fmt.Errorf("failed to save tenant %s: %v", save.tenant, err)
+		}
+
+		backend.lock.Lock()
+		delete(backend.modified, save.tenant)
+		backend.lock.Unlock()
+	}
+	return nil
+}
+
+// Saves a tenant to its file, the caller must hold the write lock
+func (backend *InMemoryBackend) saveTenant(save tenantSave) error {
+	tenant := save.tenant
+	resources := map[string]ResourceSet{tenant: save.resources}
+	var quarantine map[string][]QuarantinedResource
+	if save.quarantine != nil {
+		quarantine = map[string][]QuarantinedResource{tenant: save.quarantine}
+	}
+	data, err := json.MarshalIndent(&serialized{Version: currentVersion, Resources: resources, Quarantine: quarantine}, "", "  ")
+	if err == nil {
+		data, err = backend.encode(data)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = backend.directory.write(backend.directory.file(tenant), data); err != nil {
+		return err
+	}
+
+	if save.journal != nil {
+		return save.journal.truncate()
+	}
+
+	// A journal left from an earlier run is included in the file now
+	err = os.Remove(backend.directory.journal(tenant))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Close closes the journals opened for the tenant directory
+func (backend *InMemoryBackend) Close() error {
+	backend.lockModification()
+	defer backend.unlockModification()
+
+	var err error
+	for tenant, journal := range backend.journals {
+		if closeErr := journal.Close(); err == nil {
+			err = closeErr
+		}
+		delete(backend.journals, tenant)
+	}
+	return err
+}
@@ -0,0 +1,158 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package scimserverlite
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Creates a backend using a tenant directory, the files written are
+// recorded in written
+func newTenantDirectoryBackend(t *testing.T, path string, journal bool, written *[]string) *InMemoryBackend {
+	t.Helper()
+	b := NewInMemoryBackend(newSerialIDGenerator(), objectParser)
+	Ensure(t, b.UseTenantDirectory(&TenantDirectory{
+		Path:    path,
+		Journal: journal,
+		Sync:    SyncAlways,
+		WriteFile: func(path string, data []byte) error {
+			if written != nil {
+				*written = append(*written, filepath.Base(path))
+			}
+			return os.WriteFile(path, data, 0600)
+		},
+	}))
+	return b
+}
+
+func TestTenantFileNames(t *testing.T) {
+	d := TenantDirectory{Path: "dir"}
+	if name := d.file("https://skola.example/Tenant"); name != filepath.Join("dir", "tenant-https_3a_2f_2fskola.example_2f_54enant.json") {
+		t.Errorf("Unexpected file name for tenant: %s", name)
+	}
+	if d.file("A") == d.file("a") {
+		t.Errorf("Expected different file names for tenants differing in case")
+	}
+}
+
+func TestTenantDirectory(t *testing.T) {
+	dir := t.TempDir()
+	var written []string
+	b := newTenantDirectoryBackend(t, dir, true, &written)
+
+	_, err := b.Create(T1, UserType, UserA)
+	Ensure(t, err)
+	_, err = b.Create(T2, UserType, UserB)
+	Ensure(t, err)
+	Ensure(t, b.SaveTenants())
+	if len(written) != 2 {
+		t.Errorf("Expected both tenants to be saved, got %v", written)
+	}
+
+	// Only modified tenants are saved
+	written = nil
+	_, err = b.Create(T1, GroupType, GroupA)
+	Ensure(t, err)
+	Ensure(t, b.SaveTenants())
+	if len(written) != 1 || written[0] != filepath.Base(b.directory.file(T1)) {
+		t.Errorf("Expected only the modified tenant to be saved, got %v", written)
+	}
+
+	// Modifications after the last save are in the journal
+	Ensure(t, b.Delete(T2, UserType, "1"))
+	Ensure(t, b.Close())
+
+	// Tenants are loaded when they're used
+	b2 := newTenantDirectoryBackend(t, dir, true, nil)
+	defer b2.Close()
+	if len(b2.loaded) != 0 {
+		t.Errorf("Expected no tenants to be loaded before use, got %v", b2.loaded)
+	}
+	if n := b2.CountResources(T1, UserType); n != 1 {
+		t.Errorf("Expected 1 user for %s, got %d", T1, n)
+	}
+	if n := b2.CountResources(T1, GroupType); n != 1 {
+		t.Errorf("Expected 1 group for %s, got %d", T1, n)
+	}
+	if b2.loaded[T2] {
+		t.Errorf("Expected %s not to be loaded", T2)
+	}
+	if n := b2.CountResources(T2, UserType); n != 0 {
+		t.Errorf("Expected the deletion for %s to be replayed, got %d users", T2, n)
+	}
+}
+
+func TestMigrateToTenantDirectory(t *testing.T) {
+	old := NewInMemoryBackend(newSerialIDGenerator(), objectParser)
+	_, err := old.Create(T1, UserType, UserA)
+	Ensure(t, err)
+	_, err = old.Create(T2, UserType, UserB)
+	Ensure(t, err)
+	saved, err := old.Serialize()
+	Ensure(t, err)
+
+	dir := t.TempDir()
+	var written []string
+	b := newTenantDirectoryBackend(t, dir, false, &written)
+	Ensure(t, b.Load(saved))
+	Ensure(t, b.SaveTenants())
+	if len(written) != 2 {
+		t.Errorf("Expected a file for each tenant, got %v", written)
+	}
+
+	b2 := newTenantDirectoryBackend(t, dir, false, nil)
+	for _, tenant := range []string{T1, T2} {
+		if n := b2.CountResources(tenant, UserType); n != 1 {
+			t.Errorf("Expected 1 user for %s after migration, got %d", tenant, n)
+		}
+	}
+}
+
+func TestTenantDirectoryTornWrite(t *testing.T) {
+	dir := t.TempDir()
+	b := newTenantDirectoryBackend(t, dir, true, nil)
+	_, err := b.Create(T1, UserType, UserA)
+	Ensure(t, err)
+	Ensure(t, b.Close())
+
+	// A crash while writing leaves an incomplete last line
+	f, err := os.OpenFile(b.directory.journal(T1), os.O_WRONLY|os.O_APPEND, 0600)
+	Ensure(t, err)
+	_, err = f.WriteString(`{"op":"put","tenant":"`)
+	Ensure(t, err)
+	Ensure(t, f.Close())
+
+	// The incomplete line is removed when the tenant is loaded, so
+	// later entries can be replayed
+	b = newTenantDirectoryBackend(t, dir, true, nil)
+	_, err = b.Create(T1, GroupType, GroupA)
+	Ensure(t, err)
+	Ensure(t, b.Close())
+
+	b = newTenantDirectoryBackend(t, dir, true, nil)
+	defer b.Close()
+	groups, err := b.GetResources(T1, GroupType)
+	Ensure(t, err)
+	if len(groups) != 1 || b.CountResources(T1, UserType) != 1 {
+		t.Errorf("Expected the user and the group after recovering from torn write, got %v", b.resources[T1])
+	}
+}
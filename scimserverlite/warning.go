@@ -0,0 +1,131 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package scimserverlite
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// DiscardedAttributes returns the attributes in a resource sent by a client
+// which are missing in the resource returned by the backend, for instance
+// because the backend has nowhere to store them. Attributes without a value
+// (null, empty lists and complex values), schemas and the attributes the
+// server maintains (id and meta) are ignored. Sub-attributes are given as
+// "attribute.subAttribute", attribute names are compared case insensitively.
+func DiscardedAttributes(sent, stored string) []string {
+	decodedSent, err := decodeJSON([]byte(sent))
+	if err != nil {
+		return nil
+	}
+	decodedStored, err := decodeJSON([]byte(stored))
+	if err != nil {
+		return nil
+	}
+
+	s, ok := decodedSent.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	delete(s, "schemas")
+	delete(s, "id")
+	delete(s, "meta")
+
+	discarded := make(map[string]bool)
+	findDiscarded(s, decodedStored, "", discarded)
+
+	result := make([]string, 0, len(discarded))
+	for attribute := range discarded {
+		result = append(result, attribute)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// Adds the attributes with a value in sent but not in stored to discarded
+func findDiscarded(sent, stored interface{}, prefix string, discarded map[string]bool) {
+	switch s := sent.(type) {
+	case map[string]interface{}:
+		st, _ := stored.(map[string]interface{})
+		for name, value := range s {
+			if !hasValue(value) {
+				continue
+			}
+			_, storedValue, _ := lookupAttribute(st, name)
+			if _, complex := value.(map[string]interface{}); !complex && !hasValue(storedValue) {
+				discarded[prefix+name] = true
+				continue
+			}
+			// Attributes in extension schemas are separated from the schema URI by ":"
+			separator := "."
+			if strings.HasPrefix(strings.ToLower(name), "urn:") {
+				separator = ":"
+			}
+			findDiscarded(value, storedValue, prefix+name+separator, discarded)
+		}
+	case []interface{}:
+		// Compares the sub-attributes used in any of the values, since
+		// the backend may not keep the order of multi-valued attributes
+		st, _ := stored.([]interface{})
+		sentUnion, storedUnion := make(map[string]interface{}), make(map[string]interface{})
+		for _, v := range s {
+			if m, ok := v.(map[string]interface{}); ok {
+				for name, value := range m {
+					if hasValue(value) {
+						sentUnion[name] = value
+					}
+				}
+			}
+		}
+		for _, v := range st {
+			if m, ok := v.(map[string]interface{}); ok {
+				for name, value := range m {
+					if hasValue(value) {
+						storedUnion[name] = value
+					}
+				}
+			}
+		}
+		findDiscarded(sentUnion, storedUnion, prefix, discarded)
+	}
+}
+
+func hasValue(v interface{}) bool {
+	switch value := v.(type) {
+	case nil:
+		return false
+	case []interface{}:
+		return len(value) > 0
+	case map[string]interface{}:
+		return len(value) > 0
+	}
+	return true
+}
+
+// Sets a Warning header (RFC 7234 section 5.5) listing the attributes
+// in the request which the backend didn't store
+func setDiscardedWarning(w http.ResponseWriter, sent, stored string) {
+	discarded := DiscardedAttributes(sent, stored)
+	if len(discarded) > 0 {
+		w.Header().Set("Warning", fmt.Sprintf("299 - \"Attributes not stored: %s\"", strings.Join(discarded, ", ")))
+	}
+}
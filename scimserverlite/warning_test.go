@@ -0,0 +1,57 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package scimserverlite
+
+import (
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestDiscardedAttributes(t *testing.T) {
+	tests := []struct {
+		sent     string
+		stored   string
+		expected []string
+	}{
+		{`{"userName": "baje", "age": 47}`, `{"userName": "baje", "age": 47}`, []string{}},
+		{`{"userName": "baje", "nickName": null, "emails": [], "id": "1", "meta": {}, "schemas": ["x"]}`, `{"userName": "baje"}`, []string{}},
+		{`{"UserName": "baje", "age": 47}`, `{"userName": "baje"}`, []string{"age"}},
+		{`{"name": {"givenName": "Barbara", "middleName": "B"}}`, `{"name": {"givenName": "Barbara"}}`, []string{"name.middleName"}},
+		{`{"emails": [{"value": "a@example.com", "type": "work"}, {"value": "b@example.com"}]}`,
+			`{"emails": [{"value": "b@example.com"}, {"value": "a@example.com"}]}`, []string{"emails.type"}},
+		{`{"urn:ext:User": {"civicNo": "1", "userRelations": [{"value": "2"}]}}`, `{"urn:ext:User": {"civicNo": "1"}}`,
+			[]string{"urn:ext:User:userRelations"}},
+		{`{"urn:ext:User": {"securityMarking": true}}`, `{}`, []string{"urn:ext:User:securityMarking"}},
+	}
+
+	for _, test := range tests {
+		discarded := DiscardedAttributes(test.sent, test.stored)
+		if !reflect.DeepEqual(discarded, test.expected) {
+			t.Errorf("Expected %v to be discarded from %s, got %v", test.expected, test.sent, discarded)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	setDiscardedWarning(w, `{"a": 1, "b": 2, "c": 3}`, `{"b": 2}`)
+	if warning := w.Header().Get("Warning"); warning != `299 - "Attributes not stored: a, c"` {
+		t.Errorf("Unexpected Warning header: %s", warning)
+	}
+}
@@ -58,16 +58,96 @@ func ensureRequired(required []string, data []byte) error {
 	return nil
 }
 
+// The attributes which are required in each type
+var (
+	organisationRequired    = []string{"externalId", "displayName"}
+	schoolUnitGroupRequired = []string{"externalId", "displayName"}
+	schoolUnitRequired      = []string{"externalId", "displayName", "schoolUnitCode"}
+	activityRequired        = []string{"externalId", "displayName", "owner"}
+	studentGroupRequired    = []string{"externalId", "displayName", "owner"}
+	scimNameRequired        = []string{"familyName", "givenName"}
+	enrolmentRequired       = []string{"value"}
+	userRelationRequired    = []string{"value", "relationType"}
+	userRequired            = []string{"externalId", "userName", "name", "displayName"}
+	employmentRequired      = []string{"externalId", "employedAt", "user", "employmentRole"}
+)
+
+// RequiredAttributes returns the attributes which must be present when
+// an object of the given type is parsed from JSON. obj should be a pointer
+// to one of the types in this package.
+func RequiredAttributes(obj interface{}) []string {
+	switch obj.(type) {
+	case *Organisation:
+		return organisationRequired
+	case *SchoolUnitGroup:
+		return schoolUnitGroupRequired
+	case *SchoolUnit:
+		return schoolUnitRequired
+	case *Activity:
+		return activityRequired
+	case *StudentGroup:
+		return studentGroupRequired
+	case *SCIMName:
+		return scimNameRequired
+	case *Enrolment:
+		return enrolmentRequired
+	case *UserRelation:
+		return userRelationRequired
+	case *User:
+		return userRequired
+	case *Employment:
+		return employmentRequired
+	}
+	return nil
+}
+
 // Object is an SS12000:2018 object
 type Object interface {
 	// GetID returns the objects UUID (id/externalId)
 	GetID() string
 }
 
+// MetaObject is an Object with meta data maintained by the service
+// provider. The objects in this package (which embed SCIMResource)
+// implement it.
+type MetaObject interface {
+	Object
+	// GetMeta returns the objects meta data, nil if it has none
+	GetMeta() *SCIMMeta
+	// SetMeta replaces the objects meta data
+	SetMeta(meta *SCIMMeta)
+}
+
+// SCIMMeta is the meta data the service provider maintains for a resource
+type SCIMMeta struct {
+	ResourceType string `json:"resourceType,omitempty"`
+	Created      string `json:"created,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+	Location     string `json:"location,omitempty"`
+	Version      string `json:"version,omitempty"`
+}
+
+// SCIMResource holds the attributes common to all resources which are
+// maintained by the service provider. It is embedded in the objects.
+type SCIMResource struct {
+	Meta *SCIMMeta `json:"meta,omitempty"`
+}
+
+// GetMeta returns the objects meta data, nil if it has none
+func (r *SCIMResource) GetMeta() *SCIMMeta {
+	return r.Meta
+}
+
+// SetMeta replaces the objects meta data
+func (r *SCIMResource) SetMeta(meta *SCIMMeta) {
+	r.Meta = meta
+}
+
 // Organisation represents an organisation
 type Organisation struct {
 	ExternalID  string `json:"externalId"`
 	DisplayName string `json:"displayName"`
+	SCIMResource
 }
 
 // GetID returns the objects UUID (id/externalId)
@@ -77,7 +157,7 @@ func (o *Organisation) GetID() string {
 
 // UnmarshalJSON implements the interface for custom unmarshalling
 func (o *Organisation) UnmarshalJSON(data []byte) (err error) {
-	err = ensureRequired([]string{"externalId", "displayName"}, data)
+	err = ensureRequired(organisationRequired, data)
 	if err != nil {
 		return
 	}
@@ -90,6 +170,7 @@ func (o *Organisation) UnmarshalJSON(data []byte) (err error) {
 type SchoolUnitGroup struct {
 	ExternalID  string `json:"externalId"`
 	DisplayName string `json:"displayName"`
+	SCIMResource
 }
 
 // GetID returns the objects UUID (id/externalId)
@@ -99,7 +180,7 @@ func (sug *SchoolUnitGroup) GetID() string {
 
 // UnmarshalJSON implements the interface for custom unmarshalling
 func (sug *SchoolUnitGroup) UnmarshalJSON(data []byte) (err error) {
-	err = ensureRequired([]string{"externalId", "displayName"}, data)
+	err = ensureRequired(schoolUnitGroupRequired, data)
 	if err != nil {
 		return
 	}
@@ -117,6 +198,7 @@ type SchoolUnit struct {
 	SchoolUnitGroup  *SCIMReference `json:"schoolUnitGroup"`
 	SchoolTypes      *[]string      `json:"schoolTypes"`
 	MunicipalityCode *string        `json:"municipalityCode"`
+	SCIMResource
 }
 
 // GetID returns the objects UUID (id/externalId)
@@ -126,7 +208,7 @@ func (su *SchoolUnit) GetID() string {
 
 // UnmarshalJSON implements the interface for custom unmarshalling
 func (su *SchoolUnit) UnmarshalJSON(data []byte) (err error) {
-	err = ensureRequired([]string{"externalId", "displayName", "schoolUnitCode"}, data)
+	err = ensureRequired(schoolUnitRequired, data)
 	if err != nil {
 		return
 	}
@@ -144,6 +226,7 @@ type ActivityJSON struct {
 	Groups         []SCIMReference `json:"groups"` // According to spec
 	Teachers       []SCIMReference `json:"teachers"`
 	ParentActivity []SCIMReference `json:"parentActivity"`
+	SCIMResource
 }
 
 // Activity represents an activity
@@ -154,6 +237,7 @@ type Activity struct {
 	Groups         []SCIMReference `json:"groups"`
 	Teachers       []SCIMReference `json:"teachers"`
 	ParentActivity []SCIMReference `json:"parentActivity"`
+	SCIMResource
 }
 
 // GetID returns the objects UUID (id/externalId)
@@ -163,7 +247,7 @@ func (a *Activity) GetID() string {
 
 // UnmarshalJSON implements the interface for custom unmarshalling
 func (a *Activity) UnmarshalJSON(data []byte) error {
-	err := ensureRequired([]string{"externalId", "displayName", "owner"}, data)
+	err := ensureRequired(activityRequired, data)
 	if err != nil {
 		return err
 	}
@@ -184,6 +268,7 @@ func (a *Activity) UnmarshalJSON(data []byte) error {
 	}
 	a.Teachers = ajson.Teachers
 	a.ParentActivity = ajson.ParentActivity
+	a.Meta = ajson.Meta
 
 	return nil
 }
@@ -202,6 +287,7 @@ type StudentGroup struct {
 	Type               *string         `json:"studentGroupType"`   // Type is the type of group (klass, undervisning...)
 	StudentMemberships []SCIMReference `json:"studentMemberships"` // StudentMemberships is a list of students in the group
 	SchoolType         *string         `json:"schoolType"`         // SchoolType is the type of education ("skolform", GR, GY etc.)
+	SCIMResource
 }
 
 // GetID returns the objects UUID (id/externalId)
@@ -211,7 +297,7 @@ func (sg *StudentGroup) GetID() string {
 
 // UnmarshalJSON implements the interface for custom unmarshalling
 func (sg *StudentGroup) UnmarshalJSON(data []byte) (err error) {
-	err = ensureRequired([]string{"externalId", "displayName", "owner"}, data)
+	err = ensureRequired(studentGroupRequired, data)
 	if err != nil {
 		return
 	}
@@ -228,7 +314,7 @@ type SCIMName struct {
 
 // UnmarshalJSON implements the interface for custom unmarshalling
 func (sn *SCIMName) UnmarshalJSON(data []byte) (err error) {
-	err = ensureRequired([]string{"familyName", "givenName"}, data)
+	err = ensureRequired(scimNameRequired, data)
 	if err != nil {
 		return
 	}
@@ -254,7 +340,7 @@ type Enrolment struct {
 
 // UnmarshalJSON implements the interface for custom unmarshalling
 func (e *Enrolment) UnmarshalJSON(data []byte) (err error) {
-	err = ensureRequired([]string{"value"}, data)
+	err = ensureRequired(enrolmentRequired, data)
 	if err != nil {
 		return
 	}
@@ -273,7 +359,7 @@ type UserRelation struct {
 
 // UnmarshalJSON implements the interface for custom unmarshalling
 func (ur *UserRelation) UnmarshalJSON(data []byte) (err error) {
-	err = ensureRequired([]string{"value", "relationType"}, data)
+	err = ensureRequired(userRelationRequired, data)
 	if err != nil {
 		return
 	}
@@ -298,6 +384,7 @@ type User struct {
 	DisplayName string        `json:"displayName"`                                    // DisplayName is what to show (required in EGIL, not in SS12000:2018 it seems)
 	Emails      []SCIMEmail   `json:"emails"`                                         // Emails is the user's email addresses
 	Extension   UserExtension `json:"urn:scim:schemas:extension:sis:school:1.0:User"` // Extension is the SS12000:2028 SCIM extension
+	SCIMResource
 }
 
 // GetID returns the objects UUID (id/externalId)
@@ -307,7 +394,7 @@ func (u *User) GetID() string {
 
 // UnmarshalJSON implements the interface for custom unmarshalling
 func (u *User) UnmarshalJSON(data []byte) (err error) {
-	err = ensureRequired([]string{"externalId", "userName", "name", "displayName"}, data)
+	err = ensureRequired(userRequired, data)
 	if err != nil {
 		return
 	}
@@ -333,6 +420,7 @@ type Employment struct {
 	User           SCIMReference `json:"user"`           // User is the employed user
 	EmploymentRole string        `json:"employmentRole"` // EmploymentRole is the type of employment
 	Signature      string        `json:"signature"`      // Teacher signature
+	SCIMResource
 }
 
 // GetID returns the objects UUID (id/externalId)
@@ -342,7 +430,7 @@ func (e *Employment) GetID() string {
 
 // UnmarshalJSON implements the interface for custom unmarshalling
 func (e *Employment) UnmarshalJSON(data []byte) (err error) {
-	err = ensureRequired([]string{"externalId", "employedAt", "user", "employmentRole"}, data)
+	err = ensureRequired(employmentRequired, data)
 	if err != nil {
 		return
 	}
@@ -0,0 +1,158 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package windermere
+
+import (
+	"reflect"
+	"strings"
+
+	scim "github.com/Sambruk/windermere/scimserverlite"
+	"github.com/Sambruk/windermere/ss12000v1"
+)
+
+// Information about an SS12000 resource type needed for the
+// SCIM discovery endpoints.
+type discoveryInfo struct {
+	name      string
+	schema    string
+	object    ss12000v1.Object
+	extension string      // URI of the extension schema, empty if none
+	extended  interface{} // the extension type, if extension is given
+}
+
+const ss12000SchemaPrefix = "urn:scim:schemas:extension:sis:school:1.0:"
+
+// Discovery information per endpoint
+var discoveryInfos = map[string]discoveryInfo{
+	"Users": {
+		name:      "User",
+		schema:    "urn:ietf:params:scim:schemas:core:2.0:User",
+		object:    &ss12000v1.User{},
+		extension: userExtensionURI,
+		extended:  &ss12000v1.UserExtension{},
+	},
+	"StudentGroups":    {name: "StudentGroup", schema: ss12000SchemaPrefix + "StudentGroup", object: &ss12000v1.StudentGroup{}},
+	"Organisations":    {name: "Organisation", schema: ss12000SchemaPrefix + "Organisation", object: &ss12000v1.Organisation{}},
+	"SchoolUnits":      {name: "SchoolUnit", schema: ss12000SchemaPrefix + "SchoolUnit", object: &ss12000v1.SchoolUnit{}},
+	"SchoolUnitGroups": {name: "SchoolUnitGroup", schema: ss12000SchemaPrefix + "SchoolUnitGroup", object: &ss12000v1.SchoolUnitGroup{}},
+	"Employments":      {name: "Employment", schema: ss12000SchemaPrefix + "Employment", object: &ss12000v1.Employment{}},
+	"Activities":       {name: "Activity", schema: ss12000SchemaPrefix + "Activity", object: &ss12000v1.Activity{}},
+}
+
+// Generates schema attributes from the JSON representation of a struct type.
+// Fields named after a schema URI (extensions) are skipped since they are
+// described in a schema of their own.
+func schemaAttributes(t reflect.Type) []scim.SchemaAttribute {
+	required := ss12000v1.RequiredAttributes(reflect.New(t).Interface())
+	isRequired := func(name string) bool {
+		for _, r := range required {
+			if r == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	result := []scim.SchemaAttribute{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" || name == "-" || strings.HasPrefix(name, "urn:") {
+			continue
+		}
+
+		attribute := scim.SchemaAttribute{
+			Name:       name,
+			Required:   isRequired(name),
+			Mutability: "readWrite",
+			Returned:   "default",
+			Uniqueness: "none",
+		}
+
+		ft := field.Type
+		if ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+		if ft.Kind() == reflect.Slice {
+			attribute.MultiValued = true
+			ft = ft.Elem()
+		}
+
+		switch ft.Kind() {
+		case reflect.String:
+			attribute.Type = "string"
+		case reflect.Bool:
+			attribute.Type = "boolean"
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			attribute.Type = "integer"
+		case reflect.Float32, reflect.Float64:
+			attribute.Type = "decimal"
+		case reflect.Struct:
+			attribute.Type = "complex"
+			attribute.SubAttributes = schemaAttributes(ft)
+		}
+
+		switch name {
+		case "$ref":
+			attribute.Type = "reference"
+			attribute.ReferenceTypes = []string{"uri"}
+			attribute.CaseExact = true
+		case "externalId":
+			// Windermere uses externalId as the resource's id
+			attribute.CaseExact = true
+			attribute.Uniqueness = "server"
+		}
+		result = append(result, attribute)
+	}
+	return result
+}
+
+// Returns the resource types and schemas for the discovery endpoints
+func discoveryResources(endpoints []string) ([]scim.ResourceType, []scim.Schema) {
+	resourceTypes := []scim.ResourceType{}
+	schemas := []scim.Schema{}
+
+	for _, endpoint := range endpoints {
+		info, ok := discoveryInfos[endpoint]
+		if !ok {
+			continue
+		}
+		resourceType := scim.ResourceType{
+			Name:     info.name,
+			Endpoint: "/" + endpoint,
+			Schema:   info.schema,
+		}
+		schemas = append(schemas, scim.Schema{
+			ID:         info.schema,
+			Name:       info.name,
+			Attributes: schemaAttributes(reflect.TypeOf(info.object).Elem()),
+		})
+		if info.extension != "" {
+			resourceType.SchemaExtensions = []scim.SchemaExtension{{Schema: info.extension}}
+			schemas = append(schemas, scim.Schema{
+				ID:         info.extension,
+				Name:       info.name + " extension",
+				Attributes: schemaAttributes(reflect.TypeOf(info.extended).Elem()),
+			})
+		}
+		resourceTypes = append(resourceTypes, resourceType)
+	}
+	return resourceTypes, schemas
+}
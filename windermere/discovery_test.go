@@ -0,0 +1,80 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package windermere
+
+import (
+	"testing"
+
+	scim "github.com/Sambruk/windermere/scimserverlite"
+)
+
+func findAttribute(attributes []scim.SchemaAttribute, name string) *scim.SchemaAttribute {
+	for i := range attributes {
+		if attributes[i].Name == name {
+			return &attributes[i]
+		}
+	}
+	return nil
+}
+
+func TestDiscoveryResources(t *testing.T) {
+	resourceTypes, schemas := discoveryResources([]string{"Users", "StudentGroups"})
+
+	if len(resourceTypes) != 2 || resourceTypes[0].Endpoint != "/Users" || resourceTypes[1].Name != "StudentGroup" {
+		t.Fatalf("Unexpected resource types: %v", resourceTypes)
+	}
+	if len(resourceTypes[0].SchemaExtensions) != 1 || resourceTypes[0].SchemaExtensions[0].Schema != userExtensionURI {
+		t.Errorf("Expected the SS12000 user extension: %v", resourceTypes[0].SchemaExtensions)
+	}
+	if len(schemas) != 3 {
+		t.Fatalf("Expected schemas for User, the user extension and StudentGroup, got %d", len(schemas))
+	}
+
+	user := schemas[0].Attributes
+	if a := findAttribute(user, "userName"); a == nil || !a.Required || a.Type != "string" {
+		t.Errorf("Unexpected userName attribute: %v", a)
+	}
+	if a := findAttribute(user, "emails"); a == nil || a.Required || !a.MultiValued || a.Type != "complex" {
+		t.Errorf("Unexpected emails attribute: %v", a)
+	}
+	if a := findAttribute(user, "name"); a == nil || findAttribute(a.SubAttributes, "givenName") == nil || !findAttribute(a.SubAttributes, "givenName").Required {
+		t.Errorf("Unexpected name attribute: %v", a)
+	}
+	if findAttribute(user, userExtensionURI) != nil {
+		t.Errorf("The extension should not be an attribute in the core schema")
+	}
+
+	if schemas[1].ID != userExtensionURI {
+		t.Fatalf("Expected user extension schema, got %s", schemas[1].ID)
+	}
+	enrolments := findAttribute(schemas[1].Attributes, "enrolments")
+	if enrolments == nil || !enrolments.MultiValued {
+		t.Fatalf("Unexpected enrolments attribute: %v", enrolments)
+	}
+	if a := findAttribute(enrolments.SubAttributes, "schoolYear"); a == nil || a.Type != "integer" || a.Required {
+		t.Errorf("Unexpected schoolYear attribute: %v", a)
+	}
+	if a := findAttribute(enrolments.SubAttributes, "$ref"); a == nil || a.Type != "reference" {
+		t.Errorf("Unexpected $ref attribute: %v", a)
+	}
+	if a := findAttribute(schemas[2].Attributes, "owner"); a == nil || !a.Required || a.Type != "complex" {
+		t.Errorf("Unexpected owner attribute: %v", a)
+	}
+}
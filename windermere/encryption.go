@@ -0,0 +1,413 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package windermere
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Environment variables with encryption keys, used when no key file is
+// configured (see LoadKeyring)
+const (
+	EnvStorageKey     = "WINDERMERE_STORAGE_KEY"
+	EnvStorageOldKeys = "WINDERMERE_STORAGE_OLD_KEYS"
+)
+
+const encryptionAlgorithm = "AES-256-GCM"
+
+// PlaintextPolicy decides whether encrypted storage may contain
+// unencrypted data, for instance from before encryption was configured
+type PlaintextPolicy int
+
+const (
+	// PlaintextUntilReencrypted reads unencrypted data, with a warning,
+	// until the storage has been re-encrypted with Reencrypt (for SQL
+	// storage, until no unencrypted data remains)
+	PlaintextUntilReencrypted PlaintextPolicy = iota
+	// PlaintextAllowed always reads unencrypted data, with a warning
+	PlaintextAllowed
+	// PlaintextRejected never reads unencrypted data
+	PlaintextRejected
+)
+
+// ParsePlaintextPolicy parses a plaintext policy from its name as used in
+// configuration files ("auto", "allow" or "reject")
+func ParsePlaintextPolicy(name string) (PlaintextPolicy, error) {
+	switch name {
+	case "auto":
+		return PlaintextUntilReencrypted, nil
+	case "allow":
+		return PlaintextAllowed, nil
+	case "reject":
+		return PlaintextRejected, nil
+	}
+	return 0, fmt.Errorf("unknown policy for unencrypted data: %s", name)
+}
+
+// Encrypted data is stored as JSON, starting with this prefix
+var envelopePrefix = []byte(`{"encryption":`)
+
+// Encrypted data. The data is encrypted with a random data key, which
+// in turn is encrypted with a storage key.
+type envelope struct {
+	Encryption string `json:"encryption"`
+	KeyID      string `json:"keyID"`
+	WrappedKey []byte `json:"wrappedKey"`
+	Data       []byte `json:"data"`
+}
+
+type storageKey struct {
+	id   string
+	aead cipher.AEAD
+}
+
+// A Keyring encrypts the data of storage at rest with envelope
+// encryption. It has a current key, used for encrypting, and possibly
+// older keys which are still accepted for decrypting (during rotation,
+// see Reencrypt). Unencrypted data is decrypted to itself, with a
+// warning, so existing storage is encrypted as it's written. Once storage
+// has been re-encrypted, unencrypted data is rejected instead (see
+// PlaintextPolicy).
+type Keyring struct {
+	current         *storageKey
+	keys            map[string]*storageKey
+	rejectPlaintext bool
+}
+
+// Returns an AES-256-GCM AEAD
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption keys must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// NewKeyring creates a keyring from base64 encoded 32 byte keys. The
+// first key is the current key.
+func NewKeyring(keys ...string) (*Keyring, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no encryption keys")
+	}
+
+	keyring := &Keyring{keys: make(map[string]*storageKey)}
+	for i, encoded := range keys {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %d: %v", i+1, err)
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key %d: %v", i+1, err)
+		}
+		hash := sha256.Sum256(key)
+		k := &storageKey{id: hex.EncodeToString(hash[:8]), aead: aead}
+		if i == 0 {
+			keyring.current = k
+		}
+		keyring.keys[k.id] = k
+	}
+	return keyring, nil
+}
+
+// LoadKeyring reads the encryption keys from keyFile, one base64 encoded
+// key per line with the current key first (empty lines and lines
+// starting with # are ignored). Without a key file the keys are read from
+// the environment variables WINDERMERE_STORAGE_KEY (the current key) and
+// WINDERMERE_STORAGE_OLD_KEYS (comma separated). Returns nil if no keys
+// are configured.
+func LoadKeyring(keyFile string) (*Keyring, error) {
+	var keys []string
+
+	if keyFile != "" {
+		f, err := os.Open(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read key file: %v", err)
+		}
+		defer f.Close()
+
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line != "" && !strings.HasPrefix(line, "#") {
+				keys = append(keys, line)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, fmt.Errorf("failed to read key file: %v", err)
+		}
+		if len(keys) == 0 {
+			return nil, fmt.Errorf("no keys in key file %s", keyFile)
+		}
+	} else if key := os.Getenv(EnvStorageKey); key != "" {
+		keys = append(keys, key)
+		for _, old := range strings.Split(os.Getenv(EnvStorageOldKeys), ",") {
+			if strings.TrimSpace(old) != "" {
+				keys = append(keys, old)
+			}
+		}
+	} else {
+		return nil, nil
+	}
+
+	return NewKeyring(keys...)
+}
+
+// Encrypts with a random nonce, which is prepended to the result
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// Decrypts the result of seal
+func unseal(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted data too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// Encode encrypts data with a new data key, which is encrypted with the
+// current key
+func (k *Keyring) Encode(data []byte) ([]byte, error) {
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	sealedData, err := seal(dataAEAD, data, nil)
+	if err != nil {
+		return nil, err
+	}
+	wrappedKey, err := seal(k.current.aead, dataKey, []byte(k.current.id))
+	if err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(envelope{
+		Encryption: encryptionAlgorithm,
+		KeyID:      k.current.id,
+		WrappedKey: wrappedKey,
+		Data:       sealedData,
+	})
+}
+
+// Returns a copy of the keyring which rejects unencrypted data
+func (k *Keyring) rejectingPlaintext() *Keyring {
+	strict := *k
+	strict.rejectPlaintext = true
+	return &strict
+}
+
+// Decode decrypts data encrypted with any of the keys, see DecodeFrom
+func (k *Keyring) Decode(data []byte) ([]byte, error) {
+	return k.DecodeFrom("data", data)
+}
+
+// DecodeFrom decrypts data read from source, encrypted with any of the
+// keys. Unencrypted data is returned as it is and a warning is logged,
+// unless the keyring rejects unencrypted data.
+func (k *Keyring) DecodeFrom(source string, data []byte) ([]byte, error) {
+	if !isEncrypted(data) {
+		if k.rejectPlaintext {
+			return nil, fmt.Errorf("%s isn't encrypted", source)
+		}
+		log.Printf("Warning: %s isn't encrypted", source)
+		return data, nil
+	}
+	return k.decrypt(data)
+}
+
+// Decrypts data which has been encrypted with any of the keys
+func (k *Keyring) decrypt(data []byte) ([]byte, error) {
+	var e envelope
+	if err := json.Unmarshal(data, &e); err != nil {
+		return nil, fmt.Errorf("invalid encrypted data: %v", err)
+	}
+	if e.Encryption != encryptionAlgorithm {
+		return nil, fmt.Errorf("unsupported encryption: %s", e.Encryption)
+	}
+
+	key, ok := k.keys[e.KeyID]
+	if !ok {
+		return nil, fmt.Errorf("data is encrypted with an unknown key (%s)", e.KeyID)
+	}
+
+	dataKey, err := unseal(key.aead, e.WrappedKey, []byte(e.KeyID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data key: %v", err)
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := unseal(dataAEAD, e.Data, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt data: %v", err)
+	}
+	return plaintext, nil
+}
+
+// Checks if data has been encrypted by a Keyring
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(bytes.TrimSpace(data), envelopePrefix)
+}
+
+// The codec for file storage without encryption keys, encrypted data
+// can't be read
+type unencrypted struct{}
+
+func (unencrypted) Encode(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (u unencrypted) Decode(data []byte) ([]byte, error) {
+	return u.DecodeFrom("data", data)
+}
+
+func (unencrypted) DecodeFrom(source string, data []byte) ([]byte, error) {
+	if isEncrypted(data) {
+		return nil, fmt.Errorf("%s is encrypted but no encryption key is configured", source)
+	}
+	return data, nil
+}
+
+// Reencrypt encrypts file storage with the current key of a keyring. The
+// files may be encrypted with older keys in the keyring, or unencrypted.
+// The file at path, its journal and, if tenantDirectory isn't empty, the
+// files in the tenant directory are rewritten. Windermere must not be
+// running meanwhile. Returns the number of files rewritten.
+//
+// Afterwards a marker file is written next to the file at path, and as
+// long as it exists unencrypted data is rejected (with the default
+// PlaintextUntilReencrypted policy).
+func Reencrypt(path, tenantDirectory string, keyring *Keyring) (int, error) {
+	paths := []string{path, journalPath(path)}
+
+	if tenantDirectory != "" {
+		entries, err := os.ReadDir(tenantDirectory)
+		if err != nil {
+			return 0, err
+		}
+		for _, entry := range entries {
+			name := entry.Name()
+			if entry.Type().IsRegular() && (strings.HasSuffix(name, ".json") || strings.HasSuffix(name, ".journal")) {
+				paths = append(paths, filepath.Join(tenantDirectory, name))
+			}
+		}
+	}
+
+	count := 0
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return count, err
+		}
+
+		if strings.HasSuffix(p, ".journal") {
+			data, err = reencryptLines(data, keyring)
+		} else {
+			data, err = reencrypt(data, keyring)
+		}
+		if err != nil {
+			return count, fmt.Errorf("failed to re-encrypt %s: %v", p, err)
+		}
+
+		if err = writeSnapshot(p, data); err != nil {
+			return count, err
+		}
+		count++
+	}
+
+	err := writeSnapshot(reencryptedMarkerPath(path), []byte("All files have been encrypted by windermere reencrypt, unencrypted files are rejected while this file exists.\n"))
+	return count, err
+}
+
+// The marker file written by Reencrypt is kept next to the file
+func reencryptedMarkerPath(path string) string {
+	return path + ".encrypted"
+}
+
+// Checks if file storage has been encrypted by Reencrypt
+func reencrypted(path string) bool {
+	_, err := os.Stat(reencryptedMarkerPath(path))
+	return err == nil
+}
+
+func reencrypt(data []byte, keyring *Keyring) ([]byte, error) {
+	plaintext := data
+	if isEncrypted(data) {
+		var err error
+		if plaintext, err = keyring.decrypt(data); err != nil {
+			return nil, err
+		}
+	}
+	return keyring.Encode(plaintext)
+}
+
+// Re-encrypts each line of a journal. A partially written last line is
+// dropped, just like when the journal is replayed.
+func reencryptLines(data []byte, keyring *Keyring) ([]byte, error) {
+	var result []byte
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			return result, nil
+		}
+		line := bytes.TrimSpace(data[:i])
+		data = data[i+1:]
+
+		if len(line) == 0 {
+			continue
+		}
+		line, err := reencrypt(line, keyring)
+		if err != nil {
+			return nil, err
+		}
+		result = append(append(result, line...), '\n')
+	}
+}
@@ -0,0 +1,319 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package windermere
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	scim "github.com/Sambruk/windermere/scimserverlite"
+	"github.com/Sambruk/windermere/ss12000v1"
+	"github.com/Sambruk/windermere/test"
+)
+
+func newTestKey(t *testing.T) string {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	test.Ensure(t, err)
+	return base64.StdEncoding.EncodeToString(key)
+}
+
+func TestKeyring(t *testing.T) {
+	oldKey, newKey := newTestKey(t), newTestKey(t)
+	oldKeyring, err := NewKeyring(oldKey)
+	test.Ensure(t, err)
+	keyring, err := NewKeyring(newKey, oldKey)
+	test.Ensure(t, err)
+
+	plaintext := []byte(`{"userName": "baje"}`)
+	encrypted, err := oldKeyring.Encode(plaintext)
+	test.Ensure(t, err)
+	if bytes.Contains(encrypted, []byte("baje")) || bytes.ContainsRune(encrypted, '\n') {
+		t.Errorf("unexpected encrypted data: %s", encrypted)
+	}
+
+	// Old keys can still be used for decrypting
+	decrypted, err := keyring.Decode(encrypted)
+	test.Ensure(t, err)
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("expected %s after decrypting, got %s", plaintext, decrypted)
+	}
+
+	// But not the other way around
+	encrypted, err = keyring.Encode(plaintext)
+	test.Ensure(t, err)
+	_, err = oldKeyring.Decode(encrypted)
+	test.MustFail(t, err)
+
+	tampered := bytes.Replace(encrypted, []byte(`"data":"`), []byte(`"data":"AA`), 1)
+	_, err = keyring.Decode(tampered)
+	test.MustFail(t, err)
+
+	// Unencrypted data is decrypted to itself
+	decrypted, err = keyring.Decode(plaintext)
+	test.Ensure(t, err)
+	if !bytes.Equal(decrypted, plaintext) {
+		t.Errorf("expected unencrypted data to be unchanged, got %s", decrypted)
+	}
+	_, err = keyring.rejectingPlaintext().Decode(plaintext)
+	test.MustFail(t, err)
+	_, err = keyring.rejectingPlaintext().Decode(encrypted)
+	test.Ensure(t, err)
+
+	_, err = NewKeyring("c2hvcnQ=")
+	test.MustFail(t, err)
+}
+
+func TestLoadKeyring(t *testing.T) {
+	key, oldKey := newTestKey(t), newTestKey(t)
+	keyFile := filepath.Join(t.TempDir(), "keys")
+	test.Ensure(t, os.WriteFile(keyFile, []byte("# Current key\n"+key+"\n\n"+oldKey+"\n"), 0600))
+
+	keyring, err := LoadKeyring(keyFile)
+	test.Ensure(t, err)
+	if keyring == nil || len(keyring.keys) != 2 {
+		t.Fatalf("expected two keys from key file, got %v", keyring)
+	}
+
+	t.Setenv(EnvStorageKey, key)
+	t.Setenv(EnvStorageOldKeys, "")
+	fromEnv, err := LoadKeyring("")
+	test.Ensure(t, err)
+	if fromEnv == nil || fromEnv.current.id != keyring.current.id {
+		t.Errorf("expected the same current key from the environment")
+	}
+
+	t.Setenv(EnvStorageKey, "")
+	if none, err := LoadKeyring(""); err != nil || none != nil {
+		t.Errorf("expected no keyring without keys, got %v, %v", none, err)
+	}
+}
+
+func TestEncryptedFileStorage(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "SS12000.json")
+	tenants := filepath.Join(dir, "tenants")
+	tenantGetter := func(c context.Context) string { return tenant1 }
+	validator := CreateOptionalValidator(false, false)
+	journal := WithJournal(JournalConfig{Enabled: true, Sync: scim.SyncAlways})
+
+	oldKey := newTestKey(t)
+	keyring, err := NewKeyring(oldKey)
+	test.Ensure(t, err)
+
+	w, err := New("file", path, tenantGetter, validator, journal, WithEncryption(keyring))
+	test.Ensure(t, err)
+	_, err = w.backend.Create(tenant1, "Users", bajeJSON)
+	test.Ensure(t, err)
+
+	// Journal entries are encrypted
+	data, err := os.ReadFile(journalPath(path))
+	test.Ensure(t, err)
+	if len(data) == 0 || !isEncrypted(data) || bytes.Contains(data, []byte("Baje")) {
+		t.Errorf("expected encrypted journal, got: %s", data)
+	}
+	test.Ensure(t, w.Shutdown())
+
+	data, err = os.ReadFile(path)
+	test.Ensure(t, err)
+	if !isEncrypted(data) || bytes.Contains(data, []byte("Baje")) {
+		t.Errorf("expected encrypted file, got: %s", data)
+	}
+
+	// Without the key the file can't be read
+	_, err = New("file", path, tenantGetter, validator)
+	if err == nil || !strings.Contains(err.Error(), "no encryption key") {
+		t.Errorf("expected failure without encryption key, got: %v", err)
+	}
+
+	// Rotate the key and migrate to a tenant directory
+	newKey := newTestKey(t)
+	keyring, err = NewKeyring(newKey, oldKey)
+	test.Ensure(t, err)
+	w, err = New("file", path, tenantGetter, validator, journal, WithEncryption(keyring), WithTenantDirectory(tenants))
+	test.Ensure(t, err)
+	test.Ensure(t, w.Shutdown())
+
+	count, err := Reencrypt(path, tenants, keyring)
+	test.Ensure(t, err)
+	if count != 1 {
+		t.Errorf("expected the tenant file to be re-encrypted, got %d files", count)
+	}
+
+	tenantFiles, err := filepath.Glob(filepath.Join(tenants, "*.json"))
+	test.Ensure(t, err)
+	if len(tenantFiles) != 1 {
+		t.Fatalf("expected one tenant file, got %v", tenantFiles)
+	}
+	data, err = os.ReadFile(tenantFiles[0])
+	test.Ensure(t, err)
+	oldKeyring, err := NewKeyring(oldKey)
+	test.Ensure(t, err)
+	_, err = oldKeyring.Decode(data)
+	test.MustFail(t, err)
+
+	keyring, err = NewKeyring(newKey)
+	test.Ensure(t, err)
+	w, err = New("file", path, tenantGetter, validator, journal, WithEncryption(keyring), WithTenantDirectory(tenants))
+	test.Ensure(t, err)
+	defer w.Shutdown()
+	if n := w.CountResources(tenant1, "Users"); n != 1 {
+		t.Errorf("expected the user to be readable with the new key only, got %d users", n)
+	}
+}
+
+func TestPlaintextPolicy(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "SS12000.json")
+	tenantGetter := func(c context.Context) string { return tenant1 }
+	validator := CreateOptionalValidator(false, false)
+	journal := WithJournal(JournalConfig{Enabled: true, Sync: scim.SyncAlways})
+
+	// Unencrypted storage, with the user in the journal
+	w, err := New("file", path, tenantGetter, validator, journal)
+	test.Ensure(t, err)
+	_, err = w.backend.Create(tenant1, "Users", bajeJSON)
+	test.Ensure(t, err)
+	w.journal.Close()
+	plaintext, err := os.ReadFile(journalPath(path))
+	test.Ensure(t, err)
+
+	keyring, err := NewKeyring(newTestKey(t))
+	test.Ensure(t, err)
+	encrypted := WithEncryption(keyring)
+
+	_, err = New("file", path, tenantGetter, validator, journal, encrypted, WithPlaintextPolicy(PlaintextRejected))
+	if err == nil || !strings.Contains(err.Error(), "line 1 isn't encrypted") {
+		t.Errorf("expected unencrypted journal to be rejected, got: %v", err)
+	}
+
+	var logged strings.Builder
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	w, err = New("file", path, tenantGetter, validator, journal, encrypted)
+	test.Ensure(t, err)
+	test.Ensure(t, w.Shutdown())
+	if !strings.Contains(logged.String(), "Warning: "+journalPath(path)+", line 1 isn't encrypted") {
+		t.Errorf("expected a warning about the unencrypted journal, got: %s", logged.String())
+	}
+
+	_, err = Reencrypt(path, "", keyring)
+	test.Ensure(t, err)
+
+	// Unencrypted data is rejected after re-encrypting, unless allowed
+	test.Ensure(t, os.WriteFile(journalPath(path), plaintext, 0600))
+	_, err = New("file", path, tenantGetter, validator, journal, encrypted)
+	test.MustFail(t, err)
+
+	w, err = New("file", path, tenantGetter, validator, journal, encrypted, WithPlaintextPolicy(PlaintextAllowed))
+	test.Ensure(t, err)
+	defer w.Shutdown()
+	if n := w.CountResources(tenant1, "Users"); n != 1 {
+		t.Errorf("expected the user from the unencrypted journal, got %d users", n)
+	}
+}
+
+func TestEncryptedSQLStorage(t *testing.T) {
+	f := startTest(t)
+
+	// A user stored before encryption was configured
+	_, err := f.b.Create(tenant1, "Users", bajeJSON)
+	test.Ensure(t, err)
+
+	oldKey := newTestKey(t)
+	keyring, err := NewKeyring(oldKey)
+	test.Ensure(t, err)
+	test.MustFail(t, f.b.UseEncryption(keyring, PlaintextRejected))
+	test.Ensure(t, f.b.UseEncryption(keyring, PlaintextUntilReencrypted))
+	_, err = f.b.GetResource(tenant1, "Users", baje.GetID())
+	test.Ensure(t, err)
+
+	var user ss12000v1.User
+	test.Ensure(t, json.Unmarshal([]byte(liniJSON), &user))
+	civicNo, guardianName := "201001012386", "Anna Andersson"
+	user.Extension.CivicNo = &civicNo
+	user.Extension.UserRelations = []ss12000v1.UserRelation{
+		{Value: baje.GetID(), RelationType: "Vårdnadshavare", DisplayName: &guardianName},
+	}
+	body, err := json.Marshal(&user)
+	test.Ensure(t, err)
+	_, err = f.b.Create(tenant1, "Users", string(body))
+	test.Ensure(t, err)
+
+	// The sensitive values can't be read in the database
+	var stored struct {
+		RawJSON string `db:"rawJSON"`
+		CivicNo string `db:"civicNo"`
+	}
+	test.Ensure(t, f.db.Get(&stored, f.db.Rebind(`SELECT rawJSON, civicNo FROM Users WHERE id = ?`), user.GetID()))
+	var relation string
+	test.Ensure(t, f.db.Get(&relation, f.db.Rebind(`SELECT displayName FROM UserRelations WHERE userId = ?`), user.GetID()))
+	for _, value := range []string{stored.RawJSON, stored.CivicNo, relation} {
+		if !isEncrypted([]byte(value)) || strings.Contains(value, civicNo) || strings.Contains(value, guardianName) {
+			t.Errorf("expected an encrypted value, got: %s", value)
+		}
+	}
+
+	// Filters on encrypted columns are evaluated in memory
+	filter, err := scim.ParseFilter(`urn:scim:schemas:extension:sis:school:1.0:User:civicNo eq "201001012386"`)
+	test.Ensure(t, err)
+	result, err := f.b.QueryResources(tenant1, "Users", &scim.Query{Filter: filter})
+	test.Ensure(t, err)
+	if len(result.Resources) != 1 || !strings.Contains(result.Resources[0].Resource, guardianName) {
+		t.Errorf("expected to find the user by civicNo, got: %v", result.Resources)
+	}
+
+	// The encrypted storage can't be used without the key
+	test.MustFail(t, (&SQLBackend{db: f.db}).ensureNotEncrypted())
+
+	// Rotate the key
+	newKey := newTestKey(t)
+	keyring, err = NewKeyring(newKey, oldKey)
+	test.Ensure(t, err)
+	count, err := ReencryptSQL(f.db, keyring)
+	test.Ensure(t, err)
+	if count != 2 {
+		t.Errorf("expected both users to be re-encrypted, got %d", count)
+	}
+
+	keyring, err = NewKeyring(newKey)
+	test.Ensure(t, err)
+	test.Ensure(t, f.b.UseEncryption(keyring, PlaintextUntilReencrypted))
+	resource, err := f.b.GetResource(tenant1, "Users", user.GetID())
+	test.Ensure(t, err)
+	if !strings.Contains(resource, civicNo) || !strings.Contains(resource, guardianName) {
+		t.Errorf("expected the user to be readable with the new key only, got: %s", resource)
+	}
+
+	// Once everything is encrypted, unencrypted values are rejected
+	_, err = f.db.Exec(f.db.Rebind(`UPDATE Users SET civicNo = ? WHERE id = ?`), civicNo, user.GetID())
+	test.Ensure(t, err)
+	_, err = f.b.GetResource(tenant1, "Users", user.GetID())
+	test.MustFail(t, err)
+}
@@ -7,6 +7,8 @@ import (
 	"net/http"
 	"path"
 	"strings"
+
+	"github.com/Sambruk/windermere/scimserverlite"
 )
 
 // This middleware takes care of a compatibility problem for Skolsynk for Google.
@@ -23,7 +25,7 @@ func putCompatibilityHandler(h http.Handler) http.Handler {
 			body, err := io.ReadAll(r.Body)
 			r.Body.Close()
 			if err != nil {
-				http.Error(w, "Failed to read HTTP body", http.StatusInternalServerError)
+				scimserverlite.WriteError(w, http.StatusInternalServerError, "", "Failed to read HTTP body")
 				return
 			}
 
@@ -35,7 +37,7 @@ func putCompatibilityHandler(h http.Handler) http.Handler {
 			err = json.Unmarshal(body, &parsed)
 
 			if err != nil {
-				http.Error(w, "Failed to parse body (also invalid PUT to resource type)", http.StatusBadRequest)
+				scimserverlite.WriteError(w, http.StatusBadRequest, "invalidSyntax", "Failed to parse body (also invalid PUT to resource type)")
 				return
 			}
 
@@ -47,7 +49,7 @@ func putCompatibilityHandler(h http.Handler) http.Handler {
 			}
 
 			if id == "" {
-				http.Error(w, "Invalid PUT to resource type didn't include id or externalId in body", http.StatusBadRequest)
+				scimserverlite.WriteError(w, http.StatusBadRequest, "invalidValue", "Invalid PUT to resource type didn't include id or externalId in body")
 				return
 			}
 
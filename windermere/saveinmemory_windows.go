@@ -2,17 +2,9 @@ package windermere
 
 import (
 	"os"
-
-	"github.com/Sambruk/windermere/scimserverlite"
 )
 
-// Saves the in-memory backend to file
-func saveSCIMBackend(backend *scimserverlite.InMemoryBackend, path string) error {
-	serializedForm, err := backend.Serialize()
-
-	if err != nil {
-		return err
-	}
-
+// Writes the serialized in-memory backend to file
+func writeSnapshot(path string, serializedForm []byte) error {
 	return os.WriteFile(path, serializedForm, 0600)
 }
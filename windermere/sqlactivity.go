@@ -23,7 +23,6 @@ import (
 	"fmt"
 
 	"github.com/Sambruk/windermere/ss12000v1"
-	"github.com/jmoiron/sqlx"
 )
 
 type dbActivityRow struct {
@@ -31,6 +30,7 @@ type dbActivityRow struct {
 	Id          string `db:"id"`
 	DisplayName string `db:"displayName"`
 	Owner       string `db:"owner"`
+	dbMeta
 }
 
 func NewActivityRow(tenant string, activity *ss12000v1.Activity) dbActivityRow {
@@ -54,7 +54,13 @@ type dbActivityGroupRow struct {
 	GroupId    string `db:"groupId"`
 }
 
-func (backend *SQLBackend) createTeachers(tx *sqlx.Tx, tenant string, activity *ss12000v1.Activity) (err error) {
+type dbActivityParentRow struct {
+	Tenant     string `db:"tenant"`
+	ActivityId string `db:"activityId"`
+	ParentId   string `db:"parentId"`
+}
+
+func (backend *SQLBackend) createTeachers(tx sqlTx, tenant string, activity *ss12000v1.Activity) (err error) {
 	if len(activity.Teachers) == 0 {
 		return nil
 	}
@@ -72,7 +78,7 @@ func (backend *SQLBackend) createTeachers(tx *sqlx.Tx, tenant string, activity *
 	return
 }
 
-func (backend *SQLBackend) createGroups(tx *sqlx.Tx, tenant string, activity *ss12000v1.Activity) (err error) {
+func (backend *SQLBackend) createGroups(tx sqlTx, tenant string, activity *ss12000v1.Activity) (err error) {
 	if len(activity.Groups) == 0 {
 		return nil
 	}
@@ -90,7 +96,25 @@ func (backend *SQLBackend) createGroups(tx *sqlx.Tx, tenant string, activity *ss
 	return
 }
 
-func (backend *SQLBackend) activityCreator(tx *sqlx.Tx, tenant string, activity *ss12000v1.Activity) (id string, err error) {
+func (backend *SQLBackend) createParentActivities(tx sqlTx, tenant string, activity *ss12000v1.Activity) (err error) {
+	if len(activity.ParentActivity) == 0 {
+		return nil
+	}
+	dbParents := make([]dbActivityParentRow, len(activity.ParentActivity))
+
+	for i := range activity.ParentActivity {
+		dbParents[i] = dbActivityParentRow{
+			Tenant:     tenant,
+			ActivityId: activity.GetID(),
+			ParentId:   activity.ParentActivity[i].Value,
+		}
+	}
+
+	_, err = tx.NamedExec(`INSERT INTO ActivityParents (tenant, activityId, parentId) VALUES (:tenant, :activityId, :parentId)`, dbParents)
+	return
+}
+
+func (backend *SQLBackend) activityCreator(tx sqlTx, tenant string, activity *ss12000v1.Activity) (id string, err error) {
 	dbActivity := NewActivityRow(tenant, activity)
 
 	_, err = tx.NamedExec(`INSERT INTO Activities (tenant, id, displayName, owner) VALUES (:tenant, :id, :displayName, :owner)`, &dbActivity)
@@ -104,10 +128,15 @@ func (backend *SQLBackend) activityCreator(tx *sqlx.Tx, tenant string, activity
 	}
 
 	err = backend.createGroups(tx, tenant, activity)
+	if err != nil {
+		return "", err
+	}
+
+	err = backend.createParentActivities(tx, tenant, activity)
 	return activity.GetID(), err
 }
 
-func (backend *SQLBackend) activityMutator(tx *sqlx.Tx, tenant string, activity *ss12000v1.Activity) (err error) {
+func (backend *SQLBackend) activityMutator(tx sqlTx, tenant string, activity *ss12000v1.Activity) (err error) {
 	dbActivity := NewActivityRow(tenant, activity)
 
 	_, err = tx.NamedExec(`UPDATE Activities SET displayName = :displayName, owner = :owner WHERE tenant = :tenant AND id = :id`, &dbActivity)
@@ -141,10 +170,26 @@ func (backend *SQLBackend) activityMutator(tx *sqlx.Tx, tenant string, activity
 		return err
 	}
 
-	return backend.createGroups(tx, tenant, activity)
+	err = backend.createGroups(tx, tenant, activity)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.NamedExec(`DELETE FROM ActivityParents WHERE tenant = :tenant AND activityId = :activityId`,
+		map[string]interface{}{
+			"tenant":     tenant,
+			"activityId": activity.GetID(),
+		})
+
+	if err != nil {
+		return err
+	}
+
+	return backend.createParentActivities(tx, tenant, activity)
 }
 
-func (backend *SQLBackend) activityReader(tx *sqlx.Tx, mainQuery, teacherQuery, groupQuery string, args map[string]interface{}) ([]ss12000v1.Object, error) {
+func (backend *SQLBackend) activityReader(tx sqlTx, mainQuery, teacherQuery, groupQuery, parentQuery string, args map[string]interface{}) ([]ss12000v1.Object, error) {
 	mainNamed, err := tx.PrepareNamed(mainQuery)
 	if err != nil {
 		return nil, err
@@ -157,6 +202,10 @@ func (backend *SQLBackend) activityReader(tx *sqlx.Tx, mainQuery, teacherQuery,
 	if err != nil {
 		return nil, err
 	}
+	parentNamed, err := tx.PrepareNamed(parentQuery)
+	if err != nil {
+		return nil, err
+	}
 
 	dbActivities := []dbActivityRow{}
 	err = mainNamed.Select(&dbActivities, args)
@@ -173,6 +222,7 @@ func (backend *SQLBackend) activityReader(tx *sqlx.Tx, mainQuery, teacherQuery,
 			Owner: ss12000v1.SCIMReference{
 				Value: dbActivities[i].Owner,
 			},
+			SCIMResource: ss12000v1.SCIMResource{Meta: dbActivities[i].scimMeta()},
 		}
 		index[dbActivities[i].Id] = i
 	}
@@ -205,22 +255,46 @@ func (backend *SQLBackend) activityReader(tx *sqlx.Tx, mainQuery, teacherQuery,
 		})
 	}
 
+	dbParents := []dbActivityParentRow{}
+	err = parentNamed.Select(&dbParents, args)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range dbParents {
+		parent := &dbParents[i]
+		activity := activities[index[parent.ActivityId]].(*ss12000v1.Activity)
+		activity.ParentActivity = append(activity.ParentActivity, ss12000v1.SCIMReference{
+			Value: parent.ParentId,
+		})
+	}
+
 	return activities, nil
 }
 
-func (backend *SQLBackend) activityReaderAll(tx *sqlx.Tx, tenant string) ([]ss12000v1.Object, error) {
+func (backend *SQLBackend) activityReaderAll(tx sqlTx, tenant string) ([]ss12000v1.Object, error) {
 	return backend.activityReader(tx, `SELECT * FROM Activities WHERE tenant = :tenant`,
 		`SELECT * FROM ActivityTeachers WHERE tenant = :tenant`,
 		`SELECT * FROM ActivityGroups WHERE tenant = :tenant`,
+		`SELECT * FROM ActivityParents WHERE tenant = :tenant`,
 		map[string]interface{}{
 			"tenant": tenant,
 		})
 }
 
-func (backend *SQLBackend) activityReaderOne(tx *sqlx.Tx, tenant, id string) (ss12000v1.Object, error) {
+func (backend *SQLBackend) activityReaderSelected(tx sqlTx, selection sqlSelection, args map[string]interface{}) ([]ss12000v1.Object, error) {
+	return backend.activityReader(tx, `SELECT * FROM Activities WHERE tenant = :tenant AND (`+selection.where+`) ORDER BY `+selection.order+selection.paging,
+		`SELECT * FROM ActivityTeachers WHERE tenant = :tenant AND activityId IN (`+selection.ids("Activities")+`)`,
+		`SELECT * FROM ActivityGroups WHERE tenant = :tenant AND activityId IN (`+selection.ids("Activities")+`)`,
+		`SELECT * FROM ActivityParents WHERE tenant = :tenant AND activityId IN (`+selection.ids("Activities")+`)`,
+		args)
+}
+
+func (backend *SQLBackend) activityReaderOne(tx sqlTx, tenant, id string) (ss12000v1.Object, error) {
 	activities, err := backend.activityReader(tx, `SELECT * FROM Activities WHERE tenant = :tenant AND id = :id`,
 		`SELECT * FROM ActivityTeachers WHERE tenant = :tenant AND activityId = :id`,
 		`SELECT * FROM ActivityGroups WHERE tenant = :tenant AND activityId = :id`,
+		`SELECT * FROM ActivityParents WHERE tenant = :tenant AND activityId = :id`,
 		map[string]interface{}{
 			"tenant": tenant,
 			"id":     id,
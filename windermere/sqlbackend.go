@@ -20,17 +20,19 @@
 package windermere
 
 import (
+	"context"
 	"database/sql"
-	"encoding/json"
 	"fmt"
 	"log"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/Sambruk/windermere/scimserverlite"
 	scim "github.com/Sambruk/windermere/scimserverlite"
 	"github.com/Sambruk/windermere/ss12000v1"
 	"github.com/jmoiron/sqlx"
+	"github.com/jmoiron/sqlx/reflectx"
 )
 
 type ObjectParser func(resourceType, resource string) (ss12000v1.Object, error)
@@ -39,11 +41,72 @@ type ObjectParser func(resourceType, resource string) (ss12000v1.Object, error)
 type SQLBackend struct {
 	db           *sqlx.DB
 	objectParser ObjectParser
+	config       SQLConfig
+	keyring      *Keyring // encrypts the encrypted columns, if set
 }
 
-// NewSQLBackend creates a new SQLBackend
+// SQLConfig configures the connection pool and how an SQLBackend
+// handles a database which can't be reached
+type SQLConfig struct {
+	MaxOpenConns        int           // Maximum number of open connections, 0 means no limit
+	MaxIdleConns        int           // Maximum number of idle connections
+	ConnMaxLifetime     time.Duration // Connections are closed when they are this old, 0 means never
+	ConnMaxIdleTime     time.Duration // Connections are closed when idle this long, 0 means never
+	ConnectRetries      int           // How many times to retry connecting at startup, 0 means forever
+	ConnectRetryWait    time.Duration // Wait before the first retry, doubled for each retry (at least a second)
+	ConnectMaxRetryWait time.Duration // Longest wait between retries, 0 means no limit
+	QueryTimeout        time.Duration // Time limit for the database work of an operation, 0 means none
+	RetryAfter          time.Duration // How long clients should wait when the database is unavailable
+}
+
+// DefaultSQLConfig returns the configuration used by NewSQLBackend
+func DefaultSQLConfig() SQLConfig {
+	return SQLConfig{
+		// Recommended by the MySQL driver documentation
+		MaxOpenConns:        10,
+		MaxIdleConns:        10,
+		ConnMaxLifetime:     3 * time.Minute,
+		ConnectRetryWait:    5 * time.Second,
+		ConnectMaxRetryWait: time.Minute,
+		RetryAfter:          5 * time.Second,
+	}
+}
+
+// Returns how long to wait before the next attempt to connect, given
+// the previous wait (0 before the first retry). A configured wait of 0
+// would retry in a busy loop, so the wait is at least a second.
+func (c SQLConfig) connectRetryWait(previous time.Duration) time.Duration {
+	wait := c.ConnectRetryWait
+	if previous > 0 {
+		wait = previous * 2
+		if c.ConnectMaxRetryWait > 0 && wait > c.ConnectMaxRetryWait {
+			wait = c.ConnectMaxRetryWait
+		}
+	}
+	if wait <= 0 {
+		wait = time.Second
+	}
+	return wait
+}
+
+// SetPool configures the connection pool of db
+func (c SQLConfig) SetPool(db *sqlx.DB) {
+	db.SetMaxOpenConns(c.MaxOpenConns)
+	db.SetMaxIdleConns(c.MaxIdleConns)
+	db.SetConnMaxLifetime(c.ConnMaxLifetime)
+	db.SetConnMaxIdleTime(c.ConnMaxIdleTime)
+}
+
+// NewSQLBackend creates a new SQLBackend with the default configuration
+// (except for the connection pool which is left as it is)
 func NewSQLBackend(d *sqlx.DB, op ObjectParser) (backend *SQLBackend, err error) {
-	backend = &SQLBackend{db: d, objectParser: op}
+	return NewSQLBackendWithConfig(d, op, DefaultSQLConfig())
+}
+
+// NewSQLBackendWithConfig creates a new SQLBackend. The connection pool
+// isn't configured, see SQLConfig.SetPool.
+func NewSQLBackendWithConfig(d *sqlx.DB, op ObjectParser, config SQLConfig) (backend *SQLBackend, err error) {
+	backend = &SQLBackend{db: d, objectParser: op, config: config}
 	err = backend.initSchema()
 	if err != nil {
 		return nil, err
@@ -51,12 +114,12 @@ func NewSQLBackend(d *sqlx.DB, op ObjectParser) (backend *SQLBackend, err error)
 	return
 }
 
-func getDBVersion(db *sqlx.DB) int {
+func getDBVersion(q sqlx.QueryerContext) int {
 	type version struct {
 		Version int `db:"version"`
 	}
 	var v version
-	err := db.Get(&v, "SELECT version FROM windermere_meta")
+	err := sqlx.GetContext(context.Background(), q, &v, "SELECT version FROM windermere_meta")
 	if err != nil {
 		return 0
 	}
@@ -225,6 +288,160 @@ var migrations = [...]string{
 
 	CREATE INDEX ActivityGroupsIdx ON ActivityGroups (tenant, activityId);
 	`,
+	// Resource meta data (created, lastModified and version). Timestamps are
+	// stored as text in the format used in SCIM (UTC with milliseconds) so
+	// they can be compared as strings, and read back the same way with all
+	// drivers. Resources created before this migration have NULL meta data
+	// until they are modified.
+	`
+	ALTER TABLE Users ADD created VARCHAR(30) NULL;
+	ALTER TABLE Users ADD lastModified VARCHAR(30) NULL;
+	ALTER TABLE Users ADD version VARCHAR(64) NULL;
+
+	ALTER TABLE StudentGroups ADD created VARCHAR(30) NULL;
+	ALTER TABLE StudentGroups ADD lastModified VARCHAR(30) NULL;
+	ALTER TABLE StudentGroups ADD version VARCHAR(64) NULL;
+
+	ALTER TABLE Organisations ADD created VARCHAR(30) NULL;
+	ALTER TABLE Organisations ADD lastModified VARCHAR(30) NULL;
+	ALTER TABLE Organisations ADD version VARCHAR(64) NULL;
+
+	ALTER TABLE SchoolUnitGroups ADD created VARCHAR(30) NULL;
+	ALTER TABLE SchoolUnitGroups ADD lastModified VARCHAR(30) NULL;
+	ALTER TABLE SchoolUnitGroups ADD version VARCHAR(64) NULL;
+
+	ALTER TABLE SchoolUnits ADD created VARCHAR(30) NULL;
+	ALTER TABLE SchoolUnits ADD lastModified VARCHAR(30) NULL;
+	ALTER TABLE SchoolUnits ADD version VARCHAR(64) NULL;
+
+	ALTER TABLE Employments ADD created VARCHAR(30) NULL;
+	ALTER TABLE Employments ADD lastModified VARCHAR(30) NULL;
+	ALTER TABLE Employments ADD version VARCHAR(64) NULL;
+
+	ALTER TABLE Activities ADD created VARCHAR(30) NULL;
+	ALTER TABLE Activities ADD lastModified VARCHAR(30) NULL;
+	ALTER TABLE Activities ADD version VARCHAR(64) NULL;
+	`,
+	// Attributes from the SS12000 user extension which weren't stored
+	// before. securityMarking is stored as 0/1 since there's no boolean
+	// type common to all databases.
+	`
+	ALTER TABLE Users ADD civicNo {{NTEXT}} NULL;
+	ALTER TABLE Users ADD securityMarking TINYINT NULL;
+
+	ALTER TABLE Enrolments ADD schoolType {{NTEXT}} NULL;
+	ALTER TABLE Enrolments ADD programCode {{NTEXT}} NULL;
+
+	CREATE TABLE UserRelations (
+		tenant {{NVARCHAR}}(255) NOT NULL,
+		userId VARCHAR(36) NOT NULL,
+		value VARCHAR(36) NOT NULL,
+		relationType {{NTEXT}} NOT NULL,
+		displayName {{NTEXT}} NULL,
+		FOREIGN KEY (tenant, userId) REFERENCES Users(tenant, id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX UserRelationsIdx ON UserRelations (tenant, userId);
+	`,
+	// StudentGroup.schoolType and Activity.parentActivity
+	`
+	ALTER TABLE StudentGroups ADD schoolType {{NTEXT}} NULL;
+
+	CREATE TABLE ActivityParents (
+		tenant {{NVARCHAR}}(255) NOT NULL,
+		activityId VARCHAR(36) NOT NULL,
+		parentId VARCHAR(36) NOT NULL,
+		FOREIGN KEY (tenant, activityId) REFERENCES Activities(tenant, id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX ActivityParentsIdx ON ActivityParents (tenant, activityId);
+	`,
+	// The resource JSON as sent by the client, so attributes without
+	// columns aren't lost
+	`
+	ALTER TABLE Users ADD rawJSON {{NTEXT}} NULL;
+	ALTER TABLE StudentGroups ADD rawJSON {{NTEXT}} NULL;
+	ALTER TABLE Organisations ADD rawJSON {{NTEXT}} NULL;
+	ALTER TABLE SchoolUnitGroups ADD rawJSON {{NTEXT}} NULL;
+	ALTER TABLE SchoolUnits ADD rawJSON {{NTEXT}} NULL;
+	ALTER TABLE Employments ADD rawJSON {{NTEXT}} NULL;
+	ALTER TABLE Activities ADD rawJSON {{NTEXT}} NULL;
+	`,
+}
+
+// downMigrations undo the migrations with the same index, so the schema
+// can be downgraded to run an older version of Windermere. Columns are
+// dropped one at a time since SQLite can't drop several in one statement,
+// and indexes are dropped together with their tables.
+var downMigrations = [len(migrations)]string{
+	`
+	DROP TABLE ActivityGroups;
+	DROP TABLE ActivityTeachers;
+	DROP TABLE Activities;
+	DROP TABLE Employments;
+	DROP TABLE SchoolTypes;
+	DROP TABLE SchoolUnits;
+	DROP TABLE SchoolUnitGroups;
+	DROP TABLE Organisations;
+	DROP TABLE StudentMemberships;
+	DROP TABLE StudentGroups;
+	DROP TABLE Enrolments;
+	DROP TABLE Emails;
+	DROP TABLE Users;
+	DROP TABLE windermere_meta;
+	`,
+	`
+	ALTER TABLE Users DROP COLUMN created;
+	ALTER TABLE Users DROP COLUMN lastModified;
+	ALTER TABLE Users DROP COLUMN version;
+
+	ALTER TABLE StudentGroups DROP COLUMN created;
+	ALTER TABLE StudentGroups DROP COLUMN lastModified;
+	ALTER TABLE StudentGroups DROP COLUMN version;
+
+	ALTER TABLE Organisations DROP COLUMN created;
+	ALTER TABLE Organisations DROP COLUMN lastModified;
+	ALTER TABLE Organisations DROP COLUMN version;
+
+	ALTER TABLE SchoolUnitGroups DROP COLUMN created;
+	ALTER TABLE SchoolUnitGroups DROP COLUMN lastModified;
+	ALTER TABLE SchoolUnitGroups DROP COLUMN version;
+
+	ALTER TABLE SchoolUnits DROP COLUMN created;
+	ALTER TABLE SchoolUnits DROP COLUMN lastModified;
+	ALTER TABLE SchoolUnits DROP COLUMN version;
+
+	ALTER TABLE Employments DROP COLUMN created;
+	ALTER TABLE Employments DROP COLUMN lastModified;
+	ALTER TABLE Employments DROP COLUMN version;
+
+	ALTER TABLE Activities DROP COLUMN created;
+	ALTER TABLE Activities DROP COLUMN lastModified;
+	ALTER TABLE Activities DROP COLUMN version;
+	`,
+	`
+	DROP TABLE UserRelations;
+
+	ALTER TABLE Enrolments DROP COLUMN programCode;
+	ALTER TABLE Enrolments DROP COLUMN schoolType;
+
+	ALTER TABLE Users DROP COLUMN securityMarking;
+	ALTER TABLE Users DROP COLUMN civicNo;
+	`,
+	`
+	DROP TABLE ActivityParents;
+
+	ALTER TABLE StudentGroups DROP COLUMN schoolType;
+	`,
+	`
+	ALTER TABLE Users DROP COLUMN rawJSON;
+	ALTER TABLE StudentGroups DROP COLUMN rawJSON;
+	ALTER TABLE Organisations DROP COLUMN rawJSON;
+	ALTER TABLE SchoolUnitGroups DROP COLUMN rawJSON;
+	ALTER TABLE SchoolUnits DROP COLUMN rawJSON;
+	ALTER TABLE Employments DROP COLUMN rawJSON;
+	ALTER TABLE Activities DROP COLUMN rawJSON;
+	`,
 }
 
 func currentSchemaVersion() int {
@@ -235,10 +452,21 @@ func getSchema(version int) string {
 	return migrations[version-1]
 }
 
+// Returns the SQL which undoes the migration to version
+func getDownSchema(version int) string {
+	return downMigrations[version-1]
+}
+
 func driverSpecificInit(db *sqlx.DB) error {
-	if db.DriverName() == "sqlite" {
+	switch db.DriverName() {
+	case "sqlite":
 		_, err := db.Exec(`PRAGMA foreign_keys = ON;`)
 		return err
+	case "postgres":
+		// PostgreSQL folds unquoted identifiers to lower case, so the
+		// column names we get back don't match the struct tags.
+		// (Named parameters are rebound to $n by sqlx for this driver.)
+		db.Mapper = reflectx.NewMapperTagFunc("db", strings.ToLower, strings.ToLower)
 	}
 	return nil
 }
@@ -251,11 +479,20 @@ func expandDriverSpecificTypes(driverName, schema string) string {
 	// Default expansion simply removes curly brackets
 	expander := removeCurlies
 
-	if driverName == "mysql" {
+	removeN := func(schema string) string {
+		re := regexp.MustCompile(`{{N(.*?)}}`)
+		return removeCurlies(string(re.ReplaceAll([]byte(schema), []byte("$1"))))
+	}
+
+	switch driverName {
+	case "mysql":
 		// For MySQL we'll replace NTEXT and NVARCHAR with TEXT and VARCHAR
+		expander = removeN
+	case "postgres":
+		// Same for PostgreSQL, which also lacks TINYINT
 		expander = func(schema string) string {
-			re := regexp.MustCompile(`{{N(.*?)}}`)
-			return removeCurlies(string(re.ReplaceAll([]byte(schema), []byte("$1"))))
+			re := regexp.MustCompile(`\bTINYINT\b`)
+			return removeN(string(re.ReplaceAll([]byte(schema), []byte("SMALLINT"))))
 		}
 	}
 	return expander(schema)
@@ -264,49 +501,29 @@ func expandDriverSpecificTypes(driverName, schema string) string {
 func (backend *SQLBackend) initSchema() error {
 	// Ensure we have a working connection since any error in
 	// getDBVersion is interpreted as an uninitialized database.
-	const waitTime = 5 * time.Second
-	for err := backend.db.Ping(); err != nil; err = backend.db.Ping() {
+	waitTime := backend.config.connectRetryWait(0)
+	for retries := 0; ; retries++ {
+		err := backend.db.Ping()
+		if err == nil {
+			break
+		}
 		log.Printf("Failed to connect to database: %v", err)
-		log.Printf("Will retry in %d seconds", waitTime/time.Second)
+		if backend.config.ConnectRetries > 0 && retries >= backend.config.ConnectRetries {
+			return fmt.Errorf("giving up connecting to database after %d retries: %v", retries, err)
+		}
+		log.Printf("Will retry in %v", waitTime)
 		time.Sleep(waitTime)
+		waitTime = backend.config.connectRetryWait(waitTime)
 	}
 	if err := driverSpecificInit(backend.db); err != nil {
 		return err
 	}
-	version := getDBVersion(backend.db)
-
-	if version > currentSchemaVersion() {
-		return fmt.Errorf("database schema is newer than this version of Windermere. Please perform a database schema downgrade if you wish to continue with this version of Windermere.")
-	}
-
-	tx, err := backend.db.Beginx()
-
-	if err != nil {
-		return err
-	}
 
-	defer tx.Rollback()
-	// loop over all migrations in order and apply those with higher
-	// version than current
-	for i := version + 1; i <= currentSchemaVersion(); i++ {
-		_, err = tx.Exec(expandDriverSpecificTypes(backend.db.DriverName(), getSchema(i)))
-		if err != nil {
-			return err
-		}
-	}
-
-	// Set the current schema version
-	tx.NamedExec(`UPDATE windermere_meta SET version = :version`, map[string]interface{}{"version": currentSchemaVersion()})
-
-	err = tx.Commit()
-	if err != nil {
-		return err
-	}
-
-	return nil
+	_, err := migrateSchema(backend.db, currentSchemaVersion(), false)
+	return err
 }
 
-func (backend *SQLBackend) objectCreator(tx *sqlx.Tx, tenant string, obj interface{}) (id string, err error) {
+func (backend *SQLBackend) objectCreator(tx sqlTx, tenant string, obj interface{}) (id string, err error) {
 	switch v := obj.(type) {
 	case *ss12000v1.User:
 		return backend.userCreator(tx, tenant, v)
@@ -327,7 +544,7 @@ func (backend *SQLBackend) objectCreator(tx *sqlx.Tx, tenant string, obj interfa
 	}
 }
 
-func (backend *SQLBackend) objectMutator(tx *sqlx.Tx, tenant string, obj interface{}) (err error) {
+func (backend *SQLBackend) objectMutator(tx sqlTx, tenant string, obj interface{}) (err error) {
 	switch v := obj.(type) {
 	case *ss12000v1.User:
 		return backend.userMutator(tx, tenant, v)
@@ -348,7 +565,7 @@ func (backend *SQLBackend) objectMutator(tx *sqlx.Tx, tenant string, obj interfa
 	}
 }
 
-func (backend *SQLBackend) objectReaderAll(tx *sqlx.Tx, resourceType, tenant string) ([]ss12000v1.Object, error) {
+func (backend *SQLBackend) objectReaderAll(tx sqlTx, resourceType, tenant string) ([]ss12000v1.Object, error) {
 	switch resourceType {
 	case "Users":
 		return backend.userReaderAll(tx, tenant)
@@ -370,7 +587,30 @@ func (backend *SQLBackend) objectReaderAll(tx *sqlx.Tx, resourceType, tenant str
 
 }
 
-func (backend *SQLBackend) objectReaderOne(tx *sqlx.Tx, resourceType, tenant, id string) (ss12000v1.Object, error) {
+// Reads the objects in a selection, args must contain the tenant and
+// any parameters used in the selection.
+func (backend *SQLBackend) objectReaderSelected(tx sqlTx, resourceType string, selection sqlSelection, args map[string]interface{}) ([]ss12000v1.Object, error) {
+	switch resourceType {
+	case "Users":
+		return backend.userReaderSelected(tx, selection, args)
+	case "StudentGroups":
+		return backend.studentGroupReaderSelected(tx, selection, args)
+	case "Organisations":
+		return backend.organisationReaderSelected(tx, selection, args)
+	case "SchoolUnitGroups":
+		return backend.schoolUnitGroupReaderSelected(tx, selection, args)
+	case "SchoolUnits":
+		return backend.schoolUnitReaderSelected(tx, selection, args)
+	case "Employments":
+		return backend.employmentReaderSelected(tx, selection, args)
+	case "Activities":
+		return backend.activityReaderSelected(tx, selection, args)
+	default:
+		return nil, fmt.Errorf("failed to read unknown type: %s", resourceType)
+	}
+}
+
+func (backend *SQLBackend) objectReaderOne(tx sqlTx, resourceType, tenant, id string) (ss12000v1.Object, error) {
 	switch resourceType {
 	case "Users":
 		return backend.userReaderOne(tx, tenant, id)
@@ -392,103 +632,294 @@ func (backend *SQLBackend) objectReaderOne(tx *sqlx.Tx, resourceType, tenant, id
 }
 
 func (backend *SQLBackend) Create(tenant, resourceType, resource string) (string, error) {
+	return backend.CreateContext(context.Background(), tenant, resourceType, resource)
+}
+
+func (backend *SQLBackend) CreateContext(ctx context.Context, tenant, resourceType, resource string) (string, error) {
+	var created string
+	err := backend.BatchContext(ctx, tenant, func(b scim.BatchModifier) (err error) {
+		_, created, err = b.Create(resourceType, resource)
+		return
+	})
+	return created, err
+}
+
+func (backend *SQLBackend) Update(tenant, resourceType, resourceID, resource string) (string, error) {
+	return backend.UpdateIfMatchContext(context.Background(), tenant, resourceType, resourceID, resource, nil)
+}
+
+func (backend *SQLBackend) UpdateContext(ctx context.Context, tenant, resourceType, resourceID, resource string) (string, error) {
+	return backend.UpdateIfMatchContext(ctx, tenant, resourceType, resourceID, resource, nil)
+}
+
+// UpdateIfMatch updates an object if its current version matches ifMatch
+func (backend *SQLBackend) UpdateIfMatch(tenant, resourceType, resourceID, resource string, ifMatch *scim.Precondition) (string, error) {
+	return backend.UpdateIfMatchContext(context.Background(), tenant, resourceType, resourceID, resource, ifMatch)
+}
+
+func (backend *SQLBackend) UpdateIfMatchContext(ctx context.Context, tenant, resourceType, resourceID, resource string, ifMatch *scim.Precondition) (string, error) {
+	var updated string
+	err := backend.BatchContext(ctx, tenant, func(b scim.BatchModifier) (err error) {
+		updated, err = b.Update(resourceType, resourceID, resource, ifMatch)
+		return
+	})
+	return updated, err
+}
+
+func (backend *SQLBackend) Patch(tenant, resourceType, resourceID string, patch *scim.PatchRequest) (string, error) {
+	return backend.PatchContext(context.Background(), tenant, resourceType, resourceID, patch)
+}
+
+func (backend *SQLBackend) PatchContext(ctx context.Context, tenant, resourceType, resourceID string, patch *scim.PatchRequest) (string, error) {
+	var patched string
+	err := backend.BatchContext(ctx, tenant, func(b scim.BatchModifier) (err error) {
+		patched, err = b.Patch(resourceType, resourceID, patch, nil)
+		return
+	})
+	return patched, err
+}
+
+func (backend *SQLBackend) Delete(tenant, resourceType, resourceID string) error {
+	return backend.DeleteIfMatchContext(context.Background(), tenant, resourceType, resourceID, nil)
+}
+
+func (backend *SQLBackend) DeleteContext(ctx context.Context, tenant, resourceType, resourceID string) error {
+	return backend.DeleteIfMatchContext(ctx, tenant, resourceType, resourceID, nil)
+}
+
+// DeleteIfMatch deletes an object if its current version matches ifMatch
+func (backend *SQLBackend) DeleteIfMatch(tenant, resourceType, resourceID string, ifMatch *scim.Precondition) error {
+	return backend.DeleteIfMatchContext(context.Background(), tenant, resourceType, resourceID, ifMatch)
+}
+
+func (backend *SQLBackend) DeleteIfMatchContext(ctx context.Context, tenant, resourceType, resourceID string, ifMatch *scim.Precondition) error {
+	return backend.BatchContext(ctx, tenant, func(b scim.BatchModifier) error {
+		return b.Delete(resourceType, resourceID, ifMatch)
+	})
+}
+
+// Starts a transaction for an operation, limited by the operation's
+// context and the configured query timeout. cancel must be called when
+// the transaction is done.
+func (backend *SQLBackend) beginx(ctx context.Context) (sqlTx, context.CancelFunc, error) {
+	cancel := context.CancelFunc(func() {})
+	if backend.config.QueryTimeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, backend.config.QueryTimeout)
+	}
+	tx, err := backend.db.BeginTxx(ctx, nil)
+	if err != nil {
+		cancel()
+		return sqlTx{}, nil, err
+	}
+	return sqlTx{Tx: tx, ctx: ctx}, cancel, nil
+}
+
+// Batch applies several modifications in one transaction. All
+// modifications are rolled back if apply returns an error.
+func (backend *SQLBackend) Batch(tenant string, apply func(scim.BatchModifier) error) error {
+	return backend.BatchContext(context.Background(), tenant, apply)
+}
+
+func (backend *SQLBackend) BatchContext(ctx context.Context, tenant string, apply func(scim.BatchModifier) error) error {
+	return backend.unavailable(backend.batch(ctx, tenant, apply))
+}
+
+func (backend *SQLBackend) batch(ctx context.Context, tenant string, apply func(scim.BatchModifier) error) error {
+	tx, cancel, err := backend.beginx(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer cancel()
+	defer tx.Rollback()
+
+	err = apply(&sqlBatch{backend: backend, tx: tx, tenant: tenant})
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// The BatchModifier for SQLBackend, all modifications are done in one transaction
+type sqlBatch struct {
+	backend *SQLBackend
+	tx      sqlTx
+	tenant  string
+}
+
+func (b *sqlBatch) Create(resourceType, resource string) (string, string, error) {
 	table, err := mainTable(resourceType)
 
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	obj, err := backend.objectParser(resourceType, resource)
+	obj, err := b.backend.objectParser(resourceType, resource)
 
 	if err != nil {
-		return "", scim.NewError(scim.MalformedResourceError, "Failed to parse resource:\n"+err.Error())
+		return "", "", scim.NewError(scim.MalformedResourceError, "Failed to parse resource:\n"+err.Error())
 	}
 
-	tx, err := backend.db.Beginx()
+	err = ensureDoesntHaveRecord(b.tx, table, b.tenant, obj.GetID())
+	if err != nil {
+		return "", "", err
+	}
+
+	_, err = b.backend.objectCreator(b.tx, b.tenant, obj)
 
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	defer tx.Rollback()
+	err = b.backend.touchObject(b.tx, table, b.tenant, obj, resource, true, time.Now())
+
+	if err != nil {
+		return "", "", err
+	}
+
+	created, err := b.readBack(resourceType, obj.GetID())
+	return obj.GetID(), created, err
+}
+
+func (b *sqlBatch) Update(resourceType, resourceID, resource string, ifMatch *scim.Precondition) (string, error) {
+	table, err := mainTable(resourceType)
 
-	err = ensureDoesntHaveRecord(tx, table, tenant, obj.GetID())
 	if err != nil {
 		return "", err
 	}
 
-	_, err = backend.objectCreator(tx, tenant, obj)
+	obj, err := b.backend.objectParser(resourceType, resource)
 
+	if err != nil {
+		return "", scim.NewError(scim.MalformedResourceError, "Failed to parse resource:\n"+err.Error())
+	}
+
+	if obj.GetID() != resourceID {
+		return "", scim.NewError(scim.MalformedResourceError, "The resource's id doesn't match the id in the URL")
+	}
+
+	err = ensureVersionMatches(b.tx, table, b.tenant, resourceID, ifMatch)
 	if err != nil {
 		return "", err
 	}
 
-	err = tx.Commit()
+	err = ensureHasRecord(b.tx, table, b.tenant, resourceID)
 	if err != nil {
 		return "", err
 	}
 
-	// TODO: Should perhaps read back the object from the database instead,
-	//       on the other hand that means another transaction...
-	body, err := json.Marshal(obj)
+	err = b.backend.objectMutator(b.tx, b.tenant, obj)
 
 	if err != nil {
 		return "", err
 	}
 
-	return string(body), nil
+	err = b.backend.touchObject(b.tx, table, b.tenant, obj, resource, false, time.Now())
+
+	if err != nil {
+		return "", err
+	}
+
+	return b.readBack(resourceType, obj.GetID())
 }
 
-func (backend *SQLBackend) Update(tenant, resourceType, resourceID, resource string) (string, error) {
+func (b *sqlBatch) Patch(resourceType, resourceID string, patch *scim.PatchRequest, ifMatch *scim.Precondition) (string, error) {
 	table, err := mainTable(resourceType)
 
 	if err != nil {
 		return "", err
 	}
 
-	obj, err := backend.objectParser(resourceType, resource)
+	err = ensureVersionMatches(b.tx, table, b.tenant, resourceID, ifMatch)
+	if err != nil {
+		return "", err
+	}
 
+	err = ensureHasRecord(b.tx, table, b.tenant, resourceID)
 	if err != nil {
-		return "", scim.NewError(scim.MalformedResourceError, "Failed to parse resource:\n"+err.Error())
+		return "", err
 	}
 
-	tx, err := backend.db.Beginx()
+	existing, err := b.backend.readMerged(b.tx, resourceType, b.tenant, resourceID)
 
 	if err != nil {
 		return "", err
 	}
 
-	defer tx.Rollback()
+	resource, err := scim.ApplyPatch(existing, patch)
 
-	err = ensureHasRecord(tx, table, tenant, resourceID)
 	if err != nil {
 		return "", err
 	}
 
-	err = backend.objectMutator(tx, tenant, obj)
+	obj, err := b.backend.objectParser(resourceType, resource)
+
+	if err != nil {
+		return "", scim.NewError(scim.MalformedResourceError, "Failed to parse resource:\n"+err.Error())
+	}
+
+	if obj.GetID() != resourceID {
+		return "", scim.NewError(scim.MalformedResourceError, "PATCH request may not change the resource's id")
+	}
+
+	err = b.backend.objectMutator(b.tx, b.tenant, obj)
 
 	if err != nil {
 		return "", err
 	}
 
-	err = tx.Commit()
+	err = b.backend.touchObject(b.tx, table, b.tenant, obj, resource, false, time.Now())
 
 	if err != nil {
 		return "", err
 	}
 
-	// TODO: Should perhaps read back the object from the database instead,
-	//       on the other hand that means another transaction...
-	body, err := json.Marshal(obj)
+	return b.readBack(resourceType, obj.GetID())
+}
+
+// Reads back an object within the transaction, so that the resource returned
+// to the client is what was actually stored (the tables don't have columns
+// for every attribute in SS12000).
+func (b *sqlBatch) readBack(resourceType, resourceID string) (string, error) {
+	stored, err := b.backend.readMerged(b.tx, resourceType, b.tenant, resourceID)
 
 	if err != nil {
 		return "", err
 	}
 
-	return string(body), nil
+	return scim.SetResourceID(stored, resourceID)
 }
 
-func ensureHasRecord(tx *sqlx.Tx, table safeString, tenant, resourceID string) error {
+func (b *sqlBatch) Delete(resourceType, resourceID string, ifMatch *scim.Precondition) error {
+	table, err := mainTable(resourceType)
+
+	if err != nil {
+		return err
+	}
+
+	err = ensureVersionMatches(b.tx, table, b.tenant, resourceID, ifMatch)
+	if err != nil {
+		return err
+	}
+
+	err = ensureHasRecord(b.tx, table, b.tenant, resourceID)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.tx.NamedExec(`DELETE FROM `+string(table)+` WHERE tenant = :tenant AND id = :id`,
+		map[string]interface{}{
+			"tenant": b.tenant,
+			"id":     resourceID,
+		})
+
+	return err
+}
+
+func ensureHasRecord(tx sqlTx, table safeString, tenant, resourceID string) error {
 	named, err := tx.PrepareNamed(`SELECT 1 FROM ` + string(table) + ` WHERE tenant = :tenant AND id = :id`)
 
 	if err != nil {
@@ -507,7 +938,7 @@ func ensureHasRecord(tx *sqlx.Tx, table safeString, tenant, resourceID string) e
 	}
 }
 
-func ensureDoesntHaveRecord(tx *sqlx.Tx, table safeString, tenant, resourceID string) error {
+func ensureDoesntHaveRecord(tx sqlTx, table safeString, tenant, resourceID string) error {
 	err := ensureHasRecord(tx, table, tenant, resourceID)
 	if err == nil {
 		return scim.NewError(scim.ConflictError, fmt.Sprintf("object %s already exists", resourceID))
@@ -519,46 +950,22 @@ func ensureDoesntHaveRecord(tx *sqlx.Tx, table safeString, tenant, resourceID st
 	return nil
 }
 
-func (backend *SQLBackend) Delete(tenant, resourceType, resourceID string) error {
-	table, err := mainTable(resourceType)
-
-	if err != nil {
-		return err
-	}
-
-	tx, err := backend.db.Beginx()
-
-	if err != nil {
-		return err
-	}
-
-	defer tx.Rollback()
-
-	err = ensureHasRecord(tx, table, tenant, resourceID)
-	if err != nil {
-		return err
-	}
-
-	_, err = tx.NamedExec(`DELETE FROM `+string(table)+` WHERE tenant = :tenant AND id = :id`,
-		map[string]interface{}{
-			"tenant": tenant,
-			"id":     resourceID,
-		})
-
-	if err != nil {
-		return err
-	}
+func (backend *SQLBackend) Clear(tenant string) error {
+	return backend.ClearContext(context.Background(), tenant)
+}
 
-	return tx.Commit()
+func (backend *SQLBackend) ClearContext(ctx context.Context, tenant string) error {
+	return backend.unavailable(backend.clear(ctx, tenant))
 }
 
-func (backend *SQLBackend) Clear(tenant string) error {
-	tx, err := backend.db.Beginx()
+func (backend *SQLBackend) clear(ctx context.Context, tenant string) error {
+	tx, cancel, err := backend.beginx(ctx)
 
 	if err != nil {
 		return err
 	}
 
+	defer cancel()
 	defer tx.Rollback()
 
 	for _, table := range tablesForClearTenant {
@@ -574,41 +981,110 @@ func (backend *SQLBackend) Clear(tenant string) error {
 	return tx.Commit()
 }
 
+// GetResources returns all objects of a type, merged with their
+// stored resource JSON
 func (backend *SQLBackend) GetResources(tenant, resourceType string) (map[string]string, error) {
-	objs, err := backend.GetParsedResources(tenant, resourceType)
+	return backend.GetResourcesContext(context.Background(), tenant, resourceType)
+}
+
+func (backend *SQLBackend) GetResourcesContext(ctx context.Context, tenant, resourceType string) (map[string]string, error) {
+	result, err := backend.getResources(ctx, tenant, resourceType)
+	return result, backend.unavailable(err)
+}
+
+func (backend *SQLBackend) getResources(ctx context.Context, tenant, resourceType string) (map[string]string, error) {
+	table, err := mainTable(resourceType)
+
 	if err != nil {
 		return nil, err
 	}
-	result := make(map[string]string)
-	for key := range objs {
-		bytes, err := json.Marshal(objs[key])
-		if err != nil {
-			return nil, err
-		}
-		result[key] = string(bytes)
+
+	tx, cancel, err := backend.beginx(ctx)
+
+	if err != nil {
+		return nil, err
 	}
-	return result, nil
+
+	defer cancel()
+	defer tx.Rollback()
+
+	objs, err := backend.objectReaderAll(tx, resourceType, tenant)
+
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := backend.readRawJSON(tx, table, "1 = 1", map[string]interface{}{"tenant": tenant})
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeObjects(objs, raw)
 }
 
+// GetResource returns an object merged with its stored resource JSON
 func (backend *SQLBackend) GetResource(tenant, resourceType string, id string) (string, error) {
-	obj, err := backend.GetParsedResource(tenant, resourceType, id)
+	return backend.GetResourceContext(context.Background(), tenant, resourceType, id)
+}
+
+func (backend *SQLBackend) GetResourceContext(ctx context.Context, tenant, resourceType string, id string) (string, error) {
+	result, err := backend.getResource(ctx, tenant, resourceType, id)
+	return result, backend.unavailable(err)
+}
+
+func (backend *SQLBackend) getResource(ctx context.Context, tenant, resourceType string, id string) (string, error) {
+	table, err := mainTable(resourceType)
+
+	if err != nil {
+		return "", err
+	}
+
+	tx, cancel, err := backend.beginx(ctx)
+
 	if err != nil {
 		return "", err
 	}
-	bytes, err := json.Marshal(obj)
+
+	defer cancel()
+	defer tx.Rollback()
+
+	err = ensureHasRecord(tx, table, tenant, id)
+	if err != nil {
+		return "", err
+	}
+
+	resource, err := backend.readMerged(tx, resourceType, tenant, id)
+
 	if err != nil {
 		return "", err
 	}
-	return string(bytes), nil
+
+	return resource, tx.Commit()
 }
 
 func (backend *SQLBackend) GetParsedResources(tenant, resourceType string) (map[string]interface{}, error) {
-	tx, err := backend.db.Beginx()
+	return backend.GetParsedResourcesContext(context.Background(), tenant, resourceType)
+}
+
+func (backend *SQLBackend) GetParsedResourcesContext(ctx context.Context, tenant, resourceType string) (map[string]interface{}, error) {
+	result, err := backend.getParsedResources(ctx, tenant, resourceType)
+	return result, backend.unavailable(err)
+}
+
+func (backend *SQLBackend) getParsedResources(ctx context.Context, tenant, resourceType string) (map[string]interface{}, error) {
+	tx, cancel, err := backend.beginx(ctx)
 
 	if err != nil {
 		return nil, err
 	}
 
+	defer cancel()
 	defer tx.Rollback()
 
 	objs, err := backend.objectReaderAll(tx, resourceType, tenant)
@@ -631,18 +1107,28 @@ func (backend *SQLBackend) GetParsedResources(tenant, resourceType string) (map[
 }
 
 func (backend *SQLBackend) GetParsedResource(tenant, resourceType string, id string) (interface{}, error) {
+	return backend.GetParsedResourceContext(context.Background(), tenant, resourceType, id)
+}
+
+func (backend *SQLBackend) GetParsedResourceContext(ctx context.Context, tenant, resourceType string, id string) (interface{}, error) {
+	result, err := backend.getParsedResource(ctx, tenant, resourceType, id)
+	return result, backend.unavailable(err)
+}
+
+func (backend *SQLBackend) getParsedResource(ctx context.Context, tenant, resourceType string, id string) (interface{}, error) {
 	table, err := mainTable(resourceType)
 
 	if err != nil {
 		return nil, err
 	}
 
-	tx, err := backend.db.Beginx()
+	tx, cancel, err := backend.beginx(ctx)
 
 	if err != nil {
 		return nil, err
 	}
 
+	defer cancel()
 	defer tx.Rollback()
 
 	err = ensureHasRecord(tx, table, tenant, id)
@@ -19,11 +19,20 @@
 package windermere
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
 	"reflect"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/Sambruk/windermere/scimserverlite"
 	"github.com/Sambruk/windermere/ss12000v1"
@@ -260,11 +269,49 @@ type sqltestfixture struct {
 	db *sqlx.DB
 }
 
+// The tests run against an in-memory SQLite database, unless this
+// environment variable is set to the connection string of a PostgreSQL
+// database. Each test then gets its own schema in that database.
+const postgresTestEnv = "WINDERMERE_TEST_POSTGRES"
+
+func openTestDB(t *testing.T) *sqlx.DB {
+	dsn := os.Getenv(postgresTestEnv)
+	if dsn == "" {
+		db, err := sqlx.Open("sqlite", ":memory:")
+		test.Ensure(t, err)
+		return db
+	}
+
+	schema := "windermere_" + regexp.MustCompile(`[^a-z0-9_]`).ReplaceAllString(strings.ToLower(t.Name()), "_")
+	admin, err := sqlx.Open("postgres", dsn)
+	test.Ensure(t, err)
+	defer admin.Close()
+	_, err = admin.Exec(`DROP SCHEMA IF EXISTS ` + schema + ` CASCADE; CREATE SCHEMA ` + schema)
+	test.Ensure(t, err)
+
+	// Unknown connection parameters are passed on as run-time
+	// parameters by the driver, in both connection string formats
+	if strings.Contains(dsn, "://") {
+		u, err := url.Parse(dsn)
+		test.Ensure(t, err)
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		dsn = u.String()
+	} else {
+		dsn += " search_path=" + schema
+	}
+
+	db, err := sqlx.Open("postgres", dsn)
+	test.Ensure(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
 func startTest(t *testing.T) *sqltestfixture {
 	initOnce.Do(initTestData)
 	var f sqltestfixture
-	db, err := sqlx.Open("sqlite", ":memory:")
-	test.Ensure(t, err)
+	db := openTestDB(t)
 	parser := validatingObjectParser(CreateOptionalValidator(true, true), objectParser)
 	b, err := NewSQLBackend(db, parser)
 	test.Ensure(t, err)
@@ -275,8 +322,15 @@ func startTest(t *testing.T) *sqltestfixture {
 
 func TestCreate(t *testing.T) {
 	f := startTest(t)
-	_, err := f.b.Create(tenant1, "Users", bajeJSON)
+	created, err := f.b.Create(tenant1, "Users", bajeJSON)
 	test.Ensure(t, err)
+	var createdID struct {
+		ID string `json:"id"`
+	}
+	test.Ensure(t, json.Unmarshal([]byte(created), &createdID))
+	if createdID.ID != baje.GetID() {
+		t.Errorf("expected id %s in created resource, got: %s", baje.GetID(), created)
+	}
 	_, err = f.b.Create(tenant1, "Users", bajeJSON)
 	test.MustFail(t, err)
 	scimError, ok := err.(scimserverlite.SCIMTypedError)
@@ -289,19 +343,217 @@ func TestCreate(t *testing.T) {
 	test.Ensure(t, err)
 }
 
+func TestReadBack(t *testing.T) {
+	f := startTest(t)
+	var user map[string]interface{}
+	test.Ensure(t, json.Unmarshal([]byte(bajeJSON), &user))
+	// nickName isn't part of SS12000
+	user["nickName"] = "Babs"
+	withNickName, err := json.Marshal(user)
+	test.Ensure(t, err)
+
+	created, err := f.b.Create(tenant1, "Users", string(withNickName))
+	test.Ensure(t, err)
+
+	if discarded := scimserverlite.DiscardedAttributes(string(withNickName), created); len(discarded) != 0 {
+		t.Errorf("expected nothing to be discarded, got: %v (%s)", discarded, created)
+	}
+
+	updated, err := f.b.Update(tenant1, "Users", baje.GetID(), bajeNewUserName)
+	test.Ensure(t, err)
+	if discarded := scimserverlite.DiscardedAttributes(bajeNewUserName, updated); len(discarded) != 0 {
+		t.Errorf("expected nothing to be discarded, got: %v (%s)", discarded, updated)
+	}
+}
+
+func TestRawJSON(t *testing.T) {
+	f := startTest(t)
+	var user map[string]interface{}
+	test.Ensure(t, json.Unmarshal([]byte(bajeJSON), &user))
+	// Neither nickName nor emails.display are stored in columns
+	user["nickName"] = "Babs"
+	user["emails"] = []interface{}{map[string]interface{}{"value": "baje@skolan.kommunen.se", "display": "Babs"}}
+	withUnknown, err := json.Marshal(user)
+	test.Ensure(t, err)
+
+	_, err = f.b.Create(tenant1, "Users", string(withUnknown))
+	test.Ensure(t, err)
+
+	type storedUser struct {
+		NickName string `json:"nickName"`
+		UserName string `json:"userName"`
+		Emails   []struct {
+			Value   string `json:"value"`
+			Display string `json:"display"`
+		} `json:"emails"`
+	}
+
+	check := func(resource string, userName string) {
+		t.Helper()
+		var stored storedUser
+		test.Ensure(t, json.Unmarshal([]byte(resource), &stored))
+		if stored.NickName != "Babs" || stored.UserName != userName ||
+			len(stored.Emails) != 1 || stored.Emails[0].Display != "Babs" {
+			t.Errorf("unexpected stored resource: %s", resource)
+		}
+	}
+
+	resource, err := f.b.GetResource(tenant1, "Users", baje.GetID())
+	test.Ensure(t, err)
+	check(resource, "baje@skola.kommunen.se")
+
+	resources, err := f.b.GetResources(tenant1, "Users")
+	test.Ensure(t, err)
+	check(resources[baje.GetID()], "baje@skola.kommunen.se")
+
+	// Values from the normalised tables take precedence
+	_, err = f.db.Exec(`UPDATE Users SET userName = 'other@skola.kommunen.se'`)
+	test.Ensure(t, err)
+	result, err := f.b.QueryResources(tenant1, "Users", &scimserverlite.Query{})
+	test.Ensure(t, err)
+	if len(result.Resources) != 1 {
+		t.Fatalf("expected one resource, got: %v", result.Resources)
+	}
+	check(result.Resources[0].Resource, "other@skola.kommunen.se")
+
+	patched, err := f.b.Patch(tenant1, "Users", baje.GetID(), &scimserverlite.PatchRequest{
+		Operations: []scimserverlite.PatchOperation{
+			{Op: "replace", Path: "userName", Value: json.RawMessage(`"baje@skola.kommunen.se"`)},
+		},
+	})
+	test.Ensure(t, err)
+	check(patched, "baje@skola.kommunen.se")
+}
+
+func TestRenormalise(t *testing.T) {
+	f := startTest(t)
+	var user map[string]interface{}
+	test.Ensure(t, json.Unmarshal([]byte(bajeJSON), &user))
+	user["urn:scim:schemas:extension:sis:school:1.0:User"] = map[string]interface{}{"civicNo": "201001012386"}
+	withCivicNo, err := json.Marshal(user)
+	test.Ensure(t, err)
+
+	_, err = f.b.Create(tenant1, "Users", string(withCivicNo))
+	test.Ensure(t, err)
+
+	// Simulate a column added after the object was stored
+	_, err = f.db.Exec(`UPDATE Users SET civicNo = NULL`)
+	test.Ensure(t, err)
+
+	test.Ensure(t, f.b.Renormalise())
+
+	obj, err := f.b.GetParsedResource(tenant1, "Users", baje.GetID())
+	test.Ensure(t, err)
+	civicNo := obj.(*ss12000v1.User).Extension.CivicNo
+	if civicNo == nil || *civicNo != "201001012386" {
+		t.Errorf("expected civicNo to be re-normalised, got: %v", civicNo)
+	}
+}
+
 func TestUpdate(t *testing.T) {
 	f := startTest(t)
 	_, err := f.b.Create(tenant1, "Users", bajeJSON)
 	test.Ensure(t, err)
 
+	before, err := f.b.GetParsedResource(tenant1, "Users", baje.GetID())
+	test.Ensure(t, err)
+
 	_, err = f.b.Update(tenant1, "Users", baje.GetID(), bajeNewUserName)
 	test.Ensure(t, err)
+
+	after, err := f.b.GetParsedResource(tenant1, "Users", baje.GetID())
+	test.Ensure(t, err)
+	beforeMeta, afterMeta := before.(ss12000v1.MetaObject).GetMeta(), after.(ss12000v1.MetaObject).GetMeta()
+	if afterMeta.Created != beforeMeta.Created || afterMeta.Version == beforeMeta.Version {
+		t.Errorf("unexpected meta after update, before: %v, after: %v", beforeMeta, afterMeta)
+	}
+
 	_, err = f.b.Update(tenant2, "Users", baje.GetID(), bajeJSON)
 	test.MustFail(t, err)
 	scimError, ok := err.(scimserverlite.SCIMTypedError)
 	if !ok || scimError.Type() != scimserverlite.MissingResourceError {
 		t.Errorf("wrong error, expected conflict, got: %v", err)
 	}
+
+	// The id in the resource must match the id in the URL
+	_, err = f.b.Create(tenant1, "Users", ananJSON)
+	test.Ensure(t, err)
+	_, err = f.b.UpdateIfMatch(tenant1, "Users", anan.GetID(), bajeNewUserName, scimserverlite.ParsePrecondition("*"))
+	scimError, ok = err.(scimserverlite.SCIMTypedError)
+	if !ok || scimError.Type() != scimserverlite.MalformedResourceError {
+		t.Errorf("wrong error, expected malformed resource, got: %v", err)
+	}
+	user, err := f.b.GetParsedResource(tenant1, "Users", anan.GetID())
+	test.Ensure(t, err)
+	if user.(*ss12000v1.User).UserName != anan.UserName {
+		t.Errorf("expected the user in the URL to be unchanged, got: %v", user)
+	}
+}
+
+func TestIfMatch(t *testing.T) {
+	f := startTest(t)
+	_, err := f.b.Create(tenant1, "Users", bajeJSON)
+	test.Ensure(t, err)
+
+	obj, err := f.b.GetParsedResource(tenant1, "Users", baje.GetID())
+	test.Ensure(t, err)
+	version := obj.(ss12000v1.MetaObject).GetMeta().Version
+
+	_, err = f.b.UpdateIfMatch(tenant1, "Users", baje.GetID(), bajeNewUserName, scimserverlite.ParsePrecondition(`W/"other"`))
+	scimError, ok := err.(scimserverlite.SCIMTypedError)
+	if !ok || scimError.Type() != scimserverlite.PreconditionFailedError {
+		t.Errorf("wrong error, expected precondition failed, got: %v", err)
+	}
+
+	_, err = f.b.UpdateIfMatch(tenant1, "Users", baje.GetID(), bajeNewUserName, scimserverlite.ParsePrecondition(version))
+	test.Ensure(t, err)
+
+	err = f.b.DeleteIfMatch(tenant1, "Users", baje.GetID(), scimserverlite.ParsePrecondition(version))
+	test.MustFail(t, err)
+
+	_, err = f.b.UpdateIfMatch(tenant2, "Users", baje.GetID(), bajeJSON, scimserverlite.ParsePrecondition("*"))
+	scimError, ok = err.(scimserverlite.SCIMTypedError)
+	if !ok || scimError.Type() != scimserverlite.MissingResourceError {
+		t.Errorf("wrong error, expected missing resource, got: %v", err)
+	}
+
+	test.Ensure(t, f.b.DeleteIfMatch(tenant1, "Users", baje.GetID(), scimserverlite.ParsePrecondition("*")))
+}
+
+func TestBatch(t *testing.T) {
+	f := startTest(t)
+
+	err := f.b.Batch(tenant1, func(b scimserverlite.BatchModifier) error {
+		id, _, err := b.Create("Users", bajeJSON)
+		if err != nil {
+			return err
+		}
+		if id != baje.GetID() {
+			t.Errorf("wrong id for created resource: %s", id)
+		}
+		_, err = b.Update("Users", id, bajeNewUserName, nil)
+		return err
+	})
+	test.Ensure(t, err)
+
+	obj, err := f.b.GetParsedResource(tenant1, "Users", baje.GetID())
+	test.Ensure(t, err)
+	if obj.(*ss12000v1.User).UserName != "baje12@skola.kommunen.se" {
+		t.Errorf("batch wasn't committed, got: %v", obj)
+	}
+
+	// Nothing should be modified if apply fails
+	err = f.b.Batch(tenant1, func(b scimserverlite.BatchModifier) error {
+		err := b.Delete("Users", baje.GetID(), nil)
+		if err != nil {
+			return err
+		}
+		return fmt.Errorf("fail")
+	})
+	test.MustFail(t, err)
+
+	_, err = f.b.GetResource(tenant1, "Users", baje.GetID())
+	test.Ensure(t, err)
 }
 
 func TestDelete(t *testing.T) {
@@ -448,6 +700,12 @@ func TestIdentity(t *testing.T) {
 
 		obj, err := f.b.GetParsedResource(tenant, resourceType, id)
 		test.Ensure(t, err)
+		// The meta data is maintained by the backend, compare the content
+		parsed := obj.(ss12000v1.MetaObject)
+		if parsed.GetMeta() == nil || parsed.GetMeta().Version == "" {
+			t.Errorf("object of type %s has no meta data after round-trip", resourceType)
+		}
+		parsed.SetMeta(nil)
 		if !reflect.DeepEqual(want, obj) {
 			t.Errorf("object of type %s wasn't the same after round-trip, expected %v\n,got %v\n", resourceType, want, obj)
 		}
@@ -481,6 +739,48 @@ func TestIdentity(t *testing.T) {
 	roundTrip(tenant1, "Employments", string(body), bajeEmpCopy.GetID(), &bajeEmpCopy, false)
 
 	roundTrip(tenant1, "Activities", grupp2ActivityJSON, grupp2Activity.GetID(), &grupp2Activity, true)
+
+	var grupp1Copy ss12000v1.StudentGroup
+	json.Unmarshal([]byte(grupp1JSON), &grupp1Copy)
+	groupSchoolType := "GY"
+	grupp1Copy.SchoolType = &groupSchoolType
+	body, _ = json.Marshal(&grupp1Copy)
+	roundTrip(tenant1, "StudentGroups", string(body), grupp1Copy.GetID(), &grupp1Copy, false)
+
+	var grupp2ActivityCopy ss12000v1.Activity
+	json.Unmarshal([]byte(grupp2ActivityJSON), &grupp2ActivityCopy)
+	grupp2ActivityCopy.ParentActivity = []ss12000v1.SCIMReference{
+		{Value: "0d2bce4b-f1b5-4a5c-8d3e-6a1b2b3c4d5e"},
+		{Value: "5b2f6d7c-1e4a-4b9c-9f2d-3c4b5a6d7e8f"},
+	}
+	body, _ = json.Marshal(&grupp2ActivityCopy)
+	roundTrip(tenant1, "Activities", string(body), grupp2ActivityCopy.GetID(), &grupp2ActivityCopy, false)
+	grupp2ActivityCopy.ParentActivity = grupp2ActivityCopy.ParentActivity[:1]
+	body, _ = json.Marshal(&grupp2ActivityCopy)
+	roundTrip(tenant1, "Activities", string(body), grupp2ActivityCopy.GetID(), &grupp2ActivityCopy, false)
+
+	var liniCopy ss12000v1.User
+	json.Unmarshal([]byte(liniJSON), &liniCopy)
+	civicNo := "201001012386"
+	securityMarking := true
+	schoolType := "GR"
+	programCode := "NA"
+	guardianName := "Anna Andersson"
+	liniCopy.Extension.CivicNo = &civicNo
+	liniCopy.Extension.SecurityMarking = &securityMarking
+	liniCopy.Extension.Enrolments[0].SchoolType = &schoolType
+	liniCopy.Extension.Enrolments[0].ProgramCode = &programCode
+	liniCopy.Extension.UserRelations = []ss12000v1.UserRelation{
+		{Value: anan.GetID(), RelationType: "Vårdnadshavare", DisplayName: &guardianName},
+		{Value: baje.GetID(), RelationType: "Annan god man"},
+	}
+	body, _ = json.Marshal(&liniCopy)
+	roundTrip(tenant1, "Users", string(body), liniCopy.GetID(), &liniCopy, false)
+	securityMarking = false
+	liniCopy.Extension.CivicNo = nil
+	liniCopy.Extension.UserRelations = liniCopy.Extension.UserRelations[1:]
+	body, _ = json.Marshal(&liniCopy)
+	roundTrip(tenant1, "Users", string(body), liniCopy.GetID(), &liniCopy, false)
 }
 
 func TestValidation(t *testing.T) {
@@ -523,3 +823,385 @@ func TestValidation(t *testing.T) {
 		t.Errorf("wrong error, expected malformed resource, got: %v", err)
 	}
 }
+
+func TestPatch(t *testing.T) {
+	f := startTest(t)
+	_, err := f.b.Create(tenant1, "StudentGroups", grupp1JSON)
+	test.Ensure(t, err)
+
+	patch, err := scimserverlite.ParsePatchRequest(`
+	{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [
+			{"op": "replace", "path": "displayName", "value": "grupp1b"},
+			{"op": "remove", "path": "studentMemberships[value eq \"aeb9dfad-c824-49e2-89d6-84cf5e33feef\"]"},
+			{"op": "add", "path": "studentMemberships", "value": [{"value": "88c0f298-8e33-4566-ace7-6e26228a9bc6"}]}
+		]
+	}`)
+	test.Ensure(t, err)
+
+	_, err = f.b.Patch(tenant1, "StudentGroups", grupp1.GetID(), patch)
+	test.Ensure(t, err)
+
+	obj, err := f.b.GetParsedResource(tenant1, "StudentGroups", grupp1.GetID())
+	test.Ensure(t, err)
+	group := obj.(*ss12000v1.StudentGroup)
+	if group.DisplayName != "grupp1b" {
+		t.Errorf("Unexpected displayName after patch: %s", group.DisplayName)
+	}
+	members := []string{}
+	for _, m := range group.StudentMemberships {
+		members = append(members, m.Value)
+	}
+	expected := []string{"2b3a480f-d0b9-4c09-bbac-70f915964b02", "88c0f298-8e33-4566-ace7-6e26228a9bc6"}
+	if !reflect.DeepEqual(members, expected) {
+		t.Errorf("Unexpected members after patch, expected %v, got %v", expected, members)
+	}
+
+	_, err = f.b.Patch(tenant2, "StudentGroups", grupp1.GetID(), patch)
+	test.MustFail(t, err)
+
+	invalid, err := scimserverlite.ParsePatchRequest(`
+	{
+		"schemas": ["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+		"Operations": [{"op": "remove", "path": "owner"}]
+	}`)
+	test.Ensure(t, err)
+	_, err = f.b.Patch(tenant1, "StudentGroups", grupp1.GetID(), invalid)
+	scimError, ok := err.(scimserverlite.SCIMTypedError)
+	if !ok || scimError.Type() != scimserverlite.MalformedResourceError {
+		t.Errorf("wrong error, expected malformed resource, got: %v", err)
+	}
+}
+
+func TestQueryResources(t *testing.T) {
+	f := startTest(t)
+	for _, user := range []string{bajeJSON, ananJSON, liniJSON} {
+		_, err := f.b.Create(tenant1, "Users", user)
+		test.Ensure(t, err)
+	}
+	_, err := f.b.Create(tenant2, "Users", bajeJSON)
+	test.Ensure(t, err)
+	_, err = f.b.Create(tenant1, "StudentGroups", grupp1JSON)
+	test.Ensure(t, err)
+	_, err = f.b.Create(tenant1, "SchoolUnits", skolenhet1JSON)
+	test.Ensure(t, err)
+	_, err = f.b.Create(tenant1, "Activities", grupp2ActivityJSON)
+	test.Ensure(t, err)
+
+	tests := []struct {
+		resourceType string
+		filter       string
+		expected     []string
+	}{
+		{"Users", `userName eq "BAJE@skola.kommunen.se"`, []string{baje.GetID()}},
+		{"Users", `name.familyName sw "ander" or name.givenName eq "lisa"`, []string{anan.GetID(), lini.GetID()}},
+		{"Users", `not (userName co "an") and displayName pr`, []string{baje.GetID(), lini.GetID()}},
+		{"Users", `emails[value ew "@skolan.kommunen.se" and not (value sw "baje")]`, []string{anan.GetID(), lini.GetID()}},
+		{"Users", `emails.type pr`, []string{}},
+		{"Users", `urn:scim:schemas:extension:sis:school:1.0:User:enrolments.schoolYear ge 4`, []string{lini.GetID()}},
+		{"Users", `urn:scim:schemas:extension:sis:school:1.0:User:enrolments eq null`, []string{baje.GetID(), anan.GetID()}},
+		{"Users", `userName co "%" or userName co "_"`, []string{}},
+		{"Users", `urn:scim:schemas:extension:sis:school:1.0:User:civicNo pr or urn:scim:schemas:extension:sis:school:1.0:User:userRelations pr`, []string{}},
+		{"Users", `not (name eq "anan") and userName sw "anan"`, []string{anan.GetID()}},
+		{"Users", `meta.created gt "2000-01-01T00:00:00Z" and meta.lastModified pr`, []string{baje.GetID(), anan.GetID(), lini.GetID()}},
+		{"StudentGroups", `studentMemberships.value eq "2b3a480f-d0b9-4c09-bbac-70f915964b02"`, []string{grupp1.GetID()}},
+		{"StudentGroups", `owner.value ne "8d371858-3fbd-4af2-ae33-84225ead4a1b"`, []string{}},
+		{"SchoolUnits", `schoolUnitCode eq "12345678" and municipalityCode pr`, []string{skolenhet1.GetID()}},
+		{"Activities", `teachers[value eq "163cbddb-9fd0-53df-81e4-e022c5dd5c71"] and groups pr`, []string{grupp2Activity.GetID()}},
+		{"Activities", `parentActivity pr`, []string{}},
+		{"StudentGroups", `schoolType eq "GR"`, []string{}},
+	}
+
+	for _, tc := range tests {
+		filter, err := scimserverlite.ParseFilter(tc.filter)
+		test.Ensure(t, err)
+		result, err := f.b.QueryResources(tenant1, tc.resourceType, &scimserverlite.Query{Filter: filter})
+		test.Ensure(t, err)
+
+		ids := []string{}
+		for _, resource := range result.Resources {
+			ids = append(ids, resource.ID)
+		}
+		sort.Strings(tc.expected)
+		if !reflect.DeepEqual(ids, tc.expected) {
+			t.Errorf("Filter %s: expected %v, got %v", tc.filter, tc.expected, ids)
+		}
+
+		// The result should be the same as when evaluating the filter in memory
+		all, err := f.b.GetResources(tenant1, tc.resourceType)
+		test.Ensure(t, err)
+		inMemory, err := scimserverlite.ApplyQuery(all, &scimserverlite.Query{Filter: filter})
+		test.Ensure(t, err)
+		if !reflect.DeepEqual(result, inMemory) {
+			t.Errorf("Filter %s: SQL and in-memory evaluation differ", tc.filter)
+		}
+	}
+}
+
+func TestQueryPaging(t *testing.T) {
+	f := startTest(t)
+	for _, user := range []string{bajeJSON, ananJSON, liniJSON} {
+		_, err := f.b.Create(tenant1, "Users", user)
+		test.Ensure(t, err)
+	}
+	ordered := []string{baje.GetID(), anan.GetID(), lini.GetID()}
+	sort.Strings(ordered)
+
+	count := func(c int) *int { return &c }
+	tests := []struct {
+		query    scimserverlite.Query
+		expected []string
+	}{
+		{scimserverlite.Query{}, ordered},
+		{scimserverlite.Query{StartIndex: 2}, ordered[1:]},
+		{scimserverlite.Query{StartIndex: 1, Count: count(2)}, ordered[:2]},
+		{scimserverlite.Query{StartIndex: 3, Count: count(2)}, ordered[2:]},
+		{scimserverlite.Query{StartIndex: 4, Count: count(2)}, []string{}},
+		{scimserverlite.Query{StartIndex: 1, Count: count(0)}, []string{}},
+	}
+
+	for _, tc := range tests {
+		result, err := f.b.QueryResources(tenant1, "Users", &tc.query)
+		test.Ensure(t, err)
+		if result.TotalResults != len(ordered) {
+			t.Errorf("Expected %d total results, got %d", len(ordered), result.TotalResults)
+		}
+		ids := []string{}
+		for _, resource := range result.Resources {
+			ids = append(ids, resource.ID)
+		}
+		if !reflect.DeepEqual(ids, tc.expected) {
+			t.Errorf("Query %+v: expected %v, got %v", tc.query, tc.expected, ids)
+		}
+
+		// Child tables must be paged the same way as the main table
+		for _, resource := range result.Resources {
+			var user ss12000v1.User
+			test.Ensure(t, json.Unmarshal([]byte(resource.Resource), &user))
+			if len(user.Emails) != 1 {
+				t.Errorf("Expected one email for user %s, got %v", resource.ID, user.Emails)
+			}
+		}
+	}
+
+	filter, err := scimserverlite.ParseFilter(`userName ne "anan@skola.kommunen.se"`)
+	test.Ensure(t, err)
+	result, err := f.b.QueryResources(tenant1, "Users", &scimserverlite.Query{Filter: filter, StartIndex: 2, Count: count(5)})
+	test.Ensure(t, err)
+	if result.TotalResults != 2 || len(result.Resources) != 1 || result.StartIndex != 2 {
+		t.Errorf("Unexpected result when combining filter and paging: %+v", result)
+	}
+}
+
+func TestQuerySorting(t *testing.T) {
+	f := startTest(t)
+	for _, user := range []string{bajeJSON, ananJSON, liniJSON} {
+		_, err := f.b.Create(tenant1, "Users", user)
+		test.Ensure(t, err)
+	}
+
+	tests := []struct {
+		sortBy     string
+		descending bool
+		expected   []string
+	}{
+		{"name.familyName", false, []string{anan.GetID(), baje.GetID(), lini.GetID()}},
+		{"name.givenName", true, []string{lini.GetID(), baje.GetID(), anan.GetID()}},
+		{"emails.value", false, []string{anan.GetID(), baje.GetID(), lini.GetID()}},
+		{"urn:scim:schemas:extension:sis:school:1.0:User:enrolments.schoolYear", false, []string{lini.GetID(), baje.GetID(), anan.GetID()}},
+	}
+
+	for _, tc := range tests {
+		path, err := scimserverlite.ParseAttributePath(tc.sortBy)
+		test.Ensure(t, err)
+		query := scimserverlite.Query{SortBy: &path, SortDescending: tc.descending}
+		result, err := f.b.QueryResources(tenant1, "Users", &query)
+		test.Ensure(t, err)
+
+		ids := []string{}
+		for _, resource := range result.Resources {
+			ids = append(ids, resource.ID)
+		}
+		if !reflect.DeepEqual(ids, tc.expected) {
+			t.Errorf("Sorting by %s: expected %v, got %v", tc.sortBy, tc.expected, ids)
+		}
+
+		all, err := f.b.GetResources(tenant1, "Users")
+		test.Ensure(t, err)
+		inMemory, err := scimserverlite.ApplyQuery(all, &query)
+		test.Ensure(t, err)
+		if !reflect.DeepEqual(result, inMemory) {
+			t.Errorf("Sorting by %s: SQL and in-memory sorting differ", tc.sortBy)
+		}
+	}
+}
+
+func TestExpandDriverSpecificTypes(t *testing.T) {
+	schema := `CREATE TABLE T (a {{NVARCHAR}}(255), b {{NTEXT}}, c TINYINT, d TINYINTEGER);`
+	expected := map[string]string{
+		"sqlite":    `CREATE TABLE T (a NVARCHAR(255), b NTEXT, c TINYINT, d TINYINTEGER);`,
+		"sqlserver": `CREATE TABLE T (a NVARCHAR(255), b NTEXT, c TINYINT, d TINYINTEGER);`,
+		"mysql":     `CREATE TABLE T (a VARCHAR(255), b TEXT, c TINYINT, d TINYINTEGER);`,
+		"postgres":  `CREATE TABLE T (a VARCHAR(255), b TEXT, c SMALLINT, d TINYINTEGER);`,
+	}
+	for driver, want := range expected {
+		if got := expandDriverSpecificTypes(driver, schema); got != want {
+			t.Errorf("%s: expected %s, got %s", driver, want, got)
+		}
+	}
+}
+
+// The migrations are only run against PostgreSQL when WINDERMERE_TEST_POSTGRES
+// is set, so check that the SQL for PostgreSQL doesn't use types it lacks
+func TestPostgresMigrationSQL(t *testing.T) {
+	unsupported := regexp.MustCompile(`{{|}}|\b(TINYINT|NTEXT|NVARCHAR|DATETIME|AUTOINCREMENT)\b`)
+	up := migrationSteps("postgres", 0, currentSchemaVersion())
+	down := migrationSteps("postgres", currentSchemaVersion(), 0)
+	if len(up) != currentSchemaVersion() || len(down) != currentSchemaVersion() {
+		t.Fatalf("expected %d migrations each way, got %d up and %d down", currentSchemaVersion(), len(up), len(down))
+	}
+	for i, step := range append(up, down...) {
+		if found := unsupported.FindString(step); found != "" {
+			t.Errorf("migration step %d uses %s, which PostgreSQL lacks:\n%s", i+1, found, step)
+		}
+	}
+
+	schema := strings.Join(up, "\n")
+	for _, column := range []string{"schoolYear SMALLINT NULL", "securityMarking SMALLINT NULL", "rawJSON TEXT NULL", "tenant VARCHAR(255) NOT NULL"} {
+		if !strings.Contains(schema, column) {
+			t.Errorf("expected column %q in the schema for PostgreSQL", column)
+		}
+	}
+}
+
+func TestUnavailable(t *testing.T) {
+	f := startTest(t)
+
+	isUnavailable := func(err error) bool {
+		scimError, ok := err.(scimserverlite.SCIMTypedError)
+		return ok && scimError.Type() == scimserverlite.UnavailableError
+	}
+
+	if err := f.b.unavailable(driver.ErrBadConn); !isUnavailable(err) {
+		t.Errorf("expected bad connection to be unavailable, got: %v", err)
+	}
+	if err := f.b.unavailable(sql.ErrNoRows); err != sql.ErrNoRows {
+		t.Errorf("expected other errors to be unchanged, got: %v", err)
+	}
+
+	config := DefaultSQLConfig()
+	config.QueryTimeout = time.Nanosecond
+	b, err := NewSQLBackendWithConfig(f.db, f.b.objectParser, config)
+	test.Ensure(t, err)
+	_, err = b.GetResources(tenant1, "Users")
+	if !isUnavailable(err) {
+		t.Errorf("expected timeout to be unavailable, got: %v", err)
+	}
+
+	db, err := sqlx.Open("postgres", "postgres://windermere@127.0.0.1:1/windermere?sslmode=disable&connect_timeout=1")
+	test.Ensure(t, err)
+	defer db.Close()
+	config = DefaultSQLConfig()
+	config.ConnectRetries = 2
+	config.ConnectRetryWait = time.Millisecond
+	_, err = NewSQLBackendWithConfig(db, f.b.objectParser, config)
+	test.MustFail(t, err)
+}
+
+func TestConnectRetryWait(t *testing.T) {
+	config := DefaultSQLConfig()
+	config.ConnectRetryWait = 0
+	config.ConnectMaxRetryWait = 0
+	if wait := config.connectRetryWait(0); wait != time.Second {
+		t.Errorf("expected a second before the first retry when not configured, got %v", wait)
+	}
+	if wait := config.connectRetryWait(time.Second); wait != 2*time.Second {
+		t.Errorf("expected the wait to double without a max wait, got %v", wait)
+	}
+
+	config.ConnectRetryWait = 20 * time.Second
+	config.ConnectMaxRetryWait = 30 * time.Second
+	if wait := config.connectRetryWait(0); wait != 20*time.Second {
+		t.Errorf("expected the configured wait before the first retry, got %v", wait)
+	}
+	if wait := config.connectRetryWait(20 * time.Second); wait != 30*time.Second {
+		t.Errorf("expected the wait to be limited by the max wait, got %v", wait)
+	}
+}
+
+func TestContext(t *testing.T) {
+	f := startTest(t)
+	var baje ss12000v1.User
+	json.Unmarshal([]byte(bajeJSON), &baje)
+	_, err := f.b.Create(tenant1, "Users", bajeJSON)
+	test.Ensure(t, err)
+
+	if _, ok := scimserverlite.WithContext(f.b).(*SQLBackend); !ok {
+		t.Errorf("expected SQLBackend to be used as a ContextBackend directly")
+	}
+
+	resource, err := f.b.GetResourceContext(context.Background(), tenant1, "Users", baje.GetID())
+	test.Ensure(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = f.b.GetResourceContext(ctx, tenant1, "Users", baje.GetID())
+	test.MustFail(t, err)
+	_, err = f.b.UpdateContext(ctx, tenant1, "Users", baje.GetID(), resource)
+	test.MustFail(t, err)
+	err = f.b.ClearContext(ctx, tenant1)
+	if typed, ok := err.(scimserverlite.SCIMTypedError); !ok || typed.Type() != scimserverlite.CanceledError {
+		t.Errorf("expected a cancelled request to fail with CanceledError, got: %v", err)
+	}
+
+	// Nothing should have been cleared
+	_, err = f.b.GetResource(tenant1, "Users", baje.GetID())
+	test.Ensure(t, err)
+}
+
+func TestMigrations(t *testing.T) {
+	f := startTest(t)
+	_, err := f.b.Create(tenant1, "Users", bajeJSON)
+	test.Ensure(t, err)
+
+	current, latest, err := SchemaVersions(f.db)
+	test.Ensure(t, err)
+	if current != latest || latest != currentSchemaVersion() {
+		t.Fatalf("unexpected schema versions: %d, %d", current, latest)
+	}
+
+	_, err = MigrateSchema(f.db, latest-1, false)
+	test.MustFail(t, err)
+
+	// Every migration should be possible to undo and redo
+	for version := latest - 1; version >= 0; version-- {
+		from, err := MigrateSchema(f.db, version, true)
+		test.Ensure(t, err)
+		if from != version+1 {
+			t.Errorf("expected migration from %d, got %d", version+1, from)
+		}
+		if current, _, _ := SchemaVersions(f.db); current != version {
+			t.Errorf("expected version %d after migrating down, got %d", version, current)
+		}
+		_, err = MigrateSchema(f.db, version+1, false)
+		test.Ensure(t, err)
+		_, err = MigrateSchema(f.db, version, true)
+		test.Ensure(t, err)
+	}
+
+	_, err = MigrateSchema(f.db, latest, false)
+	test.Ensure(t, err)
+	b, err := NewSQLBackend(f.db, f.b.objectParser)
+	test.Ensure(t, err)
+	_, err = b.Create(tenant1, "Users", bajeJSON)
+	test.Ensure(t, err)
+
+	steps, err := MigrationSQL("postgres", 2, 3, false)
+	test.Ensure(t, err)
+	if len(steps) != 1 || !strings.Contains(steps[0], "securityMarking SMALLINT") {
+		t.Errorf("unexpected SQL for PostgreSQL: %v", steps)
+	}
+	_, err = MigrationSQL("postgres", 3, 2, false)
+	test.MustFail(t, err)
+}
@@ -23,7 +23,6 @@ import (
 	"fmt"
 
 	"github.com/Sambruk/windermere/ss12000v1"
-	"github.com/jmoiron/sqlx"
 )
 
 type dbEmploymentRow struct {
@@ -33,6 +32,7 @@ type dbEmploymentRow struct {
 	UserId         string  `db:"userId"`
 	EmploymentRole string  `db:"employmentRole"`
 	Signature      *string `db:"signature"`
+	dbMeta
 }
 
 func NewEmploymentRow(tenant string, employment *ss12000v1.Employment) dbEmploymentRow {
@@ -50,21 +50,21 @@ func NewEmploymentRow(tenant string, employment *ss12000v1.Employment) dbEmploym
 	}
 }
 
-func (backend *SQLBackend) employmentCreator(tx *sqlx.Tx, tenant string, employment *ss12000v1.Employment) (id string, err error) {
+func (backend *SQLBackend) employmentCreator(tx sqlTx, tenant string, employment *ss12000v1.Employment) (id string, err error) {
 	dbEmployment := NewEmploymentRow(tenant, employment)
 
 	_, err = tx.NamedExec(`INSERT INTO Employments (tenant, id, employedAt, userId, employmentRole, signature) VALUES (:tenant, :id, :employedAt, :userId, :employmentRole, :signature)`, &dbEmployment)
 	return employment.GetID(), err
 }
 
-func (backend *SQLBackend) employmentMutator(tx *sqlx.Tx, tenant string, employment *ss12000v1.Employment) (err error) {
+func (backend *SQLBackend) employmentMutator(tx sqlTx, tenant string, employment *ss12000v1.Employment) (err error) {
 	dbEmployment := NewEmploymentRow(tenant, employment)
 
 	_, err = tx.NamedExec(`UPDATE Employments SET employedAt = :employedAt, userId = :userId, employmentRole = :employmentRole, signature = :signature WHERE tenant = :tenant AND id = :id`, &dbEmployment)
 	return
 }
 
-func (backend *SQLBackend) employmentReader(tx *sqlx.Tx, mainQuery string, args map[string]interface{}) ([]ss12000v1.Object, error) {
+func (backend *SQLBackend) employmentReader(tx sqlTx, mainQuery string, args map[string]interface{}) ([]ss12000v1.Object, error) {
 	mainNamed, err := tx.PrepareNamed(mainQuery)
 	if err != nil {
 		return nil, err
@@ -92,19 +92,25 @@ func (backend *SQLBackend) employmentReader(tx *sqlx.Tx, mainQuery string, args
 			},
 			EmploymentRole: dbEmployments[i].EmploymentRole,
 			Signature:      sig,
+			SCIMResource:   ss12000v1.SCIMResource{Meta: dbEmployments[i].scimMeta()},
 		}
 	}
 	return employments, nil
 }
 
-func (backend *SQLBackend) employmentReaderAll(tx *sqlx.Tx, tenant string) ([]ss12000v1.Object, error) {
+func (backend *SQLBackend) employmentReaderAll(tx sqlTx, tenant string) ([]ss12000v1.Object, error) {
 	return backend.employmentReader(tx, `SELECT * FROM Employments WHERE tenant = :tenant`,
 		map[string]interface{}{
 			"tenant": tenant,
 		})
 }
 
-func (backend *SQLBackend) employmentReaderOne(tx *sqlx.Tx, tenant, id string) (ss12000v1.Object, error) {
+func (backend *SQLBackend) employmentReaderSelected(tx sqlTx, selection sqlSelection, args map[string]interface{}) ([]ss12000v1.Object, error) {
+	return backend.employmentReader(tx, `SELECT * FROM Employments WHERE tenant = :tenant AND (`+selection.where+`) ORDER BY `+selection.order+selection.paging,
+		args)
+}
+
+func (backend *SQLBackend) employmentReaderOne(tx sqlTx, tenant, id string) (ss12000v1.Object, error) {
 	employments, err := backend.employmentReader(tx, `SELECT * FROM Employments WHERE tenant = :tenant AND id = :id`,
 		map[string]interface{}{
 			"tenant": tenant,
@@ -0,0 +1,257 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package windermere
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	scim "github.com/Sambruk/windermere/scimserverlite"
+	"github.com/jmoiron/sqlx"
+)
+
+// A column which is encrypted when an SQLBackend uses encryption
+type encryptedColumn struct {
+	table  safeString
+	column safeString
+}
+
+// The encrypted columns: the stored resource JSON, which has all
+// attributes, and the sensitive columns which aren't needed for
+// filtering in SQL. The normalised tables are otherwise unencrypted so
+// queries can be answered by the database. Filters on civicNo are
+// evaluated in memory instead.
+var encryptedColumns = []encryptedColumn{
+	{"Users", "rawJSON"},
+	{"StudentGroups", "rawJSON"},
+	{"Organisations", "rawJSON"},
+	{"SchoolUnitGroups", "rawJSON"},
+	{"SchoolUnits", "rawJSON"},
+	{"Employments", "rawJSON"},
+	{"Activities", "rawJSON"},
+	{"Users", "civicNo"},
+	{"UserRelations", "displayName"},
+}
+
+// Counts the values in the encrypted columns which are (or with
+// encrypted false, aren't) encrypted
+func countEncrypted(db *sqlx.DB, encrypted bool) (int, error) {
+	operator := "LIKE"
+	if !encrypted {
+		operator = "NOT LIKE"
+	}
+
+	total := 0
+	for _, c := range encryptedColumns {
+		var count int
+		query := db.Rebind(`SELECT COUNT(*) FROM ` + string(c.table) + ` WHERE ` + string(c.column) + ` IS NOT NULL AND ` + string(c.column) + ` ` + operator + ` ?`)
+		if err := db.Get(&count, query, string(envelopePrefix)+"%"); err != nil {
+			return 0, err
+		}
+		total += count
+	}
+	return total, nil
+}
+
+// UseEncryption makes the backend encrypt the stored resource JSON and
+// the sensitive columns with keys from a keyring. Values stored before
+// encryption was configured are read as they are, with a warning at
+// startup, until they have been encrypted (see ReencryptSQL). After
+// that, unencrypted values are rejected unless policy is PlaintextAllowed.
+// It should be called before the backend is used.
+func (backend *SQLBackend) UseEncryption(keyring *Keyring, policy PlaintextPolicy) error {
+	unencrypted, err := countEncrypted(backend.db, false)
+	if err != nil {
+		return err
+	}
+
+	if unencrypted > 0 {
+		if policy == PlaintextRejected {
+			return fmt.Errorf("%d stored values aren't encrypted", unencrypted)
+		}
+		log.Printf("Warning: %d stored values aren't encrypted, they are encrypted when the resources are modified (or run windermere reencrypt)", unencrypted)
+	} else if policy != PlaintextAllowed {
+		keyring = keyring.rejectingPlaintext()
+	}
+
+	backend.keyring = keyring
+	return nil
+}
+
+// Checks that nothing has been stored encrypted, for a backend without
+// encryption
+func (backend *SQLBackend) ensureNotEncrypted() error {
+	encrypted, err := countEncrypted(backend.db, true)
+	if err != nil {
+		return err
+	}
+	if encrypted > 0 {
+		return errors.New("stored data is encrypted but no encryption key is configured")
+	}
+	return nil
+}
+
+// Encrypts a value for an encrypted column, if the backend uses encryption
+func (backend *SQLBackend) encrypt(value string) (string, error) {
+	if backend.keyring == nil {
+		return value, nil
+	}
+	encrypted, err := backend.keyring.Encode([]byte(value))
+	return string(encrypted), err
+}
+
+func (backend *SQLBackend) encryptOptional(value *string) (*string, error) {
+	if value == nil {
+		return nil, nil
+	}
+	encrypted, err := backend.encrypt(*value)
+	return &encrypted, err
+}
+
+// Decrypts a value from an encrypted column, if the backend uses encryption
+func (backend *SQLBackend) decrypt(value string) (string, error) {
+	if backend.keyring == nil {
+		return value, nil
+	}
+	if !isEncrypted([]byte(value)) {
+		if backend.keyring.rejectPlaintext {
+			return "", errors.New("stored data isn't encrypted")
+		}
+		return value, nil
+	}
+	decrypted, err := backend.keyring.decrypt([]byte(value))
+	return string(decrypted), err
+}
+
+func (backend *SQLBackend) decryptOptional(value *string) (*string, error) {
+	if value == nil {
+		return nil, nil
+	}
+	decrypted, err := backend.decrypt(*value)
+	return &decrypted, err
+}
+
+// ReencryptSQL encrypts the encrypted columns of SQL storage with the
+// current key of a keyring. The values may be encrypted with older keys
+// in the keyring, or unencrypted. Windermere must not be running
+// meanwhile. Returns the number of resources rewritten.
+func ReencryptSQL(db *sqlx.DB, keyring *Keyring) (int, error) {
+	backend, err := NewSQLBackend(db, objectParser)
+	if err != nil {
+		return 0, err
+	}
+	backend.keyring = keyring
+
+	count := 0
+	for _, table := range tablesForClearTenant {
+		var keys []struct {
+			Tenant string `db:"tenant"`
+			ID     string `db:"id"`
+		}
+
+		err := db.Select(&keys, `SELECT tenant, id FROM `+string(table))
+
+		if err != nil {
+			return count, err
+		}
+
+		for _, key := range keys {
+			err = backend.reencryptObject(string(table), key.Tenant, key.ID)
+			if err != nil {
+				return count, fmt.Errorf("failed to re-encrypt %s/%s for tenant %s: %v", table, key.ID, key.Tenant, err)
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Re-encrypts one object by writing it back as it's read. Main tables are
+// named after their resource types.
+func (backend *SQLBackend) reencryptObject(resourceType, tenant, id string) error {
+	table, err := mainTable(resourceType)
+
+	if err != nil {
+		return err
+	}
+
+	tx, cancel, err := backend.beginx(context.Background())
+
+	if err != nil {
+		return err
+	}
+
+	defer cancel()
+	defer tx.Rollback()
+
+	args := map[string]interface{}{
+		"tenant": tenant,
+		"id":     id,
+	}
+
+	// Lock the row so a concurrent modification isn't overwritten
+	_, err = tx.NamedExec(`UPDATE `+string(table)+` SET version = version WHERE tenant = :tenant AND id = :id`, args)
+
+	if err != nil {
+		return err
+	}
+
+	err = ensureHasRecord(tx, table, tenant, id)
+
+	if scimError, ok := err.(scim.SCIMTypedError); ok && scimError.Type() == scim.MissingResourceError {
+		// Deleted since we started
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	obj, err := backend.objectReaderOne(tx, resourceType, tenant, id)
+
+	if err != nil {
+		return err
+	}
+
+	err = backend.objectMutator(tx, tenant, obj)
+
+	if err != nil {
+		return err
+	}
+
+	raw, err := backend.readRawJSON(tx, table, "id = :id", args)
+
+	if err != nil {
+		return err
+	}
+
+	if resource, ok := raw[id]; ok {
+		args["rawJSON"], err = backend.encrypt(resource)
+		if err != nil {
+			return err
+		}
+		_, err = tx.NamedExec(`UPDATE `+string(table)+` SET rawJSON = :rawJSON WHERE tenant = :tenant AND id = :id`, args)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
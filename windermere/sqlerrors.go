@@ -0,0 +1,109 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package windermere
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net"
+	"strings"
+
+	scim "github.com/Sambruk/windermere/scimserverlite"
+	mssql "github.com/denisenkom/go-mssqldb"
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+)
+
+// Checks if an error from the database is likely to go away if the
+// client retries later, for instance if the database can't be reached,
+// the operation timed out or the transaction lost a deadlock.
+func isTransient(err error) bool {
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) ||
+		errors.Is(err, mysql.ErrInvalidConn) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+
+	// Transactions are rolled back by database/sql when they time out
+	if errors.Is(err, sql.ErrTxDone) {
+		return true
+	}
+
+	var netError net.Error
+	if errors.As(err, &netError) {
+		return true
+	}
+
+	var pqError *pq.Error
+	if errors.As(err, &pqError) {
+		switch pqError.Code.Class() {
+		case "08", // connection exception
+			"40", // transaction rollback (serialization failure, deadlock)
+			"53", // insufficient resources (such as too many connections)
+			"57": // operator intervention (such as shutdown or query canceled)
+			return true
+		}
+		return false
+	}
+
+	var mysqlError *mysql.MySQLError
+	if errors.As(err, &mysqlError) {
+		switch mysqlError.Number {
+		case 1040, // too many connections
+			1205, // lock wait timeout
+			1213: // deadlock
+			return true
+		}
+		return false
+	}
+
+	var mssqlError mssql.Error
+	if errors.As(err, &mssqlError) {
+		switch mssqlError.Number {
+		case 1205, // deadlock victim
+			1222: // lock request timeout
+			return true
+		}
+		return false
+	}
+
+	// SQLITE_BUSY
+	return strings.Contains(err.Error(), "database is locked")
+}
+
+// Turns transient database errors into errors telling the client to
+// retry later and requests cancelled by the client into a CanceledError,
+// other errors are returned as they are.
+func (backend *SQLBackend) unavailable(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := err.(scim.SCIMTypedError); ok {
+		return err
+	}
+	if errors.Is(err, context.Canceled) {
+		return scim.ContextError(context.Canceled)
+	}
+	if !isTransient(err) {
+		return err
+	}
+	return scim.NewUnavailableError("Database temporarily unavailable: "+err.Error(), backend.config.RetryAfter)
+}
@@ -0,0 +1,445 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package windermere
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	scim "github.com/Sambruk/windermere/scimserverlite"
+)
+
+const userExtensionURI = "urn:scim:schemas:extension:sis:school:1.0:User"
+
+// A sqlAttribute describes where a SCIM attribute is stored in the database
+type sqlAttribute struct {
+	column     safeString // column holding the value
+	table      safeString // table for multi-valued attributes, empty if column is in the main table
+	foreignKey safeString // column in table which refers to the main table's id
+	numeric    bool       // true if the column is numeric, otherwise it is text
+	extension  bool       // true if the attribute belongs to the SS12000 user extension
+	encrypted  bool       // true if the column is encrypted when the backend uses encryption
+}
+
+// Attributes we can filter on in the database, per resource type.
+// Names are lower case, complex attributes are given with their
+// sub-attribute ("emails.value"). A complex attribute without
+// sub-attribute refers to its value sub-attribute, as in the
+// in-memory evaluation of filters. All resource types also have the
+// meta data columns, see metaAttributes.
+var filterAttributes = map[string]map[string]sqlAttribute{
+	"Users": {
+		"id":                         {column: "id"},
+		"externalid":                 {column: "id"},
+		"username":                   {column: "userName"},
+		"displayname":                {column: "displayName"},
+		"name.familyname":            {column: "familyName"},
+		"name.givenname":             {column: "givenName"},
+		"emails":                     {column: "value", table: "Emails", foreignKey: "userId"},
+		"emails.value":               {column: "value", table: "Emails", foreignKey: "userId"},
+		"emails.type":                {column: "type", table: "Emails", foreignKey: "userId"},
+		"enrolments":                 {column: "value", table: "Enrolments", foreignKey: "userId", extension: true},
+		"enrolments.value":           {column: "value", table: "Enrolments", foreignKey: "userId", extension: true},
+		"enrolments.schoolyear":      {column: "schoolYear", table: "Enrolments", foreignKey: "userId", numeric: true, extension: true},
+		"enrolments.schooltype":      {column: "schoolType", table: "Enrolments", foreignKey: "userId", extension: true},
+		"enrolments.programcode":     {column: "programCode", table: "Enrolments", foreignKey: "userId", extension: true},
+		"civicno":                    {column: "civicNo", extension: true, encrypted: true},
+		"userrelations":              {column: "value", table: "UserRelations", foreignKey: "userId", extension: true},
+		"userrelations.value":        {column: "value", table: "UserRelations", foreignKey: "userId", extension: true},
+		"userrelations.relationtype": {column: "relationType", table: "UserRelations", foreignKey: "userId", extension: true},
+	},
+	"StudentGroups": {
+		"id":                       {column: "id"},
+		"externalid":               {column: "id"},
+		"displayname":              {column: "displayName"},
+		"owner":                    {column: "owner"},
+		"owner.value":              {column: "owner"},
+		"studentgrouptype":         {column: "studentGroupType"},
+		"studentmemberships":       {column: "userId", table: "StudentMemberships", foreignKey: "groupId"},
+		"studentmemberships.value": {column: "userId", table: "StudentMemberships", foreignKey: "groupId"},
+		"schooltype":               {column: "schoolType"},
+	},
+	"Organisations": {
+		"id":          {column: "id"},
+		"externalid":  {column: "id"},
+		"displayname": {column: "displayName"},
+	},
+	"SchoolUnitGroups": {
+		"id":          {column: "id"},
+		"externalid":  {column: "id"},
+		"displayname": {column: "displayName"},
+	},
+	"SchoolUnits": {
+		"id":                    {column: "id"},
+		"externalid":            {column: "id"},
+		"displayname":           {column: "displayName"},
+		"schoolunitcode":        {column: "schoolUnitCode"},
+		"organisation":          {column: "organisation"},
+		"organisation.value":    {column: "organisation"},
+		"schoolunitgroup":       {column: "schoolUnitGroup"},
+		"schoolunitgroup.value": {column: "schoolUnitGroup"},
+		"municipalitycode":      {column: "municipalityCode"},
+		"schooltypes":           {column: "schoolType", table: "SchoolTypes", foreignKey: "schoolUnitId"},
+	},
+	"Employments": {
+		"id":               {column: "id"},
+		"externalid":       {column: "id"},
+		"employedat":       {column: "employedAt"},
+		"employedat.value": {column: "employedAt"},
+		"user":             {column: "userId"},
+		"user.value":       {column: "userId"},
+		"employmentrole":   {column: "employmentRole"},
+		"signature":        {column: "signature"},
+	},
+	"Activities": {
+		"id":                   {column: "id"},
+		"externalid":           {column: "id"},
+		"displayname":          {column: "displayName"},
+		"owner":                {column: "owner"},
+		"owner.value":          {column: "owner"},
+		"teachers":             {column: "employmentId", table: "ActivityTeachers", foreignKey: "activityId"},
+		"teachers.value":       {column: "employmentId", table: "ActivityTeachers", foreignKey: "activityId"},
+		"groups":               {column: "groupId", table: "ActivityGroups", foreignKey: "activityId"},
+		"groups.value":         {column: "groupId", table: "ActivityGroups", foreignKey: "activityId"},
+		"parentactivity":       {column: "parentId", table: "ActivityParents", foreignKey: "activityId"},
+		"parentactivity.value": {column: "parentId", table: "ActivityParents", foreignKey: "activityId"},
+	},
+}
+
+// Meta data attributes, which are stored in the main table for all
+// resource types
+var metaAttributes = map[string]sqlAttribute{
+	"meta.created":      {column: "created"},
+	"meta.lastmodified": {column: "lastModified"},
+	"meta.version":      {column: "version"},
+}
+
+// errUntranslatableQuery is returned when a filter or sort attribute refers
+// to something we can't express in SQL. The query then needs to be evaluated
+// in memory.
+var errUntranslatableQuery = errors.New("query can't be translated to SQL")
+
+// A filterTranslator translates a SCIM filter to an SQL condition
+// for the main table of a resource type.
+type filterTranslator struct {
+	driverName string
+	table      safeString
+	attributes map[string]sqlAttribute
+	encrypted  bool // true if encrypted columns can't be queried
+	args       map[string]interface{}
+	aliases    int
+}
+
+// translateFilter returns an SQL condition corresponding to a filter.
+// The condition refers to the main table by name and uses named parameters
+// which are returned in args (together with any parameters in initialArgs).
+func (backend *SQLBackend) translateFilter(resourceType string, filter scim.Filter, initialArgs map[string]interface{}) (string, map[string]interface{}, error) {
+	table, err := mainTable(resourceType)
+	if err != nil {
+		return "", nil, err
+	}
+	t := filterTranslator{
+		driverName: backend.db.DriverName(),
+		table:      table,
+		attributes: filterAttributes[resourceType],
+		encrypted:  backend.keyring != nil,
+		args:       make(map[string]interface{}),
+	}
+	for k, v := range initialArgs {
+		t.args[k] = v
+	}
+	condition, err := t.translateIn(filter, nil, "")
+	if err != nil {
+		return "", nil, err
+	}
+	return condition, t.args, nil
+}
+
+func (t *filterTranslator) addArg(value interface{}) string {
+	name := fmt.Sprintf("filter%d", len(t.args))
+	t.args[name] = value
+	return ":" + name
+}
+
+// Finds the attribute a path refers to. Within a value path (such as
+// emails[type eq "work"]) parent is the multi-valued attribute.
+func (t *filterTranslator) lookup(path scim.AttributePath, parent *scim.AttributePath) (sqlAttribute, error) {
+	name := path.Name
+	uri := path.URI
+	if parent != nil {
+		if path.URI != "" || path.SubAttribute != "" {
+			return sqlAttribute{}, errUntranslatableQuery
+		}
+		name = parent.Name + "." + path.Name
+		uri = parent.URI
+	} else if path.SubAttribute != "" {
+		name = name + "." + path.SubAttribute
+	}
+
+	attribute, ok := t.attributes[strings.ToLower(name)]
+	if !ok {
+		attribute, ok = metaAttributes[strings.ToLower(name)]
+	}
+	if !ok || attribute.extension != strings.EqualFold(uri, userExtensionURI) {
+		return sqlAttribute{}, errUntranslatableQuery
+	}
+	if attribute.encrypted && t.encrypted {
+		return sqlAttribute{}, errUntranslatableQuery
+	}
+	return attribute, nil
+}
+
+// Returns an SQL expression for the lower case text of a column
+func (t *filterTranslator) lowerText(column string) string {
+	if t.driverName == "sqlserver" {
+		// NTEXT can't be compared or used with LOWER directly
+		return "LOWER(CAST(" + column + " AS NVARCHAR(MAX)))"
+	}
+	return "LOWER(" + column + ")"
+}
+
+// Escapes a value for use in a LIKE pattern with ESCAPE '!'
+func escapeLike(s string) string {
+	r := strings.NewReplacer("!", "!!", "%", "!%", "_", "!_", "[", "![")
+	return r.Replace(s)
+}
+
+// Returns the condition for an attribute expression on a column,
+// not taking into account whether the column is in a separate table.
+func (t *filterTranslator) compare(column string, attribute sqlAttribute, op string, value interface{}) string {
+	// Comparisons are written so they never evaluate to NULL,
+	// otherwise negation wouldn't work as in the in-memory evaluation.
+	notNull := column + " IS NOT NULL"
+
+	if op == scim.OpPresent {
+		if attribute.numeric {
+			return notNull
+		}
+		return "(" + notNull + " AND " + t.lowerText(column) + " <> '')"
+	}
+
+	switch v := value.(type) {
+	case string:
+		if attribute.numeric {
+			return "1 = 0"
+		}
+		lower := strings.ToLower(v)
+		var condition string
+		switch op {
+		case scim.OpEqual:
+			condition = t.lowerText(column) + " = " + t.addArg(lower)
+		case scim.OpNotEqual:
+			condition = t.lowerText(column) + " <> " + t.addArg(lower)
+		case scim.OpContains:
+			condition = t.lowerText(column) + " LIKE " + t.addArg("%"+escapeLike(lower)+"%") + " ESCAPE '!'"
+		case scim.OpStartsWith:
+			condition = t.lowerText(column) + " LIKE " + t.addArg(escapeLike(lower)+"%") + " ESCAPE '!'"
+		case scim.OpEndsWith:
+			condition = t.lowerText(column) + " LIKE " + t.addArg("%"+escapeLike(lower)) + " ESCAPE '!'"
+		case scim.OpGreaterThan:
+			condition = t.lowerText(column) + " > " + t.addArg(lower)
+		case scim.OpLessThan:
+			condition = t.lowerText(column) + " < " + t.addArg(lower)
+		case scim.OpGreaterOrEqual:
+			condition = t.lowerText(column) + " >= " + t.addArg(lower)
+		case scim.OpLessOrEqual:
+			condition = t.lowerText(column) + " <= " + t.addArg(lower)
+		default:
+			return "1 = 0"
+		}
+		return "(" + notNull + " AND " + condition + ")"
+	case float64:
+		if !attribute.numeric {
+			return "1 = 0"
+		}
+		operators := map[string]string{
+			scim.OpEqual:          "=",
+			scim.OpNotEqual:       "<>",
+			scim.OpGreaterThan:    ">",
+			scim.OpLessThan:       "<",
+			scim.OpGreaterOrEqual: ">=",
+			scim.OpLessOrEqual:    "<=",
+		}
+		operator, ok := operators[op]
+		if !ok {
+			return "1 = 0"
+		}
+		return "(" + notNull + " AND " + column + " " + operator + " " + t.addArg(v) + ")"
+	case nil:
+		if op == scim.OpEqual {
+			return column + " IS NULL"
+		} else if op == scim.OpNotEqual {
+			return notNull
+		}
+	}
+	// No boolean attributes are stored in the database
+	return "1 = 0"
+}
+
+// Returns an SQL condition which is true if a row in a multi-valued
+// attribute's table matches condition (given the alias for the table).
+func (t *filterTranslator) exists(attribute sqlAttribute, condition func(alias string) string) string {
+	alias := fmt.Sprintf("f%d", t.aliases)
+	t.aliases++
+	return fmt.Sprintf("EXISTS (SELECT 1 FROM %s %s WHERE %s.tenant = %s.tenant AND %s.%s = %s.id AND %s)",
+		attribute.table, alias, alias, t.table, alias, attribute.foreignKey, t.table, condition(alias))
+}
+
+// Translates a filter to an SQL condition. Within a value path parent is
+// the multi-valued attribute and childAlias is the alias of its table
+// (empty if its sub-attributes are stored in the main table).
+func (t *filterTranslator) translateIn(filter scim.Filter, parent *scim.AttributePath, childAlias string) (string, error) {
+	switch f := filter.(type) {
+	case *scim.AttributeExpression:
+		attribute, err := t.lookup(f.Path, parent)
+		if err != nil {
+			return "", err
+		}
+		if attribute.table == "" {
+			return t.compare(string(t.table)+"."+string(attribute.column), attribute, f.Operator, f.Value), nil
+		}
+		if childAlias != "" {
+			return t.compare(childAlias+"."+string(attribute.column), attribute, f.Operator, f.Value), nil
+		}
+		if f.Value == nil && f.Operator == scim.OpEqual {
+			// No values at all
+			return "NOT " + t.exists(attribute, func(alias string) string {
+				return alias + "." + string(attribute.column) + " IS NOT NULL"
+			}), nil
+		}
+		return t.exists(attribute, func(alias string) string {
+			return t.compare(alias+"."+string(attribute.column), attribute, f.Operator, f.Value)
+		}), nil
+	case *scim.LogicalExpression:
+		left, err := t.translateIn(f.Left, parent, childAlias)
+		if err != nil {
+			return "", err
+		}
+		right, err := t.translateIn(f.Right, parent, childAlias)
+		if err != nil {
+			return "", err
+		}
+		operator := "AND"
+		if f.Operator == "or" {
+			operator = "OR"
+		}
+		return "(" + left + " " + operator + " " + right + ")", nil
+	case *scim.NotExpression:
+		condition, err := t.translateIn(f.Filter, parent, childAlias)
+		if err != nil {
+			return "", err
+		}
+		return "NOT (" + condition + ")", nil
+	case *scim.ValuePathExpression:
+		if parent != nil {
+			return "", errUntranslatableQuery
+		}
+		table, err := t.valuePathTable(f.Path, f.Filter)
+		if err != nil {
+			return "", err
+		}
+		if table.table == "" {
+			// A complex attribute stored in the main table
+			return t.translateIn(f.Filter, &f.Path, "")
+		}
+		var innerErr error
+		condition := t.exists(table, func(alias string) string {
+			var inner string
+			inner, innerErr = t.translateIn(f.Filter, &f.Path, alias)
+			return inner
+		})
+		return condition, innerErr
+	default:
+		return "", errUntranslatableQuery
+	}
+}
+
+// Finds out where the sub-attributes referred to in a value path are
+// stored. They all need to be in the same table.
+func (t *filterTranslator) valuePathTable(path scim.AttributePath, filter scim.Filter) (sqlAttribute, error) {
+	if path.SubAttribute != "" {
+		return sqlAttribute{}, errUntranslatableQuery
+	}
+	var result *sqlAttribute
+	var walk func(f scim.Filter) error
+	walk = func(f scim.Filter) error {
+		switch e := f.(type) {
+		case *scim.AttributeExpression:
+			attribute, err := t.lookup(e.Path, &path)
+			if err != nil {
+				return err
+			}
+			if result != nil && result.table != attribute.table {
+				return errUntranslatableQuery
+			}
+			result = &attribute
+			return nil
+		case *scim.LogicalExpression:
+			if err := walk(e.Left); err != nil {
+				return err
+			}
+			return walk(e.Right)
+		case *scim.NotExpression:
+			return walk(e.Filter)
+		default:
+			return errUntranslatableQuery
+		}
+	}
+	if err := walk(filter); err != nil {
+		return sqlAttribute{}, err
+	}
+	return *result, nil
+}
+
+// translateSortOrder returns the expressions for ORDER BY when sorting
+// by an attribute. Only single-valued attributes can be sorted on in the
+// database. As in the in-memory sorting, objects without a value are placed
+// last and objects with the same value are ordered by id.
+func (backend *SQLBackend) translateSortOrder(resourceType string, sortBy scim.AttributePath, descending bool) (string, error) {
+	table, err := mainTable(resourceType)
+	if err != nil {
+		return "", err
+	}
+	t := filterTranslator{
+		driverName: backend.db.DriverName(),
+		table:      table,
+		attributes: filterAttributes[resourceType],
+		encrypted:  backend.keyring != nil,
+	}
+	attribute, err := t.lookup(sortBy, nil)
+	if err != nil {
+		return "", err
+	}
+	if attribute.table != "" {
+		return "", errUntranslatableQuery
+	}
+
+	column := string(table) + "." + string(attribute.column)
+	value := column
+	if !attribute.numeric {
+		value = t.lowerText(column)
+	}
+	direction := "ASC"
+	if descending {
+		direction = "DESC"
+	}
+	return "CASE WHEN " + column + " IS NULL THEN 1 ELSE 0 END, " + value + " " + direction + ", " + string(table) + ".id", nil
+}
@@ -0,0 +1,170 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package windermere
+
+import (
+	"database/sql"
+	"encoding/json"
+	"time"
+
+	scim "github.com/Sambruk/windermere/scimserverlite"
+	"github.com/Sambruk/windermere/ss12000v1"
+)
+
+// The meta data columns which all main tables have
+type dbMeta struct {
+	Created      sql.NullString `db:"created"`
+	LastModified sql.NullString `db:"lastModified"`
+	Version      sql.NullString `db:"version"`
+	RawJSON      sql.NullString `db:"rawJSON"`
+}
+
+// Returns the meta data for an object read from the database,
+// nil for objects which haven't been modified since meta data
+// was introduced.
+func (m dbMeta) scimMeta() *ss12000v1.SCIMMeta {
+	if !m.Created.Valid && !m.LastModified.Valid && !m.Version.Valid {
+		return nil
+	}
+	return &ss12000v1.SCIMMeta{
+		Created:      m.Created.String,
+		LastModified: m.LastModified.String,
+		Version:      m.Version.String,
+	}
+}
+
+// Updates the meta data columns and the stored resource JSON for an
+// object which has been created or modified from resource, and sets
+// the object's meta data accordingly (if it's a MetaObject). Any meta
+// data in the object from the client is ignored.
+func (backend *SQLBackend) touchObject(tx sqlTx, table safeString, tenant string, obj ss12000v1.Object, resource string, created bool, now time.Time) error {
+	metaObject, hasMeta := obj.(ss12000v1.MetaObject)
+	if hasMeta {
+		metaObject.SetMeta(nil)
+	}
+	normalised, err := json.Marshal(obj)
+
+	if err != nil {
+		return err
+	}
+
+	raw, err := rawResource(resource)
+
+	if err != nil {
+		return err
+	}
+
+	// The version covers attributes which are only in the stored JSON
+	content, err := mergeRawJSON(raw, string(normalised))
+
+	if err != nil {
+		return err
+	}
+
+	meta := &ss12000v1.SCIMMeta{
+		LastModified: scim.MetaTime(now),
+		Version:      scim.ResourceVersion([]byte(content)),
+	}
+
+	stored, err := backend.encrypt(raw)
+
+	if err != nil {
+		return err
+	}
+
+	args := map[string]interface{}{
+		"tenant":       tenant,
+		"id":           obj.GetID(),
+		"lastModified": meta.LastModified,
+		"version":      meta.Version,
+		"rawJSON":      stored,
+	}
+
+	if created {
+		meta.Created = meta.LastModified
+		args["created"] = meta.Created
+		_, err = tx.NamedExec(`UPDATE `+string(table)+` SET created = :created, lastModified = :lastModified, version = :version, rawJSON = :rawJSON WHERE tenant = :tenant AND id = :id`, args)
+	} else {
+		_, err = tx.NamedExec(`UPDATE `+string(table)+` SET lastModified = :lastModified, version = :version, rawJSON = :rawJSON WHERE tenant = :tenant AND id = :id`, args)
+		if err == nil {
+			err = getCreated(tx, table, args, meta)
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if hasMeta {
+		metaObject.SetMeta(meta)
+	}
+	return nil
+}
+
+// Reads the creation time for an object into meta
+func getCreated(tx sqlTx, table safeString, args map[string]interface{}, meta *ss12000v1.SCIMMeta) error {
+	named, err := tx.PrepareNamed(`SELECT created FROM ` + string(table) + ` WHERE tenant = :tenant AND id = :id`)
+
+	if err != nil {
+		return err
+	}
+
+	var created sql.NullString
+	err = named.Get(&created, args)
+	meta.Created = created.String
+	return err
+}
+
+// Checks an If-Match precondition against the stored version of an
+// object. This should be done first in the transaction: the row is
+// locked with an UPDATE before the version is read, so concurrent
+// modifications of the object can't both pass the check.
+func ensureVersionMatches(tx sqlTx, table safeString, tenant, resourceID string, ifMatch *scim.Precondition) error {
+	if ifMatch == nil {
+		return nil
+	}
+
+	args := map[string]interface{}{
+		"tenant": tenant,
+		"id":     resourceID,
+	}
+
+	_, err := tx.NamedExec(`UPDATE `+string(table)+` SET version = version WHERE tenant = :tenant AND id = :id`, args)
+	if err != nil {
+		return err
+	}
+
+	err = ensureHasRecord(tx, table, tenant, resourceID)
+	if err != nil {
+		return err
+	}
+
+	named, err := tx.PrepareNamed(`SELECT version FROM ` + string(table) + ` WHERE tenant = :tenant AND id = :id`)
+	if err != nil {
+		return err
+	}
+
+	var version sql.NullString
+	err = named.Get(&version, args)
+	if err != nil {
+		return err
+	}
+	return scim.CheckVersion(ifMatch, resourceID, version.String)
+}
@@ -0,0 +1,175 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package windermere
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// The lock key used to serialize migrations between instances
+const migrationLock = "windermere_migrations"
+
+// Takes a lock so only one instance at a time migrates the schema. The
+// lock belongs to the connection and is released by the returned function.
+// SQLite has no such locks, but a second writer fails instead of waiting.
+func lockMigrations(ctx context.Context, conn *sqlx.Conn, driverName string) (func(), error) {
+	var lock, unlock string
+	switch driverName {
+	case "postgres":
+		lock = `SELECT pg_advisory_lock(hashtext('` + migrationLock + `'))`
+		unlock = `SELECT pg_advisory_unlock(hashtext('` + migrationLock + `'))`
+	case "mysql":
+		lock = `SELECT GET_LOCK('` + migrationLock + `', -1)`
+		unlock = `SELECT RELEASE_LOCK('` + migrationLock + `')`
+	case "sqlserver":
+		lock = `EXEC sp_getapplock @Resource = '` + migrationLock + `', @LockMode = 'Exclusive', @LockOwner = 'Session', @LockTimeout = -1`
+		unlock = `EXEC sp_releaseapplock @Resource = '` + migrationLock + `', @LockOwner = 'Session'`
+	default:
+		return func() {}, nil
+	}
+
+	_, err := conn.ExecContext(ctx, lock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock database for migration: %v", err)
+	}
+	return func() { conn.ExecContext(ctx, unlock) }, nil
+}
+
+// Returns the SQL for the migrations from one schema version to another
+// (up or down), one string per migration in the order they are applied.
+func migrationSteps(driverName string, from, to int) []string {
+	var steps []string
+	for i := from + 1; i <= to; i++ {
+		steps = append(steps, expandDriverSpecificTypes(driverName, getSchema(i)))
+	}
+	for i := from; i > to; i-- {
+		steps = append(steps, expandDriverSpecificTypes(driverName, getDownSchema(i)))
+	}
+	return steps
+}
+
+// Checks that a migration is possible and in the allowed direction
+func checkMigration(from, to int, down bool) error {
+	if to < 0 || to > currentSchemaVersion() {
+		return fmt.Errorf("unknown schema version %d, this version of Windermere supports versions 0 to %d", to, currentSchemaVersion())
+	}
+	if from > currentSchemaVersion() {
+		return fmt.Errorf("database schema (version %d) is newer than this version of Windermere (version %d). Please downgrade the schema with a newer version of Windermere (windermere migrate down %d) if you wish to continue with this version.", from, currentSchemaVersion(), currentSchemaVersion())
+	}
+	if !down && from > to {
+		return fmt.Errorf("database schema (version %d) is newer than version %d", from, to)
+	}
+	if down && from < to {
+		return fmt.Errorf("database schema (version %d) is older than version %d", from, to)
+	}
+	return nil
+}
+
+// Migrates the schema to version to while holding the migration lock,
+// returns the version migrated from. Only migrates down if down is set.
+// The migrations are done in one transaction, but note that MySQL
+// commits implicitly after each schema change.
+func migrateSchema(db *sqlx.DB, to int, down bool) (int, error) {
+	ctx := context.Background()
+	conn, err := db.Connx(ctx)
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer conn.Close()
+
+	unlock, err := lockMigrations(ctx, conn, db.DriverName())
+
+	if err != nil {
+		return 0, err
+	}
+
+	defer unlock()
+
+	// Read after locking, another instance may have migrated while we waited
+	from := getDBVersion(conn)
+
+	err = checkMigration(from, to, down)
+
+	if err != nil || from == to {
+		return from, err
+	}
+
+	tx, err := conn.BeginTxx(ctx, nil)
+
+	if err != nil {
+		return from, err
+	}
+
+	defer tx.Rollback()
+
+	for _, step := range migrationSteps(db.DriverName(), from, to) {
+		_, err = tx.Exec(step)
+		if err != nil {
+			return from, err
+		}
+	}
+
+	// The meta table is gone if we migrated down to an empty database
+	if to > 0 {
+		_, err = tx.NamedExec(`UPDATE windermere_meta SET version = :version`, map[string]interface{}{"version": to})
+		if err != nil {
+			return from, err
+		}
+	}
+
+	return from, tx.Commit()
+}
+
+// SchemaVersions returns the schema version of a database (0 if it has no
+// tables) and the latest schema version known to this version of Windermere.
+func SchemaVersions(db *sqlx.DB) (current, latest int, err error) {
+	err = db.Ping()
+	if err != nil {
+		return 0, 0, err
+	}
+	return getDBVersion(db), currentSchemaVersion(), nil
+}
+
+// MigrateSchema migrates the schema of a database to version to, and
+// returns the version it was migrated from. Unless down is set only
+// upgrades are done. Concurrent migrations (from other instances of
+// Windermere starting up) wait for each other.
+func MigrateSchema(db *sqlx.DB, to int, down bool) (int, error) {
+	err := driverSpecificInit(db)
+	if err != nil {
+		return 0, err
+	}
+	return migrateSchema(db, to, down)
+}
+
+// MigrationSQL returns the SQL MigrateSchema would execute when migrating
+// a database with the given driver from one version to another.
+func MigrationSQL(driverName string, from, to int, down bool) ([]string, error) {
+	err := checkMigration(from, to, down)
+	if err != nil {
+		return nil, err
+	}
+	return migrationSteps(driverName, from, to), nil
+}
@@ -23,13 +23,13 @@ import (
 	"fmt"
 
 	"github.com/Sambruk/windermere/ss12000v1"
-	"github.com/jmoiron/sqlx"
 )
 
 type dbOrganisationRow struct {
 	Tenant      string `db:"tenant"`
 	Id          string `db:"id"`
 	DisplayName string `db:"displayName"`
+	dbMeta
 }
 
 func NewOrganisationRow(tenant string, organisation *ss12000v1.Organisation) dbOrganisationRow {
@@ -40,21 +40,21 @@ func NewOrganisationRow(tenant string, organisation *ss12000v1.Organisation) dbO
 	}
 }
 
-func (backend *SQLBackend) organisationCreator(tx *sqlx.Tx, tenant string, organisation *ss12000v1.Organisation) (id string, err error) {
+func (backend *SQLBackend) organisationCreator(tx sqlTx, tenant string, organisation *ss12000v1.Organisation) (id string, err error) {
 	dbOrganisation := NewOrganisationRow(tenant, organisation)
 
 	_, err = tx.NamedExec(`INSERT INTO Organisations (tenant, id, displayName) VALUES (:tenant, :id, :displayName)`, &dbOrganisation)
 	return organisation.GetID(), err
 }
 
-func (backend *SQLBackend) organisationMutator(tx *sqlx.Tx, tenant string, organisation *ss12000v1.Organisation) (err error) {
+func (backend *SQLBackend) organisationMutator(tx sqlTx, tenant string, organisation *ss12000v1.Organisation) (err error) {
 	dbOrganisation := NewOrganisationRow(tenant, organisation)
 
 	_, err = tx.NamedExec(`UPDATE Organisations SET displayName = :displayName WHERE tenant = :tenant AND id = :id`, &dbOrganisation)
 	return
 }
 
-func (backend *SQLBackend) organisationReader(tx *sqlx.Tx, mainQuery string, args map[string]interface{}) ([]ss12000v1.Object, error) {
+func (backend *SQLBackend) organisationReader(tx sqlTx, mainQuery string, args map[string]interface{}) ([]ss12000v1.Object, error) {
 	mainNamed, err := tx.PrepareNamed(mainQuery)
 	if err != nil {
 		return nil, err
@@ -69,21 +69,27 @@ func (backend *SQLBackend) organisationReader(tx *sqlx.Tx, mainQuery string, arg
 	organisations := make([]ss12000v1.Object, len(dbOrganisations))
 	for i := range dbOrganisations {
 		organisations[i] = &ss12000v1.Organisation{
-			ExternalID:  dbOrganisations[i].Id,
-			DisplayName: dbOrganisations[i].DisplayName,
+			ExternalID:   dbOrganisations[i].Id,
+			DisplayName:  dbOrganisations[i].DisplayName,
+			SCIMResource: ss12000v1.SCIMResource{Meta: dbOrganisations[i].scimMeta()},
 		}
 	}
 	return organisations, nil
 }
 
-func (backend *SQLBackend) organisationReaderAll(tx *sqlx.Tx, tenant string) ([]ss12000v1.Object, error) {
+func (backend *SQLBackend) organisationReaderAll(tx sqlTx, tenant string) ([]ss12000v1.Object, error) {
 	return backend.organisationReader(tx, `SELECT * FROM Organisations WHERE tenant = :tenant`,
 		map[string]interface{}{
 			"tenant": tenant,
 		})
 }
 
-func (backend *SQLBackend) organisationReaderOne(tx *sqlx.Tx, tenant, id string) (ss12000v1.Object, error) {
+func (backend *SQLBackend) organisationReaderSelected(tx sqlTx, selection sqlSelection, args map[string]interface{}) ([]ss12000v1.Object, error) {
+	return backend.organisationReader(tx, `SELECT * FROM Organisations WHERE tenant = :tenant AND (`+selection.where+`) ORDER BY `+selection.order+selection.paging,
+		args)
+}
+
+func (backend *SQLBackend) organisationReaderOne(tx sqlTx, tenant, id string) (ss12000v1.Object, error) {
 	organisations, err := backend.organisationReader(tx, `SELECT * FROM Organisations WHERE tenant = :tenant AND id = :id`,
 		map[string]interface{}{
 			"tenant": tenant,
@@ -0,0 +1,183 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package windermere
+
+import (
+	"context"
+	"fmt"
+
+	scim "github.com/Sambruk/windermere/scimserverlite"
+)
+
+// Returns a clause to append to a query ordered by id which skips offset
+// rows and returns at most count rows (all remaining rows if count is nil).
+// Returns an empty string if no paging is needed.
+func pagingClause(driverName string, offset int, count *int) string {
+	if offset == 0 && count == nil {
+		return ""
+	}
+
+	if driverName == "sqlserver" {
+		clause := fmt.Sprintf(" OFFSET %d ROWS", offset)
+		if count != nil {
+			clause += fmt.Sprintf(" FETCH NEXT %d ROWS ONLY", *count)
+		}
+		return clause
+	}
+
+	if count != nil {
+		return fmt.Sprintf(" LIMIT %d OFFSET %d", *count, offset)
+	}
+
+	switch driverName {
+	case "sqlite":
+		return fmt.Sprintf(" LIMIT -1 OFFSET %d", offset)
+	case "mysql":
+		// MySQL has no OFFSET without LIMIT, its documentation suggests this
+		return fmt.Sprintf(" LIMIT 18446744073709551615 OFFSET %d", offset)
+	default:
+		return fmt.Sprintf(" OFFSET %d", offset)
+	}
+}
+
+// An sqlSelection selects and orders objects from a main table
+type sqlSelection struct {
+	where  string // condition on the main table
+	order  string // expressions for ORDER BY
+	paging string // optional paging clause, see pagingClause
+}
+
+// Returns a sub query selecting the ids of the objects in the selection
+func (s sqlSelection) ids(table safeString) string {
+	if s.paging == "" {
+		return `SELECT id FROM ` + string(table) + ` WHERE tenant = :tenant AND (` + s.where + `)`
+	}
+	// The paged query is wrapped in a derived table since MySQL doesn't
+	// support LIMIT in IN sub queries.
+	return `SELECT id FROM (SELECT id FROM ` + string(table) + ` WHERE tenant = :tenant AND (` + s.where + `) ORDER BY ` + s.order + s.paging + `) page`
+}
+
+// QueryResources returns the resources matching a query. Filters and
+// sorting are translated to SQL when possible, otherwise all resources
+// of the type are read and the query is evaluated in memory.
+func (backend *SQLBackend) QueryResources(tenant, resourceType string, query *scim.Query) (*scim.QueryResult, error) {
+	return backend.QueryResourcesContext(context.Background(), tenant, resourceType, query)
+}
+
+func (backend *SQLBackend) QueryResourcesContext(ctx context.Context, tenant, resourceType string, query *scim.Query) (*scim.QueryResult, error) {
+	result, err := backend.queryResources(ctx, tenant, resourceType, query)
+	return result, backend.unavailable(err)
+}
+
+func (backend *SQLBackend) queryResources(ctx context.Context, tenant, resourceType string, query *scim.Query) (*scim.QueryResult, error) {
+	table, err := mainTable(resourceType)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if query == nil {
+		query = &scim.Query{}
+	}
+
+	selection := sqlSelection{
+		where:  "1 = 1",
+		order:  string(table) + ".id",
+		paging: pagingClause(backend.db.DriverName(), query.Offset(), query.Count),
+	}
+	args := map[string]interface{}{"tenant": tenant}
+
+	if query.Filter != nil {
+		selection.where, args, err = backend.translateFilter(resourceType, query.Filter, args)
+	}
+	if err == nil && query.SortBy != nil {
+		selection.order, err = backend.translateSortOrder(resourceType, *query.SortBy, query.SortDescending)
+	}
+
+	if err == errUntranslatableQuery {
+		resources, err := backend.getResources(ctx, tenant, resourceType)
+		if err != nil {
+			return nil, err
+		}
+		return scim.ApplyQuery(resources, query)
+	} else if err != nil {
+		return nil, err
+	}
+
+	tx, cancel, err := backend.beginx(ctx)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer cancel()
+	defer tx.Rollback()
+
+	countNamed, err := tx.PrepareNamed(`SELECT COUNT(*) FROM ` + string(table) + ` WHERE tenant = :tenant AND (` + selection.where + `)`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := &scim.QueryResult{
+		StartIndex: query.Offset() + 1,
+		Resources:  []scim.QueryResource{},
+	}
+
+	err = countNamed.Get(&result.TotalResults, args)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Nothing to read if the client only asked for the number of results
+	if query.Count != nil && *query.Count <= 0 {
+		return result, tx.Commit()
+	}
+
+	objs, err := backend.objectReaderSelected(tx, resourceType, selection, args)
+
+	if err != nil {
+		return nil, err
+	}
+
+	raw, err := backend.readRawJSON(tx, table, "id IN ("+selection.ids(table)+")", args)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	merged, err := mergeObjects(objs, raw)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range objs {
+		id := objs[i].GetID()
+		result.Resources = append(result.Resources, scim.QueryResource{ID: id, Resource: merged[id]})
+	}
+	return result, nil
+}
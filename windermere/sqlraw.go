@@ -0,0 +1,286 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package windermere
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"reflect"
+
+	"github.com/Sambruk/windermere/ss12000v1"
+)
+
+// Prepares a resource from a client for storage in the rawJSON column.
+// Meta data is managed by the server so it's not stored.
+func rawResource(resource string) (string, error) {
+	var parsed map[string]interface{}
+	err := json.Unmarshal([]byte(resource), &parsed)
+	if err != nil {
+		return "", err
+	}
+	delete(parsed, "meta")
+	raw, err := json.Marshal(parsed)
+	return string(raw), err
+}
+
+// Merges a resource read from the normalised tables with the resource
+// JSON stored when the object was last modified. Values from the
+// normalised tables take precedence, the stored JSON contributes the
+// attributes which have no columns.
+func mergeRawJSON(raw, normalised string) (string, error) {
+	if raw == "" {
+		return normalised, nil
+	}
+
+	var r, n interface{}
+	err := json.Unmarshal([]byte(raw), &r)
+	if err != nil {
+		return "", err
+	}
+	err = json.Unmarshal([]byte(normalised), &n)
+	if err != nil {
+		return "", err
+	}
+
+	merged, err := json.Marshal(mergeValues(r, n))
+	return string(merged), err
+}
+
+func mergeValues(raw, normalised interface{}) interface{} {
+	switch n := normalised.(type) {
+	case nil:
+		return raw
+	case map[string]interface{}:
+		r, ok := raw.(map[string]interface{})
+		if !ok {
+			return n
+		}
+		merged := make(map[string]interface{})
+		for key, value := range r {
+			merged[key] = value
+		}
+		for key, value := range n {
+			merged[key] = mergeValues(r[key], value)
+		}
+		return merged
+	case []interface{}:
+		r, ok := raw.([]interface{})
+		if !ok {
+			return n
+		}
+		// The normalised tables decide which values an array has, each
+		// value is merged with a stored value it agrees with (if any).
+		used := make([]bool, len(r))
+		merged := make([]interface{}, len(n))
+		for i := range n {
+			merged[i] = n[i]
+			for j := range r {
+				if !used[j] && agrees(r[j], n[i]) {
+					used[j] = true
+					merged[i] = mergeValues(r[j], n[i])
+					break
+				}
+			}
+		}
+		return merged
+	default:
+		return n
+	}
+}
+
+// Checks if a stored value and a normalised value can be the same
+// value, i.e. all attributes they both have are equal.
+func agrees(raw, normalised interface{}) bool {
+	r, rok := raw.(map[string]interface{})
+	n, nok := normalised.(map[string]interface{})
+	if !rok || !nok {
+		return reflect.DeepEqual(raw, normalised)
+	}
+	for key, value := range n {
+		if rvalue, ok := r[key]; ok && value != nil && !agrees(rvalue, value) {
+			return false
+		}
+	}
+	return true
+}
+
+// Reads the stored resource JSON for the objects in a main table
+// matching condition, args must contain the tenant and any parameters
+// used in condition. Objects without stored JSON are left out.
+func (backend *SQLBackend) readRawJSON(tx sqlTx, table safeString, condition string, args map[string]interface{}) (map[string]string, error) {
+	named, err := tx.PrepareNamed(`SELECT id, rawJSON FROM ` + string(table) + ` WHERE tenant = :tenant AND rawJSON IS NOT NULL AND (` + condition + `)`)
+
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		ID      string `db:"id"`
+		RawJSON string `db:"rawJSON"`
+	}
+
+	err = named.Select(&rows, args)
+
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]string)
+	for _, row := range rows {
+		result[row.ID], err = backend.decrypt(row.RawJSON)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read stored JSON for %s: %v", row.ID, err)
+		}
+	}
+	return result, nil
+}
+
+// Marshals objects read from the normalised tables and merges them with
+// their stored resource JSON
+func mergeObjects(objs []ss12000v1.Object, raw map[string]string) (map[string]string, error) {
+	result := make(map[string]string)
+	for i := range objs {
+		bytes, err := json.Marshal(objs[i])
+		if err != nil {
+			return nil, err
+		}
+		id := objs[i].GetID()
+		result[id], err = mergeRawJSON(raw[id], string(bytes))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Reads one object, merged with its stored resource JSON
+func (backend *SQLBackend) readMerged(tx sqlTx, resourceType, tenant, id string) (string, error) {
+	table, err := mainTable(resourceType)
+
+	if err != nil {
+		return "", err
+	}
+
+	obj, err := backend.objectReaderOne(tx, resourceType, tenant, id)
+
+	if err != nil {
+		return "", err
+	}
+
+	raw, err := backend.readRawJSON(tx, table, "id = :id", map[string]interface{}{"tenant": tenant, "id": id})
+
+	if err != nil {
+		return "", err
+	}
+
+	merged, err := mergeObjects([]ss12000v1.Object{obj}, raw)
+
+	if err != nil {
+		return "", err
+	}
+
+	return merged[obj.GetID()], nil
+}
+
+// Renormalise parses the stored resource JSON of all objects again and
+// updates the normalised tables. This fills in columns added by
+// migrations after the objects were last modified. Meta data isn't
+// changed since the resources as seen by clients stay the same.
+func (backend *SQLBackend) Renormalise() error {
+	for _, table := range tablesForClearTenant {
+		var keys []struct {
+			Tenant string `db:"tenant"`
+			ID     string `db:"id"`
+		}
+
+		err := backend.db.Select(&keys, `SELECT tenant, id FROM `+string(table)+` WHERE rawJSON IS NOT NULL`)
+
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			err = backend.renormaliseObject(string(table), key.Tenant, key.ID)
+			if err != nil {
+				log.Printf("Failed to re-normalise %s/%s for tenant %s: %v", table, key.ID, key.Tenant, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Re-normalises one object. Main tables are named after their resource types.
+func (backend *SQLBackend) renormaliseObject(resourceType, tenant, id string) error {
+	table, err := mainTable(resourceType)
+
+	if err != nil {
+		return err
+	}
+
+	tx, cancel, err := backend.beginx(context.Background())
+
+	if err != nil {
+		return err
+	}
+
+	defer cancel()
+	defer tx.Rollback()
+
+	args := map[string]interface{}{
+		"tenant": tenant,
+		"id":     id,
+	}
+
+	// Lock the row so a concurrent modification isn't overwritten by
+	// the stored JSON we're about to read.
+	_, err = tx.NamedExec(`UPDATE `+string(table)+` SET version = version WHERE tenant = :tenant AND id = :id`, args)
+
+	if err != nil {
+		return err
+	}
+
+	raw, err := backend.readRawJSON(tx, table, "id = :id", args)
+
+	if err != nil {
+		return err
+	}
+
+	resource, ok := raw[id]
+	if !ok {
+		// Deleted since we started
+		return nil
+	}
+
+	obj, err := backend.objectParser(resourceType, resource)
+
+	if err != nil {
+		return err
+	}
+
+	err = backend.objectMutator(tx, tenant, obj)
+
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -23,7 +23,6 @@ import (
 	"fmt"
 
 	"github.com/Sambruk/windermere/ss12000v1"
-	"github.com/jmoiron/sqlx"
 )
 
 type dbSchoolUnitRow struct {
@@ -34,6 +33,7 @@ type dbSchoolUnitRow struct {
 	Organisation     *string `db:"organisation"`
 	SchoolUnitGroup  *string `db:"schoolUnitGroup"`
 	MunicipalityCode *string `db:"municipalityCode"`
+	dbMeta
 }
 
 func NewSchoolUnitRow(tenant string, schoolUnit *ss12000v1.SchoolUnit) dbSchoolUnitRow {
@@ -64,7 +64,7 @@ type dbSchoolTypeRow struct {
 	SchoolType   string `db:"schoolType"`
 }
 
-func (backend *SQLBackend) createSchoolTypes(tx *sqlx.Tx, tenant string, schoolUnit *ss12000v1.SchoolUnit) (err error) {
+func (backend *SQLBackend) createSchoolTypes(tx sqlTx, tenant string, schoolUnit *ss12000v1.SchoolUnit) (err error) {
 	if schoolUnit.SchoolTypes == nil || len(*schoolUnit.SchoolTypes) == 0 {
 		return nil
 	}
@@ -82,7 +82,7 @@ func (backend *SQLBackend) createSchoolTypes(tx *sqlx.Tx, tenant string, schoolU
 	return
 }
 
-func (backend *SQLBackend) schoolUnitCreator(tx *sqlx.Tx, tenant string, schoolUnit *ss12000v1.SchoolUnit) (id string, err error) {
+func (backend *SQLBackend) schoolUnitCreator(tx sqlTx, tenant string, schoolUnit *ss12000v1.SchoolUnit) (id string, err error) {
 	dbSchoolUnit := NewSchoolUnitRow(tenant, schoolUnit)
 
 	_, err = tx.NamedExec(`INSERT INTO SchoolUnits (tenant, id, displayName, schoolUnitCode, organisation, schoolUnitGroup, municipalityCode) VALUES (:tenant, :id, :displayName, :schoolUnitCode, :organisation, :schoolUnitGroup, :municipalityCode)`, &dbSchoolUnit)
@@ -94,7 +94,7 @@ func (backend *SQLBackend) schoolUnitCreator(tx *sqlx.Tx, tenant string, schoolU
 	return schoolUnit.GetID(), err
 }
 
-func (backend *SQLBackend) schoolUnitMutator(tx *sqlx.Tx, tenant string, schoolUnit *ss12000v1.SchoolUnit) (err error) {
+func (backend *SQLBackend) schoolUnitMutator(tx sqlTx, tenant string, schoolUnit *ss12000v1.SchoolUnit) (err error) {
 	dbSchoolUnit := NewSchoolUnitRow(tenant, schoolUnit)
 
 	_, err = tx.NamedExec(`UPDATE SchoolUnits SET displayName = :displayName, schoolUnitCode = :schoolUnitCode, organisation = :organisation, schoolUnitGroup = :schoolUnitGroup, municipalityCode = :municipalityCode WHERE tenant = :tenant AND id = :id`, &dbSchoolUnit)
@@ -115,7 +115,7 @@ func (backend *SQLBackend) schoolUnitMutator(tx *sqlx.Tx, tenant string, schoolU
 	return backend.createSchoolTypes(tx, tenant, schoolUnit)
 }
 
-func (backend *SQLBackend) schoolUnitReader(tx *sqlx.Tx, mainQuery, schoolTypeQuery string, args map[string]interface{}) ([]ss12000v1.Object, error) {
+func (backend *SQLBackend) schoolUnitReader(tx sqlTx, mainQuery, schoolTypeQuery string, args map[string]interface{}) ([]ss12000v1.Object, error) {
 	mainNamed, err := tx.PrepareNamed(mainQuery)
 	if err != nil {
 		return nil, err
@@ -155,6 +155,7 @@ func (backend *SQLBackend) schoolUnitReader(tx *sqlx.Tx, mainQuery, schoolTypeQu
 			Organisation:     org,
 			SchoolUnitGroup:  sug,
 			MunicipalityCode: dbSchoolUnits[i].MunicipalityCode,
+			SCIMResource:     ss12000v1.SCIMResource{Meta: dbSchoolUnits[i].scimMeta()},
 		}
 		index[dbSchoolUnits[i].Id] = i
 	}
@@ -178,7 +179,7 @@ func (backend *SQLBackend) schoolUnitReader(tx *sqlx.Tx, mainQuery, schoolTypeQu
 	return schoolUnits, nil
 }
 
-func (backend *SQLBackend) schoolUnitReaderAll(tx *sqlx.Tx, tenant string) ([]ss12000v1.Object, error) {
+func (backend *SQLBackend) schoolUnitReaderAll(tx sqlTx, tenant string) ([]ss12000v1.Object, error) {
 	return backend.schoolUnitReader(tx, `SELECT * FROM SchoolUnits WHERE tenant = :tenant`,
 		`SELECT * FROM SchoolTypes WHERE tenant = :tenant`,
 		map[string]interface{}{
@@ -186,7 +187,13 @@ func (backend *SQLBackend) schoolUnitReaderAll(tx *sqlx.Tx, tenant string) ([]ss
 		})
 }
 
-func (backend *SQLBackend) schoolUnitReaderOne(tx *sqlx.Tx, tenant, id string) (ss12000v1.Object, error) {
+func (backend *SQLBackend) schoolUnitReaderSelected(tx sqlTx, selection sqlSelection, args map[string]interface{}) ([]ss12000v1.Object, error) {
+	return backend.schoolUnitReader(tx, `SELECT * FROM SchoolUnits WHERE tenant = :tenant AND (`+selection.where+`) ORDER BY `+selection.order+selection.paging,
+		`SELECT * FROM SchoolTypes WHERE tenant = :tenant AND schoolUnitId IN (`+selection.ids("SchoolUnits")+`)`,
+		args)
+}
+
+func (backend *SQLBackend) schoolUnitReaderOne(tx sqlTx, tenant, id string) (ss12000v1.Object, error) {
 	schoolUnits, err := backend.schoolUnitReader(tx, `SELECT * FROM SchoolUnits WHERE tenant = :tenant AND id = :id`,
 		`SELECT * FROM SchoolTypes WHERE tenant = :tenant AND schoolUnitId = :id`,
 		map[string]interface{}{
@@ -23,13 +23,13 @@ import (
 	"fmt"
 
 	"github.com/Sambruk/windermere/ss12000v1"
-	"github.com/jmoiron/sqlx"
 )
 
 type dbSchoolUnitGroupRow struct {
 	Tenant      string `db:"tenant"`
 	Id          string `db:"id"`
 	DisplayName string `db:"displayName"`
+	dbMeta
 }
 
 func NewSchoolUnitGroupRow(tenant string, schoolUnitGroup *ss12000v1.SchoolUnitGroup) dbSchoolUnitGroupRow {
@@ -40,21 +40,21 @@ func NewSchoolUnitGroupRow(tenant string, schoolUnitGroup *ss12000v1.SchoolUnitG
 	}
 }
 
-func (backend *SQLBackend) schoolUnitGroupCreator(tx *sqlx.Tx, tenant string, schoolUnitGroup *ss12000v1.SchoolUnitGroup) (id string, err error) {
+func (backend *SQLBackend) schoolUnitGroupCreator(tx sqlTx, tenant string, schoolUnitGroup *ss12000v1.SchoolUnitGroup) (id string, err error) {
 	dbSchoolUnitGroup := NewSchoolUnitGroupRow(tenant, schoolUnitGroup)
 
 	_, err = tx.NamedExec(`INSERT INTO SchoolUnitGroups (tenant, id, displayName) VALUES (:tenant, :id, :displayName)`, &dbSchoolUnitGroup)
 	return schoolUnitGroup.GetID(), err
 }
 
-func (backend *SQLBackend) schoolUnitGroupMutator(tx *sqlx.Tx, tenant string, schoolUnitGroup *ss12000v1.SchoolUnitGroup) (err error) {
+func (backend *SQLBackend) schoolUnitGroupMutator(tx sqlTx, tenant string, schoolUnitGroup *ss12000v1.SchoolUnitGroup) (err error) {
 	dbSchoolUnitGroup := NewSchoolUnitGroupRow(tenant, schoolUnitGroup)
 
 	_, err = tx.NamedExec(`UPDATE SchoolUnitGroups SET displayName = :displayName WHERE tenant = :tenant AND id = :id`, &dbSchoolUnitGroup)
 	return
 }
 
-func (backend *SQLBackend) schoolUnitGroupReader(tx *sqlx.Tx, mainQuery string, args map[string]interface{}) ([]ss12000v1.Object, error) {
+func (backend *SQLBackend) schoolUnitGroupReader(tx sqlTx, mainQuery string, args map[string]interface{}) ([]ss12000v1.Object, error) {
 	mainNamed, err := tx.PrepareNamed(mainQuery)
 	if err != nil {
 		return nil, err
@@ -69,21 +69,27 @@ func (backend *SQLBackend) schoolUnitGroupReader(tx *sqlx.Tx, mainQuery string,
 	schoolUnitGroups := make([]ss12000v1.Object, len(dbSchoolUnitGroups))
 	for i := range dbSchoolUnitGroups {
 		schoolUnitGroups[i] = &ss12000v1.SchoolUnitGroup{
-			ExternalID:  dbSchoolUnitGroups[i].Id,
-			DisplayName: dbSchoolUnitGroups[i].DisplayName,
+			ExternalID:   dbSchoolUnitGroups[i].Id,
+			DisplayName:  dbSchoolUnitGroups[i].DisplayName,
+			SCIMResource: ss12000v1.SCIMResource{Meta: dbSchoolUnitGroups[i].scimMeta()},
 		}
 	}
 	return schoolUnitGroups, nil
 }
 
-func (backend *SQLBackend) schoolUnitGroupReaderAll(tx *sqlx.Tx, tenant string) ([]ss12000v1.Object, error) {
+func (backend *SQLBackend) schoolUnitGroupReaderAll(tx sqlTx, tenant string) ([]ss12000v1.Object, error) {
 	return backend.schoolUnitGroupReader(tx, `SELECT * FROM SchoolUnitGroups WHERE tenant = :tenant`,
 		map[string]interface{}{
 			"tenant": tenant,
 		})
 }
 
-func (backend *SQLBackend) schoolUnitGroupReaderOne(tx *sqlx.Tx, tenant, id string) (ss12000v1.Object, error) {
+func (backend *SQLBackend) schoolUnitGroupReaderSelected(tx sqlTx, selection sqlSelection, args map[string]interface{}) ([]ss12000v1.Object, error) {
+	return backend.schoolUnitGroupReader(tx, `SELECT * FROM SchoolUnitGroups WHERE tenant = :tenant AND (`+selection.where+`) ORDER BY `+selection.order+selection.paging,
+		args)
+}
+
+func (backend *SQLBackend) schoolUnitGroupReaderOne(tx sqlTx, tenant, id string) (ss12000v1.Object, error) {
 	schoolUnitGroups, err := backend.schoolUnitGroupReader(tx, `SELECT * FROM SchoolUnitGroups WHERE tenant = :tenant AND id = :id`,
 		map[string]interface{}{
 			"tenant": tenant,
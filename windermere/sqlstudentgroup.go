@@ -23,7 +23,6 @@ import (
 	"fmt"
 
 	"github.com/Sambruk/windermere/ss12000v1"
-	"github.com/jmoiron/sqlx"
 )
 
 type dbStudentGroupRow struct {
@@ -32,6 +31,8 @@ type dbStudentGroupRow struct {
 	DisplayName      string  `db:"displayName"`
 	Owner            string  `db:"owner"`
 	StudentGroupType *string `db:"studentGroupType"`
+	SchoolType       *string `db:"schoolType"`
+	dbMeta
 }
 
 func NewStudentGroupRow(tenant string, group *ss12000v1.StudentGroup) dbStudentGroupRow {
@@ -41,6 +42,7 @@ func NewStudentGroupRow(tenant string, group *ss12000v1.StudentGroup) dbStudentG
 		DisplayName:      group.DisplayName,
 		Owner:            group.Owner.Value,
 		StudentGroupType: group.Type,
+		SchoolType:       group.SchoolType,
 	}
 }
 
@@ -50,7 +52,7 @@ type dbStudentMembershipRow struct {
 	UserId  string `db:"userId"`
 }
 
-func (backend *SQLBackend) createMemberships(tx *sqlx.Tx, tenant string, group *ss12000v1.StudentGroup) (err error) {
+func (backend *SQLBackend) createMemberships(tx sqlTx, tenant string, group *ss12000v1.StudentGroup) (err error) {
 	if len(group.StudentMemberships) == 0 {
 		return nil
 	}
@@ -68,10 +70,10 @@ func (backend *SQLBackend) createMemberships(tx *sqlx.Tx, tenant string, group *
 	return
 }
 
-func (backend *SQLBackend) studentGroupCreator(tx *sqlx.Tx, tenant string, group *ss12000v1.StudentGroup) (id string, err error) {
+func (backend *SQLBackend) studentGroupCreator(tx sqlTx, tenant string, group *ss12000v1.StudentGroup) (id string, err error) {
 	dbGroup := NewStudentGroupRow(tenant, group)
 
-	_, err = tx.NamedExec(`INSERT INTO StudentGroups (tenant, id, displayName, owner, studentGroupType) VALUES (:tenant, :id, :displayName, :owner, :studentGroupType)`, &dbGroup)
+	_, err = tx.NamedExec(`INSERT INTO StudentGroups (tenant, id, displayName, owner, studentGroupType, schoolType) VALUES (:tenant, :id, :displayName, :owner, :studentGroupType, :schoolType)`, &dbGroup)
 	if err != nil {
 		return "", err
 	}
@@ -83,10 +85,10 @@ func (backend *SQLBackend) studentGroupCreator(tx *sqlx.Tx, tenant string, group
 	return group.ID, err
 }
 
-func (backend *SQLBackend) studentGroupMutator(tx *sqlx.Tx, tenant string, group *ss12000v1.StudentGroup) (err error) {
+func (backend *SQLBackend) studentGroupMutator(tx sqlTx, tenant string, group *ss12000v1.StudentGroup) (err error) {
 	dbGroup := NewStudentGroupRow(tenant, group)
 
-	_, err = tx.NamedExec(`UPDATE StudentGroups SET displayName = :displayName, owner = :owner, studentGroupType = :studentGroupType WHERE tenant = :tenant AND id = :id`, &dbGroup)
+	_, err = tx.NamedExec(`UPDATE StudentGroups SET displayName = :displayName, owner = :owner, studentGroupType = :studentGroupType, schoolType = :schoolType WHERE tenant = :tenant AND id = :id`, &dbGroup)
 	if err != nil {
 		return err
 	}
@@ -104,7 +106,7 @@ func (backend *SQLBackend) studentGroupMutator(tx *sqlx.Tx, tenant string, group
 	return backend.createMemberships(tx, tenant, group)
 }
 
-func (backend *SQLBackend) studentGroupReader(tx *sqlx.Tx, mainQuery, membershipQuery string, args map[string]interface{}) ([]ss12000v1.Object, error) {
+func (backend *SQLBackend) studentGroupReader(tx sqlTx, mainQuery, membershipQuery string, args map[string]interface{}) ([]ss12000v1.Object, error) {
 	mainNamed, err := tx.PrepareNamed(mainQuery)
 	if err != nil {
 		return nil, err
@@ -129,7 +131,9 @@ func (backend *SQLBackend) studentGroupReader(tx *sqlx.Tx, mainQuery, membership
 			Owner: ss12000v1.SCIMReference{
 				Value: dbGroups[i].Owner,
 			},
-			Type: dbGroups[i].StudentGroupType,
+			Type:         dbGroups[i].StudentGroupType,
+			SchoolType:   dbGroups[i].SchoolType,
+			SCIMResource: ss12000v1.SCIMResource{Meta: dbGroups[i].scimMeta()},
 		}
 		index[dbGroups[i].Id] = i
 	}
@@ -151,7 +155,7 @@ func (backend *SQLBackend) studentGroupReader(tx *sqlx.Tx, mainQuery, membership
 	return groups, nil
 }
 
-func (backend *SQLBackend) studentGroupReaderAll(tx *sqlx.Tx, tenant string) ([]ss12000v1.Object, error) {
+func (backend *SQLBackend) studentGroupReaderAll(tx sqlTx, tenant string) ([]ss12000v1.Object, error) {
 	return backend.studentGroupReader(tx, `SELECT * FROM StudentGroups WHERE tenant = :tenant`,
 		`SELECT * FROM StudentMemberships WHERE tenant = :tenant`,
 		map[string]interface{}{
@@ -159,7 +163,13 @@ func (backend *SQLBackend) studentGroupReaderAll(tx *sqlx.Tx, tenant string) ([]
 		})
 }
 
-func (backend *SQLBackend) studentGroupReaderOne(tx *sqlx.Tx, tenant, id string) (ss12000v1.Object, error) {
+func (backend *SQLBackend) studentGroupReaderSelected(tx sqlTx, selection sqlSelection, args map[string]interface{}) ([]ss12000v1.Object, error) {
+	return backend.studentGroupReader(tx, `SELECT * FROM StudentGroups WHERE tenant = :tenant AND (`+selection.where+`) ORDER BY `+selection.order+selection.paging,
+		`SELECT * FROM StudentMemberships WHERE tenant = :tenant AND groupId IN (`+selection.ids("StudentGroups")+`)`,
+		args)
+}
+
+func (backend *SQLBackend) studentGroupReaderOne(tx sqlTx, tenant, id string) (ss12000v1.Object, error) {
 	groups, err := backend.studentGroupReader(tx, `SELECT * FROM StudentGroups WHERE tenant = :tenant AND id = :id`,
 		`SELECT * FROM StudentMemberships WHERE tenant = :tenant AND groupId = :id`,
 		map[string]interface{}{
@@ -0,0 +1,62 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package windermere
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// A transaction together with the context of the operation it belongs to.
+// The statements of the transaction are run with the context, so they are
+// cancelled when the client goes away or the request times out.
+type sqlTx struct {
+	*sqlx.Tx
+	ctx context.Context
+}
+
+func (tx sqlTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	return tx.ExecContext(tx.ctx, query, args...)
+}
+
+func (tx sqlTx) NamedExec(query string, arg interface{}) (sql.Result, error) {
+	return tx.NamedExecContext(tx.ctx, query, arg)
+}
+
+func (tx sqlTx) PrepareNamed(query string) (namedStmt, error) {
+	stmt, err := tx.PrepareNamedContext(tx.ctx, query)
+	return namedStmt{NamedStmt: stmt, ctx: tx.ctx}, err
+}
+
+// A prepared statement in a sqlTx, runs with the transaction's context
+type namedStmt struct {
+	*sqlx.NamedStmt
+	ctx context.Context
+}
+
+func (stmt namedStmt) Get(dest interface{}, arg interface{}) error {
+	return stmt.GetContext(stmt.ctx, dest, arg)
+}
+
+func (stmt namedStmt) Select(dest interface{}, arg interface{}) error {
+	return stmt.SelectContext(stmt.ctx, dest, arg)
+}
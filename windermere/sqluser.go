@@ -20,29 +20,54 @@
 package windermere
 
 import (
+	"database/sql/driver"
 	"fmt"
 
 	"github.com/Sambruk/windermere/ss12000v1"
-	"github.com/jmoiron/sqlx"
 )
 
 type dbUserRow struct {
-	Tenant      string `db:"tenant"`
-	Id          string `db:"id"`
-	UserName    string `db:"userName"`
-	FamilyName  string `db:"familyName"`
-	GivenName   string `db:"givenName"`
-	DisplayName string `db:"displayName"`
+	Tenant          string  `db:"tenant"`
+	Id              string  `db:"id"`
+	UserName        string  `db:"userName"`
+	FamilyName      string  `db:"familyName"`
+	GivenName       string  `db:"givenName"`
+	DisplayName     string  `db:"displayName"`
+	CivicNo         *string `db:"civicNo"`
+	SecurityMarking *dbBool `db:"securityMarking"`
+	dbMeta
+}
+
+// A boolean stored as 0/1 since there's no boolean type common to all
+// databases. Some drivers (PostgreSQL) won't convert booleans to integers.
+type dbBool bool
+
+func (b dbBool) Value() (driver.Value, error) {
+	if b {
+		return int64(1), nil
+	}
+	return int64(0), nil
+}
+
+func (b *dbBool) Scan(src interface{}) error {
+	v, err := driver.Bool.ConvertValue(src)
+	if err != nil {
+		return err
+	}
+	*b = dbBool(v.(bool))
+	return nil
 }
 
 func NewUserRow(tenant string, user *ss12000v1.User) dbUserRow {
 	return dbUserRow{
-		Tenant:      tenant,
-		Id:          user.ID,
-		UserName:    user.UserName,
-		FamilyName:  user.Name.FamilyName,
-		GivenName:   user.Name.GivenName,
-		DisplayName: user.DisplayName,
+		Tenant:          tenant,
+		Id:              user.ID,
+		UserName:        user.UserName,
+		FamilyName:      user.Name.FamilyName,
+		GivenName:       user.Name.GivenName,
+		DisplayName:     user.DisplayName,
+		CivicNo:         user.Extension.CivicNo,
+		SecurityMarking: (*dbBool)(user.Extension.SecurityMarking),
 	}
 }
 
@@ -54,13 +79,23 @@ type dbEmailRow struct {
 }
 
 type dbEnrolmentRow struct {
-	Tenant     string `db:"tenant"`
-	UserId     string `db:"userId"`
-	Value      string `db:"value"`
-	SchoolYear *int   `db:"schoolYear"`
+	Tenant      string  `db:"tenant"`
+	UserId      string  `db:"userId"`
+	Value       string  `db:"value"`
+	SchoolYear  *int    `db:"schoolYear"`
+	SchoolType  *string `db:"schoolType"`
+	ProgramCode *string `db:"programCode"`
+}
+
+type dbUserRelationRow struct {
+	Tenant       string  `db:"tenant"`
+	UserId       string  `db:"userId"`
+	Value        string  `db:"value"`
+	RelationType string  `db:"relationType"`
+	DisplayName  *string `db:"displayName"`
 }
 
-func (backend *SQLBackend) createEmails(tx *sqlx.Tx, tenant string, user *ss12000v1.User) (err error) {
+func (backend *SQLBackend) createEmails(tx sqlTx, tenant string, user *ss12000v1.User) (err error) {
 	if len(user.Emails) == 0 {
 		return nil
 	}
@@ -81,7 +116,7 @@ func (backend *SQLBackend) createEmails(tx *sqlx.Tx, tenant string, user *ss1200
 	return
 }
 
-func (backend *SQLBackend) createEnrolments(tx *sqlx.Tx, tenant string, user *ss12000v1.User) (err error) {
+func (backend *SQLBackend) createEnrolments(tx sqlTx, tenant string, user *ss12000v1.User) (err error) {
 	if len(user.Extension.Enrolments) == 0 {
 		return nil
 	}
@@ -89,21 +124,50 @@ func (backend *SQLBackend) createEnrolments(tx *sqlx.Tx, tenant string, user *ss
 
 	for i := range user.Extension.Enrolments {
 		dbEnrolments[i] = dbEnrolmentRow{
-			Tenant:     tenant,
-			UserId:     user.ID,
-			Value:      user.Extension.Enrolments[i].Value,
-			SchoolYear: user.Extension.Enrolments[i].SchoolYear,
+			Tenant:      tenant,
+			UserId:      user.ID,
+			Value:       user.Extension.Enrolments[i].Value,
+			SchoolYear:  user.Extension.Enrolments[i].SchoolYear,
+			SchoolType:  user.Extension.Enrolments[i].SchoolType,
+			ProgramCode: user.Extension.Enrolments[i].ProgramCode,
+		}
+	}
+
+	_, err = tx.NamedExec(`INSERT INTO Enrolments (tenant, userId, value, schoolYear, schoolType, programCode) VALUES (:tenant, :userId, :value, :schoolYear, :schoolType, :programCode)`, dbEnrolments)
+	return
+}
+
+func (backend *SQLBackend) createUserRelations(tx sqlTx, tenant string, user *ss12000v1.User) (err error) {
+	if len(user.Extension.UserRelations) == 0 {
+		return nil
+	}
+	dbUserRelations := make([]dbUserRelationRow, len(user.Extension.UserRelations))
+
+	for i := range user.Extension.UserRelations {
+		dbUserRelations[i] = dbUserRelationRow{
+			Tenant:       tenant,
+			UserId:       user.ID,
+			Value:        user.Extension.UserRelations[i].Value,
+			RelationType: user.Extension.UserRelations[i].RelationType,
+		}
+		dbUserRelations[i].DisplayName, err = backend.encryptOptional(user.Extension.UserRelations[i].DisplayName)
+		if err != nil {
+			return err
 		}
 	}
 
-	_, err = tx.NamedExec(`INSERT INTO Enrolments (tenant, userId, value, schoolYear) VALUES (:tenant, :userId, :value, :schoolYear)`, dbEnrolments)
+	_, err = tx.NamedExec(`INSERT INTO UserRelations (tenant, userId, value, relationType, displayName) VALUES (:tenant, :userId, :value, :relationType, :displayName)`, dbUserRelations)
 	return
 }
 
-func (backend *SQLBackend) userCreator(tx *sqlx.Tx, tenant string, user *ss12000v1.User) (id string, err error) {
+func (backend *SQLBackend) userCreator(tx sqlTx, tenant string, user *ss12000v1.User) (id string, err error) {
 	dbUser := NewUserRow(tenant, user)
+	dbUser.CivicNo, err = backend.encryptOptional(dbUser.CivicNo)
+	if err != nil {
+		return "", err
+	}
 
-	_, err = tx.NamedExec(`INSERT INTO Users (tenant, id, userName, familyName, givenName, displayName) VALUES (:tenant, :id, :userName, :familyName, :givenName, :displayName)`, &dbUser)
+	_, err = tx.NamedExec(`INSERT INTO Users (tenant, id, userName, familyName, givenName, displayName, civicNo, securityMarking) VALUES (:tenant, :id, :userName, :familyName, :givenName, :displayName, :civicNo, :securityMarking)`, &dbUser)
 	if err != nil {
 		return "", err
 	}
@@ -113,13 +177,21 @@ func (backend *SQLBackend) userCreator(tx *sqlx.Tx, tenant string, user *ss12000
 		return "", err
 	}
 	err = backend.createEnrolments(tx, tenant, user)
+	if err != nil {
+		return "", err
+	}
+	err = backend.createUserRelations(tx, tenant, user)
 	return user.ID, err
 }
 
-func (backend *SQLBackend) userMutator(tx *sqlx.Tx, tenant string, user *ss12000v1.User) (err error) {
+func (backend *SQLBackend) userMutator(tx sqlTx, tenant string, user *ss12000v1.User) (err error) {
 	dbUser := NewUserRow(tenant, user)
+	dbUser.CivicNo, err = backend.encryptOptional(dbUser.CivicNo)
+	if err != nil {
+		return err
+	}
 
-	_, err = tx.NamedExec(`UPDATE Users SET userName = :userName, familyName = :familyName, givenName = :givenName, displayName = :displayName WHERE tenant = :tenant AND id = :id`, &dbUser)
+	_, err = tx.NamedExec(`UPDATE Users SET userName = :userName, familyName = :familyName, givenName = :givenName, displayName = :displayName, civicNo = :civicNo, securityMarking = :securityMarking WHERE tenant = :tenant AND id = :id`, &dbUser)
 	if err != nil {
 		return err
 	}
@@ -150,10 +222,26 @@ func (backend *SQLBackend) userMutator(tx *sqlx.Tx, tenant string, user *ss12000
 		return err
 	}
 
-	return backend.createEnrolments(tx, tenant, user)
+	err = backend.createEnrolments(tx, tenant, user)
+
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.NamedExec(`DELETE FROM UserRelations WHERE tenant = :tenant AND userId = :userId`,
+		map[string]interface{}{
+			"tenant": tenant,
+			"userId": user.ID,
+		})
+
+	if err != nil {
+		return err
+	}
+
+	return backend.createUserRelations(tx, tenant, user)
 }
 
-func (backend *SQLBackend) userReader(tx *sqlx.Tx, mainQuery, emailQuery, enrolmentQuery string, args map[string]interface{}) ([]ss12000v1.Object, error) {
+func (backend *SQLBackend) userReader(tx sqlTx, mainQuery, emailQuery, enrolmentQuery, userRelationQuery string, args map[string]interface{}) ([]ss12000v1.Object, error) {
 	mainNamed, err := tx.PrepareNamed(mainQuery)
 	if err != nil {
 		return nil, err
@@ -168,6 +256,11 @@ func (backend *SQLBackend) userReader(tx *sqlx.Tx, mainQuery, emailQuery, enrolm
 		return nil, err
 	}
 
+	userRelationNamed, err := tx.PrepareNamed(userRelationQuery)
+	if err != nil {
+		return nil, err
+	}
+
 	dbUsers := []dbUserRow{}
 	err = mainNamed.Select(&dbUsers, args)
 	if err != nil {
@@ -177,6 +270,10 @@ func (backend *SQLBackend) userReader(tx *sqlx.Tx, mainQuery, emailQuery, enrolm
 	users := make([]ss12000v1.Object, len(dbUsers))
 	index := make(map[string]int)
 	for i := range dbUsers {
+		dbUsers[i].CivicNo, err = backend.decryptOptional(dbUsers[i].CivicNo)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read civicNo for %s: %v", dbUsers[i].Id, err)
+		}
 		users[i] = &ss12000v1.User{
 			ID:       dbUsers[i].Id,
 			UserName: dbUsers[i].UserName,
@@ -185,6 +282,11 @@ func (backend *SQLBackend) userReader(tx *sqlx.Tx, mainQuery, emailQuery, enrolm
 				GivenName:  dbUsers[i].GivenName,
 			},
 			DisplayName: dbUsers[i].DisplayName,
+			Extension: ss12000v1.UserExtension{
+				CivicNo:         dbUsers[i].CivicNo,
+				SecurityMarking: (*bool)(dbUsers[i].SecurityMarking),
+			},
+			SCIMResource: ss12000v1.SCIMResource{Meta: dbUsers[i].scimMeta()},
 		}
 		index[dbUsers[i].Id] = i
 	}
@@ -219,27 +321,60 @@ func (backend *SQLBackend) userReader(tx *sqlx.Tx, mainQuery, emailQuery, enrolm
 		user := users[index[enrolment.UserId]].(*ss12000v1.User)
 		user.Extension.Enrolments = append(user.Extension.Enrolments,
 			ss12000v1.Enrolment{
-				Value:      enrolment.Value,
-				SchoolYear: enrolment.SchoolYear,
+				Value:       enrolment.Value,
+				SchoolYear:  enrolment.SchoolYear,
+				SchoolType:  enrolment.SchoolType,
+				ProgramCode: enrolment.ProgramCode,
+			})
+	}
+
+	dbUserRelations := []dbUserRelationRow{}
+	err = userRelationNamed.Select(&dbUserRelations, args)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range dbUserRelations {
+		relation := &dbUserRelations[i]
+		user := users[index[relation.UserId]].(*ss12000v1.User)
+		relation.DisplayName, err = backend.decryptOptional(relation.DisplayName)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read user relation for %s: %v", relation.UserId, err)
+		}
+		user.Extension.UserRelations = append(user.Extension.UserRelations,
+			ss12000v1.UserRelation{
+				Value:        relation.Value,
+				RelationType: relation.RelationType,
+				DisplayName:  relation.DisplayName,
 			})
 	}
 
 	return users, nil
 }
 
-func (backend *SQLBackend) userReaderAll(tx *sqlx.Tx, tenant string) ([]ss12000v1.Object, error) {
+func (backend *SQLBackend) userReaderAll(tx sqlTx, tenant string) ([]ss12000v1.Object, error) {
 	return backend.userReader(tx, `SELECT * FROM Users WHERE tenant = :tenant`,
 		`SELECT * FROM Emails WHERE tenant = :tenant`,
 		`SELECT * FROM Enrolments WHERE tenant = :tenant`,
+		`SELECT * FROM UserRelations WHERE tenant = :tenant`,
 		map[string]interface{}{
 			"tenant": tenant,
 		})
 }
 
-func (backend *SQLBackend) userReaderOne(tx *sqlx.Tx, tenant, id string) (ss12000v1.Object, error) {
+func (backend *SQLBackend) userReaderSelected(tx sqlTx, selection sqlSelection, args map[string]interface{}) ([]ss12000v1.Object, error) {
+	return backend.userReader(tx, `SELECT * FROM Users WHERE tenant = :tenant AND (`+selection.where+`) ORDER BY `+selection.order+selection.paging,
+		`SELECT * FROM Emails WHERE tenant = :tenant AND userId IN (`+selection.ids("Users")+`)`,
+		`SELECT * FROM Enrolments WHERE tenant = :tenant AND userId IN (`+selection.ids("Users")+`)`,
+		`SELECT * FROM UserRelations WHERE tenant = :tenant AND userId IN (`+selection.ids("Users")+`)`,
+		args)
+}
+
+func (backend *SQLBackend) userReaderOne(tx sqlTx, tenant, id string) (ss12000v1.Object, error) {
 	users, err := backend.userReader(tx, `SELECT * FROM Users WHERE tenant = :tenant AND id = :id`,
 		`SELECT * FROM Emails WHERE tenant = :tenant AND userId = :id`,
 		`SELECT * FROM Enrolments WHERE tenant = :tenant AND userId = :id`,
+		`SELECT * FROM UserRelations WHERE tenant = :tenant AND userId = :id`,
 		map[string]interface{}{
 			"tenant": tenant,
 			"id":     id,
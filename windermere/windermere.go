@@ -22,8 +22,10 @@ package windermere
 import (
 	"encoding/json"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/Sambruk/windermere/scimserverlite"
@@ -31,6 +33,7 @@ import (
 	_ "github.com/denisenkom/go-mssqldb"
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
+	_ "github.com/lib/pq"
 	_ "modernc.org/sqlite"
 )
 
@@ -39,6 +42,17 @@ type Windermere struct {
 	backingPath string
 	server      *scimserverlite.Server
 	handler     http.Handler
+
+	// For file storage with a journal, see WithJournal
+	journal       *scimserverlite.Journal
+	stopSnapshots chan struct{}
+	snapshots     sync.WaitGroup
+
+	// For file storage with one file per tenant, see WithTenantDirectory
+	tenantFiles bool
+
+	// Encrypts file storage, see WithEncryption
+	codec scimserverlite.Codec
 }
 
 func (wind *Windermere) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -46,11 +60,135 @@ func (wind *Windermere) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 }
 
 func (wind *Windermere) Shutdown() error {
-	return wind.Save()
+	if wind.stopSnapshots != nil {
+		close(wind.stopSnapshots)
+		wind.snapshots.Wait()
+	}
+
+	err := wind.Save()
+
+	if wind.journal != nil {
+		if closeErr := wind.journal.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if wind.tenantFiles {
+		if closeErr := wind.backend.(*scimserverlite.InMemoryBackend).Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
 }
 
-func New(backingType, backingSource string, tenantGetter scimserverlite.TenantGetter, v Validator) (*Windermere, error) {
+// Option configures optional settings in New
+type Option func(*options)
+
+type options struct {
+	baseURL         string
+	sql             SQLConfig
+	journal         JournalConfig
+	tenantDirectory string
+	keyring         *Keyring
+	plaintext       PlaintextPolicy
+	strictLoading   bool
+}
+
+// WithBaseURL sets the URL clients use to reach Windermere, which is used
+// for the locations of resources. By default it's derived from each request.
+func WithBaseURL(baseURL string) Option {
+	return func(o *options) {
+		o.baseURL = baseURL
+	}
+}
+
+// WithSQLConfig configures the connection pool and retry behaviour when
+// using SQL storage. By default DefaultSQLConfig is used.
+func WithSQLConfig(config SQLConfig) Option {
+	return func(o *options) {
+		o.sql = config
+	}
+}
+
+// JournalConfig configures the journal kept with file storage. Without a
+// journal the file is only written at shutdown.
+type JournalConfig struct {
+	Enabled bool
+
+	// When the journal is flushed to disk
+	Sync         scimserverlite.SyncPolicy
+	SyncInterval time.Duration
+
+	// How often the journal is compacted into the file (0 means only
+	// at startup and shutdown)
+	SnapshotInterval time.Duration
+}
+
+// WithJournal configures the journal for file storage. By default no
+// journal is kept.
+func WithJournal(config JournalConfig) Option {
+	return func(o *options) {
+		o.journal = config
+	}
+}
+
+// WithTenantDirectory makes file storage keep each tenant in a file of
+// its own in a directory, so tenants are loaded when first used and only
+// modified tenants are saved. If the ordinary file exists it is migrated
+// to the directory at startup, and renamed with the suffix ".migrated".
+func WithTenantDirectory(path string) Option {
+	return func(o *options) {
+		o.tenantDirectory = path
+	}
+}
+
+// WithEncryption encrypts storage with keys from a keyring. With file
+// storage everything is encrypted (the file, journals and the tenant
+// directory), with SQL storage the stored resource JSON and the sensitive
+// columns are (see SQLBackend.UseEncryption). Unencrypted data is
+// encrypted when it's written, see Reencrypt and ReencryptSQL for
+// encrypting everything at once.
+func WithEncryption(keyring *Keyring) Option {
+	return func(o *options) {
+		o.keyring = keyring
+	}
+}
+
+// WithPlaintextPolicy decides whether encrypted storage may contain
+// unencrypted data. By default it's PlaintextUntilReencrypted.
+func WithPlaintextPolicy(policy PlaintextPolicy) Option {
+	return func(o *options) {
+		o.plaintext = policy
+	}
+}
+
+// WithStrictLoading makes file storage refuse to load if any stored
+// resource is invalid. Otherwise invalid resources are quarantined, see
+// GetQuarantine. With a tenant directory, a tenant with invalid resources
+// fails to load when it's first used.
+func WithStrictLoading(strict bool) Option {
+	return func(o *options) {
+		o.strictLoading = strict
+	}
+}
+
+func New(backingType, backingSource string, tenantGetter scimserverlite.TenantGetter, v Validator, opts ...Option) (*Windermere, error) {
+	o := options{sql: DefaultSQLConfig()}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
 	var b scimserverlite.Backend
+	var journal *scimserverlite.Journal
+	var codec scimserverlite.SourceCodec = unencrypted{}
+	if o.keyring != nil {
+		if o.plaintext == PlaintextRejected ||
+			o.plaintext == PlaintextUntilReencrypted && reencrypted(backingSource) {
+			codec = o.keyring.rejectingPlaintext()
+		} else {
+			codec = o.keyring
+		}
+	}
+	compact := false
 	parser := validatingObjectParser(v, objectParser)
 
 	// TODO: remove this untypedObjectParser once InMemory-backend and Dummy-backend are SS12000-aware
@@ -59,12 +197,54 @@ func New(backingType, backingSource string, tenantGetter scimserverlite.TenantGe
 	}
 	if backingType == "file" {
 		inMemoryBackend := scimserverlite.NewInMemoryBackend(scimserverlite.CreateIDFromExternalID, untypedObjectParser)
+		inMemoryBackend.SetCodec(codec)
+		inMemoryBackend.SetStrictLoading(o.strictLoading)
+
+		if o.tenantDirectory != "" {
+			err := inMemoryBackend.UseTenantDirectory(&scimserverlite.TenantDirectory{
+				Path:         o.tenantDirectory,
+				Journal:      o.journal.Enabled,
+				Sync:         o.journal.Sync,
+				SyncInterval: o.journal.SyncInterval,
+				WriteFile:    writeSnapshot,
+			})
+
+			if err != nil {
+				return nil, fmt.Errorf("failed to use tenant directory: %v", err)
+			}
+
+			// The ordinary file is migrated to the tenant directory
+			if _, err := os.Stat(backingSource); err == nil {
+				compact = true
+			}
+		}
 
-		err := loadSCIMBackend(inMemoryBackend, backingSource)
+		// A journal left from the last run is compacted into the file
+		// once it has been replayed
+		if _, err := os.Stat(journalPath(backingSource)); err == nil {
+			compact = true
+		}
+
+		err := loadSCIMBackend(inMemoryBackend, backingSource, codec)
 
 		if err != nil {
 			return nil, fmt.Errorf("failed to read SS12000 model from file: %v", err)
 		}
+
+		if report := inMemoryBackend.LoadReport(); report.Invalid() > 0 {
+			log.Printf("Quarantined %d invalid stored resources:\n%s", report.Invalid(), report)
+			// The file is saved without them
+			compact = true
+		}
+
+		if o.journal.Enabled && o.tenantDirectory == "" {
+			journal, err = scimserverlite.OpenJournal(journalPath(backingSource), o.journal.Sync, o.journal.SyncInterval)
+
+			if err != nil {
+				return nil, fmt.Errorf("failed to open journal: %v", err)
+			}
+			inMemoryBackend.SetJournal(journal)
+		}
 		b = inMemoryBackend
 	} else if backingType == "dummy" {
 		dummyBackend := scimserverlite.NewDummyBackend(untypedObjectParser)
@@ -76,13 +256,19 @@ func New(backingType, backingSource string, tenantGetter scimserverlite.TenantGe
 			return nil, fmt.Errorf("failed to open connection to database: %v", err)
 		}
 
-		// Recommended by the MySQL driver documentation,
-		// should perhaps be configurable?
-		db.SetConnMaxLifetime(time.Minute * 3)
-		db.SetMaxOpenConns(10)
-		db.SetMaxIdleConns(10)
+		o.sql.SetPool(db)
 
-		sqlBackend, err := NewSQLBackend(db, parser)
+		sqlBackend, err := NewSQLBackendWithConfig(db, parser, o.sql)
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to initialize SQL backend: %v", err)
+		}
+
+		if o.keyring != nil {
+			err = sqlBackend.UseEncryption(o.keyring, o.plaintext)
+		} else {
+			err = sqlBackend.ensureNotEncrypted()
+		}
 
 		if err != nil {
 			return nil, fmt.Errorf("failed to initialize SQL backend: %v", err)
@@ -94,26 +280,109 @@ func New(backingType, backingSource string, tenantGetter scimserverlite.TenantGe
 		"SchoolUnits", "SchoolUnitGroups", "Employments", "Activities"}
 
 	s := scimserverlite.NewServer(endpoints, b, tenantGetter)
+	s.EnableDiscovery(discoveryResources(endpoints))
+	if o.baseURL != "" {
+		s.SetBaseURL(o.baseURL)
+	}
 
 	result := &Windermere{
 		backend:     b,
 		backingPath: backingSource,
 		server:      s,
 		handler:     putCompatibilityHandler(s),
+		journal:     journal,
+		tenantFiles: o.tenantDirectory != "",
+		codec:       codec,
+	}
+
+	if compact {
+		err := result.Save()
+
+		if err != nil {
+			return nil, err
+		}
+
+		if result.tenantFiles {
+			err = retireFile(backingSource)
+
+			if err != nil {
+				return nil, fmt.Errorf("failed to rename migrated file: %v", err)
+			}
+		}
+	}
+
+	if backingType == "file" && o.journal.Enabled && o.journal.SnapshotInterval > 0 {
+		result.stopSnapshots = make(chan struct{})
+		result.snapshots.Add(1)
+		go result.snapshotPeriodically(o.journal.SnapshotInterval)
 	}
 
 	return result, nil
 }
 
-// Save makes sure the datamodel is persisted to disk
+// Renames the ordinary file after it has been migrated to the tenant
+// directory, it's kept in case it's needed again
+func retireFile(path string) error {
+	err := os.Rename(path, path+".migrated")
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	err = os.Remove(journalPath(path))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Saves the file periodically so the journal doesn't grow too large
+func (w *Windermere) snapshotPeriodically(interval time.Duration) {
+	defer w.snapshots.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := w.Save(); err != nil {
+				log.Printf("Failed to save snapshot: %v", err)
+			}
+		case <-w.stopSnapshots:
+			return
+		}
+	}
+}
+
+// Save makes sure the datamodel is persisted to disk. The journal, if
+// any, is emptied since its modifications are now in the file. With a
+// tenant directory only modified tenants are saved.
 func (w *Windermere) Save() error {
 	inMemory, ok := w.backend.(*scimserverlite.InMemoryBackend)
-	if ok {
-		err := saveSCIMBackend(inMemory, w.backingPath)
+	if ok && w.tenantFiles {
+		err := inMemory.SaveTenants()
+
+		if err != nil {
+			return fmt.Errorf("failed to save SS12000 model to tenant directory: %v", err)
+		}
+	} else if ok {
+		err := inMemory.Snapshot(func(serializedForm []byte) error {
+			encoded, err := w.codec.Encode(serializedForm)
+			if err != nil {
+				return err
+			}
+			return writeSnapshot(w.backingPath, encoded)
+		})
 
 		if err != nil {
 			return fmt.Errorf("failed to save SS12000 model to file: %v", err)
 		}
+
+		// A journal from when journaling was enabled is no longer needed
+		if w.journal == nil {
+			err = os.Remove(journalPath(w.backingPath))
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("failed to remove journal: %v", err)
+			}
+		}
 	}
 	// No need to save for other backends
 	return nil
@@ -159,18 +428,56 @@ func (w *Windermere) GetParsedResource(tenant, resourceType string, id string) (
 	return w.backend.GetParsedResource(tenant, resourceType, id)
 }
 
-// Loads the in-memory backend from file
-func loadSCIMBackend(backend *scimserverlite.InMemoryBackend, path string) error {
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		return nil
+// LoadReport returns the report from loading file storage, or nil for
+// other storage types. With a tenant directory it covers the tenants
+// loaded so far.
+func (w *Windermere) LoadReport() scimserverlite.LoadReport {
+	if inMemory, ok := w.backend.(*scimserverlite.InMemoryBackend); ok {
+		return inMemory.LoadReport()
 	}
+	return nil
+}
 
-	serializedForm, err := os.ReadFile(path)
-	if err != nil {
+// GetQuarantine returns the invalid resources quarantined when loading
+// file storage, by tenant
+func (w *Windermere) GetQuarantine() map[string][]scimserverlite.QuarantinedResource {
+	if inMemory, ok := w.backend.(*scimserverlite.InMemoryBackend); ok {
+		return inMemory.GetQuarantine()
+	}
+	return nil
+}
+
+// The journal for file storage is kept next to the file
+func journalPath(path string) string {
+	return path + ".journal"
+}
+
+// Loads the in-memory backend from file and replays the journal, if any
+func loadSCIMBackend(backend *scimserverlite.InMemoryBackend, path string, codec scimserverlite.SourceCodec) error {
+	if _, err := os.Stat(path); err == nil {
+		serializedForm, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		serializedForm, err = codec.DecodeFrom(path, serializedForm)
+		if err != nil {
+			return err
+		}
+		err = backend.Load(serializedForm)
+		if err != nil {
+			return err
+		}
+	}
+
+	journal, err := os.Open(journalPath(path))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
 		return err
 	}
-	err = backend.Load(serializedForm)
-	return err
+	defer journal.Close()
+
+	return backend.Replay(journal)
 }
 
 func objectParser(resourceType, resource string) (ss12000v1.Object, error) {
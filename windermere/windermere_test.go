@@ -0,0 +1,191 @@
+/*
+ *  This file is part of Windermere (EGIL SCIM Server).
+ *
+ *  Copyright (C) 2019-2021 Föreningen Sambruk
+ *
+ *  This program is free software: you can redistribute it and/or modify
+ *  it under the terms of the GNU Affero General Public License as
+ *  published by the Free Software Foundation, either version 3 of the
+ *  License, or (at your option) any later version.
+
+ *  This program is distributed in the hope that it will be useful,
+ *  but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *  MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *  GNU Affero General Public License for more details.
+
+ *  You should have received a copy of the GNU Affero General Public License
+ *  along with this program.  If not, see <https://www.gnu.org/licenses/>.
+ */
+
+package windermere
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	scim "github.com/Sambruk/windermere/scimserverlite"
+	"github.com/Sambruk/windermere/test"
+)
+
+func TestFileJournal(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "SS12000.json")
+	tenantGetter := func(c context.Context) string { return tenant1 }
+	validator := CreateOptionalValidator(false, false)
+	journal := WithJournal(JournalConfig{Enabled: true, Sync: scim.SyncAlways})
+
+	w, err := New("file", path, tenantGetter, validator, journal)
+	test.Ensure(t, err)
+	_, err = w.backend.Create(tenant1, "Users", bajeJSON)
+	test.Ensure(t, err)
+
+	// Start again without shutting down, as after a crash
+	recovered, err := New("file", path, tenantGetter, validator, journal)
+	test.Ensure(t, err)
+	test.Ensure(t, w.journal.Close())
+	if n := recovered.CountResources(tenant1, "Users"); n != 1 {
+		t.Errorf("expected the user to be recovered from the journal, got %d users", n)
+	}
+	test.Ensure(t, recovered.Shutdown())
+
+	// The journal is compacted into the file
+	if info, err := os.Stat(journalPath(path)); err != nil || info.Size() != 0 {
+		t.Errorf("expected empty journal after shutdown: %v", err)
+	}
+
+	// A journal isn't needed when journaling is disabled
+	w, err = New("file", path, tenantGetter, validator)
+	test.Ensure(t, err)
+	if n := w.CountResources(tenant1, "Users"); n != 1 {
+		t.Errorf("expected the user to be loaded from file, got %d users", n)
+	}
+	test.Ensure(t, w.Shutdown())
+	if _, err := os.Stat(journalPath(path)); !os.IsNotExist(err) {
+		t.Errorf("expected journal to be removed: %v", err)
+	}
+}
+
+func TestTenantDirectory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "SS12000.json")
+	dir := filepath.Join(filepath.Dir(path), "tenants")
+	tenantGetter := func(c context.Context) string { return tenant1 }
+	validator := CreateOptionalValidator(false, false)
+
+	w, err := New("file", path, tenantGetter, validator)
+	test.Ensure(t, err)
+	_, err = w.backend.Create(tenant1, "Users", bajeJSON)
+	test.Ensure(t, err)
+	test.Ensure(t, w.Shutdown())
+
+	// The file is migrated to the tenant directory
+	journal := WithJournal(JournalConfig{Enabled: true, Sync: scim.SyncAlways})
+	w, err = New("file", path, tenantGetter, validator, journal, WithTenantDirectory(dir))
+	test.Ensure(t, err)
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the migrated file to be renamed: %v", err)
+	}
+	if _, err := os.Stat(path + ".migrated"); err != nil {
+		t.Errorf("expected the migrated file to be kept: %v", err)
+	}
+	if n := w.CountResources(tenant1, "Users"); n != 1 {
+		t.Errorf("expected the user to be migrated, got %d users", n)
+	}
+	test.Ensure(t, w.Clear(tenant1))
+	test.Ensure(t, w.Shutdown())
+
+	w, err = New("file", path, tenantGetter, validator, journal, WithTenantDirectory(dir))
+	test.Ensure(t, err)
+	defer w.Shutdown()
+	if n := w.CountResources(tenant1, "Users"); n != 0 {
+		t.Errorf("expected the cleared tenant to be saved, got %d users", n)
+	}
+}
+
+func TestQuarantine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "SS12000.json")
+	tenantGetter := func(c context.Context) string { return tenant1 }
+	validator := CreateOptionalValidator(false, false)
+
+	w, err := New("file", path, tenantGetter, validator)
+	test.Ensure(t, err)
+	_, err = w.backend.Create(tenant1, "Users", bajeJSON)
+	test.Ensure(t, err)
+	test.Ensure(t, w.Shutdown())
+
+	// Add a stored user which can't be parsed
+	data, err := os.ReadFile(path)
+	test.Ensure(t, err)
+	var stored map[string]interface{}
+	test.Ensure(t, json.Unmarshal(data, &stored))
+	users := stored["Resources"].(map[string]interface{})[tenant1].(map[string]interface{})["Users"].(map[string]interface{})
+	users["corrupt"] = `{"id": "corrupt", "userName": `
+	data, err = json.Marshal(stored)
+	test.Ensure(t, err)
+	test.Ensure(t, os.WriteFile(path, data, 0600))
+
+	_, err = New("file", path, tenantGetter, validator, WithStrictLoading(true))
+	if err == nil || !strings.Contains(err.Error(), "1 stored resources are invalid") {
+		t.Errorf("expected strict loading to fail, got: %v", err)
+	}
+
+	w, err = New("file", path, tenantGetter, validator)
+	test.Ensure(t, err)
+	if n := w.CountResources(tenant1, "Users"); n != 1 {
+		t.Errorf("expected only the valid user to be loaded, got %d users", n)
+	}
+	if report := w.LoadReport()[tenant1]["Users"]; report == nil || report.Valid != 1 || report.Invalid != 1 {
+		t.Errorf("unexpected load report: %v", w.LoadReport())
+	}
+	if quarantine := w.GetQuarantine()[tenant1]; len(quarantine) != 1 || quarantine[0].ID != "corrupt" {
+		t.Errorf("expected the invalid user to be quarantined, got %v", quarantine)
+	}
+	test.Ensure(t, w.Shutdown())
+
+	// The file was saved with the user in quarantine
+	w, err = New("file", path, tenantGetter, validator, WithStrictLoading(true))
+	test.Ensure(t, err)
+	defer w.Shutdown()
+	if len(w.GetQuarantine()[tenant1]) != 1 {
+		t.Errorf("expected the quarantine to be kept, got %v", w.GetQuarantine())
+	}
+}
+
+func TestFileUpdateID(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "SS12000.json")
+	tenantGetter := func(c context.Context) string { return tenant1 }
+	validator := CreateOptionalValidator(false, false)
+
+	w, err := New("file", path, tenantGetter, validator)
+	test.Ensure(t, err)
+	defer w.Shutdown()
+	bajeID, err := scim.CreateIDFromExternalID(bajeJSON)
+	test.Ensure(t, err)
+	_, err = w.backend.Create(tenant1, "Users", bajeJSON)
+	test.Ensure(t, err)
+
+	isMalformed := func(err error) bool {
+		typed, ok := err.(scim.SCIMTypedError)
+		return ok && typed.Type() == scim.MalformedResourceError
+	}
+
+	// The id in the resource must match the id in the URL
+	_, err = w.backend.Update(tenant1, "Users", bajeID, ananJSON)
+	if !isMalformed(err) {
+		t.Errorf("expected update of another user's id to fail, got: %v", err)
+	}
+	patch, err := scim.ParsePatchRequest(`{"Operations": [{"op": "replace", "path": "externalId", "value": "0d3b9f40-fd1f-4a3b-a6e4-5b1b2c9a1f40"}]}`)
+	test.Ensure(t, err)
+	_, err = w.backend.(scim.PatchBackend).Patch(tenant1, "Users", bajeID, patch)
+	if !isMalformed(err) {
+		t.Errorf("expected patch of the id to fail, got: %v", err)
+	}
+
+	_, err = w.backend.Update(tenant1, "Users", bajeID, bajeNewUserName)
+	test.Ensure(t, err)
+	if n := w.CountResources(tenant1, "Users"); n != 1 {
+		t.Errorf("expected one user, got %d", n)
+	}
+}